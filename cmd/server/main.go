@@ -1,19 +1,59 @@
 package main
 
 import (
+	"GOtify/internal/config"
+	"GOtify/internal/logging"
 	"GOtify/internal/server"
+	"GOtify/internal/tracing"
+	"context"
+	"fmt"
+	"log/slog"
 	"os"
+	"time"
 
 	"github.com/joho/godotenv"
 )
 
 func main() {
 	_ = godotenv.Load()
-	port := os.Getenv("PORT")
-	if port == "" {
-		port = "8080"
+
+	cfg, opts, err := config.Load(os.Args[1:], os.LookupEnv)
+	if opts.PrintConfig {
+		_ = cfg.Print(os.Stdout)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	if opts.PrintConfig {
+		return
+	}
+
+	slog.SetDefault(logging.New(os.Stdout, logging.ParseLevel(cfg.Log.Level)))
+
+	if err := run(cfg); err != nil {
+		slog.Error("server stopped", "error", err)
+		os.Exit(1)
+	}
+}
+
+func run(cfg config.Config) error {
+	shutdownTracing, err := tracing.Setup(context.Background(), tracing.Config{
+		Exporter:    cfg.Tracing.Exporter,
+		ServiceName: cfg.Tracing.ServiceName,
+	})
+	if err != nil {
+		return err
+	}
+	defer func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		_ = shutdownTracing(ctx)
+	}()
+
+	s, err := server.FromConfig(context.Background(), cfg)
+	if err != nil {
+		return err
 	}
-	// basic example with audio in the assets/audio/ folder
-	s := server.New("assets/audio")
-	s.Run(":" + port)
+	return s.Run(cfg.Addr())
 }
@@ -0,0 +1,255 @@
+// Package cache reduce las llamadas a Supabase Storage desde /stream:
+// guarda listas de reproducción en memoria, segmentos en disco y URLs
+// firmadas durante unos segundos.
+package cache
+
+import (
+	"GOtify/internal/metrics"
+	"GOtify/internal/storage"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/sync/singleflight"
+)
+
+// Backend es el bucket envuelto; storage.BucketClient lo implementa.
+type Backend interface {
+	UploadBatch(ctx context.Context, prefix string, files []storage.UploadFile) error
+	DeletePrefix(ctx context.Context, prefix string) error
+	DownloadFile(ctx context.Context, objectPath string) ([]byte, error)
+	SignedURL(ctx context.Context, objectPath string, expiresIn int) (string, error)
+}
+
+// Config fija tamaños y caducidades. Cada caché se desactiva con TTL 0 (o
+// SegmentDir vacío para la de segmentos).
+type Config struct {
+	// PlaylistTTL y PlaylistEntries limitan la LRU en memoria de .m3u8.
+	PlaylistTTL     time.Duration
+	PlaylistEntries int
+	// SegmentDir es el directorio de la caché de segmentos; se vacía al
+	// arrancar. SegmentMaxBytes limita su tamaño total.
+	SegmentDir      string
+	SegmentMaxBytes int64
+	SegmentTTL      time.Duration
+	// SignedURLTTL es cuánto se reutiliza una URL firmada, nunca más de la
+	// mitad de su validez.
+	SignedURLTTL time.Duration
+}
+
+// DefaultConfig devuelve la caché de listas y de URLs firmadas activa y la
+// de segmentos desactivada.
+func DefaultConfig() Config {
+	return Config{
+		PlaylistTTL:     30 * time.Second,
+		PlaylistEntries: 1000,
+		SegmentMaxBytes: 1 << 30,
+		SegmentTTL:      24 * time.Hour,
+		SignedURLTTL:    20 * time.Second,
+	}
+}
+
+const maxSignedURLs = 10000
+
+// Bucket envuelve un Backend con las cachés de Config. Las escrituras
+// (UploadBatch, DeletePrefix) invalidan la carpeta afectada, así que
+// SongHandler.Update y Delete no sirven contenido viejo en esta réplica; en
+// las demás caduca con el TTL.
+type Bucket struct {
+	backend   Backend
+	cfg       Config
+	playlists *lru[[]byte]
+	segments  *lru[string]
+	signed    *lru[string]
+	// gen cambia en cada invalidación para descartar descargas que
+	// empezaron antes.
+	gen   atomic.Uint64
+	group singleflight.Group
+}
+
+// New crea la caché. Con SegmentDir crea el directorio y borra los segmentos
+// que quedaran de una ejecución anterior.
+func New(backend Backend, cfg Config) (*Bucket, error) {
+	b := &Bucket{
+		backend:   backend,
+		cfg:       cfg,
+		playlists: newLRU[[]byte](cfg.PlaylistEntries, 0, nil),
+		signed:    newLRU[string](maxSignedURLs, 0, nil),
+	}
+	if cfg.SegmentDir != "" {
+		if err := resetDir(cfg.SegmentDir); err != nil {
+			return nil, fmt.Errorf("cache: %w", err)
+		}
+		b.segments = newLRU(0, cfg.SegmentMaxBytes, func(_ string, path string) {
+			_ = os.Remove(path)
+		})
+	}
+	return b, nil
+}
+
+// CachesSegments indica si los segmentos se guardan en disco. FileHandler lo
+// usa para servirlos él mismo en lugar de redirigir al bucket.
+func (b *Bucket) CachesSegments() bool {
+	return b.segments != nil
+}
+
+// DownloadFile devuelve objectPath desde la caché de listas o de segmentos,
+// descargándolo una sola vez aunque lleguen varias peticiones a la vez.
+func (b *Bucket) DownloadFile(ctx context.Context, objectPath string) ([]byte, error) {
+	if strings.HasSuffix(strings.ToLower(objectPath), ".m3u8") {
+		if b.cfg.PlaylistTTL <= 0 {
+			return b.backend.DownloadFile(ctx, objectPath)
+		}
+		if data, ok := b.playlists.get(objectPath); ok {
+			metrics.CacheLookup("playlist", true)
+			return data, nil
+		}
+		metrics.CacheLookup("playlist", false)
+		return b.fetch(ctx, "playlist", objectPath, func(data []byte) {
+			b.playlists.add(objectPath, data, int64(len(data)), b.cfg.PlaylistTTL)
+		})
+	}
+
+	// Los originales solo se leen para transcodificar y pesan lo que cientos
+	// de segmentos: guardarlos expulsaría los segmentos más pedidos.
+	if b.segments == nil || strings.HasPrefix(objectPath, storage.MezzaninePrefix+"/") {
+		return b.backend.DownloadFile(ctx, objectPath)
+	}
+	if path, ok := b.segments.get(objectPath); ok {
+		data, err := os.ReadFile(path)
+		if err == nil {
+			metrics.CacheLookup("segment", true)
+			return data, nil
+		}
+		b.segments.remove(objectPath)
+	}
+	metrics.CacheLookup("segment", false)
+	return b.fetch(ctx, "segment", objectPath, func(data []byte) {
+		path, err := writeFile(b.cfg.SegmentDir, objectPath, data)
+		if err != nil {
+			return
+		}
+		if !b.segments.add(objectPath, path, int64(len(data)), b.cfg.SegmentTTL) {
+			_ = os.Remove(path)
+		}
+	})
+}
+
+// fetch descarga objectPath compartiendo la llamada entre peticiones
+// concurrentes y llama a store si ninguna invalidación ocurrió entretanto.
+func (b *Bucket) fetch(ctx context.Context, kind, objectPath string, store func([]byte)) ([]byte, error) {
+	gen := b.gen.Load()
+	key := kind + "|" + strconv.FormatUint(gen, 10) + "|" + objectPath
+	v, err, _ := b.group.Do(key, func() (any, error) {
+		// La descarga compartida no depende de que siga conectado quien la inició.
+		data, err := b.backend.DownloadFile(context.WithoutCancel(ctx), objectPath)
+		if err != nil {
+			return nil, err
+		}
+		if b.gen.Load() == gen {
+			store(data)
+		}
+		return data, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return v.([]byte), nil
+}
+
+// SignedURL reutiliza la URL firmada de objectPath mientras le quede al
+// menos la mitad de su validez.
+func (b *Bucket) SignedURL(ctx context.Context, objectPath string, expiresIn int) (string, error) {
+	ttl := min(b.cfg.SignedURLTTL, time.Duration(expiresIn)*time.Second/2)
+	if ttl <= 0 {
+		return b.backend.SignedURL(ctx, objectPath, expiresIn)
+	}
+	key := objectPath + "|" + strconv.Itoa(expiresIn)
+	if url, ok := b.signed.get(key); ok {
+		metrics.CacheLookup("signed_url", true)
+		return url, nil
+	}
+	metrics.CacheLookup("signed_url", false)
+	gen := b.gen.Load()
+	url, err := b.backend.SignedURL(ctx, objectPath, expiresIn)
+	if err != nil {
+		return "", err
+	}
+	if b.gen.Load() == gen {
+		b.signed.add(key, url, 0, ttl)
+	}
+	return url, nil
+}
+
+// UploadBatch sube los archivos e invalida prefix.
+func (b *Bucket) UploadBatch(ctx context.Context, prefix string, files []storage.UploadFile) error {
+	defer b.Invalidate(prefix)
+	return b.backend.UploadBatch(ctx, prefix, files)
+}
+
+// DeletePrefix borra la carpeta e invalida prefix.
+func (b *Bucket) DeletePrefix(ctx context.Context, prefix string) error {
+	defer b.Invalidate(prefix)
+	return b.backend.DeletePrefix(ctx, prefix)
+}
+
+// Invalidate descarta todo lo guardado bajo la carpeta prefix.
+func (b *Bucket) Invalidate(prefix string) {
+	b.gen.Add(1)
+	b.playlists.removePrefix(prefix)
+	b.signed.removePrefix(prefix)
+	if b.segments != nil {
+		b.segments.removePrefix(prefix)
+	}
+}
+
+// writeFile guarda data en un archivo nuevo de dir. Cada escritura usa un
+// nombre distinto para que reemplazar una entrada no borre la nueva.
+func writeFile(dir, objectPath string, data []byte) (string, error) {
+	sum := sha256.Sum256([]byte(objectPath))
+	f, err := os.CreateTemp(dir, hex.EncodeToString(sum[:])+"-*")
+	if err != nil {
+		return "", err
+	}
+	_, err = f.Write(data)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return "", err
+	}
+	return f.Name(), nil
+}
+
+// resetDir crea dir y borra solo los archivos con nombre de segmento
+// cacheado, por si apunta a un directorio compartido.
+func resetDir(dir string) error {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		name := e.Name()
+		hash, _, ok := strings.Cut(name, "-")
+		if e.IsDir() || !ok || len(hash) != sha256.Size*2 {
+			continue
+		}
+		if _, err := hex.DecodeString(hash); err == nil {
+			if err := os.Remove(filepath.Join(dir, name)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,293 @@
+package cache
+
+import (
+	"GOtify/internal/storage"
+	"context"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type fakeBackend struct {
+	mu        sync.Mutex
+	objects   map[string][]byte
+	downloads map[string]int
+	signs     atomic.Int32
+	release   chan struct{}
+}
+
+func newFakeBackend() *fakeBackend {
+	return &fakeBackend{
+		objects: map[string][]byte{
+			"song/master.m3u8":          []byte("#EXTM3U\n"),
+			"song/128k_segment_000.ts":  []byte("segment-0"),
+			"song/128k_segment_001.ts":  []byte("segment-1"),
+			"other/master.m3u8":         []byte("#EXTM3U\n#other\n"),
+			"other/128k_segment_000.ts": []byte("other-0"),
+		},
+		downloads: map[string]int{},
+	}
+}
+
+func (f *fakeBackend) DownloadFile(_ context.Context, objectPath string) ([]byte, error) {
+	if f.release != nil {
+		<-f.release
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.downloads[objectPath]++
+	data, ok := f.objects[objectPath]
+	if !ok {
+		return nil, storage.ErrNotFound
+	}
+	return data, nil
+}
+
+func (f *fakeBackend) SignedURL(_ context.Context, objectPath string, _ int) (string, error) {
+	n := f.signs.Add(1)
+	return "https://bucket.example/" + objectPath + "?sig=" + strconv.Itoa(int(n)), nil
+}
+
+func (f *fakeBackend) UploadBatch(_ context.Context, prefix string, files []storage.UploadFile) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, file := range files {
+		f.objects[prefix+"/"+file.Path] = file.Content
+	}
+	return nil
+}
+
+func (f *fakeBackend) DeletePrefix(context.Context, string) error { return nil }
+
+func (f *fakeBackend) count(objectPath string) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.downloads[objectPath]
+}
+
+func TestPlaylistCache(t *testing.T) {
+	backend := newFakeBackend()
+	b, err := New(backend, DefaultConfig())
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	ctx := context.Background()
+
+	for range 3 {
+		if _, err := b.DownloadFile(ctx, "song/master.m3u8"); err != nil {
+			t.Fatalf("DownloadFile: %v", err)
+		}
+	}
+	if n := backend.count("song/master.m3u8"); n != 1 {
+		t.Fatalf("expected a single backend download, got %d", n)
+	}
+
+	// Los segmentos sin caché de disco siempre van al backend.
+	b.DownloadFile(ctx, "song/128k_segment_000.ts")
+	b.DownloadFile(ctx, "song/128k_segment_000.ts")
+	if n := backend.count("song/128k_segment_000.ts"); n != 2 {
+		t.Fatalf("expected segments to bypass the cache, got %d downloads", n)
+	}
+
+	now := time.Now()
+	b.playlists.now = func() time.Time { return now.Add(time.Minute) }
+	b.DownloadFile(ctx, "song/master.m3u8")
+	if n := backend.count("song/master.m3u8"); n != 2 {
+		t.Fatalf("expected expired playlist to be downloaded again, got %d", n)
+	}
+
+	if _, err := b.DownloadFile(ctx, "missing/master.m3u8"); err != storage.ErrNotFound {
+		t.Fatalf("expected ErrNotFound, got %v", err)
+	}
+	if b.playlists.len() != 1 {
+		t.Fatalf("errors must not be cached, got %d entries", b.playlists.len())
+	}
+}
+
+func TestPlaylistCacheLimitsEntries(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.PlaylistEntries = 1
+	backend := newFakeBackend()
+	b, _ := New(backend, cfg)
+	ctx := context.Background()
+
+	b.DownloadFile(ctx, "song/master.m3u8")
+	b.DownloadFile(ctx, "other/master.m3u8")
+	b.DownloadFile(ctx, "song/master.m3u8")
+	if n := backend.count("song/master.m3u8"); n != 2 {
+		t.Fatalf("expected least recently used playlist to be evicted, got %d downloads", n)
+	}
+}
+
+func TestConcurrentMissesShareDownload(t *testing.T) {
+	backend := newFakeBackend()
+	backend.release = make(chan struct{})
+	b, _ := New(backend, DefaultConfig())
+
+	var wg sync.WaitGroup
+	for range 5 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := b.DownloadFile(context.Background(), "song/master.m3u8"); err != nil {
+				t.Errorf("DownloadFile: %v", err)
+			}
+		}()
+	}
+	time.Sleep(20 * time.Millisecond)
+	close(backend.release)
+	wg.Wait()
+	if n := backend.count("song/master.m3u8"); n != 1 {
+		t.Fatalf("expected concurrent misses to share one download, got %d", n)
+	}
+}
+
+func TestSegmentDiskCache(t *testing.T) {
+	dir := t.TempDir()
+	stale := filepath.Join(dir, "0000000000000000000000000000000000000000000000000000000000000000-1")
+	keep := filepath.Join(dir, "notes.txt")
+	for _, path := range []string{stale, keep} {
+		if err := os.WriteFile(path, []byte("x"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	cfg := DefaultConfig()
+	cfg.SegmentDir = dir
+	cfg.SegmentMaxBytes = int64(len("segment-0") + len("segment-1"))
+	backend := newFakeBackend()
+	b, err := New(backend, cfg)
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	if _, err := os.Stat(stale); !os.IsNotExist(err) {
+		t.Fatalf("expected leftover cache files to be removed")
+	}
+	if _, err := os.Stat(keep); err != nil {
+		t.Fatalf("unrelated files must be kept: %v", err)
+	}
+	if !b.CachesSegments() {
+		t.Fatalf("expected CachesSegments with a segment dir")
+	}
+
+	ctx := context.Background()
+	for range 2 {
+		data, err := b.DownloadFile(ctx, "song/128k_segment_000.ts")
+		if err != nil || string(data) != "segment-0" {
+			t.Fatalf("unexpected segment %q, %v", data, err)
+		}
+	}
+	if n := backend.count("song/128k_segment_000.ts"); n != 1 {
+		t.Fatalf("expected segment to be served from disk, got %d downloads", n)
+	}
+
+	b.DownloadFile(ctx, "song/128k_segment_001.ts")
+	b.DownloadFile(ctx, "other/128k_segment_000.ts")
+	entries, _ := os.ReadDir(dir)
+	if len(entries) != 3 { // dos segmentos más notes.txt
+		t.Fatalf("expected size limit to evict from disk, found %d files", len(entries))
+	}
+	b.DownloadFile(ctx, "song/128k_segment_000.ts")
+	if n := backend.count("song/128k_segment_000.ts"); n != 2 {
+		t.Fatalf("expected evicted segment to be downloaded again, got %d", n)
+	}
+}
+
+func TestSegmentDiskCacheSkipsOriginals(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.SegmentDir = t.TempDir()
+	backend := newFakeBackend()
+	source := storage.MezzaninePath("song-1")
+	backend.objects[source] = []byte("original audio")
+	b, err := New(backend, cfg)
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+
+	ctx := context.Background()
+	b.DownloadFile(ctx, "song/128k_segment_000.ts")
+	for range 2 {
+		if data, err := b.DownloadFile(ctx, source); err != nil || string(data) != "original audio" {
+			t.Fatalf("unexpected original %q, %v", data, err)
+		}
+	}
+	if n := backend.count(source); n != 2 {
+		t.Fatalf("expected originals to bypass the segment cache, got %d downloads", n)
+	}
+	if entries, _ := os.ReadDir(cfg.SegmentDir); len(entries) != 1 {
+		t.Fatalf("expected only the segment on disk, found %d files", len(entries))
+	}
+	b.DownloadFile(ctx, "song/128k_segment_000.ts")
+	if n := backend.count("song/128k_segment_000.ts"); n != 1 {
+		t.Fatalf("expected the segment to stay cached, got %d downloads", n)
+	}
+}
+
+func TestSignedURLCache(t *testing.T) {
+	backend := newFakeBackend()
+	b, _ := New(backend, DefaultConfig())
+	ctx := context.Background()
+
+	first, _ := b.SignedURL(ctx, "song/128k_segment_000.ts", 60)
+	second, _ := b.SignedURL(ctx, "song/128k_segment_000.ts", 60)
+	if first != second || backend.signs.Load() != 1 {
+		t.Fatalf("expected cached signed url, got %q and %q", first, second)
+	}
+
+	// Con 10s de validez se reutiliza como mucho 5s.
+	b.SignedURL(ctx, "song/128k_segment_001.ts", 10)
+	now := time.Now()
+	b.signed.now = func() time.Time { return now.Add(6 * time.Second) }
+	b.SignedURL(ctx, "song/128k_segment_001.ts", 10)
+	if got := backend.signs.Load(); got != 3 {
+		t.Fatalf("expected signed url reuse capped at half its validity, got %d signs", got)
+	}
+
+	cfg := DefaultConfig()
+	cfg.SignedURLTTL = 0
+	b, _ = New(backend, cfg)
+	b.SignedURL(ctx, "song/128k_segment_000.ts", 60)
+	b.SignedURL(ctx, "song/128k_segment_000.ts", 60)
+	if got := backend.signs.Load(); got != 5 {
+		t.Fatalf("expected disabled cache to sign every time, got %d signs", got)
+	}
+}
+
+func TestWritesInvalidateFolder(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.SegmentDir = t.TempDir()
+	backend := newFakeBackend()
+	b, _ := New(backend, cfg)
+	ctx := context.Background()
+
+	b.DownloadFile(ctx, "song/master.m3u8")
+	b.DownloadFile(ctx, "song/128k_segment_000.ts")
+	b.DownloadFile(ctx, "other/master.m3u8")
+	b.SignedURL(ctx, "song/128k_segment_000.ts", 60)
+
+	if err := b.UploadBatch(ctx, "song", []storage.UploadFile{{Path: "master.m3u8", Content: []byte("#EXTM3U\n#v2\n")}}); err != nil {
+		t.Fatalf("UploadBatch: %v", err)
+	}
+	data, _ := b.DownloadFile(ctx, "song/master.m3u8")
+	if string(data) != "#EXTM3U\n#v2\n" {
+		t.Fatalf("expected fresh playlist after upload, got %q", data)
+	}
+	b.DownloadFile(ctx, "song/128k_segment_000.ts")
+	if n := backend.count("song/128k_segment_000.ts"); n != 2 {
+		t.Fatalf("expected segment to be invalidated, got %d downloads", n)
+	}
+	b.SignedURL(ctx, "song/128k_segment_000.ts", 60)
+	if backend.signs.Load() != 2 {
+		t.Fatalf("expected signed url to be invalidated")
+	}
+
+	b.DeletePrefix(ctx, "other")
+	b.DownloadFile(ctx, "other/master.m3u8")
+	if n := backend.count("other/master.m3u8"); n != 2 {
+		t.Fatalf("expected delete to invalidate the folder, got %d downloads", n)
+	}
+}
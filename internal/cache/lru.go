@@ -0,0 +1,112 @@
+package cache
+
+import (
+	"container/list"
+	"strings"
+	"sync"
+	"time"
+)
+
+type entry[V any] struct {
+	key     string
+	value   V
+	size    int64
+	expires time.Time
+}
+
+// lru es una caché LRU con caducidad por entrada y límites de número de
+// entradas y de bytes (0 = sin límite). onEvict se llama con el lock tomado
+// cada vez que una entrada sale de la caché.
+type lru[V any] struct {
+	mu         sync.Mutex
+	maxEntries int
+	maxBytes   int64
+	bytes      int64
+	ll         *list.List
+	items      map[string]*list.Element
+	onEvict    func(key string, value V)
+	now        func() time.Time
+}
+
+func newLRU[V any](maxEntries int, maxBytes int64, onEvict func(string, V)) *lru[V] {
+	return &lru[V]{
+		maxEntries: maxEntries,
+		maxBytes:   maxBytes,
+		ll:         list.New(),
+		items:      make(map[string]*list.Element),
+		onEvict:    onEvict,
+		now:        time.Now,
+	}
+}
+
+func (c *lru[V]) get(key string) (V, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var zero V
+	el, ok := c.items[key]
+	if !ok {
+		return zero, false
+	}
+	e := el.Value.(*entry[V])
+	if !c.now().Before(e.expires) {
+		c.removeElement(el)
+		return zero, false
+	}
+	c.ll.MoveToFront(el)
+	return e.value, true
+}
+
+// add guarda value durante ttl. Las entradas mayores que maxBytes no se
+// guardan.
+func (c *lru[V]) add(key string, value V, size int64, ttl time.Duration) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if ttl <= 0 || (c.maxBytes > 0 && size > c.maxBytes) {
+		return false
+	}
+	if el, ok := c.items[key]; ok {
+		c.removeElement(el)
+	}
+	e := &entry[V]{key: key, value: value, size: size, expires: c.now().Add(ttl)}
+	c.items[key] = c.ll.PushFront(e)
+	c.bytes += size
+	for (c.maxEntries > 0 && c.ll.Len() > c.maxEntries) || (c.maxBytes > 0 && c.bytes > c.maxBytes) {
+		c.removeElement(c.ll.Back())
+	}
+	return true
+}
+
+func (c *lru[V]) remove(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.items[key]; ok {
+		c.removeElement(el)
+	}
+}
+
+// removePrefix borra key == prefix y las claves bajo prefix + "/".
+func (c *lru[V]) removePrefix(prefix string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	dir := strings.TrimSuffix(prefix, "/") + "/"
+	for key, el := range c.items {
+		if key == prefix || strings.HasPrefix(key, dir) {
+			c.removeElement(el)
+		}
+	}
+}
+
+func (c *lru[V]) len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.ll.Len()
+}
+
+func (c *lru[V]) removeElement(el *list.Element) {
+	e := c.ll.Remove(el).(*entry[V])
+	delete(c.items, e.key)
+	c.bytes -= e.size
+	if c.onEvict != nil {
+		c.onEvict(e.key, e.value)
+	}
+}
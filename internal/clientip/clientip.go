@@ -0,0 +1,163 @@
+// Package clientip resuelve la IP real del cliente detrás de proxies de
+// confianza a partir de Forwarded (RFC 7239) o X-Forwarded-For.
+package clientip
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Cabeceras de reenvío admitidas. Solo se lee la que escriben los proxies de
+// confianza: la otra llega tal cual la mande el cliente.
+const (
+	HeaderXForwardedFor = "X-Forwarded-For"
+	HeaderForwarded     = "Forwarded"
+)
+
+// ParseTrusted convierte una lista de IPs o rangos CIDR en prefijos.
+func ParseTrusted(entries []string) ([]netip.Prefix, error) {
+	out := make([]netip.Prefix, 0, len(entries))
+	for _, entry := range entries {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		if strings.Contains(entry, "/") {
+			prefix, err := netip.ParsePrefix(entry)
+			if err != nil {
+				return nil, fmt.Errorf("clientip: invalid trusted proxy %q", entry)
+			}
+			out = append(out, prefix.Masked())
+			continue
+		}
+		addr, err := netip.ParseAddr(entry)
+		if err != nil {
+			return nil, fmt.Errorf("clientip: invalid trusted proxy %q", entry)
+		}
+		addr = addr.Unmap()
+		out = append(out, netip.PrefixFrom(addr, addr.BitLen()))
+	}
+	return out, nil
+}
+
+// Resolver determina la IP del cliente. Sin proxies de confianza usa siempre
+// la dirección de la conexión e ignora las cabeceras de reenvío.
+type Resolver struct {
+	trusted []netip.Prefix
+	header  string
+}
+
+// New crea un Resolver que lee header (HeaderXForwardedFor si está vacío)
+// solo cuando la petición llega desde uno de los prefijos indicados.
+func New(trusted []netip.Prefix, header string) *Resolver {
+	header = http.CanonicalHeaderKey(strings.TrimSpace(header))
+	if header == "" {
+		header = HeaderXForwardedFor
+	}
+	return &Resolver{trusted: trusted, header: header}
+}
+
+// Resolve recorre la cadena de saltos de la cabecera configurada de derecha a
+// izquierda saltando los proxies de confianza; el primer salto que no lo es
+// se toma como cliente. Una entrada ilegible corta el recorrido y deja el
+// último salto válido.
+func (r *Resolver) Resolve(req *http.Request) (netip.Addr, bool) {
+	peer, ok := parseHost(req.RemoteAddr)
+	if !ok {
+		return netip.Addr{}, false
+	}
+	if !r.isTrusted(peer) {
+		return peer, true
+	}
+
+	var hops []string
+	if r.header == HeaderForwarded {
+		hops = forwardedFor(req.Header.Values(HeaderForwarded))
+	} else {
+		hops = forwardedList(req.Header.Values(r.header))
+	}
+	client := peer
+	for i := len(hops) - 1; i >= 0; i-- {
+		addr, ok := parseHost(hops[i])
+		if !ok {
+			break
+		}
+		client = addr
+		if !r.isTrusted(addr) {
+			break
+		}
+	}
+	return client, true
+}
+
+// Middleware reescribe RemoteAddr con la IP resuelta para que c.ClientIP()
+// devuelva el mismo valor en rate limiting, logs y validación de tokens. El
+// engine no debe confiar en ningún proxy (SetTrustedProxies(nil)) para que
+// gin no vuelva a interpretar las cabeceras.
+func (r *Resolver) Middleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if addr, ok := r.Resolve(c.Request); ok {
+			req := c.Request.WithContext(c.Request.Context())
+			req.RemoteAddr = netip.AddrPortFrom(addr, 0).String()
+			c.Request = req
+		}
+		c.Next()
+	}
+}
+
+func (r *Resolver) isTrusted(addr netip.Addr) bool {
+	for _, prefix := range r.trusted {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// forwardedFor extrae los parámetros for= de las cabeceras Forwarded en
+// orden.
+func forwardedFor(headers []string) (hops []string) {
+	for _, header := range headers {
+		for _, element := range strings.Split(header, ",") {
+			value := ""
+			for _, pair := range strings.Split(element, ";") {
+				key, v, found := strings.Cut(strings.TrimSpace(pair), "=")
+				if found && strings.EqualFold(key, "for") {
+					value = strings.Trim(strings.TrimSpace(v), `"`)
+				}
+			}
+			hops = append(hops, value)
+		}
+	}
+	return hops
+}
+
+func forwardedList(headers []string) []string {
+	var hops []string
+	for _, header := range headers {
+		for _, hop := range strings.Split(header, ",") {
+			hops = append(hops, strings.TrimSpace(hop))
+		}
+	}
+	return hops
+}
+
+// parseHost acepta "ip", "ip:puerto", "[ipv6]" e "[ipv6]:puerto". Los
+// identificadores ofuscados de RFC 7239 ("unknown", "_x") no son válidos.
+func parseHost(value string) (netip.Addr, bool) {
+	value = strings.TrimSpace(value)
+	if host, _, err := net.SplitHostPort(value); err == nil {
+		value = host
+	}
+	value = strings.TrimSuffix(strings.TrimPrefix(value, "["), "]")
+	addr, err := netip.ParseAddr(value)
+	if err != nil {
+		return netip.Addr{}, false
+	}
+	return addr.Unmap(), true
+}
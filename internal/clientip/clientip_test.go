@@ -0,0 +1,107 @@
+package clientip
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestResolve(t *testing.T) {
+	trusted, err := ParseTrusted([]string{"10.0.0.0/8", "192.168.1.1"})
+	if err != nil {
+		t.Fatalf("ParseTrusted: %v", err)
+	}
+	r := New(trusted, "")
+
+	cases := []struct {
+		name    string
+		remote  string
+		headers map[string]string
+		want    string
+	}{
+		{"untrusted peer ignores headers", "203.0.113.9:1234", map[string]string{"X-Forwarded-For": "1.1.1.1"}, "203.0.113.9"},
+		{"no headers", "10.0.0.1:1234", nil, "10.0.0.1"},
+		{"single hop", "10.0.0.1:1234", map[string]string{"X-Forwarded-For": "198.51.100.7"}, "198.51.100.7"},
+		{"spoofed left entry", "10.0.0.1:1234", map[string]string{"X-Forwarded-For": "1.1.1.1, 198.51.100.7, 10.0.0.2"}, "198.51.100.7"},
+		{"all trusted", "10.0.0.1:1234", map[string]string{"X-Forwarded-For": "10.0.0.3, 192.168.1.1"}, "10.0.0.3"},
+		{"garbage stops the walk", "10.0.0.1:1234", map[string]string{"X-Forwarded-For": "198.51.100.7, nope"}, "10.0.0.1"},
+		{"client forwarded ignored", "10.0.0.1:1234", map[string]string{
+			"Forwarded":       "for=198.51.100.77",
+			"X-Forwarded-For": "198.51.100.7",
+		}, "198.51.100.7"},
+		{"mapped ipv4 peer", "[::ffff:10.0.0.1]:1234", map[string]string{"X-Forwarded-For": "198.51.100.7:5555"}, "198.51.100.7"},
+	}
+	for _, tc := range cases {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.RemoteAddr = tc.remote
+		for k, v := range tc.headers {
+			req.Header.Set(k, v)
+		}
+		got, ok := r.Resolve(req)
+		if !ok || got.String() != tc.want {
+			t.Fatalf("%s: expected %s, got %s (ok=%v)", tc.name, tc.want, got, ok)
+		}
+	}
+}
+
+func TestResolveForwarded(t *testing.T) {
+	trusted, _ := ParseTrusted([]string{"10.0.0.0/8"})
+	r := New(trusted, "forwarded")
+
+	cases := []struct {
+		name    string
+		headers map[string]string
+		want    string
+	}{
+		{"forwarded", map[string]string{
+			"Forwarded":       `for=192.0.2.60;proto=https, for="[2001:db8::17]:4711"`,
+			"X-Forwarded-For": "1.1.1.1",
+		}, "2001:db8::17"},
+		{"client x-forwarded-for ignored", map[string]string{"X-Forwarded-For": "198.51.100.77"}, "10.0.0.1"},
+		{"obfuscated", map[string]string{"Forwarded": "for=_hidden"}, "10.0.0.1"},
+	}
+	for _, tc := range cases {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.RemoteAddr = "10.0.0.1:1234"
+		for k, v := range tc.headers {
+			req.Header.Set(k, v)
+		}
+		got, ok := r.Resolve(req)
+		if !ok || got.String() != tc.want {
+			t.Fatalf("%s: expected %s, got %s (ok=%v)", tc.name, tc.want, got, ok)
+		}
+	}
+}
+
+func TestParseTrustedRejectsInvalid(t *testing.T) {
+	for _, entry := range []string{"10.0.0.0/33", "proxy.local"} {
+		if _, err := ParseTrusted([]string{entry}); err == nil {
+			t.Fatalf("expected error for %q", entry)
+		}
+	}
+}
+
+func TestMiddlewareSetsClientIP(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	trusted, _ := ParseTrusted([]string{"10.0.0.0/8"})
+	router := gin.New()
+	if err := router.SetTrustedProxies(nil); err != nil {
+		t.Fatal(err)
+	}
+	router.Use(New(trusted, HeaderXForwardedFor).Middleware())
+	router.GET("/", func(c *gin.Context) {
+		c.String(http.StatusOK, c.ClientIP())
+	})
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.RemoteAddr = "10.0.0.1:1234"
+	req.Header.Set("X-Forwarded-For", "198.51.100.7")
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, req)
+	if rec.Body.String() != "198.51.100.7" {
+		t.Fatalf("expected resolved client ip, got %q", rec.Body.String())
+	}
+}
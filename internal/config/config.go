@@ -0,0 +1,557 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"maps"
+	"net/netip"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"gopkg.in/yaml.v3"
+)
+
+// Config reúne toda la configuración del servicio. Se carga en este orden de
+// precedencia (cada fuente sobrescribe a la anterior): valores por defecto,
+// archivo YAML/TOML, variables de entorno y flags.
+type Config struct {
+	Server    ServerConfig    `yaml:"server" toml:"server"`
+	Supabase  SupabaseConfig  `yaml:"supabase" toml:"supabase"`
+	Transcode TranscodeConfig `yaml:"transcode" toml:"transcode"`
+	Log       LogConfig       `yaml:"log" toml:"log"`
+	Tracing   TracingConfig   `yaml:"tracing" toml:"tracing"`
+	Health    HealthConfig    `yaml:"health" toml:"health"`
+	Tokens    TokensConfig    `yaml:"tokens" toml:"tokens"`
+	RateLimit RateLimitConfig `yaml:"rate_limit" toml:"rate_limit"`
+	CORS      CORSConfig      `yaml:"cors" toml:"cors"`
+	Cache     CacheConfig     `yaml:"cache" toml:"cache"`
+	Live      LiveConfig      `yaml:"live" toml:"live"`
+}
+
+type ServerConfig struct {
+	Port int `yaml:"port" toml:"port"`
+	// PublicURL es el origen público usado en URLs absolutas; vacío lo deriva
+	// de cada petición.
+	PublicURL    string   `yaml:"public_url" toml:"public_url"`
+	Secret       string   `yaml:"secret" toml:"secret"`
+	DrainTimeout Duration `yaml:"drain_timeout" toml:"drain_timeout"`
+	CancelGrace  Duration `yaml:"cancel_grace" toml:"cancel_grace"`
+	// TrustedProxies son las IPs o rangos CIDR cuya cabecera de reenvío se
+	// acepta; vacío usa la dirección de la conexión.
+	TrustedProxies []string `yaml:"trusted_proxies" toml:"trusted_proxies"`
+	// TrustedProxyHeader es la cabecera que escriben esos proxies:
+	// X-Forwarded-For o Forwarded. La otra se ignora.
+	TrustedProxyHeader string `yaml:"trusted_proxy_header" toml:"trusted_proxy_header"`
+}
+
+type SupabaseConfig struct {
+	URL             string `yaml:"url" toml:"url"`
+	ServiceKey      string `yaml:"service_key" toml:"service_key"`
+	Bucket          string `yaml:"bucket" toml:"bucket"`
+	BucketPublicURL string `yaml:"bucket_public_url" toml:"bucket_public_url"`
+}
+
+type TranscodeConfig struct {
+	FFmpegBin      string `yaml:"ffmpeg_bin" toml:"ffmpeg_bin"`
+	FFProbeBin     string `yaml:"ffprobe_bin" toml:"ffprobe_bin"`
+	SegmentSeconds int    `yaml:"segment_seconds" toml:"segment_seconds"`
+	// Variants son las tasas de bits (Kbps) de la escalera HLS.
+	Variants []int `yaml:"variants" toml:"variants"`
+	// Encryption cifra los segmentos de las nuevas subidas: none o aes-128.
+	Encryption string `yaml:"encryption" toml:"encryption"`
+	// ProgressiveFormat añade un archivo único para clientes sin HLS:
+	// none, mp3 o m4a. ProgressiveBitrate es su tasa en Kbps.
+	ProgressiveFormat  string `yaml:"progressive_format" toml:"progressive_format"`
+	ProgressiveBitrate int    `yaml:"progressive_bitrate" toml:"progressive_bitrate"`
+	// OnDemandVariants son tasas (Kbps) que no se generan al subir sino la
+	// primera vez que se piden. OnDemandMaxJobs limita cuántas a la vez.
+	OnDemandVariants []int `yaml:"ondemand_variants" toml:"ondemand_variants"`
+	OnDemandMaxJobs  int   `yaml:"ondemand_max_jobs" toml:"ondemand_max_jobs"`
+	// KeepSource guarda el archivo subido para poder re-transcodificarlo.
+	// Las variantes bajo demanda lo necesitan y lo activan igualmente.
+	KeepSource bool `yaml:"keep_source" toml:"keep_source"`
+}
+
+type LogConfig struct {
+	Level string `yaml:"level" toml:"level"`
+}
+
+type TracingConfig struct {
+	Exporter    string `yaml:"exporter" toml:"exporter"`
+	ServiceName string `yaml:"service_name" toml:"service_name"`
+}
+
+type HealthConfig struct {
+	MinTmpFreeMB uint64 `yaml:"min_tmp_free_mb" toml:"min_tmp_free_mb"`
+}
+
+type TokensConfig struct {
+	// Audiences son las audiencias (claim aud) aceptadas en /stream; vacío
+	// acepta cualquiera.
+	Audiences []string `yaml:"audiences" toml:"audiences"`
+	// KeysFile es un keyring JSON (ver security.LoadKeyringFile) donde
+	// también se persisten las rotaciones.
+	KeysFile string `yaml:"keys_file" toml:"keys_file"`
+	// Keys y ActiveKey definen el keyring en línea. Sin KeysFile ni Keys se
+	// firma con server.secret bajo el ID "default".
+	Keys      []SigningKey `yaml:"keys" toml:"keys"`
+	ActiveKey string       `yaml:"active_key" toml:"active_key"`
+	// RotationGrace es cuánto se sigue aceptando la clave anterior tras rotar.
+	RotationGrace Duration `yaml:"rotation_grace" toml:"rotation_grace"`
+	// RevocationRefresh es cada cuánto se recarga la lista de revocación.
+	RevocationRefresh Duration `yaml:"revocation_refresh" toml:"revocation_refresh"`
+	// DefaultTTL y MaxTTL acotan la vida de los tokens; ScopeTTL los
+	// sobrescribe por audiencia.
+	DefaultTTL Duration            `yaml:"default_ttl" toml:"default_ttl"`
+	MaxTTL     Duration            `yaml:"max_ttl" toml:"max_ttl"`
+	ScopeTTL   map[string]TTLScope `yaml:"scope_ttl" toml:"scope_ttl"`
+	// Mode es cómo viaja el token en las URLs de /stream por defecto: query,
+	// path o cookie. SessionTTL limita la vida de la cookie de sesión.
+	Mode       string   `yaml:"mode" toml:"mode"`
+	SessionTTL Duration `yaml:"session_ttl" toml:"session_ttl"`
+}
+
+type TTLScope struct {
+	Default Duration `yaml:"default" toml:"default"`
+	Max     Duration `yaml:"max" toml:"max"`
+}
+
+type SigningKey struct {
+	ID       string    `yaml:"id" toml:"id"`
+	Secret   string    `yaml:"secret" toml:"secret"`
+	RetireAt time.Time `yaml:"retire_at,omitempty" toml:"retire_at,omitempty"`
+}
+
+type RateLimitConfig struct {
+	// Backend es "memory" (por réplica) o "redis" (compartido).
+	Backend  string        `yaml:"backend" toml:"backend"`
+	RedisURL string        `yaml:"redis_url" toml:"redis_url"`
+	Token    RateLimitRule `yaml:"token" toml:"token"`
+	Stream   RateLimitRule `yaml:"stream" toml:"stream"`
+	Admin    RateLimitRule `yaml:"admin" toml:"admin"`
+	// Public cubre las rutas que no exigen API key ni token válido.
+	Public RateLimitRule `yaml:"public" toml:"public"`
+}
+
+// RateLimitRule permite Limit peticiones por Window y cliente. Key elige
+// cómo se identifica al cliente: ip, api_key o user.
+type RateLimitRule struct {
+	Limit  int      `yaml:"limit" toml:"limit"`
+	Window Duration `yaml:"window" toml:"window"`
+	Key    string   `yaml:"key" toml:"key"`
+}
+
+// CORSConfig habilita CORS para reproductores web. Sin AllowedOrigins está
+// desactivado; las listas vacías usan los valores de cors.DefaultConfig.
+type CORSConfig struct {
+	AllowedOrigins   []string `yaml:"allowed_origins" toml:"allowed_origins"`
+	AllowedMethods   []string `yaml:"allowed_methods" toml:"allowed_methods"`
+	AllowedHeaders   []string `yaml:"allowed_headers" toml:"allowed_headers"`
+	ExposedHeaders   []string `yaml:"exposed_headers" toml:"exposed_headers"`
+	AllowCredentials bool     `yaml:"allow_credentials" toml:"allow_credentials"`
+	MaxAge           Duration `yaml:"max_age" toml:"max_age"`
+}
+
+// CacheConfig controla la caché de /stream delante del bucket. Un TTL 0
+// desactiva la caché correspondiente; la de segmentos requiere SegmentDir.
+type CacheConfig struct {
+	PlaylistTTL     Duration `yaml:"playlist_ttl" toml:"playlist_ttl"`
+	PlaylistEntries int      `yaml:"playlist_entries" toml:"playlist_entries"`
+	SegmentDir      string   `yaml:"segment_dir" toml:"segment_dir"`
+	SegmentMaxMB    int      `yaml:"segment_max_mb" toml:"segment_max_mb"`
+	SegmentTTL      Duration `yaml:"segment_ttl" toml:"segment_ttl"`
+	SignedURLTTL    Duration `yaml:"signed_url_ttl" toml:"signed_url_ttl"`
+}
+
+// LiveConfig declara los canales en directo. Sin Channels no se montan las
+// rutas de ingesta.
+type LiveConfig struct {
+	Channels       []string `yaml:"channels" toml:"channels"`
+	Bitrate        int      `yaml:"bitrate" toml:"bitrate"`
+	SegmentSeconds int      `yaml:"segment_seconds" toml:"segment_seconds"`
+	WindowSegments int      `yaml:"window_segments" toml:"window_segments"`
+	// DVRWindow permite retroceder ese tiempo en la emisión; 0 lo desactiva.
+	DVRWindow Duration `yaml:"dvr_window" toml:"dvr_window"`
+	// SourcePassword es la contraseña de las fuentes. Es obligatoria con canales
+	// y no puede coincidir con server.secret.
+	SourcePassword string `yaml:"source_password" toml:"source_password"`
+}
+
+// Default devuelve la configuración base antes de aplicar archivo, entorno y flags.
+func Default() Config {
+	return Config{
+		Server: ServerConfig{
+			Port:               8080,
+			DrainTimeout:       Duration(30 * time.Second),
+			CancelGrace:        Duration(10 * time.Second),
+			TrustedProxyHeader: "X-Forwarded-For",
+		},
+		Transcode: TranscodeConfig{
+			FFmpegBin:      "ffmpeg",
+			FFProbeBin:     "ffprobe",
+			SegmentSeconds: 6,
+			Variants:       []int{64, 128, 192},
+			Encryption:     "none",
+
+			ProgressiveFormat:  "none",
+			ProgressiveBitrate: 128,
+			OnDemandMaxJobs:    2,
+			KeepSource:         true,
+		},
+		Log:     LogConfig{Level: "info"},
+		Tracing: TracingConfig{Exporter: "none", ServiceName: "gotify"},
+		Health:  HealthConfig{MinTmpFreeMB: 256},
+		RateLimit: RateLimitConfig{
+			Backend: "memory",
+			Token:   RateLimitRule{Limit: 60, Window: Duration(time.Minute), Key: "api_key"},
+			Stream:  RateLimitRule{Limit: 600, Window: Duration(time.Minute), Key: "user"},
+			Admin:   RateLimitRule{Limit: 60, Window: Duration(time.Minute), Key: "api_key"},
+			Public:  RateLimitRule{Limit: 1200, Window: Duration(time.Minute), Key: "ip"},
+		},
+		CORS: CORSConfig{MaxAge: Duration(10 * time.Minute)},
+		Cache: CacheConfig{
+			PlaylistTTL:     Duration(30 * time.Second),
+			PlaylistEntries: 1000,
+			SegmentMaxMB:    1024,
+			SegmentTTL:      Duration(24 * time.Hour),
+			SignedURLTTL:    Duration(20 * time.Second),
+		},
+		Live: LiveConfig{Bitrate: 128, SegmentSeconds: 4, WindowSegments: 6},
+		Tokens: TokensConfig{
+			RotationGrace:     Duration(24 * time.Hour),
+			RevocationRefresh: Duration(30 * time.Second),
+			DefaultTTL:        Duration(10 * time.Minute),
+			MaxTTL:            Duration(24 * time.Hour),
+			Mode:              "query",
+			SessionTTL:        Duration(10 * time.Minute),
+		},
+	}
+}
+
+// Validate comprueba la configuración completa y devuelve todos los problemas
+// encontrados a la vez.
+func (c Config) Validate() error {
+	var errs []error
+	add := func(format string, args ...any) {
+		errs = append(errs, fmt.Errorf(format, args...))
+	}
+
+	if c.Server.Port <= 0 || c.Server.Port > 65535 {
+		add("server.port (PORT) must be between 1 and 65535, got %d", c.Server.Port)
+	}
+	if strings.TrimSpace(c.Server.Secret) == "" {
+		add("server.secret (SECRET) is required")
+	}
+	if c.Server.DrainTimeout <= 0 {
+		add("server.drain_timeout (SHUTDOWN_DRAIN_TIMEOUT) must be positive")
+	}
+	if c.Server.CancelGrace <= 0 {
+		add("server.cancel_grace (SHUTDOWN_CANCEL_GRACE) must be positive")
+	}
+
+	if u, err := url.Parse(c.Supabase.URL); c.Supabase.URL == "" || err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		add("supabase.url (SUPABASE_URL) must be an http(s) URL, got %q", c.Supabase.URL)
+	}
+	if strings.TrimSpace(c.Supabase.ServiceKey) == "" {
+		add("supabase.service_key (SUPABASE_SERVICE_KEY) is required")
+	}
+	if strings.TrimSpace(c.Supabase.Bucket) == "" {
+		add("supabase.bucket (SUPABASE_BUCKET) is required")
+	}
+
+	if c.Transcode.FFmpegBin == "" {
+		add("transcode.ffmpeg_bin (FFMPEG_BIN) must not be empty")
+	}
+	if c.Transcode.FFProbeBin == "" {
+		add("transcode.ffprobe_bin (FFPROBE_BIN) must not be empty")
+	}
+	if c.Transcode.SegmentSeconds <= 0 {
+		add("transcode.segment_seconds (HLS_SEGMENT_SECONDS) must be positive, got %d", c.Transcode.SegmentSeconds)
+	}
+	if len(c.Transcode.Variants) == 0 {
+		add("transcode.variants (HLS_AUDIO_VARIANTS) must list at least one bitrate")
+	}
+	seen := map[int]bool{}
+	for _, kbps := range c.Transcode.Variants {
+		if kbps <= 0 {
+			add("transcode.variants (HLS_AUDIO_VARIANTS): bitrate must be positive, got %d", kbps)
+		}
+		if seen[kbps] {
+			add("transcode.variants (HLS_AUDIO_VARIANTS): duplicate bitrate %d", kbps)
+		}
+		seen[kbps] = true
+	}
+	seen = map[int]bool{}
+	for _, kbps := range c.Transcode.OnDemandVariants {
+		if kbps <= 0 {
+			add("transcode.ondemand_variants (HLS_ONDEMAND_VARIANTS): bitrate must be positive, got %d", kbps)
+		}
+		if seen[kbps] {
+			add("transcode.ondemand_variants (HLS_ONDEMAND_VARIANTS): duplicate bitrate %d", kbps)
+		}
+		seen[kbps] = true
+	}
+	if len(c.Transcode.OnDemandVariants) > 0 && c.Transcode.OnDemandMaxJobs <= 0 {
+		add("transcode.ondemand_max_jobs (HLS_ONDEMAND_MAX_JOBS) must be positive")
+	}
+
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(c.Log.Level)); err != nil {
+		add("log.level (LOG_LEVEL) must be one of debug, info, warn, error; got %q", c.Log.Level)
+	}
+	switch c.Tracing.Exporter {
+	case "none", "otlp", "stdout":
+	default:
+		add("tracing.exporter (OTEL_TRACES_EXPORTER) must be one of none, otlp, stdout; got %q", c.Tracing.Exporter)
+	}
+
+	if c.Tokens.KeysFile != "" && len(c.Tokens.Keys) > 0 {
+		add("tokens.keys_file (SIGNING_KEYS_FILE) and tokens.keys (SIGNING_KEYS) are mutually exclusive")
+	}
+	if len(c.Tokens.Keys) > 0 {
+		found := false
+		ids := map[string]bool{}
+		for _, key := range c.Tokens.Keys {
+			if key.ID == "" || key.Secret == "" {
+				add("tokens.keys (SIGNING_KEYS): every key needs an id and a secret")
+			}
+			if ids[key.ID] {
+				add("tokens.keys (SIGNING_KEYS): duplicate key id %q", key.ID)
+			}
+			ids[key.ID] = true
+			found = found || key.ID == c.Tokens.ActiveKey
+		}
+		if !found {
+			add("tokens.active_key (SIGNING_KEY_ACTIVE) %q is not one of tokens.keys", c.Tokens.ActiveKey)
+		}
+	}
+	if c.Server.PublicURL != "" {
+		if u, err := url.Parse(c.Server.PublicURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			add("server.public_url (PUBLIC_URL) must be an http(s) URL, got %q", c.Server.PublicURL)
+		}
+	}
+	for _, proxy := range c.Server.TrustedProxies {
+		if _, err := netip.ParsePrefix(proxy); err != nil {
+			if _, err := netip.ParseAddr(proxy); err != nil {
+				add("server.trusted_proxies (TRUSTED_PROXIES): %q is not an IP or CIDR", proxy)
+			}
+		}
+	}
+	if h := c.Server.TrustedProxyHeader; !strings.EqualFold(h, "X-Forwarded-For") && !strings.EqualFold(h, "Forwarded") {
+		add("server.trusted_proxy_header (TRUSTED_PROXY_HEADER) must be X-Forwarded-For or Forwarded, got %q", c.Server.TrustedProxyHeader)
+	}
+	if c.Tokens.DefaultTTL <= 0 || c.Tokens.MaxTTL <= 0 {
+		add("tokens.default_ttl (TOKEN_DEFAULT_TTL) and tokens.max_ttl (TOKEN_MAX_TTL) must be positive")
+	} else if c.Tokens.DefaultTTL > c.Tokens.MaxTTL {
+		add("tokens.default_ttl (TOKEN_DEFAULT_TTL) %s exceeds tokens.max_ttl %s", c.Tokens.DefaultTTL, c.Tokens.MaxTTL)
+	}
+	longest := c.Tokens.MaxTTL
+	for aud, scope := range c.Tokens.ScopeTTL {
+		if scope.Default < 0 || scope.Max < 0 {
+			add("tokens.scope_ttl (TOKEN_SCOPE_TTL) %q: durations must not be negative", aud)
+		}
+		if scope.Default > 0 && scope.Max > 0 && scope.Default > scope.Max {
+			add("tokens.scope_ttl (TOKEN_SCOPE_TTL) %q: default %s exceeds max %s", aud, scope.Default, scope.Max)
+		}
+		longest = max(longest, scope.Max)
+	}
+	if c.Tokens.RotationGrace < longest {
+		add("tokens.rotation_grace (SIGNING_KEY_ROTATION_GRACE) %s must be at least the longest token TTL %s", c.Tokens.RotationGrace, longest)
+	}
+	switch c.RateLimit.Backend {
+	case "memory":
+	case "redis":
+		if u, err := url.Parse(c.RateLimit.RedisURL); c.RateLimit.RedisURL == "" || err != nil || (u.Scheme != "redis" && u.Scheme != "rediss") {
+			add("rate_limit.redis_url (RATE_LIMIT_REDIS_URL) must be a redis:// URL when the backend is redis")
+		}
+	default:
+		add("rate_limit.backend (RATE_LIMIT_BACKEND) must be memory or redis, got %q", c.RateLimit.Backend)
+	}
+	for _, r := range []struct {
+		name string
+		rule RateLimitRule
+	}{{"TOKEN", c.RateLimit.Token}, {"STREAM", c.RateLimit.Stream}, {"ADMIN", c.RateLimit.Admin}, {"PUBLIC", c.RateLimit.Public}} {
+		if r.rule.Limit <= 0 || r.rule.Window <= 0 {
+			add("rate_limit.%s (RATE_LIMIT_%s): limit and window must be positive", strings.ToLower(r.name), r.name)
+		}
+		switch r.rule.Key {
+		case "ip", "api_key", "user":
+		default:
+			add("rate_limit.%s (RATE_LIMIT_%s): key must be ip, api_key or user, got %q", strings.ToLower(r.name), r.name, r.rule.Key)
+		}
+	}
+	if c.Tokens.RevocationRefresh <= 0 {
+		add("tokens.revocation_refresh (REVOCATION_REFRESH) must be positive")
+	}
+	switch c.Transcode.Encryption {
+	case "none", "aes-128":
+	default:
+		add("transcode.encryption (HLS_ENCRYPTION) must be none or aes-128, got %q", c.Transcode.Encryption)
+	}
+	switch c.Transcode.ProgressiveFormat {
+	case "none":
+	case "mp3", "m4a":
+		if c.Transcode.ProgressiveBitrate <= 0 {
+			add("transcode.progressive_bitrate (PROGRESSIVE_BITRATE) must be positive")
+		}
+	default:
+		add("transcode.progressive_format (PROGRESSIVE_FORMAT) must be none, mp3 or m4a, got %q", c.Transcode.ProgressiveFormat)
+	}
+	if c.Transcode.Encryption == "aes-128" && c.Transcode.ProgressiveFormat != "none" {
+		add("transcode.progressive_format (PROGRESSIVE_FORMAT) must be none with aes-128 encryption: the progressive file is not encrypted")
+	}
+	switch c.Tokens.Mode {
+	case "query", "path", "cookie":
+	default:
+		add("tokens.mode (STREAM_TOKEN_MODE) must be query, path or cookie, got %q", c.Tokens.Mode)
+	}
+	if c.Tokens.SessionTTL <= 0 {
+		add("tokens.session_ttl (STREAM_SESSION_TTL) must be positive")
+	}
+	if c.Cache.PlaylistTTL < 0 || c.Cache.SegmentTTL < 0 || c.Cache.SignedURLTTL < 0 {
+		add("cache TTLs (CACHE_PLAYLIST_TTL, CACHE_SEGMENT_TTL, CACHE_SIGNED_URL_TTL) must not be negative")
+	}
+	if c.Cache.PlaylistTTL > 0 && c.Cache.PlaylistEntries <= 0 {
+		add("cache.playlist_entries (CACHE_PLAYLIST_ENTRIES) must be positive, got %d", c.Cache.PlaylistEntries)
+	}
+	if c.Cache.SegmentDir != "" && c.Cache.SegmentMaxMB <= 0 {
+		add("cache.segment_max_mb (CACHE_SEGMENT_MAX_MB) must be positive, got %d", c.Cache.SegmentMaxMB)
+	}
+	for _, origin := range c.CORS.AllowedOrigins {
+		if origin == "*" {
+			continue
+		}
+		u, err := url.Parse(strings.Replace(origin, "*.", "", 1))
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || (u.Path != "" && u.Path != "/") {
+			add("cors.allowed_origins (CORS_ALLOWED_ORIGINS): %q must be *, an http(s) origin or https://*.domain", origin)
+		}
+	}
+	if c.CORS.MaxAge < 0 {
+		add("cors.max_age (CORS_MAX_AGE) must not be negative")
+	}
+	if len(c.Live.Channels) > 0 {
+		if c.Live.Bitrate <= 0 {
+			add("live.bitrate (LIVE_BITRATE) must be positive, got %d", c.Live.Bitrate)
+		}
+		if c.Live.SegmentSeconds <= 0 {
+			add("live.segment_seconds (LIVE_SEGMENT_SECONDS) must be positive, got %d", c.Live.SegmentSeconds)
+		}
+		if c.Live.WindowSegments <= 0 {
+			add("live.window_segments (LIVE_WINDOW_SEGMENTS) must be positive, got %d", c.Live.WindowSegments)
+		}
+		if c.Live.DVRWindow < 0 {
+			add("live.dvr_window (LIVE_DVR_WINDOW) must not be negative")
+		}
+		// Las fuentes suelen guardar la contraseña en texto plano: no puede
+		// ser la API key.
+		switch password := strings.TrimSpace(c.Live.SourcePassword); {
+		case password == "":
+			add("live.source_password (LIVE_SOURCE_PASSWORD) is required when live channels are configured")
+		case password == strings.TrimSpace(c.Server.Secret):
+			add("live.source_password (LIVE_SOURCE_PASSWORD) must differ from server.secret (SECRET)")
+		}
+		seen := make(map[string]bool, len(c.Live.Channels))
+		for _, ch := range c.Live.Channels {
+			if ch == "" || strings.ContainsAny(ch, "/?#") || seen[ch] {
+				add("live.channels (LIVE_CHANNELS): %q must be a unique id without /, ? or #", ch)
+			}
+			// Los IDs de canción son UUID; un canal así podría ocultar una.
+			if _, err := uuid.Parse(ch); err == nil {
+				add("live.channels (LIVE_CHANNELS): %q must not be a UUID, song ids are", ch)
+			}
+			seen[ch] = true
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// BucketPublicURL devuelve la URL pública del bucket, derivándola de la URL
+// del proyecto cuando no se configuró explícitamente.
+func (c Config) BucketPublicURL() string {
+	if c.Supabase.BucketPublicURL != "" {
+		return strings.TrimRight(c.Supabase.BucketPublicURL, "/")
+	}
+	if c.Supabase.URL == "" || c.Supabase.Bucket == "" {
+		return ""
+	}
+	return fmt.Sprintf("%s/storage/v1/object/public/%s", strings.TrimRight(c.Supabase.URL, "/"), c.Supabase.Bucket)
+}
+
+// Addr devuelve la dirección de escucha HTTP.
+func (c Config) Addr() string {
+	return ":" + strconv.Itoa(c.Server.Port)
+}
+
+const redacted = "[REDACTED]"
+
+// Redacted devuelve una copia con los secretos ocultos, apta para logs.
+func (c Config) Redacted() Config {
+	out := c
+	out.Transcode.Variants = append([]int(nil), c.Transcode.Variants...)
+	out.Transcode.OnDemandVariants = append([]int(nil), c.Transcode.OnDemandVariants...)
+	out.Server.TrustedProxies = append([]string(nil), c.Server.TrustedProxies...)
+	out.Tokens.Audiences = append([]string(nil), c.Tokens.Audiences...)
+	out.CORS.AllowedOrigins = append([]string(nil), c.CORS.AllowedOrigins...)
+	out.CORS.AllowedMethods = append([]string(nil), c.CORS.AllowedMethods...)
+	out.CORS.AllowedHeaders = append([]string(nil), c.CORS.AllowedHeaders...)
+	out.CORS.ExposedHeaders = append([]string(nil), c.CORS.ExposedHeaders...)
+	out.Live.Channels = append([]string(nil), c.Live.Channels...)
+	out.Tokens.Keys = append([]SigningKey(nil), c.Tokens.Keys...)
+	out.Tokens.ScopeTTL = maps.Clone(c.Tokens.ScopeTTL)
+	if u, err := url.Parse(c.RateLimit.RedisURL); err == nil && u.User != nil {
+		out.RateLimit.RedisURL = u.Redacted()
+	}
+	for i := range out.Tokens.Keys {
+		out.Tokens.Keys[i].Secret = redacted
+	}
+	if out.Server.Secret != "" {
+		out.Server.Secret = redacted
+	}
+	if out.Supabase.ServiceKey != "" {
+		out.Supabase.ServiceKey = redacted
+	}
+	if out.Live.SourcePassword != "" {
+		out.Live.SourcePassword = redacted
+	}
+	return out
+}
+
+// Print escribe la configuración efectiva en YAML con los secretos ocultos.
+func (c Config) Print(w io.Writer) error {
+	enc := yaml.NewEncoder(w)
+	enc.SetIndent(2)
+	if err := enc.Encode(c.Redacted()); err != nil {
+		return err
+	}
+	return enc.Close()
+}
+
+// Duration acepta valores como "30s" o "2m" en archivos, entorno y flags.
+type Duration time.Duration
+
+func (d Duration) Std() time.Duration {
+	return time.Duration(d)
+}
+
+func (d Duration) String() string {
+	return time.Duration(d).String()
+}
+
+func (d Duration) MarshalText() ([]byte, error) {
+	return []byte(d.String()), nil
+}
+
+func (d *Duration) UnmarshalText(text []byte) error {
+	parsed, err := time.ParseDuration(strings.TrimSpace(string(text)))
+	if err != nil {
+		return err
+	}
+	*d = Duration(parsed)
+	return nil
+}
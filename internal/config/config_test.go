@@ -0,0 +1,435 @@
+package config
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func envMap(values map[string]string) func(string) (string, bool) {
+	return func(key string) (string, bool) {
+		v, ok := values[key]
+		return v, ok
+	}
+}
+
+func validEnv() map[string]string {
+	return map[string]string{
+		"SECRET":               "super-secret",
+		"SUPABASE_URL":         "https://project.supabase.co",
+		"SUPABASE_SERVICE_KEY": "service-key",
+		"SUPABASE_BUCKET":      "audio",
+	}
+}
+
+func TestLoadFromEnv(t *testing.T) {
+	env := validEnv()
+	env["PORT"] = "9090"
+	env["HLS_AUDIO_VARIANTS"] = "32,64k"
+	env["HLS_SEGMENT_SECONDS"] = "4"
+	env["PROGRESSIVE_FORMAT"] = "m4a"
+	env["PROGRESSIVE_BITRATE"] = "256"
+	env["HLS_ONDEMAND_VARIANTS"] = "32k, 48"
+	env["HLS_KEEP_SOURCE"] = "false"
+	env["CACHE_PLAYLIST_TTL"] = "0"
+	env["CACHE_SEGMENT_DIR"] = "/var/cache/gotify"
+	env["CACHE_SEGMENT_MAX_MB"] = "512"
+	env["SHUTDOWN_DRAIN_TIMEOUT"] = "1m"
+	env["TOKEN_AUDIENCES"] = "web, ios"
+	env["TRUSTED_PROXIES"] = "10.0.0.0/8, 192.168.1.1"
+	env["TRUSTED_PROXY_HEADER"] = "Forwarded"
+	env["CORS_ALLOWED_ORIGINS"] = "https://player.example, https://*.tenant.example"
+	env["CORS_ALLOW_CREDENTIALS"] = "true"
+
+	cfg, _, err := Load(nil, envMap(env))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if cfg.Server.Port != 9090 {
+		t.Fatalf("expected port 9090, got %d", cfg.Server.Port)
+	}
+	if len(cfg.Transcode.Variants) != 2 || cfg.Transcode.Variants[0] != 32 || cfg.Transcode.Variants[1] != 64 {
+		t.Fatalf("unexpected variants %v", cfg.Transcode.Variants)
+	}
+	if cfg.Transcode.SegmentSeconds != 4 {
+		t.Fatalf("expected 4 second segments, got %d", cfg.Transcode.SegmentSeconds)
+	}
+	if cfg.Cache.PlaylistTTL != 0 || cfg.Cache.SegmentDir != "/var/cache/gotify" || cfg.Cache.SegmentMaxMB != 512 || cfg.Cache.SignedURLTTL.Std() != 20*time.Second {
+		t.Fatalf("unexpected cache config %+v", cfg.Cache)
+	}
+	if len(cfg.Transcode.OnDemandVariants) != 2 || cfg.Transcode.OnDemandVariants[0] != 32 || cfg.Transcode.OnDemandMaxJobs != 2 {
+		t.Fatalf("unexpected on-demand config %v %d", cfg.Transcode.OnDemandVariants, cfg.Transcode.OnDemandMaxJobs)
+	}
+	if cfg.Transcode.KeepSource {
+		t.Fatalf("expected HLS_KEEP_SOURCE=false to disable keeping the source")
+	}
+	if cfg.Transcode.ProgressiveFormat != "m4a" || cfg.Transcode.ProgressiveBitrate != 256 {
+		t.Fatalf("unexpected progressive config %q %d", cfg.Transcode.ProgressiveFormat, cfg.Transcode.ProgressiveBitrate)
+	}
+	if cfg.Server.DrainTimeout.Std() != time.Minute {
+		t.Fatalf("expected 1m drain timeout, got %v", cfg.Server.DrainTimeout)
+	}
+	if len(cfg.Tokens.Audiences) != 2 || cfg.Tokens.Audiences[1] != "ios" {
+		t.Fatalf("unexpected audiences %v", cfg.Tokens.Audiences)
+	}
+	if len(cfg.Server.TrustedProxies) != 2 || cfg.Server.TrustedProxies[1] != "192.168.1.1" {
+		t.Fatalf("unexpected trusted proxies %v", cfg.Server.TrustedProxies)
+	}
+	if cfg.Server.TrustedProxyHeader != "Forwarded" {
+		t.Fatalf("unexpected trusted proxy header %q", cfg.Server.TrustedProxyHeader)
+	}
+	if len(cfg.CORS.AllowedOrigins) != 2 || !cfg.CORS.AllowCredentials || cfg.CORS.MaxAge.Std() != 10*time.Minute {
+		t.Fatalf("unexpected cors config %+v", cfg.CORS)
+	}
+	if cfg.BucketPublicURL() != "https://project.supabase.co/storage/v1/object/public/audio" {
+		t.Fatalf("unexpected derived public url %q", cfg.BucketPublicURL())
+	}
+}
+
+func TestLoadRejectsInvalidEnv(t *testing.T) {
+	env := validEnv()
+	env["HLS_AUDIO_VARIANTS"] = "128,128,invalid"
+	env["HLS_SEGMENT_SECONDS"] = "six"
+	env["CORS_ALLOW_CREDENTIALS"] = "maybe"
+	env["STREAM_SESSION_TTL"] = "soon"
+
+	_, _, err := Load(nil, envMap(env))
+	if err == nil {
+		t.Fatalf("expected error")
+	}
+	for _, want := range []string{"HLS_AUDIO_VARIANTS", `"invalid"`, "HLS_SEGMENT_SECONDS", "CORS_ALLOW_CREDENTIALS", "STREAM_SESSION_TTL"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Fatalf("expected %q in error, got %v", want, err)
+		}
+	}
+}
+
+func TestLoadSigningKeysFromEnv(t *testing.T) {
+	env := validEnv()
+	env["SIGNING_KEYS"] = "k1:first, k2:sec:ond"
+
+	cfg, _, err := Load(nil, envMap(env))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(cfg.Tokens.Keys) != 2 || cfg.Tokens.Keys[1].Secret != "sec:ond" {
+		t.Fatalf("unexpected keys %+v", cfg.Tokens.Keys)
+	}
+	if cfg.Tokens.ActiveKey != "k2" {
+		t.Fatalf("expected last key to be active, got %q", cfg.Tokens.ActiveKey)
+	}
+
+	env["SIGNING_KEY_ACTIVE"] = "k3"
+	if _, _, err := Load(nil, envMap(env)); err == nil || !strings.Contains(err.Error(), "SIGNING_KEY_ACTIVE") {
+		t.Fatalf("expected unknown active key error, got %v", err)
+	}
+
+	env = validEnv()
+	env["SIGNING_KEYS"] = "no-separator-secret"
+	_, _, err = Load(nil, envMap(env))
+	if err == nil || strings.Contains(err.Error(), "no-separator-secret") {
+		t.Fatalf("expected error without leaking the secret, got %v", err)
+	}
+}
+
+func TestLoadTokenTTL(t *testing.T) {
+	env := validEnv()
+	env["TOKEN_MAX_TTL"] = "2h"
+	env["TOKEN_SCOPE_TTL"] = "tv=1h/6h, web=/30m"
+	env["SIGNING_KEY_ROTATION_GRACE"] = "6h"
+
+	cfg, _, err := Load(nil, envMap(env))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if cfg.Tokens.MaxTTL.Std() != 2*time.Hour || cfg.Tokens.DefaultTTL.Std() != 10*time.Minute {
+		t.Fatalf("unexpected ttl %v/%v", cfg.Tokens.DefaultTTL, cfg.Tokens.MaxTTL)
+	}
+	tv, web := cfg.Tokens.ScopeTTL["tv"], cfg.Tokens.ScopeTTL["web"]
+	if tv.Default.Std() != time.Hour || tv.Max.Std() != 6*time.Hour || web.Default != 0 || web.Max.Std() != 30*time.Minute {
+		t.Fatalf("unexpected scopes %+v", cfg.Tokens.ScopeTTL)
+	}
+
+	env["SIGNING_KEY_ROTATION_GRACE"] = "3h"
+	if _, _, err := Load(nil, envMap(env)); err == nil || !strings.Contains(err.Error(), "SIGNING_KEY_ROTATION_GRACE") {
+		t.Fatalf("expected rotation grace shorter than a scope max ttl to fail, got %v", err)
+	}
+
+	env = validEnv()
+	env["TOKEN_DEFAULT_TTL"] = "3h"
+	env["TOKEN_MAX_TTL"] = "1h"
+	if _, _, err := Load(nil, envMap(env)); err == nil || !strings.Contains(err.Error(), "TOKEN_DEFAULT_TTL") {
+		t.Fatalf("expected default above max to fail, got %v", err)
+	}
+
+	env = validEnv()
+	env["TOKEN_SCOPE_TTL"] = "tv"
+	if _, _, err := Load(nil, envMap(env)); err == nil || !strings.Contains(err.Error(), "TOKEN_SCOPE_TTL") {
+		t.Fatalf("expected malformed scope ttl to fail, got %v", err)
+	}
+
+	env = validEnv()
+	env["STREAM_TOKEN_MODE"] = "header"
+	if _, _, err := Load(nil, envMap(env)); err == nil || !strings.Contains(err.Error(), "STREAM_TOKEN_MODE") {
+		t.Fatalf("expected unknown token mode to fail, got %v", err)
+	}
+
+	env = validEnv()
+	env["HLS_ENCRYPTION"] = "sample-aes"
+	if _, _, err := Load(nil, envMap(env)); err == nil || !strings.Contains(err.Error(), "HLS_ENCRYPTION") {
+		t.Fatalf("expected unsupported encryption to fail, got %v", err)
+	}
+
+	env = validEnv()
+	env["HLS_ONDEMAND_VARIANTS"] = "32,32"
+	if _, _, err := Load(nil, envMap(env)); err == nil || !strings.Contains(err.Error(), "duplicate bitrate 32") {
+		t.Fatalf("expected duplicate on-demand bitrate to fail, got %v", err)
+	}
+
+	env = validEnv()
+	env["PROGRESSIVE_FORMAT"] = "flac"
+	if _, _, err := Load(nil, envMap(env)); err == nil || !strings.Contains(err.Error(), "PROGRESSIVE_FORMAT") {
+		t.Fatalf("expected unsupported progressive format to fail, got %v", err)
+	}
+
+	env = validEnv()
+	env["CACHE_PLAYLIST_ENTRIES"] = "0"
+	env["CACHE_SIGNED_URL_TTL"] = "-1s"
+	_, _, err = Load(nil, envMap(env))
+	for _, want := range []string{"CACHE_PLAYLIST_ENTRIES", "CACHE_SIGNED_URL_TTL"} {
+		if err == nil || !strings.Contains(err.Error(), want) {
+			t.Fatalf("expected %s to be rejected, got %v", want, err)
+		}
+	}
+}
+
+func TestLoadRateLimits(t *testing.T) {
+	env := validEnv()
+	env["RATE_LIMIT_STREAM"] = "1200/30s:ip"
+	env["RATE_LIMIT_TOKEN"] = "5/1s"
+	env["RATE_LIMIT_BACKEND"] = "redis"
+	env["RATE_LIMIT_REDIS_URL"] = "redis://:hunter2@cache:6379/0"
+
+	cfg, _, err := Load(nil, envMap(env))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if s := cfg.RateLimit.Stream; s.Limit != 1200 || s.Window.Std() != 30*time.Second || s.Key != "ip" {
+		t.Fatalf("unexpected stream rule %+v", s)
+	}
+	if tok := cfg.RateLimit.Token; tok.Limit != 5 || tok.Window.Std() != time.Second || tok.Key != "api_key" {
+		t.Fatalf("expected token rule to keep its default key, got %+v", tok)
+	}
+	if pub := cfg.RateLimit.Public; pub.Limit != 1200 || pub.Window.Std() != time.Minute || pub.Key != "ip" {
+		t.Fatalf("unexpected default public rule %+v", pub)
+	}
+	var buf bytes.Buffer
+	_ = cfg.Print(&buf)
+	if strings.Contains(buf.String(), "hunter2") {
+		t.Fatalf("redis password leaked:\n%s", buf.String())
+	}
+
+	env["RATE_LIMIT_ADMIN"] = "10/1m:session"
+	env["RATE_LIMIT_REDIS_URL"] = ""
+	_, _, err = Load(nil, envMap(env))
+	if err == nil || !strings.Contains(err.Error(), "RATE_LIMIT_ADMIN") || !strings.Contains(err.Error(), "RATE_LIMIT_REDIS_URL") {
+		t.Fatalf("expected key and redis url errors, got %v", err)
+	}
+
+	env = validEnv()
+	env["RATE_LIMIT_TOKEN"] = "lots"
+	if _, _, err := Load(nil, envMap(env)); err == nil || !strings.Contains(err.Error(), "RATE_LIMIT_TOKEN") {
+		t.Fatalf("expected malformed rule error, got %v", err)
+	}
+}
+
+func TestLoadEncryption(t *testing.T) {
+	env := validEnv()
+	env["HLS_ENCRYPTION"] = "aes-128"
+
+	cfg, _, err := Load(nil, envMap(env))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if cfg.Transcode.Encryption != "aes-128" {
+		t.Fatalf("expected aes-128 encryption, got %q", cfg.Transcode.Encryption)
+	}
+
+	env["PROGRESSIVE_FORMAT"] = "mp3"
+	if _, _, err := Load(nil, envMap(env)); err == nil || !strings.Contains(err.Error(), "PROGRESSIVE_FORMAT") {
+		t.Fatalf("expected the unencrypted progressive file to be rejected, got %v", err)
+	}
+}
+
+func TestLoadLive(t *testing.T) {
+	env := validEnv()
+	env["LIVE_CHANNELS"] = "radio, news"
+	env["LIVE_DVR_WINDOW"] = "2m"
+	env["LIVE_SOURCE_PASSWORD"] = "hackme"
+
+	cfg, _, err := Load(nil, envMap(env))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	l := cfg.Live
+	if len(l.Channels) != 2 || l.Channels[1] != "news" || l.Bitrate != 128 || l.SegmentSeconds != 4 || l.WindowSegments != 6 || l.DVRWindow.Std() != 2*time.Minute {
+		t.Fatalf("unexpected live config %+v", l)
+	}
+	var buf bytes.Buffer
+	_ = cfg.Print(&buf)
+	if strings.Contains(buf.String(), "hackme") {
+		t.Fatalf("source password leaked:\n%s", buf.String())
+	}
+
+	env["LIVE_CHANNELS"] = "radio, radio"
+	env["LIVE_SEGMENT_SECONDS"] = "0"
+	_, _, err = Load(nil, envMap(env))
+	if err == nil || !strings.Contains(err.Error(), "LIVE_CHANNELS") || !strings.Contains(err.Error(), "LIVE_SEGMENT_SECONDS") {
+		t.Fatalf("expected duplicate channel and segment errors, got %v", err)
+	}
+
+	env = validEnv()
+	env["LIVE_CHANNELS"] = "radio, 0b6f7c52-4d0e-4a43-9d55-3f2a8e1c9b10"
+	env["LIVE_SOURCE_PASSWORD"] = "hackme"
+	if _, _, err := Load(nil, envMap(env)); err == nil || !strings.Contains(err.Error(), "UUID") {
+		t.Fatalf("expected UUID channel to be refused, got %v", err)
+	}
+
+	for _, password := range []string{"", "super-secret"} {
+		env = validEnv()
+		env["LIVE_CHANNELS"] = "radio"
+		env["LIVE_SOURCE_PASSWORD"] = password
+		if _, _, err := Load(nil, envMap(env)); err == nil || !strings.Contains(err.Error(), "LIVE_SOURCE_PASSWORD") {
+			t.Fatalf("expected source password %q to be refused, got %v", password, err)
+		}
+	}
+}
+
+func TestValidateReportsAllProblems(t *testing.T) {
+	cfg := Default()
+	cfg.Transcode.Variants = []int{64, 64}
+	cfg.Log.Level = "loud"
+	cfg.Server.TrustedProxyHeader = "X-Real-IP"
+
+	err := cfg.Validate()
+	if err == nil {
+		t.Fatalf("expected validation error")
+	}
+	for _, want := range []string{"SECRET", "SUPABASE_URL", "SUPABASE_BUCKET", "duplicate bitrate 64", "LOG_LEVEL", "TRUSTED_PROXY_HEADER"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Fatalf("expected %q in error, got %v", want, err)
+		}
+	}
+}
+
+func TestLoadPrecedence(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "gotify.yaml")
+	content := `
+server:
+  port: 7000
+  drain_timeout: 45s
+transcode:
+  variants: [96, 160]
+log:
+  level: warn
+`
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatalf("write config: %v", err)
+	}
+
+	env := validEnv()
+	env["LOG_LEVEL"] = "debug"
+
+	cfg, _, err := Load([]string{"-config", path, "-port", "7100"}, envMap(env))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if cfg.Server.Port != 7100 {
+		t.Fatalf("flag should override file, got port %d", cfg.Server.Port)
+	}
+	if cfg.Log.Level != "debug" {
+		t.Fatalf("env should override file, got level %s", cfg.Log.Level)
+	}
+	if cfg.Server.DrainTimeout.Std() != 45*time.Second {
+		t.Fatalf("expected file drain timeout, got %v", cfg.Server.DrainTimeout)
+	}
+	if len(cfg.Transcode.Variants) != 2 || cfg.Transcode.Variants[0] != 96 {
+		t.Fatalf("expected file variants, got %v", cfg.Transcode.Variants)
+	}
+}
+
+func TestLoadTOMLFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "gotify.toml")
+	content := `
+[server]
+port = 7200
+secret = "from-file"
+
+[supabase]
+url = "https://project.supabase.co"
+service_key = "file-key"
+bucket = "audio"
+`
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatalf("write config: %v", err)
+	}
+
+	cfg, _, err := Load(nil, envMap(map[string]string{"GOTIFY_CONFIG": path}))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if cfg.Server.Port != 7200 || cfg.Server.Secret != "from-file" {
+		t.Fatalf("unexpected server config %#v", cfg.Server)
+	}
+}
+
+func TestLoadRejectsUnknownFileKeys(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "gotify.yaml")
+	if err := os.WriteFile(path, []byte("server:\n  prot: 80\n"), 0o644); err != nil {
+		t.Fatalf("write config: %v", err)
+	}
+	if _, _, err := Load([]string{"-config", path}, envMap(validEnv())); err == nil {
+		t.Fatalf("expected error for unknown key")
+	}
+}
+
+func TestPrintRedactsSecrets(t *testing.T) {
+	env := validEnv()
+	env["SIGNING_KEYS"] = "k1:signing-secret"
+	cfg, _, err := Load([]string{"-print-config"}, envMap(env))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	var buf bytes.Buffer
+	if err := cfg.Print(&buf); err != nil {
+		t.Fatalf("print failed: %v", err)
+	}
+	out := buf.String()
+	if strings.Contains(out, "super-secret") || strings.Contains(out, "service-key") || strings.Contains(out, "signing-secret") {
+		t.Fatalf("secrets leaked in printed config:\n%s", out)
+	}
+	if !strings.Contains(out, redacted) || !strings.Contains(out, "drain_timeout: 30s") {
+		t.Fatalf("unexpected printed config:\n%s", out)
+	}
+	if cfg.Server.Secret != "super-secret" || cfg.Tokens.Keys[0].Secret != "signing-secret" {
+		t.Fatalf("Print must not mutate the original config")
+	}
+}
+
+func TestParseVariants(t *testing.T) {
+	got, err := ParseVariants("64, 128,192")
+	if err != nil || len(got) != 3 || got[2] != 192 {
+		t.Fatalf("unexpected result %v, %v", got, err)
+	}
+	if _, err := ParseVariants("64,abc"); err == nil {
+		t.Fatalf("expected error for invalid entry")
+	}
+	if _, err := ParseVariants(" , "); err == nil {
+		t.Fatalf("expected error for empty list")
+	}
+}
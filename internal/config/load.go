@@ -0,0 +1,376 @@
+package config
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+// Options son flags que no forman parte de la configuración del servicio.
+type Options struct {
+	// PrintConfig indica que se debe imprimir la configuración efectiva y salir.
+	PrintConfig bool
+}
+
+// Load construye la configuración a partir de los argumentos de línea de
+// comandos (sin el nombre del programa) y del entorno, y la valida.
+func Load(args []string, lookupEnv func(string) (string, bool)) (Config, Options, error) {
+	var opts Options
+	if lookupEnv == nil {
+		lookupEnv = os.LookupEnv
+	}
+
+	fs := flag.NewFlagSet("gotify", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	configPath := fs.String("config", "", "path to a YAML or TOML config file (env GOTIFY_CONFIG)")
+	port := fs.Int("port", 0, "HTTP port (env PORT)")
+	logLevel := fs.String("log-level", "", "log level: debug, info, warn, error (env LOG_LEVEL)")
+	ffmpegBin := fs.String("ffmpeg", "", "ffmpeg binary (env FFMPEG_BIN)")
+	ffprobeBin := fs.String("ffprobe", "", "ffprobe binary (env FFPROBE_BIN)")
+	fs.BoolVar(&opts.PrintConfig, "print-config", false, "print the effective config with secrets redacted and exit")
+	if err := fs.Parse(args); err != nil {
+		return Config{}, opts, fmt.Errorf("invalid flags: %w", err)
+	}
+
+	cfg := Default()
+
+	path := *configPath
+	if path == "" {
+		path, _ = lookupEnv("GOTIFY_CONFIG")
+	}
+	if path = strings.TrimSpace(path); path != "" {
+		if err := loadFile(path, &cfg); err != nil {
+			return Config{}, opts, err
+		}
+	}
+
+	if err := applyEnv(&cfg, lookupEnv); err != nil {
+		return Config{}, opts, err
+	}
+
+	fs.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "port":
+			cfg.Server.Port = *port
+		case "log-level":
+			cfg.Log.Level = *logLevel
+		case "ffmpeg":
+			cfg.Transcode.FFmpegBin = *ffmpegBin
+		case "ffprobe":
+			cfg.Transcode.FFProbeBin = *ffprobeBin
+		}
+	})
+
+	if err := cfg.Validate(); err != nil {
+		return cfg, opts, fmt.Errorf("invalid configuration:\n%w", err)
+	}
+	return cfg, opts, nil
+}
+
+func loadFile(path string, cfg *Config) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("read config file: %w", err)
+	}
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		dec := yaml.NewDecoder(strings.NewReader(string(data)))
+		dec.KnownFields(true)
+		if err := dec.Decode(cfg); err != nil && !errors.Is(err, io.EOF) {
+			return fmt.Errorf("parse %s: %w", path, err)
+		}
+	case ".toml":
+		meta, err := toml.Decode(string(data), cfg)
+		if err != nil {
+			return fmt.Errorf("parse %s: %w", path, err)
+		}
+		if undecoded := meta.Undecoded(); len(undecoded) > 0 {
+			return fmt.Errorf("parse %s: unknown keys %v", path, undecoded)
+		}
+	default:
+		return fmt.Errorf("config file %s: unsupported extension (use .yaml, .yml or .toml)", path)
+	}
+	return nil
+}
+
+func applyEnv(cfg *Config, lookupEnv func(string) (string, bool)) error {
+	var errs []error
+	str := func(name string, dst *string) {
+		if v, ok := lookupEnv(name); ok && strings.TrimSpace(v) != "" {
+			*dst = strings.TrimSpace(v)
+		}
+	}
+	integer := func(name string, dst *int) {
+		v, ok := lookupEnv(name)
+		if !ok || strings.TrimSpace(v) == "" {
+			return
+		}
+		n, err := strconv.Atoi(strings.TrimSpace(v))
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %q is not an integer", name, v))
+			return
+		}
+		*dst = n
+	}
+	boolean := func(name string, dst *bool) {
+		v, ok := lookupEnv(name)
+		if !ok || strings.TrimSpace(v) == "" {
+			return
+		}
+		b, err := strconv.ParseBool(strings.TrimSpace(v))
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %q is not a boolean", name, v))
+			return
+		}
+		*dst = b
+	}
+	duration := func(name string, dst *Duration) {
+		v, ok := lookupEnv(name)
+		if !ok || strings.TrimSpace(v) == "" {
+			return
+		}
+		if err := dst.UnmarshalText([]byte(v)); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %q is not a duration (e.g. 30s, 2m)", name, v))
+		}
+	}
+
+	integer("PORT", &cfg.Server.Port)
+	str("PUBLIC_URL", &cfg.Server.PublicURL)
+	str("TRUSTED_PROXY_HEADER", &cfg.Server.TrustedProxyHeader)
+	if v, ok := lookupEnv("TRUSTED_PROXIES"); ok && strings.TrimSpace(v) != "" {
+		cfg.Server.TrustedProxies = splitList(v)
+	}
+	str("SECRET", &cfg.Server.Secret)
+	duration("SHUTDOWN_DRAIN_TIMEOUT", &cfg.Server.DrainTimeout)
+	duration("SHUTDOWN_CANCEL_GRACE", &cfg.Server.CancelGrace)
+
+	str("SUPABASE_URL", &cfg.Supabase.URL)
+	str("SUPABASE_SERVICE_KEY", &cfg.Supabase.ServiceKey)
+	str("SUPABASE_BUCKET", &cfg.Supabase.Bucket)
+	str("SUPABASE_BUCKET_PUBLIC_URL", &cfg.Supabase.BucketPublicURL)
+
+	str("FFMPEG_BIN", &cfg.Transcode.FFmpegBin)
+	str("FFPROBE_BIN", &cfg.Transcode.FFProbeBin)
+	integer("HLS_SEGMENT_SECONDS", &cfg.Transcode.SegmentSeconds)
+	str("HLS_ENCRYPTION", &cfg.Transcode.Encryption)
+	str("PROGRESSIVE_FORMAT", &cfg.Transcode.ProgressiveFormat)
+	integer("PROGRESSIVE_BITRATE", &cfg.Transcode.ProgressiveBitrate)
+	if v, ok := lookupEnv("HLS_AUDIO_VARIANTS"); ok && strings.TrimSpace(v) != "" {
+		variants, err := ParseVariants(v)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("HLS_AUDIO_VARIANTS: %w", err))
+		} else {
+			cfg.Transcode.Variants = variants
+		}
+	}
+
+	if v, ok := lookupEnv("HLS_ONDEMAND_VARIANTS"); ok {
+		if strings.TrimSpace(v) == "" {
+			cfg.Transcode.OnDemandVariants = nil
+		} else if variants, err := ParseVariants(v); err != nil {
+			errs = append(errs, fmt.Errorf("HLS_ONDEMAND_VARIANTS: %w", err))
+		} else {
+			cfg.Transcode.OnDemandVariants = variants
+		}
+	}
+	integer("HLS_ONDEMAND_MAX_JOBS", &cfg.Transcode.OnDemandMaxJobs)
+	boolean("HLS_KEEP_SOURCE", &cfg.Transcode.KeepSource)
+
+	str("LOG_LEVEL", &cfg.Log.Level)
+	str("OTEL_TRACES_EXPORTER", &cfg.Tracing.Exporter)
+	str("OTEL_SERVICE_NAME", &cfg.Tracing.ServiceName)
+
+	if v, ok := lookupEnv("HEALTH_MIN_TMP_FREE_MB"); ok && strings.TrimSpace(v) != "" {
+		mb, err := strconv.ParseUint(strings.TrimSpace(v), 10, 64)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("HEALTH_MIN_TMP_FREE_MB: %q is not a positive integer", v))
+		} else {
+			cfg.Health.MinTmpFreeMB = mb
+		}
+	}
+
+	if v, ok := lookupEnv("TOKEN_AUDIENCES"); ok && strings.TrimSpace(v) != "" {
+		cfg.Tokens.Audiences = splitList(v)
+	}
+	str("SIGNING_KEYS_FILE", &cfg.Tokens.KeysFile)
+	if v, ok := lookupEnv("SIGNING_KEYS"); ok && strings.TrimSpace(v) != "" {
+		keys, err := parseSigningKeys(v)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("SIGNING_KEYS: %w", err))
+		} else {
+			cfg.Tokens.Keys = keys
+		}
+	}
+	str("SIGNING_KEY_ACTIVE", &cfg.Tokens.ActiveKey)
+	if cfg.Tokens.ActiveKey == "" && len(cfg.Tokens.Keys) > 0 {
+		cfg.Tokens.ActiveKey = cfg.Tokens.Keys[len(cfg.Tokens.Keys)-1].ID
+	}
+	duration("SIGNING_KEY_ROTATION_GRACE", &cfg.Tokens.RotationGrace)
+	duration("REVOCATION_REFRESH", &cfg.Tokens.RevocationRefresh)
+	duration("TOKEN_DEFAULT_TTL", &cfg.Tokens.DefaultTTL)
+	duration("TOKEN_MAX_TTL", &cfg.Tokens.MaxTTL)
+	str("STREAM_TOKEN_MODE", &cfg.Tokens.Mode)
+	duration("STREAM_SESSION_TTL", &cfg.Tokens.SessionTTL)
+	if v, ok := lookupEnv("TOKEN_SCOPE_TTL"); ok && strings.TrimSpace(v) != "" {
+		scopes, err := parseScopeTTL(v)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("TOKEN_SCOPE_TTL: %w", err))
+		} else {
+			cfg.Tokens.ScopeTTL = scopes
+		}
+	}
+
+	str("RATE_LIMIT_BACKEND", &cfg.RateLimit.Backend)
+	str("RATE_LIMIT_REDIS_URL", &cfg.RateLimit.RedisURL)
+	for name, dst := range map[string]*RateLimitRule{
+		"RATE_LIMIT_TOKEN":  &cfg.RateLimit.Token,
+		"RATE_LIMIT_STREAM": &cfg.RateLimit.Stream,
+		"RATE_LIMIT_ADMIN":  &cfg.RateLimit.Admin,
+		"RATE_LIMIT_PUBLIC": &cfg.RateLimit.Public,
+	} {
+		if v, ok := lookupEnv(name); ok && strings.TrimSpace(v) != "" {
+			if err := parseRateLimitRule(v, dst); err != nil {
+				errs = append(errs, fmt.Errorf("%s: %w", name, err))
+			}
+		}
+	}
+
+	for name, dst := range map[string]*[]string{
+		"CORS_ALLOWED_ORIGINS": &cfg.CORS.AllowedOrigins,
+		"CORS_ALLOWED_METHODS": &cfg.CORS.AllowedMethods,
+		"CORS_ALLOWED_HEADERS": &cfg.CORS.AllowedHeaders,
+		"CORS_EXPOSED_HEADERS": &cfg.CORS.ExposedHeaders,
+	} {
+		if v, ok := lookupEnv(name); ok && strings.TrimSpace(v) != "" {
+			*dst = splitList(v)
+		}
+	}
+	boolean("CORS_ALLOW_CREDENTIALS", &cfg.CORS.AllowCredentials)
+	duration("CORS_MAX_AGE", &cfg.CORS.MaxAge)
+
+	duration("CACHE_PLAYLIST_TTL", &cfg.Cache.PlaylistTTL)
+	integer("CACHE_PLAYLIST_ENTRIES", &cfg.Cache.PlaylistEntries)
+	str("CACHE_SEGMENT_DIR", &cfg.Cache.SegmentDir)
+	integer("CACHE_SEGMENT_MAX_MB", &cfg.Cache.SegmentMaxMB)
+	duration("CACHE_SEGMENT_TTL", &cfg.Cache.SegmentTTL)
+	duration("CACHE_SIGNED_URL_TTL", &cfg.Cache.SignedURLTTL)
+
+	if v, ok := lookupEnv("LIVE_CHANNELS"); ok && strings.TrimSpace(v) != "" {
+		cfg.Live.Channels = splitList(v)
+	}
+	integer("LIVE_BITRATE", &cfg.Live.Bitrate)
+	integer("LIVE_SEGMENT_SECONDS", &cfg.Live.SegmentSeconds)
+	integer("LIVE_WINDOW_SEGMENTS", &cfg.Live.WindowSegments)
+	duration("LIVE_DVR_WINDOW", &cfg.Live.DVRWindow)
+	str("LIVE_SOURCE_PASSWORD", &cfg.Live.SourcePassword)
+
+	if len(errs) > 0 {
+		return fmt.Errorf("invalid environment:\n%w", errors.Join(errs...))
+	}
+	return nil
+}
+
+// ParseVariants interpreta una lista separada por comas de bitrates en Kbps
+// ("64,128,192"). A diferencia del parser anterior, cualquier entrada inválida
+// es un error en lugar de ignorarse.
+func ParseVariants(value string) ([]int, error) {
+	var out []int
+	for _, part := range strings.Split(value, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		kbps, err := strconv.Atoi(strings.TrimSuffix(strings.ToLower(part), "k"))
+		if err != nil || kbps <= 0 {
+			return nil, fmt.Errorf("invalid bitrate %q", part)
+		}
+		out = append(out, kbps)
+	}
+	if len(out) == 0 {
+		return nil, fmt.Errorf("no bitrates in %q", value)
+	}
+	return out, nil
+}
+
+func splitList(value string) []string {
+	var out []string
+	for _, part := range strings.Split(value, ",") {
+		if part = strings.TrimSpace(part); part != "" {
+			out = append(out, part)
+		}
+	}
+	return out
+}
+
+// parseSigningKeys interpreta "id:secreto,id2:secreto2". Si no se indica
+// SIGNING_KEY_ACTIVE, la activa es la última.
+func parseSigningKeys(value string) ([]SigningKey, error) {
+	var out []SigningKey
+	for i, part := range splitList(value) {
+		id, secret, ok := strings.Cut(part, ":")
+		if !ok || strings.TrimSpace(id) == "" || secret == "" {
+			return nil, fmt.Errorf("entry %d must be id:secret", i+1)
+		}
+		out = append(out, SigningKey{ID: strings.TrimSpace(id), Secret: secret})
+	}
+	return out, nil
+}
+
+// parseScopeTTL interpreta "aud=default/max,...", p. ej. "tv=2h/4h,web=10m/1h".
+// Cualquiera de las dos duraciones puede omitirse ("tv=/4h").
+func parseScopeTTL(value string) (map[string]TTLScope, error) {
+	out := map[string]TTLScope{}
+	for _, part := range splitList(value) {
+		aud, spec, ok := strings.Cut(part, "=")
+		aud = strings.TrimSpace(aud)
+		if !ok || aud == "" {
+			return nil, fmt.Errorf("entry %q must be audience=default/max", part)
+		}
+		def, maxTTL, _ := strings.Cut(spec, "/")
+		var scope TTLScope
+		for _, d := range []struct {
+			raw string
+			dst *Duration
+		}{{def, &scope.Default}, {maxTTL, &scope.Max}} {
+			if strings.TrimSpace(d.raw) == "" {
+				continue
+			}
+			if err := d.dst.UnmarshalText([]byte(d.raw)); err != nil {
+				return nil, fmt.Errorf("entry %q: %q is not a duration", part, d.raw)
+			}
+		}
+		out[aud] = scope
+	}
+	return out, nil
+}
+
+// parseRateLimitRule interpreta "limite/ventana[:clave]", p. ej. "600/1m:user".
+// Sin clave se conserva la configurada.
+func parseRateLimitRule(value string, dst *RateLimitRule) error {
+	spec, key, hasKey := strings.Cut(strings.TrimSpace(value), ":")
+	limit, window, ok := strings.Cut(spec, "/")
+	if !ok {
+		return fmt.Errorf("%q must be limit/window[:key]", value)
+	}
+	n, err := strconv.Atoi(strings.TrimSpace(limit))
+	if err != nil {
+		return fmt.Errorf("%q: limit is not an integer", value)
+	}
+	var d Duration
+	if err := d.UnmarshalText([]byte(window)); err != nil {
+		return fmt.Errorf("%q: window is not a duration", value)
+	}
+	dst.Limit, dst.Window = n, d
+	if hasKey {
+		dst.Key = strings.TrimSpace(key)
+	}
+	return nil
+}
@@ -0,0 +1,122 @@
+// Package cors implementa CORS para reproductores web (hls.js) servidos desde
+// otro origen.
+package cors
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Config describe la política CORS. Sin orígenes el middleware no añade
+// cabeceras ni responde preflights.
+type Config struct {
+	// AllowedOrigins son orígenes exactos ("https://player.example"), "*" o
+	// comodines de subdominio ("https://*.example.com").
+	AllowedOrigins   []string
+	AllowedMethods   []string
+	AllowedHeaders   []string
+	ExposedHeaders   []string
+	AllowCredentials bool
+	MaxAge           time.Duration
+}
+
+// DefaultConfig devuelve métodos y cabeceras pensados para la API y hls.js,
+// sin ningún origen permitido.
+func DefaultConfig() Config {
+	return Config{
+		AllowedMethods: []string{http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut, http.MethodDelete},
+		AllowedHeaders: []string{"X-API-Key", "Content-Type", "Range", "X-Request-ID"},
+		ExposedHeaders: []string{
+			"Content-Length", "Content-Range", "X-Request-ID", "Retry-After",
+			"X-RateLimit-Limit", "X-RateLimit-Remaining", "X-RateLimit-Reset",
+		},
+		MaxAge: 10 * time.Minute,
+	}
+}
+
+// Middleware aplica la política. Debe registrarse en el engine, antes de
+// cualquier autenticación: los preflight (OPTIONS con
+// Access-Control-Request-Method) se responden aquí con 204 sin pedir la API
+// key. Las respuestas normales, incluidos rechazos y redirecciones a
+// segmentos firmados, llevan las cabeceras para que el navegador las exponga.
+func Middleware(cfg Config) gin.HandlerFunc {
+	if len(cfg.AllowedOrigins) == 0 {
+		return func(c *gin.Context) { c.Next() }
+	}
+	anyOrigin := false
+	for _, o := range cfg.AllowedOrigins {
+		anyOrigin = anyOrigin || o == "*"
+	}
+	methods := strings.Join(cfg.AllowedMethods, ", ")
+	headers := strings.Join(cfg.AllowedHeaders, ", ")
+	exposed := strings.Join(cfg.ExposedHeaders, ", ")
+	maxAge := strconv.Itoa(int(cfg.MaxAge.Seconds()))
+
+	return func(c *gin.Context) {
+		origin := c.GetHeader("Origin")
+		preflight := c.Request.Method == http.MethodOptions && c.GetHeader("Access-Control-Request-Method") != ""
+		if !anyOrigin || cfg.AllowCredentials {
+			c.Writer.Header().Add("Vary", "Origin")
+		}
+		if origin == "" {
+			c.Next()
+			return
+		}
+		if !allowed(cfg.AllowedOrigins, origin) {
+			if preflight {
+				c.AbortWithStatus(http.StatusForbidden)
+				return
+			}
+			c.Next()
+			return
+		}
+
+		h := c.Writer.Header()
+		if anyOrigin && !cfg.AllowCredentials {
+			h.Set("Access-Control-Allow-Origin", "*")
+		} else {
+			h.Set("Access-Control-Allow-Origin", origin)
+		}
+		if cfg.AllowCredentials {
+			h.Set("Access-Control-Allow-Credentials", "true")
+		}
+
+		if !preflight {
+			if exposed != "" {
+				h.Set("Access-Control-Expose-Headers", exposed)
+			}
+			c.Next()
+			return
+		}
+
+		h.Add("Vary", "Access-Control-Request-Method")
+		h.Add("Vary", "Access-Control-Request-Headers")
+		h.Set("Access-Control-Allow-Methods", methods)
+		if headers != "" {
+			h.Set("Access-Control-Allow-Headers", headers)
+		}
+		if cfg.MaxAge > 0 {
+			h.Set("Access-Control-Max-Age", maxAge)
+		}
+		c.AbortWithStatus(http.StatusNoContent)
+	}
+}
+
+func allowed(origins []string, origin string) bool {
+	for _, o := range origins {
+		if o == "*" || strings.EqualFold(o, origin) {
+			return true
+		}
+		if prefix, suffix, ok := strings.Cut(o, "*"); ok &&
+			len(origin) > len(prefix)+len(suffix) &&
+			strings.HasPrefix(origin, prefix) && strings.HasSuffix(origin, suffix) &&
+			!strings.Contains(origin[len(prefix):len(origin)-len(suffix)], "/") {
+			return true
+		}
+	}
+	return false
+}
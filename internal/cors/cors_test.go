@@ -0,0 +1,109 @@
+package cors
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func newRouter(cfg Config) *gin.Engine {
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.Use(Middleware(cfg))
+	// Simula RequireSecret: sin Middleware los preflight morirían aquí.
+	api := r.Group("/", func(c *gin.Context) {
+		if c.GetHeader("X-API-Key") == "" {
+			c.AbortWithStatus(http.StatusUnauthorized)
+			return
+		}
+		c.Next()
+	})
+	api.GET("/token/:id", func(c *gin.Context) { c.Status(http.StatusOK) })
+	return r
+}
+
+func request(r *gin.Engine, method, origin string, headers map[string]string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, "/token/song", nil)
+	if origin != "" {
+		req.Header.Set("Origin", origin)
+	}
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	rec := httptest.NewRecorder()
+	r.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestPreflightBypassesAuth(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.AllowedOrigins = []string{"https://player.example", "https://*.tenant.example"}
+	r := newRouter(cfg)
+
+	rec := request(r, http.MethodOptions, "https://player.example", map[string]string{
+		"Access-Control-Request-Method":  "GET",
+		"Access-Control-Request-Headers": "x-api-key",
+	})
+	if rec.Code != http.StatusNoContent {
+		t.Fatalf("expected 204 preflight, got %d", rec.Code)
+	}
+	if got := rec.Header().Get("Access-Control-Allow-Origin"); got != "https://player.example" {
+		t.Fatalf("unexpected allow origin %q", got)
+	}
+	if rec.Header().Get("Access-Control-Allow-Headers") == "" || rec.Header().Get("Access-Control-Max-Age") != "600" {
+		t.Fatalf("expected allow headers and max age, got %v", rec.Header())
+	}
+
+	rec = request(r, http.MethodOptions, "https://a.tenant.example", map[string]string{"Access-Control-Request-Method": "GET"})
+	if rec.Code != http.StatusNoContent {
+		t.Fatalf("expected wildcard subdomain to be allowed, got %d", rec.Code)
+	}
+	rec = request(r, http.MethodOptions, "https://evil.example", map[string]string{"Access-Control-Request-Method": "GET"})
+	if rec.Code != http.StatusForbidden || rec.Header().Get("Access-Control-Allow-Origin") != "" {
+		t.Fatalf("expected disallowed preflight to be rejected, got %d %v", rec.Code, rec.Header())
+	}
+}
+
+func TestActualRequestHeaders(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.AllowedOrigins = []string{"https://player.example"}
+	r := newRouter(cfg)
+
+	rec := request(r, http.MethodGet, "https://player.example", nil)
+	if rec.Code != http.StatusUnauthorized {
+		t.Fatalf("expected auth to still apply, got %d", rec.Code)
+	}
+	if rec.Header().Get("Access-Control-Allow-Origin") != "https://player.example" || rec.Header().Get("Access-Control-Expose-Headers") == "" {
+		t.Fatalf("expected cors headers on rejections, got %v", rec.Header())
+	}
+	if rec.Header().Get("Vary") != "Origin" {
+		t.Fatalf("expected Vary: Origin, got %q", rec.Header().Get("Vary"))
+	}
+
+	rec = request(r, http.MethodGet, "https://evil.example", map[string]string{"X-API-Key": "k"})
+	if rec.Code != http.StatusOK || rec.Header().Get("Access-Control-Allow-Origin") != "" {
+		t.Fatalf("expected no cors headers for other origins, got %d %v", rec.Code, rec.Header())
+	}
+}
+
+func TestAnyOriginAndDisabled(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.AllowedOrigins = []string{"*"}
+	rec := request(newRouter(cfg), http.MethodGet, "https://anyone.example", nil)
+	if rec.Header().Get("Access-Control-Allow-Origin") != "*" {
+		t.Fatalf("expected wildcard origin, got %v", rec.Header())
+	}
+
+	cfg.AllowCredentials = true
+	rec = request(newRouter(cfg), http.MethodGet, "https://anyone.example", nil)
+	if rec.Header().Get("Access-Control-Allow-Origin") != "https://anyone.example" || rec.Header().Get("Access-Control-Allow-Credentials") != "true" {
+		t.Fatalf("expected echoed origin with credentials, got %v", rec.Header())
+	}
+
+	rec = request(newRouter(DefaultConfig()), http.MethodOptions, "https://player.example", map[string]string{"Access-Control-Request-Method": "GET"})
+	if rec.Header().Get("Access-Control-Allow-Origin") != "" || rec.Code == http.StatusNoContent {
+		t.Fatalf("expected cors to be disabled without origins, got %d %v", rec.Code, rec.Header())
+	}
+}
@@ -0,0 +1,61 @@
+package handlers
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// PrivateCacheKey marca en el contexto de gin las peticiones de /stream cuyas
+// respuestas no pueden guardarse en cachés compartidas (CDN): las
+// autenticadas con la cookie de sesión o con tokens ligados a una IP.
+const PrivateCacheKey = "private_cache"
+
+const (
+	// playlistMaxAge es corto: las listas cambian al actualizar la canción y
+	// se revalidan con ETag.
+	playlistMaxAge = 10 * time.Second
+	// segmentMaxAge: un segmento nunca cambia bajo la misma URL. Cada subida
+	// estrena carpeta (songFolder) y los segmentos en directo llevan el id de
+	// su emisión.
+	segmentMaxAge = 365 * 24 * time.Hour
+)
+
+// setCacheControl fija Cache-Control para una respuesta correcta de /stream.
+// El resto de respuestas conservan el no-store que pone el servidor.
+func setCacheControl(c *gin.Context, maxAge time.Duration, immutable bool) {
+	value := "public, max-age="
+	if c.GetBool(PrivateCacheKey) {
+		value = "private, max-age="
+	}
+	value += strconv.Itoa(int(maxAge.Seconds()))
+	if immutable {
+		value += ", immutable"
+	}
+	c.Header("Cache-Control", value)
+}
+
+// contentETag es un ETag fuerte derivado del contenido servido.
+func contentETag(data []byte) string {
+	sum := sha256.Sum256(data)
+	return `"` + hex.EncodeToString(sum[:16]) + `"`
+}
+
+// etagMatches compara If-None-Match con etag usando la comparación débil que
+// exige RFC 9110 para peticiones GET.
+func etagMatches(header, etag string) bool {
+	if header == "" {
+		return false
+	}
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+		if candidate == "*" || candidate == etag {
+			return true
+		}
+	}
+	return false
+}
@@ -1,17 +1,20 @@
 package handlers
 
 import (
-	"bufio"
-	"bytes"
 	"context"
 	"errors"
 	"fmt"
-	"log"
 	"net/http"
 	"path"
 	"strings"
+	"time"
 
+	"GOtify/internal/logging"
+	"GOtify/internal/m3u8"
+	"GOtify/internal/metrics"
+	"GOtify/internal/ondemand"
 	"GOtify/internal/storage"
+	"GOtify/internal/transcode"
 
 	"github.com/gin-gonic/gin"
 )
@@ -21,14 +24,31 @@ type songLoader interface {
 }
 
 type bucketDownloader interface {
-	DownloadFile(objectPath string) ([]byte, error)
-	SignedURL(objectPath string, expiresIn int) (string, error)
+	DownloadFile(ctx context.Context, objectPath string) ([]byte, error)
+	SignedURL(ctx context.Context, objectPath string, expiresIn int) (string, error)
+}
+
+// segmentCache lo implementa cache.Bucket cuando guarda segmentos en disco:
+// entonces el FileHandler los sirve él mismo en vez de redirigir al bucket.
+type segmentCache interface {
+	CachesSegments() bool
+}
+
+// VariantGenerator genera bajo demanda variantes que no están en el bucket;
+// ondemand.Generator lo implementa.
+type VariantGenerator interface {
+	Allows(name string) bool
+	Variants() []transcode.Variant
+	Playlist(ctx context.Context, songID, folder, name string) ([]byte, error)
+	Segment(ctx context.Context, folder, name string) (data []byte, ok bool, err error)
 }
 
 type FileHandler struct {
 	store      songLoader
 	bucket     bucketDownloader
 	bucketName string
+	onDemand   VariantGenerator
+	live       LiveChannels
 }
 
 func NewFileHandler(store songLoader, bucket bucketDownloader, bucketName string) *FileHandler {
@@ -39,9 +59,17 @@ func NewFileHandler(store songLoader, bucket bucketDownloader, bucketName string
 	}
 }
 
+// WithOnDemand hace que las variantes de gen aparezcan en la lista maestra y
+// se generen la primera vez que se piden.
+func (h *FileHandler) WithOnDemand(gen VariantGenerator) *FileHandler {
+	h.onDemand = gen
+	return h
+}
+
 func (h *FileHandler) Serve(c *gin.Context) {
 	songID := c.Param("file_id")
-	log.Println("Requested song ID:", songID)
+	logger := logging.FromContext(c.Request.Context())
+	logger.Debug("stream requested", "song_id", songID, "quality", c.Param("quality"))
 	if songID == "" {
 		c.AbortWithStatus(http.StatusBadRequest)
 		return
@@ -54,6 +82,11 @@ func (h *FileHandler) Serve(c *gin.Context) {
 		return
 	}
 
+	if h.live != nil && h.live.Has(songID) {
+		h.serveLive(c, songID, trimmedQuality)
+		return
+	}
+
 	song, err := h.store.GetSong(c.Request.Context(), songID)
 	if err != nil {
 		status := http.StatusInternalServerError
@@ -69,6 +102,11 @@ func (h *FileHandler) Serve(c *gin.Context) {
 		c.AbortWithStatus(http.StatusInternalServerError)
 		return
 	}
+	if strings.HasPrefix(masterKey, storage.MezzaninePrefix+"/") {
+		// Los originales nunca se sirven, aunque una fila apunte a ellos.
+		c.AbortWithStatus(http.StatusForbidden)
+		return
+	}
 
 	objectKey, err := resolveObjectKey(masterKey, rawQuality)
 	if err != nil {
@@ -80,23 +118,76 @@ func (h *FileHandler) Serve(c *gin.Context) {
 		return
 	}
 
+	// El archivo progresivo solo se sirve por ProgressiveRoute, que aplica el
+	// alcance "file" del token.
+	if strings.HasPrefix(path.Base(objectKey), transcode.ProgressiveName+".") {
+		c.AbortWithStatus(http.StatusNotFound)
+		return
+	}
+
 	if strings.HasSuffix(strings.ToLower(objectKey), ".m3u8") {
-		data, err := h.bucket.DownloadFile(objectKey)
+		data, err := h.bucket.DownloadFile(c.Request.Context(), objectKey)
+		variant := strings.TrimSuffix(path.Base(objectKey), path.Ext(objectKey))
+		if errors.Is(err, storage.ErrNotFound) && h.onDemand != nil && song.Source != nil && h.onDemand.Allows(variant) {
+			h.serveOnDemandPlaylist(c, song.ID, path.Dir(masterKey), variant)
+			return
+		}
+		metrics.StreamServed("playlist", err)
 		if err != nil {
 			c.AbortWithStatus(http.StatusNotFound)
 			return
 		}
+		// Sin original registrado no hay de dónde generar las variantes.
+		if objectKey == masterKey && h.onDemand != nil && song.Source != nil {
+			data = h.withOnDemandVariants(c, data)
+		}
 		h.servePlaylist(c, data, c.Request.URL.RawQuery)
 		return
 	}
 
+	if h.onDemand != nil {
+		data, ok, err := h.onDemand.Segment(c.Request.Context(), path.Dir(masterKey), path.Base(objectKey))
+		if ok {
+			metrics.StreamServed("segment", err)
+			if err != nil {
+				c.AbortWithStatus(onDemandStatus(err))
+				return
+			}
+			setCacheControl(c, segmentMaxAge, true)
+			c.Data(http.StatusOK, segmentContentType(objectKey), data)
+			return
+		}
+	}
+
+	if sc, ok := h.bucket.(segmentCache); ok && sc.CachesSegments() {
+		data, err := h.bucket.DownloadFile(c.Request.Context(), objectKey)
+		metrics.StreamServed("segment", err)
+		if err != nil {
+			status := http.StatusInternalServerError
+			if errors.Is(err, storage.ErrNotFound) {
+				status = http.StatusNotFound
+			} else {
+				logger.Error("segment download failed", "object", objectKey, "error", err)
+			}
+			c.AbortWithStatus(status)
+			return
+		}
+		setCacheControl(c, segmentMaxAge, true)
+		c.Data(http.StatusOK, segmentContentType(objectKey), data)
+		return
+	}
+
 	const signedTTLSeconds = 60
-	signedURL, err := h.bucket.SignedURL(objectKey, signedTTLSeconds)
-	log.Println("Signed url:", signedURL)
+	signedURL, err := h.bucket.SignedURL(c.Request.Context(), objectKey, signedTTLSeconds)
+	metrics.StreamServed("segment", err)
 	if err != nil {
+		logger.Error("signed url failed", "object", objectKey, "error", err)
 		c.AbortWithStatus(http.StatusInternalServerError)
 		return
 	}
+	logger.Debug("redirecting to signed url", "object", objectKey, "signed_url", signedURL)
+	// La redirección vale lo que la URL firmada; se cachea solo la mitad.
+	setCacheControl(c, signedTTLSeconds*time.Second/2, false)
 	c.Redirect(http.StatusTemporaryRedirect, signedURL)
 }
 
@@ -168,13 +259,98 @@ func resolveObjectKey(masterKey string, rawQuality string) (string, error) {
 	return clean, nil
 }
 
+// servePlaylist responde con la lista (reescrita con query si la hay), su
+// ETag y 304 si el cliente ya la tiene.
 func (h *FileHandler) servePlaylist(c *gin.Context, data []byte, query string) {
-	if query == "" {
-		c.Data(http.StatusOK, "application/vnd.apple.mpegurl", data)
+	if query != "" {
+		rewritten, err := rewritePlaylist(data, query)
+		if err != nil {
+			logging.FromContext(c.Request.Context()).Error("playlist parse failed", "error", err)
+			c.AbortWithStatus(http.StatusInternalServerError)
+			return
+		}
+		data = rewritten
+	}
+
+	etag := contentETag(data)
+	c.Header("ETag", etag)
+	setCacheControl(c, playlistMaxAge, false)
+	if etagMatches(c.GetHeader("If-None-Match"), etag) {
+		c.Status(http.StatusNotModified)
 		return
 	}
-	rewritten := rewritePlaylist(data, query)
-	c.Data(http.StatusOK, "application/vnd.apple.mpegurl", rewritten)
+	c.Data(http.StatusOK, "application/vnd.apple.mpegurl", data)
+}
+
+// serveOnDemandPlaylist responde con la lista de una variante que se está
+// generando. No se cachea: crece hasta que ffmpeg termina, y después se
+// sirve desde el bucket como las demás.
+func (h *FileHandler) serveOnDemandPlaylist(c *gin.Context, songID, folder, variant string) {
+	data, err := h.onDemand.Playlist(c.Request.Context(), songID, folder, variant)
+	metrics.StreamServed("playlist", err)
+	if err != nil {
+		status := onDemandStatus(err)
+		if status == http.StatusServiceUnavailable {
+			c.Header("Retry-After", "5")
+		} else if status == http.StatusInternalServerError {
+			logging.FromContext(c.Request.Context()).Error("on-demand variant failed", "song_id", songID, "variant", variant, "error", err)
+		}
+		c.AbortWithStatus(status)
+		return
+	}
+	if query := c.Request.URL.RawQuery; query != "" {
+		if data, err = rewritePlaylist(data, query); err != nil {
+			c.AbortWithStatus(http.StatusInternalServerError)
+			return
+		}
+	}
+	c.Data(http.StatusOK, "application/vnd.apple.mpegurl", data)
+}
+
+// withOnDemandVariants añade a la lista maestra las variantes bajo demanda
+// que no tiene. Si no se puede interpretar se sirve tal cual.
+func (h *FileHandler) withOnDemandVariants(c *gin.Context, data []byte) []byte {
+	playlist, err := m3u8.Parse(data)
+	if err != nil || !playlist.Master {
+		logging.FromContext(c.Request.Context()).Warn("master playlist not extended", "error", err)
+		return data
+	}
+	present := make(map[string]bool, len(playlist.Variants))
+	for _, v := range playlist.Variants {
+		present[v.URI] = true
+	}
+	for _, v := range h.onDemand.Variants() {
+		entry := transcode.MasterEntry(v)
+		if !present[entry.URI] {
+			playlist.Variants = append(playlist.Variants, entry)
+		}
+	}
+	return playlist.Encode()
+}
+
+func onDemandStatus(err error) int {
+	switch {
+	case errors.Is(err, ondemand.ErrBusy), errors.Is(err, ondemand.ErrClosed):
+		return http.StatusServiceUnavailable
+	case errors.Is(err, storage.ErrNotFound):
+		// Canción subida sin guardar el original.
+		return http.StatusNotFound
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+func segmentContentType(objectKey string) string {
+	switch strings.ToLower(path.Ext(objectKey)) {
+	case ".ts":
+		return "video/mp2t"
+	case ".aac":
+		return "audio/aac"
+	case ".m4s", ".mp4":
+		return "audio/mp4"
+	default:
+		return "application/octet-stream"
+	}
 }
 
 func resolveFilename(raw string) string {
@@ -191,52 +367,14 @@ func resolveFilename(raw string) string {
 	return name + ".m3u8"
 }
 
-func rewritePlaylist(data []byte, query string) []byte {
-	scanner := bufio.NewScanner(bytes.NewReader(data))
-	var builder strings.Builder
-
-	for scanner.Scan() {
-		line := scanner.Text()
-		hasCR := strings.HasSuffix(line, "\r")
-		content := line
-		if hasCR {
-			content = strings.TrimSuffix(line, "\r")
-		}
-
-		trimmed := strings.TrimSpace(content)
-		if trimmed != "" && !strings.HasPrefix(trimmed, "#") {
-			rewritten := trimmed
-
-			if strings.Contains(rewritten, "?") {
-				rewritten += "&" + query
-			} else {
-				rewritten += "?" + query
-			}
-
-			if trimmed != content {
-				if start := strings.Index(content, trimmed); start != -1 {
-					leading := content[:start]
-					trailing := content[start+len(trimmed):]
-					content = leading + rewritten + trailing
-				} else {
-					content = rewritten
-				}
-			} else {
-				content = rewritten
-			}
-		}
-
-		if hasCR {
-			content += "\r"
-		}
-
-		builder.WriteString(content)
-		builder.WriteByte('\n')
-	}
-
-	if err := scanner.Err(); err != nil {
-		return data
+// rewritePlaylist añade query a todas las URIs de la lista, también a las
+// de etiquetas como EXT-X-KEY o EXT-X-MAP, sin repetir parámetros que ya
+// tuvieran.
+func rewritePlaylist(data []byte, query string) ([]byte, error) {
+	playlist, err := m3u8.Parse(data)
+	if err != nil {
+		return nil, err
 	}
-
-	return []byte(builder.String())
+	playlist.RewriteURIs(func(uri string) string { return m3u8.SetQuery(uri, query) })
+	return playlist.Encode(), nil
 }
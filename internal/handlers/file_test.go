@@ -5,9 +5,12 @@ import (
 	"fmt"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
 
+	"GOtify/internal/ondemand"
 	"GOtify/internal/storage"
+	"GOtify/internal/transcode"
 
 	"github.com/gin-gonic/gin"
 )
@@ -120,6 +123,17 @@ func TestFileHandlerServeRejectTraversal(t *testing.T) {
 	if w.Code != http.StatusForbidden {
 		t.Fatalf("expected status 403, got %d", w.Code)
 	}
+
+	// Una fila que apunte a los originales tampoco los expone.
+	store.songs["song-2"] = storage.Song{ID: "song-2", Name: "Song", BucketFolder: storage.MezzanineFolder("song-1")}
+	w = httptest.NewRecorder()
+	c, _ = gin.CreateTestContext(w)
+	c.Params = gin.Params{{Key: "file_id", Value: "song-2"}, {Key: "quality", Value: "/source"}}
+	c.Request = httptest.NewRequest(http.MethodGet, "/stream/song-2/source", nil)
+	handler.Serve(c)
+	if w.Code != http.StatusForbidden {
+		t.Fatalf("expected originals to be refused, got %d", w.Code)
+	}
 }
 
 func TestFileHandlerServeSegmentRedirect(t *testing.T) {
@@ -158,6 +172,64 @@ func TestFileHandlerServeSegmentRedirect(t *testing.T) {
 	if loc := w.Header().Get("Location"); loc != signed {
 		t.Fatalf("unexpected redirect location: %s", loc)
 	}
+	if cc := w.Header().Get("Cache-Control"); cc != "public, max-age=30" {
+		t.Fatalf("unexpected redirect cache policy: %q", cc)
+	}
+}
+
+func TestFileHandlerServePlaylistConditional(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	store := &fakeSongStore{
+		songs: map[string]storage.Song{
+			"song-1": {ID: "song-1", Name: "Song", BucketFolder: "my-song"},
+		},
+	}
+	bucket := &fakeDownloadBucket{
+		files: map[string][]byte{
+			"my-song/master.m3u8": []byte("#EXTM3U\n#EXT-X-STREAM-INF:BANDWIDTH=131072\n128k.m3u8\n"),
+		},
+	}
+	handler := NewFileHandler(store, bucket, "music")
+
+	serve := func(target, ifNoneMatch string, private bool) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		c, _ := gin.CreateTestContext(w)
+		c.Params = gin.Params{{Key: "file_id", Value: "song-1"}, {Key: "quality", Value: ""}}
+		c.Request = httptest.NewRequest(http.MethodGet, target, nil)
+		if ifNoneMatch != "" {
+			c.Request.Header.Set("If-None-Match", ifNoneMatch)
+		}
+		if private {
+			c.Set(PrivateCacheKey, true)
+		}
+		handler.Serve(c)
+		c.Writer.WriteHeaderNow()
+		return w
+	}
+
+	first := serve("/stream/song-1?t=abc&e=1", "", false)
+	etag := first.Header().Get("ETag")
+	if first.Code != http.StatusOK || etag == "" {
+		t.Fatalf("expected 200 with ETag, got %d %v", first.Code, first.Header())
+	}
+	if cc := first.Header().Get("Cache-Control"); cc != "public, max-age=10" {
+		t.Fatalf("unexpected playlist cache policy: %q", cc)
+	}
+
+	again := serve("/stream/song-1?t=abc&e=1", `W/"other", `+etag, true)
+	if again.Code != http.StatusNotModified || again.Body.Len() != 0 {
+		t.Fatalf("expected 304 without body, got %d %q", again.Code, again.Body.String())
+	}
+	if again.Header().Get("ETag") != etag || again.Header().Get("Cache-Control") != "private, max-age=10" {
+		t.Fatalf("expected validators on 304, got %v", again.Header())
+	}
+
+	// Otro token reescribe la lista de otra forma y cambia el ETag.
+	other := serve("/stream/song-1?t=xyz&e=1", etag, false)
+	if other.Code != http.StatusOK || other.Header().Get("ETag") == etag {
+		t.Fatalf("expected a different playlist for another token, got %d", other.Code)
+	}
 }
 
 func TestResolveFilename(t *testing.T) {
@@ -184,15 +256,36 @@ func TestResolveFilename(t *testing.T) {
 }
 
 func TestRewritePlaylistAddsPrefixToVariantEntries(t *testing.T) {
-	data := []byte("variant.m3u8\n")
+	data := []byte("#EXTM3U\n#EXT-X-STREAM-INF:BANDWIDTH=131072\nvariant.m3u8\n")
 	query := "t=abc&e=123"
 
-	got := string(rewritePlaylist(data, query))
-	want := "variant.m3u8?t=abc&e=123\n"
+	got, err := rewritePlaylist(data, query)
+	if err != nil {
+		t.Fatalf("rewritePlaylist: %v", err)
+	}
+	want := "#EXTM3U\n#EXT-X-STREAM-INF:BANDWIDTH=131072\nvariant.m3u8?t=abc&e=123\n"
+
+	if string(got) != want {
+		t.Fatalf("expected %q, got %q", want, got)
+	}
+}
+
+func TestRewritePlaylistSignsTagURIs(t *testing.T) {
+	data := []byte("#EXTM3U\r\n#EXT-X-KEY:METHOD=AES-128,URI=\"key\",IV=0x00\r\n#EXT-X-MAP:URI=\"init.mp4\"\r\n#EXTINF:4,\r\nseg0.ts?t=old\r\n")
 
-	if got != want {
+	got, err := rewritePlaylist(data, "t=abc&e=123")
+	if err != nil {
+		t.Fatalf("rewritePlaylist: %v", err)
+	}
+	want := "#EXTM3U\n#EXT-X-KEY:METHOD=AES-128,URI=\"key?t=abc&e=123\",IV=0x00\n#EXT-X-MAP:URI=\"init.mp4?t=abc&e=123\"\n#EXTINF:4,\nseg0.ts?t=abc&e=123\n"
+
+	if string(got) != want {
 		t.Fatalf("expected %q, got %q", want, got)
 	}
+
+	if _, err := rewritePlaylist([]byte("variant.m3u8\n"), "t=abc"); err == nil {
+		t.Fatalf("expected invalid playlist to fail")
+	}
 }
 
 type fakeSongStore struct {
@@ -210,21 +303,121 @@ func (f *fakeSongStore) GetSong(_ context.Context, id string) (storage.Song, err
 type fakeDownloadBucket struct {
 	files  map[string][]byte
 	signed map[string]string
+	// strict hace que SignedURL falle, como Supabase, con los objetos que
+	// no están en files.
+	strict bool
 }
 
-func (b *fakeDownloadBucket) DownloadFile(objectPath string) ([]byte, error) {
+func (b *fakeDownloadBucket) DownloadFile(_ context.Context, objectPath string) ([]byte, error) {
 	data, ok := b.files[objectPath]
 	if !ok {
-		return nil, fmt.Errorf("not found")
+		return nil, storage.ErrNotFound
 	}
 	return data, nil
 }
 
-func (b *fakeDownloadBucket) SignedURL(objectPath string, expiresIn int) (string, error) {
+func (b *fakeDownloadBucket) SignedURL(_ context.Context, objectPath string, expiresIn int) (string, error) {
 	if b.signed != nil {
 		if url, ok := b.signed[objectPath]; ok {
 			return url, nil
 		}
 	}
+	if _, ok := b.files[objectPath]; b.strict && !ok {
+		return "", storage.ErrNotFound
+	}
 	return fmt.Sprintf("https://signed.test/%s?ttl=%d", objectPath, expiresIn), nil
 }
+
+type fakeGenerator struct {
+	busy bool
+}
+
+func (g *fakeGenerator) Allows(name string) bool { return name == "32k" }
+
+func (g *fakeGenerator) Variants() []transcode.Variant {
+	return []transcode.Variant{{Name: "32k", BitrateKbps: 32}, {Name: "128k", BitrateKbps: 128}}
+}
+
+func (g *fakeGenerator) Playlist(_ context.Context, songID, folder, name string) ([]byte, error) {
+	if g.busy {
+		return nil, ondemand.ErrBusy
+	}
+	return []byte("#EXTM3U\n#EXTINF:4,\n" + name + "_segment_000.ts\n"), nil
+}
+
+func (g *fakeGenerator) Segment(_ context.Context, folder, name string) ([]byte, bool, error) {
+	if folder != "my-song" || name != "32k_segment_000.ts" {
+		return nil, false, nil
+	}
+	return []byte("fresh"), true, nil
+}
+
+func TestFileHandlerServeOnDemand(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	store := &fakeSongStore{
+		songs: map[string]storage.Song{
+			"song-1": {ID: "song-1", Name: "Song", BucketFolder: "my-song", Source: &storage.SongSource{Format: "wav"}},
+			"song-2": {ID: "song-2", Name: "Old", BucketFolder: "my-song"},
+		},
+	}
+	bucket := &fakeDownloadBucket{
+		files: map[string][]byte{
+			"my-song/master.m3u8": []byte("#EXTM3U\n#EXT-X-STREAM-INF:BANDWIDTH=131072\n128k.m3u8\n"),
+		},
+	}
+	gen := &fakeGenerator{}
+	handler := NewFileHandler(store, bucket, "music").WithOnDemand(gen)
+
+	serveSong := func(songID, quality, query string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		c, _ := gin.CreateTestContext(w)
+		c.Params = gin.Params{
+			{Key: "file_id", Value: songID},
+			{Key: "quality", Value: quality},
+		}
+		c.Request = httptest.NewRequest(http.MethodGet, "/stream/"+songID+quality+query, nil)
+		handler.Serve(c)
+		return w
+	}
+	serve := func(quality, query string) *httptest.ResponseRecorder {
+		return serveSong("song-1", quality, query)
+	}
+
+	w := serve("", "")
+	if body := w.Body.String(); strings.Count(body, "128k.m3u8") != 1 || !strings.Contains(body, "BANDWIDTH=32768") || !strings.Contains(body, "32k.m3u8") {
+		t.Fatalf("expected master with the on-demand variant, got:\n%s", body)
+	}
+
+	w = serve("/32k.m3u8", "?t=tok&e=1")
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "32k_segment_000.ts?t=tok&e=1") {
+		t.Fatalf("expected generated playlist with token, got %d:\n%s", w.Code, w.Body.String())
+	}
+	if cc := w.Header().Get("Cache-Control"); cc != "" {
+		t.Fatalf("in-progress playlist must not be cacheable, got %q", cc)
+	}
+
+	w = serve("/32k_segment_000.ts", "")
+	if w.Code != http.StatusOK || w.Body.String() != "fresh" {
+		t.Fatalf("expected segment from the generator, got %d %q", w.Code, w.Body.String())
+	}
+	if w = serve("/128k_segment_000.ts", ""); w.Code != http.StatusTemporaryRedirect {
+		t.Fatalf("expected other segments to redirect to the bucket, got %d", w.Code)
+	}
+	if w = serve("/64k.m3u8", ""); w.Code != http.StatusNotFound {
+		t.Fatalf("expected variant outside the on-demand set to 404, got %d", w.Code)
+	}
+
+	gen.busy = true
+	if w = serve("/32k.m3u8", ""); w.Code != http.StatusServiceUnavailable || w.Header().Get("Retry-After") == "" {
+		t.Fatalf("expected 503 with Retry-After when busy, got %d", w.Code)
+	}
+
+	// Sin original registrado no se anuncian ni generan variantes.
+	if body := serveSong("song-2", "", "").Body.String(); strings.Contains(body, "32k.m3u8") {
+		t.Fatalf("expected master without on-demand variants, got:\n%s", body)
+	}
+	if w = serveSong("song-2", "/32k.m3u8", ""); w.Code != http.StatusNotFound {
+		t.Fatalf("expected 404 for a song without original, got %d", w.Code)
+	}
+}
@@ -0,0 +1,49 @@
+package handlers
+
+import (
+	"GOtify/internal/metrics"
+	"GOtify/internal/storage"
+	"context"
+	"encoding/hex"
+	"errors"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// SongKeyLoader lee la clave de cifrado de una canción del catálogo.
+type SongKeyLoader interface {
+	GetSongKey(ctx context.Context, songID string) (storage.SongKey, error)
+}
+
+// KeyDeliveryHandler entrega las claves AES-128 referenciadas por
+// #EXT-X-KEY. Se monta detrás de la autorización de /stream, así que la
+// clave solo llega a quien tiene un token válido para la canción.
+type KeyDeliveryHandler struct {
+	keys SongKeyLoader
+}
+
+func NewKeyDeliveryHandler(keys SongKeyLoader) *KeyDeliveryHandler {
+	return &KeyDeliveryHandler{keys: keys}
+}
+
+// Serve responde con los 16 bytes de la clave de file_id.
+func (h *KeyDeliveryHandler) Serve(c *gin.Context) {
+	key, err := h.keys.GetSongKey(c.Request.Context(), c.Param("file_id"))
+	metrics.StreamServed("key", err)
+	if err != nil {
+		status := http.StatusInternalServerError
+		if errors.Is(err, storage.ErrNotFound) {
+			status = http.StatusNotFound
+		}
+		c.AbortWithStatus(status)
+		return
+	}
+	raw, err := hex.DecodeString(key.Key)
+	if err != nil || len(raw) != 16 {
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	c.Header("Cache-Control", "no-store")
+	c.Data(http.StatusOK, "application/octet-stream", raw)
+}
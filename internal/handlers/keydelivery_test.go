@@ -0,0 +1,47 @@
+package handlers
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"GOtify/internal/storage"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestKeyDeliveryHandlerServe(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	keys := &fakeSongKeys{keys: map[string]storage.SongKey{
+		"song-1": {SongID: "song-1", Key: "000102030405060708090a0b0c0d0e0f"},
+		"broken": {SongID: "broken", Key: "zz"},
+	}}
+	r := gin.New()
+	r.GET("/stream/:file_id/key", NewKeyDeliveryHandler(keys).Serve)
+
+	serve := func(path string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		r.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+		return rec
+	}
+
+	rec := serve("/stream/song-1/key")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", rec.Code)
+	}
+	if want := []byte{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15}; !bytes.Equal(rec.Body.Bytes(), want) {
+		t.Fatalf("unexpected key bytes %x", rec.Body.Bytes())
+	}
+	if rec.Header().Get("Cache-Control") != "no-store" {
+		t.Fatalf("expected no-store, got %q", rec.Header().Get("Cache-Control"))
+	}
+
+	if rec := serve("/stream/missing/key"); rec.Code != http.StatusNotFound {
+		t.Fatalf("expected 404 for unknown song, got %d", rec.Code)
+	}
+	if rec := serve("/stream/broken/key"); rec.Code != http.StatusInternalServerError {
+		t.Fatalf("expected 500 for corrupt key, got %d", rec.Code)
+	}
+}
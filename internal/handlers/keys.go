@@ -0,0 +1,84 @@
+package handlers
+
+import (
+	"GOtify/internal/logging"
+	"GOtify/internal/security"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// KeyManager administra las claves de firma; security.Keyring lo implementa.
+type KeyManager interface {
+	Rotate(key security.Key, grace time.Duration) (security.KeyInfo, error)
+	Keys() []security.KeyInfo
+}
+
+type KeyHandler struct {
+	manager KeyManager
+	grace   time.Duration
+}
+
+// NewKeyHandler crea el handler de administración de claves. grace es el
+// tiempo que la clave anterior sigue aceptándose tras una rotación.
+func NewKeyHandler(manager KeyManager, grace time.Duration) *KeyHandler {
+	return &KeyHandler{manager: manager, grace: grace}
+}
+
+type rotateKeyRequest struct {
+	ID string `json:"id"`
+	// Secret (base64) permite rotar varias réplicas a la misma clave; si se
+	// omite se genera uno aleatorio.
+	Secret string `json:"secret"`
+	// Grace sobrescribe el periodo de gracia por defecto (p. ej. "48h").
+	Grace string `json:"grace"`
+}
+
+func (h *KeyHandler) List(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"keys": h.manager.Keys()})
+}
+
+func (h *KeyHandler) Rotate(c *gin.Context) {
+	var req rotateKeyRequest
+	if err := c.ShouldBindJSON(&req); err != nil && !errors.Is(err, io.EOF) {
+		writeError(c, http.StatusBadRequest, fmt.Errorf("cuerpo invalido: %w", err))
+		return
+	}
+
+	grace := h.grace
+	if req.Grace != "" {
+		d, err := time.ParseDuration(req.Grace)
+		if err != nil || d < 0 {
+			writeError(c, http.StatusBadRequest, fmt.Errorf("grace invalido: %q", req.Grace))
+			return
+		}
+		grace = d
+	}
+
+	key := security.Key{ID: req.ID}
+	if req.Secret != "" {
+		secret, err := base64.StdEncoding.DecodeString(req.Secret)
+		if err != nil {
+			writeError(c, http.StatusBadRequest, fmt.Errorf("secret debe ir en base64"))
+			return
+		}
+		key.Secret = secret
+	}
+
+	info, err := h.manager.Rotate(key, grace)
+	if err != nil {
+		status := http.StatusInternalServerError
+		if errors.Is(err, security.ErrInvalidKey) {
+			status = http.StatusBadRequest
+		}
+		writeError(c, status, err)
+		return
+	}
+	logging.FromContext(c.Request.Context()).Info("signing key rotated", "kid", info.ID, "grace", grace)
+	c.JSON(http.StatusCreated, gin.H{"active": info.ID, "keys": h.manager.Keys()})
+}
@@ -0,0 +1,98 @@
+package handlers
+
+import (
+	"GOtify/internal/security"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+type fakeKeyManager struct {
+	rotated security.Key
+	grace   time.Duration
+	err     error
+}
+
+func (f *fakeKeyManager) Rotate(key security.Key, grace time.Duration) (security.KeyInfo, error) {
+	if f.err != nil {
+		return security.KeyInfo{}, f.err
+	}
+	f.rotated = key
+	f.grace = grace
+	return security.KeyInfo{ID: "k2", Active: true}, nil
+}
+
+func (f *fakeKeyManager) Keys() []security.KeyInfo {
+	return []security.KeyInfo{{ID: "k2", Active: true}, {ID: "k1"}}
+}
+
+func newKeyRouter(manager KeyManager) *gin.Engine {
+	gin.SetMode(gin.TestMode)
+	h := NewKeyHandler(manager, time.Hour)
+	router := gin.New()
+	router.GET("/admin/keys", h.List)
+	router.POST("/admin/keys/rotate", h.Rotate)
+	return router
+}
+
+func TestKeyHandlerRotate(t *testing.T) {
+	manager := &fakeKeyManager{}
+	router := newKeyRouter(manager)
+
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/admin/keys/rotate", nil))
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("expected 201 without body, got %d: %s", rec.Code, rec.Body.String())
+	}
+	if manager.grace != time.Hour || manager.rotated.Secret != nil {
+		t.Fatalf("expected default grace and generated secret, got %v %v", manager.grace, manager.rotated)
+	}
+
+	rec = httptest.NewRecorder()
+	body := `{"id": "k3", "secret": "c2VjcmV0", "grace": "48h"}`
+	router.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/admin/keys/rotate", strings.NewReader(body)))
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("expected 201, got %d: %s", rec.Code, rec.Body.String())
+	}
+	if manager.rotated.ID != "k3" || string(manager.rotated.Secret) != "secret" || manager.grace != 48*time.Hour {
+		t.Fatalf("unexpected rotation %+v grace %v", manager.rotated, manager.grace)
+	}
+	var resp struct {
+		Active string             `json:"active"`
+		Keys   []security.KeyInfo `json:"keys"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil || resp.Active != "k2" || len(resp.Keys) != 2 {
+		t.Fatalf("unexpected response %s (%v)", rec.Body.String(), err)
+	}
+	if strings.Contains(rec.Body.String(), "c2VjcmV0") {
+		t.Fatal("response must not echo the secret")
+	}
+}
+
+func TestKeyHandlerRotateErrors(t *testing.T) {
+	cases := []struct {
+		name   string
+		body   string
+		err    error
+		status int
+	}{
+		{"bad grace", `{"grace": "soon"}`, nil, http.StatusBadRequest},
+		{"bad secret", `{"secret": "%%%"}`, nil, http.StatusBadRequest},
+		{"invalid key", `{}`, fmt.Errorf("%w: duplicate id", security.ErrInvalidKey), http.StatusBadRequest},
+		{"persist failure", `{}`, fmt.Errorf("persist keyring: disk full"), http.StatusInternalServerError},
+	}
+	for _, tc := range cases {
+		router := newKeyRouter(&fakeKeyManager{err: tc.err})
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/admin/keys/rotate", strings.NewReader(tc.body)))
+		if rec.Code != tc.status {
+			t.Fatalf("%s: expected %d, got %d", tc.name, tc.status, rec.Code)
+		}
+	}
+}
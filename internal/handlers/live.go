@@ -0,0 +1,159 @@
+package handlers
+
+import (
+	"GOtify/internal/live"
+	"GOtify/internal/logging"
+	"GOtify/internal/metrics"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// MethodSource es el método con el que los codificadores Icecast antiguos
+// envían su fuente.
+const MethodSource = "SOURCE"
+
+// LiveChannels ingiere y sirve los canales en directo; live.Manager lo
+// implementa.
+type LiveChannels interface {
+	Has(channel string) bool
+	OnAir(channel string) bool
+	Master(channel string) ([]byte, error)
+	Playlist(ctx context.Context, channel, name string) ([]byte, error)
+	Segment(channel, name string) ([]byte, error)
+	Ingest(ctx context.Context, channel string, source io.Reader) error
+}
+
+// WithLive sirve los canales de channels bajo /stream/<canal>/ en lugar de
+// buscarlos en el catálogo.
+func (h *FileHandler) WithLive(channels LiveChannels) *FileHandler {
+	h.live = channels
+	return h
+}
+
+// serveLive responde con la lista maestra, la lista en directo o un segmento
+// del canal. Las listas no se cachean (la cabecera no-store por defecto se
+// mantiene) porque cambian con cada segmento.
+func (h *FileHandler) serveLive(c *gin.Context, channel, quality string) {
+	ctx := c.Request.Context()
+	switch {
+	case quality == "" || quality == "master.m3u8":
+		data, err := h.live.Master(channel)
+		h.writeLivePlaylist(c, channel, data, err)
+	case strings.HasSuffix(quality, ".m3u8"):
+		data, err := h.live.Playlist(ctx, channel, strings.TrimSuffix(quality, ".m3u8"))
+		h.writeLivePlaylist(c, channel, data, err)
+	default:
+		if strings.Contains(quality, "/") {
+			c.AbortWithStatus(http.StatusNotFound)
+			return
+		}
+		data, err := h.live.Segment(channel, quality)
+		metrics.StreamServed("segment", err)
+		if err != nil {
+			c.AbortWithStatus(liveStatus(c, channel, err))
+			return
+		}
+		// Cada emisión nombra sus segmentos de forma única.
+		setCacheControl(c, segmentMaxAge, true)
+		c.Data(http.StatusOK, segmentContentType(quality), data)
+	}
+}
+
+func (h *FileHandler) writeLivePlaylist(c *gin.Context, channel string, data []byte, err error) {
+	metrics.StreamServed("playlist", err)
+	if err != nil {
+		c.AbortWithStatus(liveStatus(c, channel, err))
+		return
+	}
+	if query := c.Request.URL.RawQuery; query != "" {
+		if data, err = rewritePlaylist(data, query); err != nil {
+			c.AbortWithStatus(http.StatusInternalServerError)
+			return
+		}
+	}
+	c.Data(http.StatusOK, "application/vnd.apple.mpegurl", data)
+}
+
+func liveStatus(c *gin.Context, channel string, err error) int {
+	switch {
+	case errors.Is(err, live.ErrNotReady):
+		c.Header("Retry-After", "2")
+		return http.StatusServiceUnavailable
+	case errors.Is(err, live.ErrOffAir), errors.Is(err, live.ErrNotFound), errors.Is(err, live.ErrUnknownChannel):
+		return http.StatusNotFound
+	default:
+		logging.FromContext(c.Request.Context()).Error("live stream failed", "channel", channel, "error", err)
+		return http.StatusInternalServerError
+	}
+}
+
+// IngestHandler recibe la fuente de un canal en directo: el audio llega en el
+// cuerpo de un PUT (chunked, como Icecast 2.4 o ffmpeg -f mp3 -method PUT) o
+// tras el método SOURCE de los codificadores Icecast antiguos. La petición
+// dura lo que la emisión.
+type IngestHandler struct {
+	channels LiveChannels
+}
+
+func NewIngestHandler(channels LiveChannels) *IngestHandler {
+	return &IngestHandler{channels: channels}
+}
+
+func (h *IngestHandler) Serve(c *gin.Context) {
+	channel := c.Param("channel")
+	if !h.channels.Has(channel) {
+		writeError(c, http.StatusNotFound, fmt.Errorf("canal no encontrado"))
+		return
+	}
+	if h.channels.OnAir(channel) {
+		writeError(c, http.StatusConflict, fmt.Errorf("el canal ya tiene una fuente"))
+		return
+	}
+	logger := logging.FromContext(c.Request.Context())
+
+	if c.Request.Method == MethodSource {
+		h.serveSource(c, channel)
+		return
+	}
+
+	err := h.channels.Ingest(c.Request.Context(), channel, c.Request.Body)
+	switch {
+	case errors.Is(err, live.ErrOnAir):
+		writeError(c, http.StatusConflict, fmt.Errorf("el canal ya tiene una fuente"))
+	case err != nil:
+		logger.Error("live ingest failed", "channel", channel, "error", err)
+		writeError(c, http.StatusInternalServerError, err)
+	default:
+		c.Status(http.StatusNoContent)
+	}
+}
+
+// serveSource atiende el método SOURCE. Llega sin Content-Length, así que
+// net/http lo trata como una petición sin cuerpo, y el codificador espera la
+// respuesta antes de enviar audio: se toma la conexión, se responde y se lee
+// el audio directamente de ella.
+func (h *IngestHandler) serveSource(c *gin.Context, channel string) {
+	logger := logging.FromContext(c.Request.Context())
+	conn, rw, err := c.Writer.Hijack()
+	if err != nil {
+		writeError(c, http.StatusInternalServerError, err)
+		return
+	}
+	defer conn.Close()
+	if _, err := rw.WriteString("HTTP/1.0 200 OK\r\n\r\n"); err == nil {
+		err = rw.Flush()
+	}
+	if err != nil {
+		logger.Warn("live source handshake failed", "channel", channel, "error", err)
+		return
+	}
+	if err := h.channels.Ingest(c.Request.Context(), channel, rw.Reader); err != nil {
+		logger.Error("live ingest failed", "channel", channel, "error", err)
+	}
+}
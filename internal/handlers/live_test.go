@@ -0,0 +1,181 @@
+package handlers
+
+import (
+	"GOtify/internal/live"
+	"GOtify/internal/security"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+// fakeLive emite el canal "radio" con una lista y un segmento fijos.
+type fakeLive struct {
+	onAir     bool
+	notReady  bool
+	ingested  string
+	ingestErr error
+}
+
+func (f *fakeLive) Has(channel string) bool   { return channel == "radio" }
+func (f *fakeLive) OnAir(channel string) bool { return f.onAir }
+
+func (f *fakeLive) Master(channel string) ([]byte, error) {
+	if !f.onAir {
+		return nil, live.ErrOffAir
+	}
+	return []byte("#EXTM3U\n#EXT-X-STREAM-INF:BANDWIDTH=131072\n128k.m3u8\n"), nil
+}
+
+func (f *fakeLive) Playlist(_ context.Context, channel, name string) ([]byte, error) {
+	switch {
+	case !f.onAir:
+		return nil, live.ErrOffAir
+	case f.notReady:
+		return nil, live.ErrNotReady
+	case name != "128k":
+		return nil, live.ErrNotFound
+	}
+	return []byte("#EXTM3U\n#EXT-X-TARGETDURATION:4\n#EXT-X-MEDIA-SEQUENCE:7\n#EXTINF:4,\n128k_segment_b1_00007.ts\n"), nil
+}
+
+func (f *fakeLive) Segment(channel, name string) ([]byte, error) {
+	if name != "128k_segment_b1_00007.ts" {
+		return nil, live.ErrNotFound
+	}
+	return []byte("segment"), nil
+}
+
+func (f *fakeLive) Ingest(_ context.Context, channel string, source io.Reader) error {
+	if f.ingestErr != nil {
+		return f.ingestErr
+	}
+	data, err := io.ReadAll(source)
+	f.ingested = string(data)
+	return err
+}
+
+func TestFileHandlerServeLive(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	channels := &fakeLive{onAir: true}
+	handler := NewFileHandler(&fakeSongStore{}, &fakeDownloadBucket{}, "music").WithLive(channels)
+
+	serve := func(quality, query string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		c, _ := gin.CreateTestContext(w)
+		c.Params = gin.Params{
+			{Key: "file_id", Value: "radio"},
+			{Key: "quality", Value: quality},
+		}
+		c.Request = httptest.NewRequest(http.MethodGet, "/stream/radio"+quality+query, nil)
+		handler.Serve(c)
+		return w
+	}
+
+	w := serve("", "?token=abc")
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "128k.m3u8?token=abc") {
+		t.Fatalf("expected signed master, got %d:\n%s", w.Code, w.Body.String())
+	}
+
+	w = serve("/128k.m3u8", "?token=abc")
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "128k_segment_b1_00007.ts?token=abc") {
+		t.Fatalf("expected signed live playlist, got %d:\n%s", w.Code, w.Body.String())
+	}
+	if cc := w.Header().Get("Cache-Control"); strings.Contains(cc, "max-age") {
+		t.Fatalf("live playlists must not be cached, got %q", cc)
+	}
+
+	w = serve("/128k_segment_b1_00007.ts", "")
+	if w.Code != http.StatusOK || w.Body.String() != "segment" {
+		t.Fatalf("expected segment, got %d %q", w.Code, w.Body.String())
+	}
+	if cc := w.Header().Get("Cache-Control"); !strings.Contains(cc, "immutable") {
+		t.Fatalf("expected immutable segment, got %q", cc)
+	}
+
+	if w = serve("/128k_segment_b1_00001.ts", ""); w.Code != http.StatusNotFound {
+		t.Fatalf("expected 404 outside the window, got %d", w.Code)
+	}
+	if w = serve("/64k.m3u8", ""); w.Code != http.StatusNotFound {
+		t.Fatalf("expected 404 for unknown variant, got %d", w.Code)
+	}
+
+	channels.notReady = true
+	w = serve("/128k.m3u8", "")
+	if w.Code != http.StatusServiceUnavailable || w.Header().Get("Retry-After") == "" {
+		t.Fatalf("expected 503 with Retry-After, got %d", w.Code)
+	}
+
+	channels.onAir = false
+	if w = serve("", ""); w.Code != http.StatusNotFound {
+		t.Fatalf("expected 404 off air, got %d", w.Code)
+	}
+}
+
+func TestTokenHandlerGenerateLive(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	handler := NewTokenHandler(&security.Signer{Secret: []byte("super-secret")}, &fakeSongStore{}, TokenHandlerConfig{}).
+		WithLive(&fakeLive{})
+
+	router := gin.New()
+	router.GET("/token/:file_id", handler.Generate)
+
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/token/radio", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+	var body struct {
+		FileID string `json:"file_id"`
+		Live   bool   `json:"live"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+		t.Fatalf("failed to decode response: %v", err)
+	}
+	if body.FileID != "radio" || !body.Live {
+		t.Fatalf("expected a live token for radio, got %+v", body)
+	}
+
+	rec = httptest.NewRecorder()
+	router.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/token/other", nil))
+	if rec.Code != http.StatusNotFound {
+		t.Fatalf("expected 404 for unknown id, got %d", rec.Code)
+	}
+}
+
+func TestIngestHandlerPut(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	channels := &fakeLive{}
+	router := gin.New()
+	router.PUT("/live/:channel", NewIngestHandler(channels).Serve)
+
+	put := func(channel string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, httptest.NewRequest(http.MethodPut, "/live/"+channel, strings.NewReader("audio")))
+		return rec
+	}
+
+	if rec := put("radio"); rec.Code != http.StatusNoContent || channels.ingested != "audio" {
+		t.Fatalf("expected the body to be ingested, got %d %q", rec.Code, channels.ingested)
+	}
+	if rec := put("other"); rec.Code != http.StatusNotFound {
+		t.Fatalf("expected 404 for unknown channel, got %d", rec.Code)
+	}
+	channels.ingestErr = live.ErrOnAir
+	if rec := put("radio"); rec.Code != http.StatusConflict {
+		t.Fatalf("expected 409 when a source is connected, got %d", rec.Code)
+	}
+	channels.onAir = true
+	channels.ingestErr = nil
+	if rec := put("radio"); rec.Code != http.StatusConflict {
+		t.Fatalf("expected 409 while on air, got %d", rec.Code)
+	}
+}
@@ -0,0 +1,184 @@
+package handlers
+
+import (
+	"GOtify/internal/logging"
+	"GOtify/internal/metrics"
+	"GOtify/internal/storage"
+	"GOtify/internal/transcode"
+	"bytes"
+	"errors"
+	"mime"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ProgressiveRoute es la ruta bajo /stream/<file_id>/ que sirve el archivo
+// progresivo de la canción.
+const ProgressiveRoute = "file"
+
+const progressiveMaxAge = time.Hour
+
+// progressiveSignedTTL es la vida de la URL firmada del archivo progresivo.
+// Es larga porque el reproductor la reutiliza en cada rango que pide al
+// avanzar o saltar dentro de la canción.
+const progressiveSignedTTL = progressiveMaxAge
+
+// ProgressiveHandler sirve el archivo único (MP3/M4A) que genera el
+// transcodificador para clientes sin HLS. Como KeyDeliveryHandler, se monta
+// detrás de la autorización de /stream.
+type ProgressiveHandler struct {
+	files   *FileHandler
+	formats []string
+}
+
+// NewProgressiveHandler busca primero el formato preferred y después el resto
+// de transcode.ProgressiveFormats, para seguir sirviendo canciones subidas
+// antes de cambiar de formato.
+func NewProgressiveHandler(files *FileHandler, preferred string) *ProgressiveHandler {
+	formats := make([]string, 0, len(transcode.ProgressiveFormats))
+	if _, ok := transcode.ProgressiveFormats[preferred]; ok {
+		formats = append(formats, preferred)
+	}
+	for _, format := range []string{"mp3", "m4a"} {
+		if format != preferred {
+			formats = append(formats, format)
+		}
+	}
+	return &ProgressiveHandler{files: files, formats: formats}
+}
+
+// Serve redirige a una URL firmada del archivo: el bucket resuelve los
+// rangos sin que cada petición lo descargue entero. Con la caché de
+// segmentos en disco lo sirve desde ella, con el rango pedido (206),
+// Content-Length exacto y Content-Disposition. Con ?download=1 el navegador
+// lo guarda en lugar de reproducirlo.
+func (h *ProgressiveHandler) Serve(c *gin.Context) {
+	ctx := c.Request.Context()
+	song, err := h.files.store.GetSong(ctx, c.Param("file_id"))
+	if err != nil {
+		status := http.StatusInternalServerError
+		if errors.Is(err, storage.ErrNotFound) {
+			status = http.StatusNotFound
+		}
+		c.AbortWithStatus(status)
+		return
+	}
+	masterKey, err := h.files.masterObjectKey(song)
+	if err != nil {
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	download, _ := strconv.ParseBool(c.Query("download"))
+	if sc, ok := h.files.bucket.(segmentCache); ok && sc.CachesSegments() {
+		h.serveCached(c, song, path.Dir(masterKey), download)
+		return
+	}
+
+	var (
+		signedURL string
+		format    string
+	)
+	err = storage.ErrNotFound
+	for _, f := range h.formats {
+		objectKey := path.Join(path.Dir(masterKey), transcode.ProgressiveName+"."+f)
+		// Firmar un objeto que no existe falla con ErrNotFound, así que
+		// también sirve para elegir el formato.
+		signedURL, err = h.files.bucket.SignedURL(ctx, objectKey, int(progressiveSignedTTL/time.Second))
+		if !errors.Is(err, storage.ErrNotFound) {
+			format = f
+			break
+		}
+	}
+	metrics.StreamServed(ProgressiveRoute, err)
+	if err != nil {
+		h.abort(c, song, err)
+		return
+	}
+	if download {
+		// Supabase Storage responde con Content-Disposition: attachment y
+		// ese nombre cuando la URL lleva download.
+		u, err := url.Parse(signedURL)
+		if err != nil {
+			h.abort(c, song, err)
+			return
+		}
+		query := u.Query()
+		query.Set("download", downloadFilename(song)+"."+format)
+		u.RawQuery = query.Encode()
+		signedURL = u.String()
+	}
+	// Como con los segmentos, la redirección se cachea la mitad de lo que
+	// vale la URL firmada.
+	setCacheControl(c, progressiveSignedTTL/2, false)
+	c.Redirect(http.StatusTemporaryRedirect, signedURL)
+}
+
+// serveCached sirve el archivo desde la caché de segmentos, que lo guarda en
+// disco tras la primera descarga.
+func (h *ProgressiveHandler) serveCached(c *gin.Context, song storage.Song, folder string, download bool) {
+	var (
+		data   []byte
+		format string
+		err    = storage.ErrNotFound
+	)
+	for _, f := range h.formats {
+		data, err = h.files.bucket.DownloadFile(c.Request.Context(), path.Join(folder, transcode.ProgressiveName+"."+f))
+		if !errors.Is(err, storage.ErrNotFound) {
+			format = f
+			break
+		}
+	}
+	metrics.StreamServed(ProgressiveRoute, err)
+	if err != nil {
+		h.abort(c, song, err)
+		return
+	}
+
+	disposition := "inline"
+	if download {
+		disposition = "attachment"
+	}
+	c.Header("Content-Type", transcode.ProgressiveFormats[format])
+	c.Header("Content-Disposition", mime.FormatMediaType(disposition, map[string]string{
+		"filename": downloadFilename(song) + "." + format,
+	}))
+	c.Header("ETag", contentETag(data))
+	setCacheControl(c, progressiveMaxAge, false)
+	// ServeContent resuelve Range, If-Range, If-None-Match y HEAD.
+	http.ServeContent(c.Writer, c.Request, "", time.Time{}, bytes.NewReader(data))
+}
+
+// abort responde 404 si la canción no tiene archivo progresivo y 500 ante
+// cualquier otro fallo del bucket.
+func (h *ProgressiveHandler) abort(c *gin.Context, song storage.Song, err error) {
+	if errors.Is(err, storage.ErrNotFound) {
+		c.AbortWithStatus(http.StatusNotFound)
+		return
+	}
+	logging.FromContext(c.Request.Context()).Error("progressive file failed", "song_id", song.ID, "error", err)
+	c.AbortWithStatus(http.StatusInternalServerError)
+}
+
+// downloadFilename deja el nombre de la canción apto para una cabecera; si
+// queda vacío usa su ID.
+func downloadFilename(song storage.Song) string {
+	name := strings.Map(func(r rune) rune {
+		switch {
+		case r == '/' || r == '\\' || r == '"' || unicode.IsControl(r):
+			return -1
+		}
+		return r
+	}, strings.TrimSpace(song.Name))
+	if name == "" {
+		return song.ID
+	}
+	return name
+}
@@ -0,0 +1,168 @@
+package handlers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"GOtify/internal/storage"
+
+	"github.com/gin-gonic/gin"
+)
+
+// cachedBucket simula cache.Bucket con la caché de segmentos en disco.
+type cachedBucket struct {
+	*fakeDownloadBucket
+}
+
+func (cachedBucket) CachesSegments() bool { return true }
+
+func newProgressiveTest(t *testing.T, cached bool) func(songID, target string, header http.Header) *httptest.ResponseRecorder {
+	t.Helper()
+	gin.SetMode(gin.TestMode)
+
+	store := &fakeSongStore{
+		songs: map[string]storage.Song{
+			"song-1": {ID: "song-1", Name: `Mi "canción"`, BucketFolder: "my-song"},
+			"song-2": {ID: "song-2", Name: "Otra", BucketFolder: "other"},
+		},
+	}
+	files := &fakeDownloadBucket{
+		files: map[string][]byte{
+			"my-song/master.m3u8":     []byte("#EXTM3U\n"),
+			"my-song/progressive.m4a": []byte("0123456789"),
+		},
+		strict: true,
+	}
+	var bucket bucketDownloader = files
+	if cached {
+		bucket = cachedBucket{files}
+	}
+	// mp3 es el preferido pero la canción solo tiene m4a.
+	handler := NewProgressiveHandler(NewFileHandler(store, bucket, "music"), "mp3")
+
+	return func(songID, target string, header http.Header) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		c, _ := gin.CreateTestContext(w)
+		c.Params = gin.Params{
+			{Key: "file_id", Value: songID},
+			{Key: "quality", Value: "/" + ProgressiveRoute},
+		}
+		c.Request = httptest.NewRequest(http.MethodGet, target, nil)
+		for k, v := range header {
+			c.Request.Header[k] = v
+		}
+		handler.Serve(c)
+		return w
+	}
+}
+
+func TestProgressiveHandlerRedirects(t *testing.T) {
+	serve := newProgressiveTest(t, false)
+
+	w := serve("song-1", "/stream/song-1/file", http.Header{"Range": {"bytes=2-5"}})
+	if w.Code != http.StatusTemporaryRedirect {
+		t.Fatalf("expected a redirect to the bucket, got %d %q", w.Code, w.Body.String())
+	}
+	if got := w.Header().Get("Location"); got != "https://signed.test/my-song/progressive.m4a?ttl=3600" {
+		t.Fatalf("unexpected location %q", got)
+	}
+	if got := w.Header().Get("Cache-Control"); got != "public, max-age=1800" {
+		t.Fatalf("expected the redirect to be cached for half the url lifetime, got %q", got)
+	}
+
+	w = serve("song-1", "/stream/song-1/file?download=1", nil)
+	location, err := url.Parse(w.Header().Get("Location"))
+	if err != nil || location.Query().Get("download") != "Mi canción.m4a" || location.Query().Get("ttl") != "3600" {
+		t.Fatalf("expected a download url keeping the signature, got %q", w.Header().Get("Location"))
+	}
+
+	if w := serve("song-2", "/stream/song-2/file", nil); w.Code != http.StatusNotFound {
+		t.Fatalf("expected 404 without progressive file, got %d", w.Code)
+	}
+	if w := serve("missing", "/stream/missing/file", nil); w.Code != http.StatusNotFound {
+		t.Fatalf("expected 404 for unknown song, got %d", w.Code)
+	}
+}
+
+func TestProgressiveHandlerServesFromCache(t *testing.T) {
+	serve := newProgressiveTest(t, true)
+
+	w := serve("song-1", "/stream/song-1/file", nil)
+	if w.Code != http.StatusOK || w.Body.String() != "0123456789" {
+		t.Fatalf("unexpected response %d %q", w.Code, w.Body.String())
+	}
+	if got := w.Header().Get("Content-Type"); got != "audio/mp4" {
+		t.Fatalf("unexpected content type %q", got)
+	}
+	if got := w.Header().Get("Content-Length"); got != "10" {
+		t.Fatalf("unexpected content length %q", got)
+	}
+	if got := w.Header().Get("Accept-Ranges"); got != "bytes" {
+		t.Fatalf("expected range support, got %q", got)
+	}
+	if got := w.Header().Get("Content-Disposition"); got != `inline; filename*=utf-8''Mi%20canci%C3%B3n.m4a` {
+		t.Fatalf("unexpected content disposition %q", got)
+	}
+
+	w = serve("song-1", "/stream/song-1/file?download=1", http.Header{"Range": {"bytes=2-5"}})
+	if w.Code != http.StatusPartialContent || w.Body.String() != "2345" {
+		t.Fatalf("unexpected range response %d %q", w.Code, w.Body.String())
+	}
+	if got := w.Header().Get("Content-Range"); got != "bytes 2-5/10" {
+		t.Fatalf("unexpected content range %q", got)
+	}
+	if got := w.Header().Get("Content-Length"); got != "4" {
+		t.Fatalf("unexpected partial content length %q", got)
+	}
+	if got := w.Header().Get("Content-Disposition"); got[:len("attachment")] != "attachment" {
+		t.Fatalf("expected attachment disposition, got %q", got)
+	}
+
+	if w := serve("song-2", "/stream/song-2/file", nil); w.Code != http.StatusNotFound {
+		t.Fatalf("expected 404 without progressive file, got %d", w.Code)
+	}
+}
+
+func TestProgressiveHandlerFallsBackOnStorageMiss(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	// Supabase Storage responde 400 "Object not found" al firmar el mp3 que
+	// falta.
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/storage/v1/object/sign/audio/my-song/progressive.m4a":
+			w.Write([]byte(`{"signedURL":"/object/sign/audio/my-song/progressive.m4a?token=signed"}`))
+		default:
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"statusCode":"404","error":"not_found","message":"Object not found"}`))
+		}
+	}))
+	defer ts.Close()
+	bucket, err := storage.NewBucketClient(storage.Config{URL: ts.URL, ServiceKey: "service-key", Bucket: "audio"})
+	if err != nil {
+		t.Fatalf("NewBucketClient: %v", err)
+	}
+	store := &fakeSongStore{songs: map[string]storage.Song{
+		"song-1": {ID: "song-1", Name: "Song", BucketFolder: "my-song"},
+		"song-2": {ID: "song-2", Name: "Otra", BucketFolder: "other"},
+	}}
+	handler := NewProgressiveHandler(NewFileHandler(store, bucket, "audio"), "mp3")
+
+	serve := func(songID string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		c, _ := gin.CreateTestContext(w)
+		c.Params = gin.Params{{Key: "file_id", Value: songID}, {Key: "quality", Value: "/" + ProgressiveRoute}}
+		c.Request = httptest.NewRequest(http.MethodGet, "/stream/"+songID+"/file", nil)
+		handler.Serve(c)
+		return w
+	}
+	want := ts.URL + "/storage/v1/object/sign/audio/my-song/progressive.m4a?token=signed"
+	if w := serve("song-1"); w.Code != http.StatusTemporaryRedirect || w.Header().Get("Location") != want {
+		t.Fatalf("expected the m4a fallback, got %d %q", w.Code, w.Header().Get("Location"))
+	}
+	if w := serve("song-2"); w.Code != http.StatusNotFound {
+		t.Fatalf("expected 404 when no format exists, got %d", w.Code)
+	}
+}
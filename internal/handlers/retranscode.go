@@ -0,0 +1,274 @@
+package handlers
+
+import (
+	"GOtify/internal/logging"
+	"GOtify/internal/metrics"
+	"GOtify/internal/storage"
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// errShuttingDown rechaza una re-transcodificación masiva durante el apagado.
+var errShuttingDown = errors.New("el servidor se esta apagando")
+
+// errNoSource indica que la canción se subió sin guardar el original.
+var errNoSource = errors.New("la cancion no tiene original guardado")
+
+// maxRetranscodeFailures acota los fallos que se guardan en el estado de la
+// re-transcodificación masiva.
+const maxRetranscodeFailures = 50
+
+// retranscodeStatus es el progreso de la última re-transcodificación masiva.
+type retranscodeStatus struct {
+	Running    bool                 `json:"running"`
+	Total      int                  `json:"total"`
+	Done       int                  `json:"done"`
+	Skipped    int                  `json:"skipped"`
+	Failed     int                  `json:"failed"`
+	Cancelled  bool                 `json:"cancelled,omitempty"`
+	Failures   []retranscodeFailure `json:"failures,omitempty"`
+	StartedAt  *time.Time           `json:"started_at,omitempty"`
+	FinishedAt *time.Time           `json:"finished_at,omitempty"`
+}
+
+type retranscodeFailure struct {
+	SongID string `json:"song_id"`
+	Error  string `json:"error"`
+}
+
+// Retranscode regenera las variantes de una canción a partir de su original
+// con la configuración actual del transcodificador. Responde 409 si la
+// canción no tiene original guardado.
+func (h *SongHandler) Retranscode(c *gin.Context) {
+	defer observeSongOperation(c, "retranscode")
+
+	id := c.Param("id")
+	if id == "" {
+		writeError(c, http.StatusBadRequest, fmt.Errorf("id requerido"))
+		return
+	}
+	song, err := h.store.GetSong(c.Request.Context(), id)
+	if err != nil {
+		status := http.StatusInternalServerError
+		if errors.Is(err, storage.ErrNotFound) {
+			status = http.StatusNotFound
+		}
+		writeError(c, status, err)
+		return
+	}
+
+	updated, status, err := h.retranscode(c.Request.Context(), song)
+	if err != nil {
+		writeError(c, status, err)
+		return
+	}
+	c.JSON(http.StatusOK, updated)
+}
+
+// RetranscodeAll re-transcodifica en segundo plano todo el catálogo, una
+// canción tras otra, y responde 202 con el estado inicial. Solo hay una
+// ejecución a la vez: mientras dure, responde 409.
+func (h *SongHandler) RetranscodeAll(c *gin.Context) {
+	defer observeSongOperation(c, "retranscode_all")
+
+	h.bulkMu.Lock()
+	if h.bulk.Running {
+		status := h.bulkSnapshot()
+		h.bulkMu.Unlock()
+		c.JSON(http.StatusConflict, status)
+		return
+	}
+	if h.base.Err() != nil {
+		h.bulkMu.Unlock()
+		writeError(c, http.StatusServiceUnavailable, errShuttingDown)
+		return
+	}
+	previous := h.bulk
+	now := time.Now().UTC()
+	h.bulk = retranscodeStatus{Running: true, StartedAt: &now}
+	// Se apunta con bulkMu tomado para que Run no pueda dejar de esperarla.
+	h.running.Add(1)
+	h.bulkMu.Unlock()
+
+	songs, err := h.store.ListSongs(c.Request.Context())
+	h.bulkMu.Lock()
+	if err != nil {
+		h.bulk = previous
+		h.bulkMu.Unlock()
+		h.running.Done()
+		writeError(c, http.StatusInternalServerError, err)
+		return
+	}
+	h.bulk.Total = len(songs)
+	status := h.bulkSnapshot()
+	h.bulkMu.Unlock()
+
+	// La ejecución sobrevive a la petición pero conserva su logger; solo la
+	// corta el apagado del servidor.
+	ctx, cancel := context.WithCancel(context.WithoutCancel(c.Request.Context()))
+	stop := context.AfterFunc(h.base, cancel)
+	go func() {
+		defer h.running.Done()
+		defer stop()
+		defer cancel()
+		h.retranscodeAll(ctx, songs)
+	}()
+	c.JSON(http.StatusAccepted, status)
+}
+
+// Run cancela la re-transcodificación masiva en curso cuando ctx se cancela
+// y espera a que la canción en marcha limpie su carpeta nueva.
+func (h *SongHandler) Run(ctx context.Context) {
+	<-ctx.Done()
+	h.bulkMu.Lock()
+	h.shutdown()
+	h.bulkMu.Unlock()
+	h.running.Wait()
+}
+
+// RetranscodeStatus devuelve el progreso de la última re-transcodificación
+// masiva.
+func (h *SongHandler) RetranscodeStatus(c *gin.Context) {
+	h.bulkMu.Lock()
+	status := h.bulkSnapshot()
+	h.bulkMu.Unlock()
+	c.JSON(http.StatusOK, status)
+}
+
+func (h *SongHandler) retranscodeAll(ctx context.Context, songs []storage.Song) {
+	for _, song := range songs {
+		if ctx.Err() != nil {
+			break
+		}
+		_, status, err := h.retranscode(ctx, song)
+		metrics.SongOperation("retranscode", status)
+
+		h.bulkMu.Lock()
+		switch {
+		case ctx.Err() != nil:
+			// La canción cortada por el apagado no cuenta como fallo.
+		case errors.Is(err, errNoSource):
+			h.bulk.Skipped++
+		case err != nil:
+			h.bulk.Failed++
+			if len(h.bulk.Failures) < maxRetranscodeFailures {
+				h.bulk.Failures = append(h.bulk.Failures, retranscodeFailure{SongID: song.ID, Error: err.Error()})
+			}
+			logging.FromContext(ctx).Error("retranscode failed", "song_id", song.ID, "error", err)
+		default:
+			h.bulk.Done++
+		}
+		h.bulkMu.Unlock()
+	}
+
+	h.bulkMu.Lock()
+	now := time.Now().UTC()
+	h.bulk.Running = false
+	h.bulk.Cancelled = ctx.Err() != nil
+	h.bulk.FinishedAt = &now
+	status := h.bulk
+	h.bulkMu.Unlock()
+	logging.FromContext(ctx).Info("retranscode finished",
+		"total", status.Total, "done", status.Done, "skipped", status.Skipped, "failed", status.Failed,
+		"cancelled", status.Cancelled)
+}
+
+// bulkSnapshot copia el estado masivo; requiere bulkMu.
+func (h *SongHandler) bulkSnapshot() retranscodeStatus {
+	status := h.bulk
+	status.Failures = append([]retranscodeFailure(nil), h.bulk.Failures...)
+	return status
+}
+
+// retranscode genera las variantes de song desde su original en una carpeta
+// nueva, apunta la canción a ella y borra la anterior, para que la carpeta
+// vigente nunca quede a medio subir. Devuelve el status HTTP del fallo.
+func (h *SongHandler) retranscode(ctx context.Context, song storage.Song) (storage.Song, int, error) {
+	content, err := h.bucket.DownloadFile(ctx, storage.MezzaninePath(song.ID))
+	if err != nil {
+		if errors.Is(err, storage.ErrNotFound) {
+			return song, http.StatusConflict, errNoSource
+		}
+		return song, http.StatusBadGateway, fmt.Errorf("no se pudo leer el original: %w", err)
+	}
+
+	audioPath, err := writeTempSource(content)
+	if err != nil {
+		return song, http.StatusInternalServerError, err
+	}
+	defer os.Remove(audioPath)
+
+	key, err := h.newKey()
+	if err != nil {
+		return song, http.StatusInternalServerError, err
+	}
+	files, err := h.transcoder.GenerateHLS(ctx, audioPath, key)
+	if err != nil {
+		return song, http.StatusInternalServerError, err
+	}
+
+	uploads := make([]storage.UploadFile, 0, len(files))
+	for _, file := range files {
+		uploads = append(uploads, storage.UploadFile{
+			Path:        file.Name,
+			Content:     file.Content,
+			ContentType: file.ContentType,
+		})
+	}
+
+	oldFolder := h.folderFromBucketPath(song.BucketFolder)
+	folder := songFolder(song.Name)
+	if err := h.bucket.UploadBatch(ctx, folder, uploads); err != nil {
+		h.discardFolder(ctx, folder)
+		return song, http.StatusBadGateway, err
+	}
+
+	updated := song
+	updated.BucketFolder = folder
+	if updated.Source == nil {
+		// Originales guardados antes de registrar hash y ffprobe.
+		updated.Source = h.describeSource(ctx, audioPath, content, "")
+	}
+	// Como en Update: la clave cambia justo antes que la carpeta y se
+	// restaura si la canción no llega a apuntar a la nueva.
+	restoreKey, err := h.replaceKey(ctx, song.ID, key)
+	if err != nil {
+		h.discardFolder(ctx, folder)
+		return song, http.StatusInternalServerError, err
+	}
+	if err := h.store.UpsertSong(ctx, updated); err != nil {
+		restoreKey(ctx)
+		h.discardFolder(ctx, folder)
+		return song, http.StatusInternalServerError, err
+	}
+
+	if oldFolder != "" && oldFolder != folder {
+		if err := h.bucket.DeletePrefix(ctx, oldFolder); err != nil {
+			logging.FromContext(ctx).Error("old folder cleanup failed", "song_id", song.ID, "folder", oldFolder, "error", err)
+		}
+	}
+	return updated, http.StatusOK, nil
+}
+
+func writeTempSource(content []byte) (string, error) {
+	tempFile, err := os.CreateTemp("", "gotify-source-*")
+	if err != nil {
+		return "", fmt.Errorf("no se pudo crear archivo temporal: %w", err)
+	}
+	if _, err := tempFile.Write(content); err != nil {
+		tempFile.Close()
+		os.Remove(tempFile.Name())
+		return "", fmt.Errorf("no se pudo escribir archivo temporal: %w", err)
+	}
+	if err := tempFile.Close(); err != nil {
+		os.Remove(tempFile.Name())
+		return "", fmt.Errorf("no se pudo cerrar archivo temporal: %w", err)
+	}
+	return tempFile.Name(), nil
+}
@@ -0,0 +1,195 @@
+package handlers
+
+import (
+	"GOtify/internal/storage"
+	"GOtify/internal/testutil/ffmpegstub"
+	"GOtify/internal/transcode"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func newRetranscodeHandler(t *testing.T) (*SongHandler, *fakeStore, *fakeBucket, *fakeSongKeys) {
+	t.Helper()
+	gin.SetMode(gin.TestMode)
+
+	store := newFakeStore()
+	store.songs["song-1"] = storage.Song{ID: "song-1", Name: "Old Song", Duration: 120, BucketFolder: "old-song"}
+	store.songs["song-2"] = storage.Song{ID: "song-2", Name: "No Source", Duration: 90, BucketFolder: "no-source"}
+	bucket := &fakeBucket{objects: map[string][]byte{storage.MezzaninePath("song-1"): []byte("original audio")}}
+	keys := &fakeSongKeys{keys: map[string]storage.SongKey{}}
+	paths := ffmpegstub.Build(t)
+
+	handler, err := NewSongHandler(store, bucket, SongHandlerConfig{
+		FFmpegBin:  paths.FFmpeg,
+		FFProbeBin: paths.FFProbe,
+		Keys:       keys,
+		Encrypt:    true,
+		KeepSource: true,
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	return handler, store, bucket, keys
+}
+
+func TestSongHandlerRetranscode(t *testing.T) {
+	handler, store, bucket, keys := newRetranscodeHandler(t)
+
+	code, resp := performRequest(handler.Retranscode, http.MethodPost, "/songs/:id/retranscode", "/songs/song-1/retranscode", nil)
+	if code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d body=%s", code, resp)
+	}
+
+	updated := store.songs["song-1"]
+	if !strings.HasPrefix(updated.BucketFolder, "old-song-r") {
+		t.Fatalf("expected a fresh folder, got %q", updated.BucketFolder)
+	}
+	if len(bucket.uploads) != 1 || bucket.uploads[0].prefix != updated.BucketFolder {
+		t.Fatalf("expected assets uploaded to the new folder, got %+v", bucket.uploads)
+	}
+	if len(bucket.deletes) != 1 || bucket.deletes[0] != "old-song" {
+		t.Fatalf("expected the old folder to be removed, got %#v", bucket.deletes)
+	}
+	if updated.Source == nil || updated.Source.Size != int64(len("original audio")) || updated.Source.Codec != "pcm_s16le" {
+		t.Fatalf("expected source metadata to be backfilled, got %+v", updated.Source)
+	}
+	if _, ok := keys.keys["song-1"]; !ok {
+		t.Fatalf("expected a new key for the regenerated segments")
+	}
+
+	code, _ = performRequest(handler.Retranscode, http.MethodPost, "/songs/:id/retranscode", "/songs/song-2/retranscode", nil)
+	if code != http.StatusConflict {
+		t.Fatalf("expected 409 without a kept source, got %d", code)
+	}
+	code, _ = performRequest(handler.Retranscode, http.MethodPost, "/songs/:id/retranscode", "/songs/missing/retranscode", nil)
+	if code != http.StatusNotFound {
+		t.Fatalf("expected 404 for unknown song, got %d", code)
+	}
+}
+
+func TestSongHandlerRetranscodeRestoresKeyOnFailure(t *testing.T) {
+	handler, store, bucket, keys := newRetranscodeHandler(t)
+	previous := storage.SongKey{SongID: "song-1", Key: "old-key", IV: "old-iv"}
+	keys.keys["song-1"] = previous
+	store.upsertErr = errors.New("catalog down")
+
+	code, _ := performRequest(handler.Retranscode, http.MethodPost, "/songs/:id/retranscode", "/songs/song-1/retranscode", nil)
+	if code != http.StatusInternalServerError {
+		t.Fatalf("expected status 500, got %d", code)
+	}
+	if got := keys.keys["song-1"]; got != previous {
+		t.Fatalf("expected the key of the current folder to be restored, got %+v", got)
+	}
+	if store.songs["song-1"].BucketFolder != "old-song" {
+		t.Fatalf("expected the song to keep its folder, got %q", store.songs["song-1"].BucketFolder)
+	}
+	if len(bucket.deletes) != 1 || bucket.deletes[0] != bucket.uploads[0].prefix {
+		t.Fatalf("expected only the new folder to be discarded, got %#v", bucket.deletes)
+	}
+}
+
+func TestSongHandlerRetranscodeAll(t *testing.T) {
+	handler, store, _, _ := newRetranscodeHandler(t)
+
+	code, resp := performRequest(handler.RetranscodeAll, http.MethodPost, "/songs/retranscode", "/songs/retranscode", nil)
+	if code != http.StatusAccepted {
+		t.Fatalf("expected status 202, got %d body=%s", code, resp)
+	}
+
+	var status retranscodeStatus
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		_, resp = performRequest(handler.RetranscodeStatus, http.MethodGet, "/songs/retranscode", "/songs/retranscode", nil)
+		if err := json.Unmarshal([]byte(resp), &status); err != nil {
+			t.Fatalf("invalid status json: %v", err)
+		}
+		if !status.Running {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("bulk retranscode did not finish: %+v", status)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if status.Total != 2 || status.Done != 1 || status.Skipped != 1 || status.Failed != 0 || status.FinishedAt == nil {
+		t.Fatalf("unexpected status %+v", status)
+	}
+	if store.songs["song-2"].BucketFolder != "no-source" {
+		t.Fatalf("songs without source must be left untouched")
+	}
+	if !strings.HasPrefix(store.songs["song-1"].BucketFolder, "old-song-r") {
+		t.Fatalf("expected song-1 to be regenerated, got %q", store.songs["song-1"].BucketFolder)
+	}
+}
+
+// blockingTranscoder no termina hasta que se cancela el contexto.
+type blockingTranscoder struct {
+	started chan struct{}
+}
+
+func (b blockingTranscoder) ProbeDuration(context.Context, string) (int32, error) {
+	return 120, nil
+}
+
+func (b blockingTranscoder) GenerateHLS(ctx context.Context, _ string, _ *transcode.Key) ([]transcode.ResultFile, error) {
+	close(b.started)
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+func TestSongHandlerRunCancelsRetranscodeAll(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	store := newFakeStore()
+	store.songs["song-1"] = storage.Song{ID: "song-1", Name: "Old Song", Duration: 120, BucketFolder: "old-song"}
+	store.songs["song-2"] = storage.Song{ID: "song-2", Name: "Other", Duration: 90, BucketFolder: "other"}
+	bucket := &fakeBucket{objects: map[string][]byte{
+		storage.MezzaninePath("song-1"): []byte("original audio"),
+		storage.MezzaninePath("song-2"): []byte("original audio"),
+	}}
+	transcoder := blockingTranscoder{started: make(chan struct{})}
+	handler, err := NewSongHandler(store, bucket, SongHandlerConfig{Transcoder: transcoder})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan struct{})
+	go func() {
+		handler.Run(ctx)
+		close(stopped)
+	}()
+
+	if code, resp := performRequest(handler.RetranscodeAll, http.MethodPost, "/songs/retranscode", "/songs/retranscode", nil); code != http.StatusAccepted {
+		t.Fatalf("expected status 202, got %d body=%s", code, resp)
+	}
+	<-transcoder.started
+	cancel()
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Run did not wait for the bulk retranscode to stop")
+	}
+
+	_, resp := performRequest(handler.RetranscodeStatus, http.MethodGet, "/songs/retranscode", "/songs/retranscode", nil)
+	var status retranscodeStatus
+	if err := json.Unmarshal([]byte(resp), &status); err != nil {
+		t.Fatalf("invalid status json: %v", err)
+	}
+	if status.Running || !status.Cancelled || status.Done != 0 || status.Failed != 0 {
+		t.Fatalf("expected a cancelled run without failures, got %+v", status)
+	}
+	if store.songs["song-1"].BucketFolder != "old-song" || store.songs["song-2"].BucketFolder != "other" {
+		t.Fatalf("cancelled songs must keep their folders, got %+v", store.songs)
+	}
+	if code, _ := performRequest(handler.RetranscodeAll, http.MethodPost, "/songs/retranscode", "/songs/retranscode", nil); code != http.StatusServiceUnavailable {
+		t.Fatalf("expected 503 after shutdown, got %d", code)
+	}
+}
@@ -0,0 +1,65 @@
+package handlers
+
+import (
+	"GOtify/internal/logging"
+	"GOtify/internal/revocation"
+	"GOtify/internal/storage"
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Revoker registra revocaciones de tokens; revocation.List lo implementa.
+type Revoker interface {
+	Revoke(ctx context.Context, r storage.Revocation) (storage.Revocation, error)
+	Entries() []storage.Revocation
+}
+
+type RevocationHandler struct {
+	revoker Revoker
+}
+
+func NewRevocationHandler(revoker Revoker) *RevocationHandler {
+	return &RevocationHandler{revoker: revoker}
+}
+
+type revokeRequest struct {
+	Kind    string `json:"kind" binding:"required"`
+	Subject string `json:"subject" binding:"required"`
+	// NotBefore (RFC 3339) invalida los tokens emitidos antes; por defecto ahora.
+	NotBefore *time.Time `json:"not_before"`
+	Reason    string     `json:"reason"`
+}
+
+func (h *RevocationHandler) List(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"revocations": h.revoker.Entries()})
+}
+
+func (h *RevocationHandler) Create(c *gin.Context) {
+	var req revokeRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		writeError(c, http.StatusBadRequest, fmt.Errorf("cuerpo invalido: %w", err))
+		return
+	}
+	r := storage.Revocation{Kind: req.Kind, Subject: req.Subject, Reason: req.Reason}
+	if req.NotBefore != nil {
+		r.NotBefore = *req.NotBefore
+	}
+
+	created, err := h.revoker.Revoke(c.Request.Context(), r)
+	if err != nil {
+		status := http.StatusInternalServerError
+		if errors.Is(err, revocation.ErrInvalid) {
+			status = http.StatusBadRequest
+		}
+		writeError(c, status, err)
+		return
+	}
+	logging.FromContext(c.Request.Context()).Info("tokens revoked",
+		"kind", created.Kind, "subject", created.Subject, "not_before", created.NotBefore)
+	c.JSON(http.StatusCreated, created)
+}
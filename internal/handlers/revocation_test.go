@@ -0,0 +1,65 @@
+package handlers
+
+import (
+	"GOtify/internal/revocation"
+	"GOtify/internal/storage"
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+type fakeRevoker struct {
+	got storage.Revocation
+	err error
+}
+
+func (f *fakeRevoker) Revoke(_ context.Context, r storage.Revocation) (storage.Revocation, error) {
+	f.got = r
+	r.ID = "r1"
+	return r, f.err
+}
+
+func (f *fakeRevoker) Entries() []storage.Revocation {
+	return []storage.Revocation{f.got}
+}
+
+func TestRevocationHandlerCreate(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	cases := []struct {
+		name   string
+		body   string
+		err    error
+		status int
+	}{
+		{"ok", `{"kind": "user", "subject": "u1", "not_before": "2026-01-02T03:04:05Z", "reason": "lapsed"}`, nil, http.StatusCreated},
+		{"missing subject", `{"kind": "user"}`, nil, http.StatusBadRequest},
+		{"bad time", `{"kind": "user", "subject": "u1", "not_before": "yesterday"}`, nil, http.StatusBadRequest},
+		{"invalid kind", `{"kind": "album", "subject": "a"}`, fmt.Errorf("%w: kind", revocation.ErrInvalid), http.StatusBadRequest},
+		{"store error", `{"kind": "song", "subject": "s"}`, errors.New("catalog down"), http.StatusInternalServerError},
+	}
+	for _, tc := range cases {
+		revoker := &fakeRevoker{err: tc.err}
+		router := gin.New()
+		router.POST("/admin/revocations", NewRevocationHandler(revoker).Create)
+
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/admin/revocations", strings.NewReader(tc.body)))
+		if rec.Code != tc.status {
+			t.Fatalf("%s: expected %d, got %d: %s", tc.name, tc.status, rec.Code, rec.Body.String())
+		}
+		if tc.name == "ok" {
+			want := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+			if revoker.got.Kind != "user" || revoker.got.Subject != "u1" || !revoker.got.NotBefore.Equal(want) || revoker.got.Reason != "lapsed" {
+				t.Fatalf("unexpected revocation %+v", revoker.got)
+			}
+		}
+	}
+}
@@ -1,13 +1,16 @@
 package handlers
 
 import (
+	"GOtify/internal/logging"
+	"GOtify/internal/metrics"
 	"GOtify/internal/storage"
 	"GOtify/internal/transcode"
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"io"
-	"log"
 	"mime/multipart"
 	"net/http"
 	"net/url"
@@ -17,6 +20,8 @@ import (
 	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/google/uuid"
@@ -29,6 +34,31 @@ type SongHandlerConfig struct {
 	FFProbeBin     string
 	SegmentSeconds int
 	Variants       []transcode.Variant
+	// Transcoder reemplaza a ffmpeg/ffprobe; si es nil se construye uno a
+	// partir de los campos anteriores.
+	Transcoder Transcoder
+	// Keys guarda las claves de cifrado en el catálogo. Con Encrypt cada
+	// subida se cifra con AES-128 y una clave nueva; sin él, Update y Delete
+	// igualmente borran las claves que queden de subidas cifradas.
+	Keys    SongKeyStore
+	Encrypt bool
+	// KeepSource guarda el archivo subido en storage.MezzaninePath para
+	// re-transcodificarlo o generar después variantes bajo demanda.
+	KeepSource bool
+}
+
+// Transcoder calcula la duración y genera los assets HLS de un archivo subido.
+// key, si no es nil, cifra los segmentos.
+type Transcoder interface {
+	ProbeDuration(ctx context.Context, sourcePath string) (int32, error)
+	GenerateHLS(ctx context.Context, sourcePath string, key *transcode.Key) ([]transcode.ResultFile, error)
+}
+
+// SongKeyStore guarda las claves de cifrado de las canciones fuera del bucket.
+type SongKeyStore interface {
+	GetSongKey(ctx context.Context, songID string) (storage.SongKey, error)
+	UpsertSongKey(ctx context.Context, key storage.SongKey) error
+	DeleteSongKey(ctx context.Context, songID string) error
 }
 
 type SongStore interface {
@@ -41,16 +71,31 @@ type SongStore interface {
 type BucketClient interface {
 	UploadBatch(ctx context.Context, prefix string, files []storage.UploadFile) error
 	DeletePrefix(ctx context.Context, prefix string) error
+	DownloadFile(ctx context.Context, objectPath string) ([]byte, error)
+}
+
+// sourceProber lo implementan los transcodificadores que saben describir el
+// original (transcode.FFmpeg); sin él solo se guardan hash y tamaño.
+type sourceProber interface {
+	Probe(ctx context.Context, sourcePath string) (transcode.ProbeInfo, error)
 }
 
 type SongHandler struct {
-	store          SongStore
-	bucket         BucketClient
-	bucketBaseURL  string
-	ffmpegBin      string
-	ffprobeBin     string
-	segmentSeconds int
-	variants       []transcode.Variant
+	store         SongStore
+	bucket        BucketClient
+	bucketBaseURL string
+	transcoder    Transcoder
+	keys          SongKeyStore
+	encrypt       bool
+	keepSource    bool
+
+	bulkMu sync.Mutex
+	bulk   retranscodeStatus
+	// base cuelga de la vida del servidor: Run lo cancela al apagarse y
+	// detiene la re-transcodificación masiva.
+	base     context.Context
+	shutdown context.CancelFunc
+	running  sync.WaitGroup
 }
 
 type createSongForm struct {
@@ -70,6 +115,8 @@ type updateSongForm struct {
 
 var slugRegex = regexp.MustCompile(`[^a-z0-9]+`)
 
+const cleanupTimeout = 30 * time.Second
+
 func NewSongHandler(store SongStore, bucket BucketClient, cfg SongHandlerConfig) (*SongHandler, error) {
 	if store == nil {
 		return nil, errors.New("store is required")
@@ -78,9 +125,6 @@ func NewSongHandler(store SongStore, bucket BucketClient, cfg SongHandlerConfig)
 		return nil, errors.New("bucket client is required")
 	}
 
-	if cfg.BucketBaseURL == "" {
-		cfg.BucketBaseURL = defaultBucketBase()
-	}
 	if cfg.FFmpegBin == "" {
 		cfg.FFmpegBin = "ffmpeg"
 	}
@@ -101,27 +145,38 @@ func NewSongHandler(store SongStore, bucket BucketClient, cfg SongHandlerConfig)
 		})
 	}
 
-	return &SongHandler{
-		store:          store,
-		bucket:         bucket,
-		bucketBaseURL:  strings.TrimRight(cfg.BucketBaseURL, "/"),
-		ffmpegBin:      cfg.FFmpegBin,
-		ffprobeBin:     cfg.FFProbeBin,
-		segmentSeconds: cfg.SegmentSeconds,
-		variants:       cfg.Variants,
-	}, nil
-}
+	if cfg.Encrypt && cfg.Keys == nil {
+		return nil, errors.New("key store is required for encryption")
+	}
 
-func defaultBucketBase() string {
-	projectURL := strings.TrimRight(os.Getenv("SUPABASE_URL"), "/")
-	bucket := strings.TrimSpace(os.Getenv("SUPABASE_BUCKET"))
-	if projectURL == "" || bucket == "" {
-		return ""
+	if cfg.Transcoder == nil {
+		cfg.Transcoder = transcode.FFmpeg{
+			Config: transcode.Config{
+				BinPath:        cfg.FFmpegBin,
+				SegmentSeconds: cfg.SegmentSeconds,
+				Variants:       cfg.Variants,
+			},
+			ProbeBin: cfg.FFProbeBin,
+		}
 	}
-	return fmt.Sprintf("%s/storage/v1/object/public/%s", projectURL, bucket)
+
+	base, shutdown := context.WithCancel(context.Background())
+	return &SongHandler{
+		base:          base,
+		shutdown:      shutdown,
+		store:         store,
+		bucket:        bucket,
+		bucketBaseURL: strings.TrimRight(cfg.BucketBaseURL, "/"),
+		transcoder:    cfg.Transcoder,
+		keys:          cfg.Keys,
+		encrypt:       cfg.Encrypt,
+		keepSource:    cfg.KeepSource,
+	}, nil
 }
 
 func (h *SongHandler) Create(c *gin.Context) {
+	defer observeSongOperation(c, "create")
+
 	var form createSongForm
 	if err := c.ShouldBind(&form); err != nil {
 		writeError(c, http.StatusBadRequest, err)
@@ -145,23 +200,23 @@ func (h *SongHandler) Create(c *gin.Context) {
 	}
 	defer cleanup()
 
-	slug := slugify(form.Name)
-	if slug == "" {
+	if slugify(form.Name) == "" {
 		writeError(c, http.StatusBadRequest, fmt.Errorf("nombre invalido"))
 		return
 	}
 
-	durationSeconds, err := transcode.ProbeDuration(c.Request.Context(), h.ffprobeBin, audioPath)
+	durationSeconds, err := h.transcoder.ProbeDuration(c.Request.Context(), audioPath)
 	if err != nil {
 		writeError(c, http.StatusBadRequest, fmt.Errorf("no se pudo calcular la duracion: %w", err))
 		return
 	}
 
-	files, err := transcode.GenerateHLS(c.Request.Context(), audioPath, transcode.Config{
-		BinPath:        h.ffmpegBin,
-		SegmentSeconds: h.segmentSeconds,
-		Variants:       h.variants,
-	})
+	key, err := h.newKey()
+	if err != nil {
+		writeError(c, http.StatusInternalServerError, err)
+		return
+	}
+	files, err := h.transcoder.GenerateHLS(c.Request.Context(), audioPath, key)
 	if err != nil {
 		writeError(c, http.StatusInternalServerError, err)
 		return
@@ -176,19 +231,41 @@ func (h *SongHandler) Create(c *gin.Context) {
 		})
 	}
 
-	if err := h.bucket.UploadBatch(c.Request.Context(), slug, uploads); err != nil {
+	folder := songFolder(form.Name)
+	if err := h.bucket.UploadBatch(c.Request.Context(), folder, uploads); err != nil {
+		h.discardFolder(c.Request.Context(), folder)
 		writeError(c, http.StatusBadGateway, err)
 		return
 	}
 
 	song := storage.Song{
-		ID:              uuid.NewString(),
-		Name:            form.Name,
-		Duration: durationSeconds,
-		BucketFolder:    slug,
+		ID:           uuid.NewString(),
+		Name:         form.Name,
+		Duration:     durationSeconds,
+		BucketFolder: folder,
 	}
 
+	song.Source, err = h.storeSource(c.Request.Context(), song.ID, audioPath, fileHeader.Header.Get("Content-Type"))
+	if err != nil {
+		h.discardFolder(c.Request.Context(), folder)
+		h.discardFolder(c.Request.Context(), storage.MezzanineFolder(song.ID))
+		writeError(c, http.StatusBadGateway, err)
+		return
+	}
+
+	// La clave va antes que la canción: una canción sin su clave no se podría
+	// reproducir.
+	if key != nil {
+		if err := h.storeKey(c.Request.Context(), song.ID, key); err != nil {
+			h.discardFolder(c.Request.Context(), folder)
+			h.discardFolder(c.Request.Context(), storage.MezzanineFolder(song.ID))
+			writeError(c, http.StatusInternalServerError, err)
+			return
+		}
+	}
 	if err := h.store.UpsertSong(c.Request.Context(), song); err != nil {
+		h.discardFolder(c.Request.Context(), folder)
+		h.discardFolder(c.Request.Context(), storage.MezzanineFolder(song.ID))
 		writeError(c, http.StatusInternalServerError, err)
 		return
 	}
@@ -197,6 +274,8 @@ func (h *SongHandler) Create(c *gin.Context) {
 }
 
 func (h *SongHandler) Get(c *gin.Context) {
+	defer observeSongOperation(c, "get")
+
 	id := c.Param("id")
 	if id == "" {
 		writeError(c, http.StatusBadRequest, fmt.Errorf("id requerido"))
@@ -215,6 +294,8 @@ func (h *SongHandler) Get(c *gin.Context) {
 }
 
 func (h *SongHandler) List(c *gin.Context) {
+	defer observeSongOperation(c, "list")
+
 	songs, err := h.store.ListSongs(c.Request.Context())
 	if err != nil {
 		writeError(c, http.StatusInternalServerError, err)
@@ -225,11 +306,13 @@ func (h *SongHandler) List(c *gin.Context) {
 	for _, song := range songs {
 		resp = append(resp, song)
 	}
-	log.Println("Listing songs:", resp)
+	logging.FromContext(c.Request.Context()).Debug("listing songs", "count", len(resp))
 	c.JSON(http.StatusOK, resp)
 }
 
 func (h *SongHandler) Update(c *gin.Context) {
+	defer observeSongOperation(c, "update")
+
 	id := c.Param("id")
 	if id == "" {
 		writeError(c, http.StatusBadRequest, fmt.Errorf("id requerido"))
@@ -273,7 +356,9 @@ func (h *SongHandler) Update(c *gin.Context) {
 	targetFolder := existingFolder
 	targetBucketKey := existing.BucketFolder
 	durationSeconds := existing.Duration
+	source := existing.Source
 
+	var key *transcode.Key
 	if newAudioProvided {
 		audioPath, cleanup, err := persistUploadedFile(fileHeader)
 		if err != nil {
@@ -282,27 +367,21 @@ func (h *SongHandler) Update(c *gin.Context) {
 		}
 		defer cleanup()
 
-		durationSeconds, err = transcode.ProbeDuration(c.Request.Context(), h.ffprobeBin, audioPath)
+		durationSeconds, err = h.transcoder.ProbeDuration(c.Request.Context(), audioPath)
 		if err != nil {
 			writeError(c, http.StatusBadRequest, fmt.Errorf("no se pudo calcular la duracion: %w", err))
 			return
 		}
 
-		files, err := transcode.GenerateHLS(c.Request.Context(), audioPath, transcode.Config{
-			BinPath:        h.ffmpegBin,
-			SegmentSeconds: h.segmentSeconds,
-			Variants:       h.variants,
-		})
+		key, err = h.newKey()
 		if err != nil {
 			writeError(c, http.StatusInternalServerError, err)
 			return
 		}
-
-		if existingFolder != "" {
-			if err := h.bucket.DeletePrefix(c.Request.Context(), existingFolder); err != nil {
-				writeError(c, http.StatusBadGateway, fmt.Errorf("no se pudo limpiar bucket: %w", err))
-				return
-			}
+		files, err := h.transcoder.GenerateHLS(c.Request.Context(), audioPath, key)
+		if err != nil {
+			writeError(c, http.StatusInternalServerError, err)
+			return
 		}
 
 		uploads := make([]storage.UploadFile, 0, len(files))
@@ -314,11 +393,27 @@ func (h *SongHandler) Update(c *gin.Context) {
 			})
 		}
 
-		targetFolder = newSlug
+		// La carpeta anterior se borra tras guardar la canción: hasta entonces
+		// es la que sirve /stream.
+		targetFolder = songFolder(form.Name)
 		if err := h.bucket.UploadBatch(c.Request.Context(), targetFolder, uploads); err != nil {
+			h.discardFolder(c.Request.Context(), targetFolder)
 			writeError(c, http.StatusBadGateway, err)
 			return
 		}
+		// Mejor sin original que con el de la versión anterior: las
+		// variantes bajo demanda y las re-transcodificaciones fallarían en
+		// vez de servir otro audio.
+		source, err = h.storeSource(c.Request.Context(), existing.ID, audioPath, fileHeader.Header.Get("Content-Type"))
+		if err != nil {
+			h.discardFolder(c.Request.Context(), targetFolder)
+			h.discardFolder(c.Request.Context(), storage.MezzanineFolder(existing.ID))
+			writeError(c, http.StatusBadGateway, err)
+			return
+		}
+		if !h.keepSource && existing.Source != nil {
+			h.discardFolder(c.Request.Context(), storage.MezzanineFolder(existing.ID))
+		}
 		targetBucketKey = targetFolder
 	} else {
 		// Mantiene los assets existentes; solo se actualiza metadata.
@@ -331,21 +426,46 @@ func (h *SongHandler) Update(c *gin.Context) {
 	}
 
 	updated := storage.Song{
-		ID:              existing.ID,
-		Name:            form.Name,
-		Duration: 			 durationSeconds,
-		BucketFolder:    targetBucketKey,
+		ID:           existing.ID,
+		Name:         form.Name,
+		Duration:     durationSeconds,
+		BucketFolder: targetBucketKey,
+		Source:       source,
 	}
 
+	// La canción tiene una sola clave y la carpeta vigente la necesita: se
+	// cambia justo antes de apuntar la canción a la carpeta nueva y se
+	// restaura si eso falla.
+	restoreKey := func(context.Context) {}
+	if newAudioProvided {
+		restoreKey, err = h.replaceKey(c.Request.Context(), existing.ID, key)
+		if err != nil {
+			h.discardFolder(c.Request.Context(), targetFolder)
+			writeError(c, http.StatusInternalServerError, err)
+			return
+		}
+	}
 	if err := h.store.UpsertSong(c.Request.Context(), updated); err != nil {
+		if newAudioProvided {
+			restoreKey(c.Request.Context())
+			h.discardFolder(c.Request.Context(), targetFolder)
+		}
 		writeError(c, http.StatusInternalServerError, err)
 		return
 	}
 
+	if newAudioProvided && existingFolder != "" && existingFolder != targetFolder {
+		if err := h.bucket.DeletePrefix(c.Request.Context(), existingFolder); err != nil {
+			logging.FromContext(c.Request.Context()).Error("old folder cleanup failed", "song_id", existing.ID, "folder", existingFolder, "error", err)
+		}
+	}
+
 	c.JSON(http.StatusOK, updated)
 }
 
 func (h *SongHandler) Delete(c *gin.Context) {
+	defer observeSongOperation(c, "delete")
+
 	id := c.Param("id")
 	if id == "" {
 		writeError(c, http.StatusBadRequest, fmt.Errorf("id requerido"))
@@ -374,6 +494,15 @@ func (h *SongHandler) Delete(c *gin.Context) {
 		writeError(c, http.StatusInternalServerError, err)
 		return
 	}
+	// También sin KeepSource: puede quedar el original de cuando estaba activo.
+	if err := h.bucket.DeletePrefix(c.Request.Context(), storage.MezzanineFolder(id)); err != nil {
+		logging.FromContext(c.Request.Context()).Error("mezzanine cleanup failed", "song_id", id, "error", err)
+	}
+	if h.keys != nil {
+		if err := h.keys.DeleteSongKey(c.Request.Context(), id); err != nil {
+			logging.FromContext(c.Request.Context()).Error("song key cleanup failed", "song_id", id, "error", err)
+		}
+	}
 
 	c.Status(http.StatusNoContent)
 }
@@ -391,7 +520,126 @@ func (h *SongHandler) Delete(c *gin.Context) {
 // 	}
 // }
 
+// newKey genera la clave de cifrado de una subida; nil si el cifrado está
+// desactivado.
+func (h *SongHandler) newKey() (*transcode.Key, error) {
+	if !h.encrypt {
+		return nil, nil
+	}
+	return transcode.NewKey()
+}
+
+// storeKey guarda la clave de songID. Sin clave (cifrado desactivado) borra
+// la anterior, porque los nuevos segmentos van en claro.
+func (h *SongHandler) storeKey(ctx context.Context, songID string, key *transcode.Key) error {
+	if h.keys == nil {
+		return nil
+	}
+	if key == nil {
+		return h.keys.DeleteSongKey(ctx, songID)
+	}
+	return h.keys.UpsertSongKey(ctx, storage.SongKey{
+		SongID:    songID,
+		Key:       hex.EncodeToString(key.Key),
+		IV:        hex.EncodeToString(key.IV),
+		CreatedAt: time.Now().UTC(),
+	})
+}
+
+// replaceKey guarda key como clave de songID y devuelve una función que
+// vuelve a dejar la anterior (o ninguna), para deshacer el cambio si la
+// canción no llega a apuntar a los segmentos cifrados con key.
+func (h *SongHandler) replaceKey(ctx context.Context, songID string, key *transcode.Key) (func(context.Context), error) {
+	if h.keys == nil {
+		return func(context.Context) {}, nil
+	}
+	previous, err := h.keys.GetSongKey(ctx, songID)
+	hadPrevious := err == nil
+	if err != nil && !errors.Is(err, storage.ErrNotFound) {
+		return nil, fmt.Errorf("no se pudo leer la clave anterior: %w", err)
+	}
+	if err := h.storeKey(ctx, songID, key); err != nil {
+		return nil, err
+	}
+	// Como discardFolder, la restauración no depende de que la petición siga
+	// viva: sin ella la canción quedaría con una clave que no es la suya.
+	return func(ctx context.Context) {
+		ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), cleanupTimeout)
+		defer cancel()
+		var err error
+		if hadPrevious {
+			err = h.keys.UpsertSongKey(ctx, previous)
+		} else {
+			err = h.keys.DeleteSongKey(ctx, songID)
+		}
+		if err != nil {
+			logging.FromContext(ctx).Error("song key restore failed", "song_id", songID, "error", err)
+		}
+	}, nil
+}
+
+// storeSource sube el archivo original de songID si KeepSource está activo y
+// devuelve su descripción para storage.Song; nil si no se guarda.
+func (h *SongHandler) storeSource(ctx context.Context, songID, audioPath, contentType string) (*storage.SongSource, error) {
+	if !h.keepSource {
+		return nil, nil
+	}
+	content, err := os.ReadFile(audioPath)
+	if err != nil {
+		return nil, fmt.Errorf("no se pudo leer el original: %w", err)
+	}
+	file := storage.MezzanineFile(content, contentType)
+	if err := h.bucket.UploadBatch(ctx, storage.MezzanineFolder(songID), []storage.UploadFile{file}); err != nil {
+		return nil, fmt.Errorf("no se pudo guardar el original: %w", err)
+	}
+	return h.describeSource(ctx, audioPath, content, file.ContentType), nil
+}
+
+// describeSource calcula el hash del original y, si el transcodificador lo
+// permite, sus datos de ffprobe. Un fallo de ffprobe solo se registra: el
+// original ya se transcodificó, así que es legible.
+func (h *SongHandler) describeSource(ctx context.Context, audioPath string, content []byte, contentType string) *storage.SongSource {
+	sum := sha256.Sum256(content)
+	source := &storage.SongSource{
+		SHA256:      hex.EncodeToString(sum[:]),
+		Size:        int64(len(content)),
+		ContentType: contentType,
+	}
+	prober, ok := h.transcoder.(sourceProber)
+	if !ok {
+		return source
+	}
+	info, err := prober.Probe(ctx, audioPath)
+	if err != nil {
+		logging.FromContext(ctx).Warn("source probe failed", "error", err)
+		return source
+	}
+	source.Format = info.Format
+	source.Codec = info.Codec
+	source.SampleRate = info.SampleRate
+	source.Channels = info.Channels
+	source.BitrateKbps = info.BitrateKbps
+	source.Duration = info.Duration
+	return source
+}
+
+// discardFolder elimina una carpeta subida a medias. Usa un contexto propio
+// porque suele llamarse cuando el de la petición ya fue cancelado (cliente
+// desconectado o apagado del servidor).
+func (h *SongHandler) discardFolder(ctx context.Context, folder string) {
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), cleanupTimeout)
+	defer cancel()
+	if err := h.bucket.DeletePrefix(ctx, folder); err != nil {
+		logging.FromContext(ctx).Error("partial upload cleanup failed", "folder", folder, "error", err)
+	}
+}
+
+func observeSongOperation(c *gin.Context, operation string) {
+	metrics.SongOperation(operation, c.Writer.Status())
+}
+
 func writeError(c *gin.Context, status int, err error) {
+	_ = c.Error(err)
 	c.JSON(status, gin.H{"error": err.Error()})
 }
 
@@ -408,6 +656,17 @@ func slugify(input string) string {
 	return slug
 }
 
+// songFolder es el slug del nombre con un sufijo de tiempo. Cada subida y
+// re-transcodificación estrena carpeta, así que un segmento nunca cambia bajo
+// la misma URL y puede servirse como immutable.
+func songFolder(name string) string {
+	slug := slugify(name)
+	if slug == "" {
+		slug = "song"
+	}
+	return slug + "-r" + strconv.FormatInt(time.Now().UnixNano(), 36)
+}
+
 func (h *SongHandler) folderFromBucketPath(bucketPath string) string {
 	if bucketPath == "" {
 		return ""
@@ -6,12 +6,15 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"io"
 	"mime/multipart"
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"path"
 	"path/filepath"
+	"strings"
 	"testing"
 
 	"github.com/gin-gonic/gin"
@@ -71,7 +74,7 @@ func TestSongHandlerCreate(t *testing.T) {
 	if len(bucket.uploads) == 0 {
 		t.Fatalf("expected upload call")
 	}
-	if bucket.uploads[0].prefix != "my-song" {
+	if !strings.HasPrefix(bucket.uploads[0].prefix, "my-song-r") {
 		t.Errorf("unexpected prefix: %s", bucket.uploads[0].prefix)
 	}
 
@@ -79,12 +82,123 @@ func TestSongHandlerCreate(t *testing.T) {
 	if !ok {
 		t.Fatalf("song not persisted")
 	}
-	if song.BucketFolder != "my-song" {
+	if song.BucketFolder != bucket.uploads[0].prefix {
 		t.Errorf("bucket folder unexpected: %s", song.BucketFolder)
 	}
 	if song.Duration == 0 {
 		t.Errorf("duration not populated")
 	}
+
+	// Otra canción con el mismo nombre no puede reutilizar las URLs de los
+	// segmentos, que se sirven como immutable.
+	code, resp = performMultipartRequest(t, handler.Create, http.MethodPost, "/songs", "/songs", fields, "file", "audio.wav", data)
+	if code != http.StatusCreated {
+		t.Fatalf("expected status 201, got %d body=%s", code, resp)
+	}
+	if len(bucket.uploads) != 2 || bucket.uploads[1].prefix == bucket.uploads[0].prefix {
+		t.Fatalf("expected a fresh folder per upload, got %#v", bucket.uploads)
+	}
+}
+
+func TestSongHandlerCreateEncrypted(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	store := newFakeStore()
+	bucket := &fakeBucket{}
+	keys := &fakeSongKeys{keys: map[string]storage.SongKey{}}
+	paths := ffmpegstub.Build(t)
+
+	if _, err := NewSongHandler(store, bucket, SongHandlerConfig{Encrypt: true}); err == nil {
+		t.Fatalf("expected encryption without key store to fail")
+	}
+
+	handler, err := NewSongHandler(store, bucket, SongHandlerConfig{
+		FFmpegBin:  paths.FFmpeg,
+		FFProbeBin: paths.FFProbe,
+		Keys:       keys,
+		Encrypt:    true,
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	code, resp := performMultipartRequest(t, handler.Create, http.MethodPost, "/songs", "/songs", map[string]string{"name": "Secret"}, "file", "audio.wav", []byte("audio"))
+	if code != http.StatusCreated {
+		t.Fatalf("expected status 201, got %d body=%s", code, resp)
+	}
+	var created storage.Song
+	if err := json.Unmarshal([]byte(resp), &created); err != nil {
+		t.Fatalf("invalid response json: %v", err)
+	}
+
+	key, ok := keys.keys[created.ID]
+	if !ok || len(key.Key) != 32 || len(key.IV) != 32 {
+		t.Fatalf("expected hex key stored for %s, got %+v", created.ID, keys.keys)
+	}
+	for _, file := range bucket.uploads[0].files {
+		if filepath.Ext(file.Path) == ".m3u8" && file.Path != "master.m3u8" && !bytes.Contains(file.Content, []byte("#EXT-X-KEY:METHOD=AES-128")) {
+			t.Errorf("variant %s not encrypted", file.Path)
+		}
+	}
+
+	code, _ = performRequest(handler.Delete, http.MethodDelete, "/songs/:id", "/songs/"+created.ID, nil)
+	if code != http.StatusNoContent {
+		t.Fatalf("expected 204 on delete, got %d", code)
+	}
+	if _, ok := keys.keys[created.ID]; ok {
+		t.Fatalf("expected key to be removed with the song")
+	}
+}
+
+func TestSongHandlerCreateKeepsSource(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	store := newFakeStore()
+	bucket := &fakeBucket{}
+	paths := ffmpegstub.Build(t)
+
+	handler, err := NewSongHandler(store, bucket, SongHandlerConfig{
+		FFmpegBin:  paths.FFmpeg,
+		FFProbeBin: paths.FFProbe,
+		KeepSource: true,
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	fields := map[string]string{"name": "My Song"}
+	code, resp := performMultipartRequest(t, handler.Create, http.MethodPost, "/songs", "/songs", fields, "file", "audio.wav", []byte("original audio"))
+	if code != http.StatusCreated {
+		t.Fatalf("expected status 201, got %d body=%s", code, resp)
+	}
+	var created storage.Song
+	_ = json.Unmarshal([]byte(resp), &created)
+
+	if len(bucket.uploads) != 2 {
+		t.Fatalf("expected assets and source uploads, got %d", len(bucket.uploads))
+	}
+	source := bucket.uploads[1]
+	if source.prefix != storage.MezzanineFolder(created.ID) || len(source.files) != 1 {
+		t.Fatalf("unexpected source upload %+v", source)
+	}
+	if string(source.files[0].Content) != "original audio" || path.Join(source.prefix, source.files[0].Path) != storage.MezzaninePath(created.ID) {
+		t.Fatalf("unexpected source file %s", source.files[0].Path)
+	}
+	// sha256("original audio") y los datos que imprime el ffprobe de prueba.
+	want := storage.SongSource{
+		SHA256:      "47b40ddea3cd0084961d752c82290f1ed224182f3ababea02d1cf6dfca6d04e1",
+		Size:        int64(len("original audio")),
+		ContentType: "application/octet-stream",
+		Format:      "wav",
+		Codec:       "pcm_s16le",
+		SampleRate:  44100,
+		Channels:    2,
+		BitrateKbps: 1411,
+		Duration:    120,
+	}
+	if got := store.songs[created.ID].Source; got == nil || *got != want {
+		t.Fatalf("unexpected source metadata %+v", got)
+	}
 }
 
 func TestSongHandlerUpdateRegeneratesAssets(t *testing.T) {
@@ -92,10 +206,10 @@ func TestSongHandlerUpdateRegeneratesAssets(t *testing.T) {
 
 	store := newFakeStore()
 	store.songs["song-1"] = storage.Song{
-		ID:              "song-1",
-		Name:            "Old Song",
-		Duration: 200,
-		BucketFolder:    "old-song",
+		ID:           "song-1",
+		Name:         "Old Song",
+		Duration:     200,
+		BucketFolder: "old-song",
 	}
 
 	bucket := &fakeBucket{}
@@ -144,7 +258,7 @@ func TestSongHandlerUpdateRegeneratesAssets(t *testing.T) {
 	if updated.Name != "New Song" {
 		t.Errorf("unexpected name: %s", updated.Name)
 	}
-	if updated.BucketFolder != "new-song" {
+	if !strings.HasPrefix(updated.BucketFolder, "new-song-r") {
 		t.Errorf("bucket folder not updated: %s", updated.BucketFolder)
 	}
 	if updated.Duration == existingBefore.Duration {
@@ -152,6 +266,35 @@ func TestSongHandlerUpdateRegeneratesAssets(t *testing.T) {
 	}
 }
 
+func TestSongHandlerUpdateRestoresKeyOnFailure(t *testing.T) {
+	handler, store, bucket, keys := newRetranscodeHandler(t)
+	previous := storage.SongKey{SongID: "song-1", Key: "old-key", IV: "old-iv"}
+	keys.keys["song-1"] = previous
+	store.upsertErr = errors.New("catalog down")
+
+	fields := map[string]string{"name": "New Song"}
+	code, _ := performMultipartRequest(t, handler.Update, http.MethodPut, "/songs/:id", "/songs/song-1", fields, "file", "audio.wav", []byte("audio"))
+	if code != http.StatusInternalServerError {
+		t.Fatalf("expected status 500, got %d", code)
+	}
+	if got := keys.keys["song-1"]; got != previous {
+		t.Fatalf("expected the key of the current folder to be restored, got %+v", got)
+	}
+	if store.songs["song-1"].BucketFolder != "old-song" {
+		t.Fatalf("expected the song to keep its folder, got %q", store.songs["song-1"].BucketFolder)
+	}
+	if len(bucket.deletes) != 1 || !strings.HasPrefix(bucket.deletes[0], "new-song-r") {
+		t.Fatalf("expected only the new folder to be discarded, got %#v", bucket.deletes)
+	}
+
+	// Sin clave previa, el fallo no deja ninguna.
+	delete(keys.keys, "song-1")
+	performMultipartRequest(t, handler.Update, http.MethodPut, "/songs/:id", "/songs/song-1", fields, "file", "audio.wav", []byte("audio"))
+	if _, ok := keys.keys["song-1"]; ok {
+		t.Fatalf("expected no key to be left behind, got %+v", keys.keys["song-1"])
+	}
+}
+
 func TestSongHandlerDelete(t *testing.T) {
 	gin.SetMode(gin.TestMode)
 
@@ -179,20 +322,52 @@ func TestSongHandlerDelete(t *testing.T) {
 		t.Fatalf("expected status 204, got %d body=%s", code, resp)
 	}
 
-	if len(bucket.deletes) != 1 || bucket.deletes[0] != "song" {
-		t.Fatalf("expected delete call, got %#v", bucket.deletes)
+	if len(bucket.deletes) != 2 || bucket.deletes[0] != "song" || bucket.deletes[1] != storage.MezzanineFolder("song-1") {
+		t.Fatalf("expected song and mezzanine deletes, got %#v", bucket.deletes)
 	}
 	if _, exists := store.songs["song-1"]; exists {
 		t.Fatalf("song should be removed from store")
 	}
 }
 
+func TestSongHandlerCreateCleansUpFailedUpload(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	store := newFakeStore()
+	bucket := &fakeBucket{uploadErr: errors.New("connection reset")}
+	paths := ffmpegstub.Build(t)
+
+	handler, err := NewSongHandler(store, bucket, SongHandlerConfig{
+		BucketBaseURL:  "https://example.com/storage",
+		FFmpegBin:      paths.FFmpeg,
+		FFProbeBin:     paths.FFProbe,
+		SegmentSeconds: 4,
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	fields := map[string]string{"name": "My Song"}
+	code, _ := performMultipartRequest(t, handler.Create, http.MethodPost, "/songs", "/songs", fields, "file", "audio.wav", []byte("audio"))
+
+	if code != http.StatusBadGateway {
+		t.Fatalf("expected status 502, got %d", code)
+	}
+	if len(bucket.deletes) != 1 || !strings.HasPrefix(bucket.deletes[0], "my-song-r") {
+		t.Fatalf("expected partial folder cleanup, got %#v", bucket.deletes)
+	}
+	if len(store.songs) != 0 {
+		t.Fatalf("song should not be persisted")
+	}
+}
+
 // Helpers
 
 type fakeStore struct {
-	songs   map[string]storage.Song
-	upserts []storage.Song
-	lists   int
+	songs     map[string]storage.Song
+	upserts   []storage.Song
+	lists     int
+	upsertErr error
 }
 
 func newFakeStore() *fakeStore {
@@ -202,6 +377,9 @@ func newFakeStore() *fakeStore {
 }
 
 func (f *fakeStore) UpsertSong(_ context.Context, song storage.Song) error {
+	if f.upsertErr != nil {
+		return f.upsertErr
+	}
 	f.songs[song.ID] = song
 	f.upserts = append(f.upserts, song)
 	return nil
@@ -232,15 +410,50 @@ func (f *fakeStore) DeleteSong(_ context.Context, id string) error {
 	return nil
 }
 
+type fakeSongKeys struct {
+	keys map[string]storage.SongKey
+}
+
+func (f *fakeSongKeys) UpsertSongKey(_ context.Context, key storage.SongKey) error {
+	f.keys[key.SongID] = key
+	return nil
+}
+
+func (f *fakeSongKeys) GetSongKey(_ context.Context, songID string) (storage.SongKey, error) {
+	key, ok := f.keys[songID]
+	if !ok {
+		return storage.SongKey{}, storage.ErrNotFound
+	}
+	return key, nil
+}
+
+func (f *fakeSongKeys) DeleteSongKey(_ context.Context, songID string) error {
+	delete(f.keys, songID)
+	return nil
+}
+
 type fakeBucket struct {
 	uploads []struct {
 		prefix string
 		files  []storage.UploadFile
 	}
-	deletes []string
+	deletes   []string
+	uploadErr error
+	objects   map[string][]byte
+}
+
+func (b *fakeBucket) DownloadFile(_ context.Context, objectPath string) ([]byte, error) {
+	data, ok := b.objects[objectPath]
+	if !ok {
+		return nil, storage.ErrNotFound
+	}
+	return data, nil
 }
 
 func (b *fakeBucket) UploadBatch(_ context.Context, prefix string, files []storage.UploadFile) error {
+	if b.uploadErr != nil {
+		return b.uploadErr
+	}
 	b.uploads = append(b.uploads, struct {
 		prefix string
 		files  []storage.UploadFile
@@ -294,6 +507,15 @@ func performMultipartRequest(t *testing.T, handler gin.HandlerFunc, method, rout
 	return result.StatusCode, string(payload)
 }
 
+func TestSlugifyNeverReachesMezzanine(t *testing.T) {
+	for _, name := range []string{"Mezzanine", "_mezzanine", "__Mezzanine__", "_mezzanine/x", " mezzanine ", "_"} {
+		slug := slugify(name)
+		if slug == storage.MezzaninePrefix || strings.HasPrefix(slug, storage.MezzaninePrefix+"/") || strings.Contains(slug, "_") {
+			t.Fatalf("slug %q of %q collides with the mezzanine prefix", slug, name)
+		}
+	}
+}
+
 func performRequest(handler gin.HandlerFunc, method, route, path string, body any) (int, string) {
 	var payload []byte
 	if body != nil {
@@ -1,36 +1,241 @@
 package handlers
 
 import (
+	"GOtify/internal/metrics"
 	"GOtify/internal/security"
+	"GOtify/internal/storage"
+	"errors"
+	"fmt"
 	"net/http"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/gin-gonic/gin"
 )
 
+// TokenSigner firma URLs de reproducción; security.Signer lo implementa.
+type TokenSigner interface {
+	Issue(claims security.Claims) (string, error)
+}
+
+// TTLPolicy fija la vida por defecto y la máxima de un token.
+type TTLPolicy struct {
+	Default time.Duration
+	Max     time.Duration
+}
+
+// Modos de entrega del token en las URLs de /stream.
+const (
+	// TokenModeQuery añade ?t=&e= a la URL y a cada URI de las listas.
+	TokenModeQuery = "query"
+	// TokenModePath firma un prefijo de ruta: /stream/<token>/<exp>/<file>/...
+	TokenModePath = "path"
+	// TokenModeCookie canjea el token por una cookie de sesión al cargar la
+	// lista maestra.
+	TokenModeCookie = "cookie"
+)
+
+// TokenHandlerConfig parametriza las URLs devueltas por el handler.
+type TokenHandlerConfig struct {
+	// BasePath es el prefijo bajo el que está montado el router (p. ej. "/gotify").
+	BasePath string
+	// PublicURL es el origen público del servicio (p. ej. "https://cdn.example").
+	// Si está vacío se deriva de la petición.
+	PublicURL string
+	// TTL se aplica a los tokens sin audiencia o cuya audiencia no aparece en
+	// ScopeTTL. Por defecto 10 minutos con un máximo de 24 horas.
+	TTL      TTLPolicy
+	ScopeTTL map[string]TTLPolicy
+	// Mode es el modo de entrega por defecto (TokenModeQuery si está vacío);
+	// el parámetro mode de la petición lo sobrescribe.
+	Mode string
+}
+
 type TokenHandler struct {
-	signer *security.Signer
+	signer    TokenSigner
+	songs     songLoader
+	basePath  string
+	publicURL string
+	ttl       TTLPolicy
+	scopeTTL  map[string]TTLPolicy
+	mode      string
+	live      liveChannels
+}
+
+// liveChannels indica qué IDs son canales en directo en vez de canciones.
+type liveChannels interface {
+	Has(channel string) bool
+}
+
+func NewTokenHandler(signer TokenSigner, songs songLoader, cfg TokenHandlerConfig) *TokenHandler {
+	if cfg.TTL.Default <= 0 {
+		cfg.TTL.Default = 10 * time.Minute
+	}
+	if cfg.TTL.Max <= 0 {
+		cfg.TTL.Max = 24 * time.Hour
+	}
+	if cfg.Mode == "" {
+		cfg.Mode = TokenModeQuery
+	}
+	return &TokenHandler{
+		signer:    signer,
+		songs:     songs,
+		basePath:  strings.TrimRight(cfg.BasePath, "/"),
+		publicURL: strings.TrimRight(cfg.PublicURL, "/"),
+		ttl:       cfg.TTL,
+		scopeTTL:  cfg.ScopeTTL,
+		mode:      cfg.Mode,
+	}
 }
 
-func NewTokenHandler(secret []byte) *TokenHandler {
-	return &TokenHandler{signer: &security.Signer{Secret: secret}}
+// WithLive permite emitir tokens para los canales en directo de channels.
+func (h *TokenHandler) WithLive(channels liveChannels) *TokenHandler {
+	h.live = channels
+	return h
 }
 
+// Generate emite un token v2 para file_id, que debe existir en el catálogo o
+// ser un canal en directo.
+// Los parámetros opcionales variants (lista separada por comas), ip (IP o
+// CIDR), user, aud y max_bitrate (Kbps) restringen su alcance; ttl (minutos)
+// no puede superar el máximo de la audiencia. mode elige cómo viaja el token
+// (query, path o cookie).
 func (h *TokenHandler) Generate(c *gin.Context) {
 	file := c.Param("file_id")
 
-	ttl := 10 * time.Minute
+	claims, err := claimsFromQuery(c)
+	if err != nil {
+		writeError(c, http.StatusBadRequest, err)
+		return
+	}
+	mode := c.DefaultQuery("mode", h.mode)
+	switch mode {
+	case TokenModeQuery, TokenModePath:
+	case TokenModeCookie:
+		claims.Session = true
+	default:
+		writeError(c, http.StatusBadRequest, fmt.Errorf("mode invalido: %q", mode))
+		return
+	}
+
+	policy := h.policyFor(claims.Audience)
+	errTTLTooLong := fmt.Errorf("ttl supera el maximo de %d minutos", int(policy.Max/time.Minute))
+	ttl := policy.Default
 	if v := c.Query("ttl"); v != "" {
-		if n, err := strconv.Atoi(v); err == nil && n > 0 {
-			ttl = time.Duration(n) * time.Minute
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			writeError(c, http.StatusBadRequest, fmt.Errorf("ttl invalido: %q", v))
+			return
+		}
+		// Se compara en minutos: multiplicar un n enorme desbordaría la
+		// duración y la dejaría negativa.
+		if n > int(policy.Max/time.Minute) {
+			writeError(c, http.StatusBadRequest, errTTLTooLong)
+			return
+		}
+		ttl = time.Duration(n) * time.Minute
+	}
+	if ttl > policy.Max {
+		writeError(c, http.StatusBadRequest, errTTLTooLong)
+		return
+	}
+
+	isLive := h.live != nil && h.live.Has(file)
+	var song storage.Song
+	if isLive {
+		// Los canales en directo no están en el catálogo.
+		song = storage.Song{ID: file, Name: file}
+	} else if song, err = h.songs.GetSong(c.Request.Context(), file); err != nil {
+		status := http.StatusInternalServerError
+		if errors.Is(err, storage.ErrNotFound) {
+			status = http.StatusNotFound
+			err = fmt.Errorf("cancion no encontrada")
 		}
+		writeError(c, status, err)
+		return
+	}
+
+	claims.File = file
+	claims.Expires = time.Now().Add(ttl).Unix()
+	token, err := h.signer.Issue(claims)
+	if err != nil {
+		writeError(c, http.StatusInternalServerError, err)
+		return
 	}
+	metrics.TokenIssued()
 
-	token, exp := h.signer.Generate(file, ttl)
+	exp := strconv.FormatInt(claims.Expires, 10)
+	streamPath := h.basePath + "/stream/" + file
+	query := "?t=" + token + "&e=" + exp
+	if mode == TokenModePath {
+		streamPath = h.basePath + "/stream/" + token + "/" + exp + "/" + file
+		query = ""
+	}
 	c.JSON(http.StatusOK, gin.H{
-		"file_id":    file,
-		"expires": exp,
-		"url":     "/stream/" + file + "?t=" + token + "&e=" + strconv.FormatInt(exp, 10),
+		"file_id":      file,
+		"expires":      claims.Expires,
+		"mode":         mode,
+		"url":          streamPath + query,
+		"playback_url": h.origin(c) + streamPath + "/master.m3u8" + query,
+		"live":         isLive,
+		"song": gin.H{
+			"id":               song.ID,
+			"name":             song.Name,
+			"duration_seconds": song.Duration,
+		},
 	})
 }
+
+func (h *TokenHandler) policyFor(audience string) TTLPolicy {
+	if p, ok := h.scopeTTL[audience]; ok && audience != "" {
+		if p.Default <= 0 {
+			p.Default = h.ttl.Default
+		}
+		if p.Max <= 0 {
+			p.Max = h.ttl.Max
+		}
+		return p
+	}
+	return h.ttl
+}
+
+// origin devuelve el esquema y host públicos con los que construir URLs
+// absolutas.
+func (h *TokenHandler) origin(c *gin.Context) string {
+	if h.publicURL != "" {
+		return h.publicURL
+	}
+	scheme := "http"
+	if c.Request.TLS != nil {
+		scheme = "https"
+	}
+	return scheme + "://" + c.Request.Host
+}
+
+func claimsFromQuery(c *gin.Context) (security.Claims, error) {
+	var claims security.Claims
+	if v := c.Query("variants"); v != "" {
+		for _, name := range strings.Split(v, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				claims.Variants = append(claims.Variants, name)
+			}
+		}
+	}
+	if v := strings.TrimSpace(c.Query("ip")); v != "" {
+		if _, err := security.ParseClientScope(v); err != nil {
+			return claims, fmt.Errorf("ip invalida: %q", v)
+		}
+		claims.ClientIP = v
+	}
+	if v := c.Query("max_bitrate"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			return claims, fmt.Errorf("max_bitrate invalido: %q", v)
+		}
+		claims.MaxBitrateKbps = n
+	}
+	claims.User = strings.TrimSpace(c.Query("user"))
+	claims.Audience = strings.TrimSpace(c.Query("aud"))
+	return claims, nil
+}
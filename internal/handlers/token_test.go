@@ -2,11 +2,13 @@ package handlers
 
 import (
 	"GOtify/internal/security"
+	"GOtify/internal/storage"
 	"encoding/json"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
 	"strconv"
+	"strings"
 	"testing"
 	"time"
 
@@ -23,7 +25,7 @@ func TestTokenHandlerGenerateDefaultTTL(t *testing.T) {
 	gin.SetMode(gin.TestMode)
 
 	secret := []byte("super-secret")
-	handler := NewTokenHandler(secret)
+	handler := NewTokenHandler(&security.Signer{Secret: secret}, trackStore(), TokenHandlerConfig{})
 
 	router := gin.New()
 	router.GET("/token/:file_id", handler.Generate)
@@ -56,7 +58,7 @@ func TestTokenHandlerGenerateCustomTTL(t *testing.T) {
 	gin.SetMode(gin.TestMode)
 
 	secret := []byte("super-secret")
-	handler := NewTokenHandler(secret)
+	handler := NewTokenHandler(&security.Signer{Secret: secret}, trackStore(), TokenHandlerConfig{})
 
 	router := gin.New()
 	router.GET("/token/:file_id", handler.Generate)
@@ -81,6 +83,217 @@ func TestTokenHandlerGenerateCustomTTL(t *testing.T) {
 	assertURLMatchesToken(t, body, secret)
 }
 
+func TestTokenHandlerGenerateTTLLimits(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	handler := NewTokenHandler(&security.Signer{Secret: []byte("s")}, trackStore(), TokenHandlerConfig{
+		TTL:      TTLPolicy{Default: 5 * time.Minute, Max: time.Hour},
+		ScopeTTL: map[string]TTLPolicy{"tv": {Default: 2 * time.Hour, Max: 4 * time.Hour}},
+	})
+	router := gin.New()
+	router.GET("/token/:file_id", handler.Generate)
+
+	cases := []struct {
+		query  string
+		status int
+		ttl    time.Duration
+	}{
+		{"", http.StatusOK, 5 * time.Minute},
+		{"ttl=60", http.StatusOK, time.Hour},
+		{"ttl=61", http.StatusBadRequest, 0},
+		{"ttl=525600", http.StatusBadRequest, 0},
+		{"ttl=153722867280912931", http.StatusBadRequest, 0},
+		{"ttl=9223372036854775807", http.StatusBadRequest, 0},
+		{"ttl=abc", http.StatusBadRequest, 0},
+		{"aud=tv", http.StatusOK, 2 * time.Hour},
+		{"aud=tv&ttl=240", http.StatusOK, 4 * time.Hour},
+		{"aud=tv&ttl=241", http.StatusBadRequest, 0},
+		{"aud=web&ttl=61", http.StatusBadRequest, 0},
+	}
+	for _, tc := range cases {
+		rec := httptest.NewRecorder()
+		before := time.Now()
+		router.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/token/track?"+tc.query, nil))
+		if rec.Code != tc.status {
+			t.Fatalf("%q: expected %d, got %d: %s", tc.query, tc.status, rec.Code, rec.Body.String())
+		}
+		if tc.status != http.StatusOK {
+			continue
+		}
+		var body tokenResponse
+		_ = json.Unmarshal(rec.Body.Bytes(), &body)
+		assertExpiryInRange(t, body.Expires, before.Add(tc.ttl-time.Second), time.Now().Add(tc.ttl+time.Second))
+	}
+}
+
+func TestTokenHandlerGenerateUnknownSong(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	router := gin.New()
+	router.GET("/token/:file_id", NewTokenHandler(&security.Signer{Secret: []byte("s")}, trackStore(), TokenHandlerConfig{}).Generate)
+
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/token/missing", nil))
+	if rec.Code != http.StatusNotFound {
+		t.Fatalf("expected 404 for unknown song, got %d", rec.Code)
+	}
+}
+
+func TestTokenHandlerGeneratePlaybackURLAndMetadata(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	for _, tc := range []struct {
+		cfg  TokenHandlerConfig
+		want string
+	}{
+		{TokenHandlerConfig{}, "http://example.com/stream/track/master.m3u8"},
+		{TokenHandlerConfig{PublicURL: "https://cdn.example/", BasePath: "/gotify"}, "https://cdn.example/gotify/stream/track/master.m3u8"},
+	} {
+		router := gin.New()
+		router.GET("/token/:file_id", NewTokenHandler(&security.Signer{Secret: []byte("s")}, trackStore(), tc.cfg).Generate)
+
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/token/track", nil))
+
+		var body struct {
+			PlaybackURL string `json:"playback_url"`
+			Song        struct {
+				ID       string `json:"id"`
+				Name     string `json:"name"`
+				Duration int32  `json:"duration_seconds"`
+			} `json:"song"`
+		}
+		if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+			t.Fatalf("failed to decode response: %v", err)
+		}
+		parsed, err := url.Parse(body.PlaybackURL)
+		if err != nil {
+			t.Fatalf("failed to parse playback url %q: %v", body.PlaybackURL, err)
+		}
+		if got := parsed.Scheme + "://" + parsed.Host + parsed.Path; got != tc.want {
+			t.Fatalf("expected playback url %q, got %q", tc.want, got)
+		}
+		if parsed.Query().Get("t") == "" {
+			t.Fatal("expected playback url to carry the token")
+		}
+		if body.Song.ID != "track" || body.Song.Name != "Track" || body.Song.Duration != 180 {
+			t.Fatalf("unexpected song metadata %+v", body.Song)
+		}
+	}
+}
+
+func trackStore() *fakeSongStore {
+	return &fakeSongStore{songs: map[string]storage.Song{
+		"track": {ID: "track", Name: "Track", Duration: 180, BucketFolder: "track"},
+	}}
+}
+
+func TestTokenHandlerGenerateWithBasePath(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	handler := NewTokenHandler(&security.Signer{Secret: []byte("super-secret")}, trackStore(), TokenHandlerConfig{BasePath: "/gotify/"})
+
+	router := gin.New()
+	router.GET("/token/:file_id", handler.Generate)
+
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/token/track", nil))
+
+	var body tokenResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+		t.Fatalf("failed to decode response: %v", err)
+	}
+	parsed, err := url.Parse(body.URL)
+	if err != nil {
+		t.Fatalf("failed to parse url %q: %v", body.URL, err)
+	}
+	if parsed.Path != "/gotify/stream/track" {
+		t.Fatalf("expected prefixed stream path, got %q", parsed.Path)
+	}
+}
+
+func TestTokenHandlerGenerateScopedClaims(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	signer := &security.Signer{Secret: []byte("super-secret")}
+	router := gin.New()
+	router.GET("/token/:file_id", NewTokenHandler(signer, trackStore(), TokenHandlerConfig{}).Generate)
+
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/token/track?variants=64k,+128k&ip=10.0.0.0/8&user=u1&aud=web&max_bitrate=128", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+
+	var body tokenResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+		t.Fatalf("failed to decode response: %v", err)
+	}
+	parsed, _ := url.Parse(body.URL)
+	claims, err := signer.ParseClaims(parsed.Query().Get("t"))
+	if err != nil {
+		t.Fatalf("ParseClaims: %v", err)
+	}
+	if len(claims.Variants) != 2 || claims.Variants[1] != "128k" {
+		t.Fatalf("unexpected variants %v", claims.Variants)
+	}
+	if claims.ClientIP != "10.0.0.0/8" || claims.User != "u1" || claims.Audience != "web" || claims.MaxBitrateKbps != 128 {
+		t.Fatalf("unexpected claims %+v", claims)
+	}
+}
+
+func TestTokenHandlerGenerateRejectsInvalidClaims(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	router := gin.New()
+	router.GET("/token/:file_id", NewTokenHandler(&security.Signer{Secret: []byte("s")}, trackStore(), TokenHandlerConfig{}).Generate)
+
+	for _, query := range []string{"ip=not-an-ip", "max_bitrate=-1", "max_bitrate=abc"} {
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/token/track?"+query, nil))
+		if rec.Code != http.StatusBadRequest {
+			t.Fatalf("%s: expected 400, got %d", query, rec.Code)
+		}
+	}
+}
+
+func TestTokenHandlerGenerateModes(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	signer := &security.Signer{Secret: []byte("s")}
+	router := gin.New()
+	router.GET("/token/:file_id", NewTokenHandler(signer, trackStore(), TokenHandlerConfig{BasePath: "/gotify"}).Generate)
+
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/token/track?mode=path", nil))
+	var body tokenResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+		t.Fatalf("failed to decode response: %v", err)
+	}
+	parts := strings.Split(body.URL, "/")
+	if len(parts) != 6 || parts[2] != "stream" || parts[4] != strconv.FormatInt(body.Expires, 10) || parts[5] != "track" {
+		t.Fatalf("unexpected path url %q", body.URL)
+	}
+	if claims, err := signer.ParseClaims(parts[3]); err != nil || claims.File != "track" {
+		t.Fatalf("path token does not validate: %v", err)
+	}
+
+	rec = httptest.NewRecorder()
+	router.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/token/track?mode=cookie", nil))
+	_ = json.Unmarshal(rec.Body.Bytes(), &body)
+	parsed, _ := url.Parse(body.URL)
+	claims, err := signer.ParseClaims(parsed.Query().Get("t"))
+	if err != nil || !claims.Session {
+		t.Fatalf("expected cookie mode to request a session, got %+v (%v)", claims, err)
+	}
+
+	rec = httptest.NewRecorder()
+	router.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/token/track?mode=header", nil))
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400 for unknown mode, got %d", rec.Code)
+	}
+}
+
 func assertExpiryInRange(t *testing.T, exp int64, min time.Time, max time.Time) {
 	t.Helper()
 
@@ -109,13 +322,12 @@ func assertURLMatchesToken(t *testing.T, body tokenResponse, secret []byte) {
 		t.Fatalf("expected expires string %s, got %s", strconv.FormatInt(body.Expires, 10), expiresStr)
 	}
 
-	exp, err := strconv.ParseInt(expiresStr, 10, 64)
+	s := &security.Signer{Secret: secret}
+	claims, err := s.ParseClaims(token)
 	if err != nil {
-		t.Fatalf("failed to parse expires %q: %v", expiresStr, err)
+		t.Fatalf("token in URL does not validate: %v", err)
 	}
-
-	s := &security.Signer{Secret: secret}
-	if !s.Validate(body.FileID, token, exp) {
-		t.Fatal("token in URL does not validate")
+	if claims.File != body.FileID || claims.Expires != body.Expires {
+		t.Fatalf("unexpected claims %+v", claims)
 	}
 }
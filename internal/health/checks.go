@@ -0,0 +1,72 @@
+package health
+
+import (
+	"GOtify/internal/transcode"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+)
+
+var errFreeSpaceUnsupported = errors.New("free space check unsupported on this platform")
+
+// Pinger es cualquier dependencia capaz de comprobar su conectividad.
+type Pinger interface {
+	Ping(ctx context.Context) error
+}
+
+// PingCheck comprueba una dependencia remota (catálogo, bucket).
+func PingCheck(name string, p Pinger) Check {
+	return Check{
+		Name: name,
+		Run: func(ctx context.Context) (string, error) {
+			if p == nil {
+				return "", errors.New("not configured")
+			}
+			return "", p.Ping(ctx)
+		},
+	}
+}
+
+// BinaryCheck verifica que el binario exista y reporta su versión.
+func BinaryCheck(name, bin string) Check {
+	return Check{
+		Name: name,
+		Run: func(ctx context.Context) (string, error) {
+			return transcode.Version(ctx, bin)
+		},
+	}
+}
+
+// TempDirCheck comprueba que el directorio temporal usado por las subidas y
+// ffmpeg sea escribible y tenga al menos minFreeBytes disponibles.
+func TempDirCheck(dir string, minFreeBytes uint64) Check {
+	return Check{
+		Name: "temp_dir",
+		Run: func(context.Context) (string, error) {
+			if dir == "" {
+				dir = os.TempDir()
+			}
+			probe, err := os.CreateTemp(dir, "gotify-readyz-*")
+			if err != nil {
+				return "", fmt.Errorf("temp dir not writable: %w", err)
+			}
+			name := probe.Name()
+			probe.Close()
+			_ = os.Remove(name)
+
+			free, err := freeBytes(dir)
+			if errors.Is(err, errFreeSpaceUnsupported) {
+				return fmt.Sprintf("%s writable", dir), nil
+			}
+			if err != nil {
+				return "", err
+			}
+			detail := fmt.Sprintf("%s: %d MiB free", dir, free>>20)
+			if free < minFreeBytes {
+				return detail, fmt.Errorf("less than %d MiB free", minFreeBytes>>20)
+			}
+			return detail, nil
+		},
+	}
+}
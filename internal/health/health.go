@@ -0,0 +1,149 @@
+package health
+
+import (
+	"GOtify/internal/logging"
+	"context"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Check es una comprobación de readiness. Detail (por ejemplo la versión de
+// ffmpeg) solo aparece en el informe detallado, tanto si pasa como si no.
+type Check struct {
+	Name string
+	Run  func(ctx context.Context) (detail string, err error)
+}
+
+// Result es el estado de una comprobación individual.
+type Result struct {
+	Status     string `json:"status"`
+	Detail     string `json:"detail,omitempty"`
+	Error      string `json:"error,omitempty"`
+	DurationMS int64  `json:"duration_ms"`
+}
+
+// Report es la respuesta de /readyz.
+type Report struct {
+	Status string            `json:"status"`
+	Checks map[string]Result `json:"checks"`
+}
+
+const (
+	statusOK   = "ok"
+	statusFail = "fail"
+)
+
+// Checker ejecuta las comprobaciones de readiness en paralelo.
+type Checker struct {
+	checks  []Check
+	timeout time.Duration
+
+	// mu serializa las ejecuciones: las peticiones que llegan durante una
+	// esperan su resultado en vez de lanzar otra.
+	mu       sync.Mutex
+	cacheTTL time.Duration
+	last     Report
+	lastAt   time.Time
+}
+
+// NewChecker construye un Checker; timeout limita cada ejecución completa.
+func NewChecker(timeout time.Duration, checks ...Check) *Checker {
+	if timeout <= 0 {
+		timeout = 5 * time.Second
+	}
+	return &Checker{checks: checks, timeout: timeout}
+}
+
+// WithCache reutiliza el último informe durante ttl, para que sondear /readyz
+// no golpee el catálogo, el bucket y ffmpeg en cada petición.
+func (c *Checker) WithCache(ttl time.Duration) *Checker {
+	c.cacheTTL = ttl
+	return c
+}
+
+// Report devuelve el último informe si sigue vigente o ejecuta las
+// comprobaciones. Los fallos nuevos se registran en el log.
+func (c *Checker) Report(ctx context.Context) Report {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.cacheTTL > 0 && !c.lastAt.IsZero() && time.Since(c.lastAt) < c.cacheTTL {
+		return c.last
+	}
+	// El informe se comparte: no debe fallar porque se cancele la petición
+	// que lo lanzó.
+	report := c.Run(context.WithoutCancel(ctx))
+	for name, result := range report.Checks {
+		if result.Status != statusOK {
+			logging.FromContext(ctx).Warn("readiness check failed", "check", name, "error", result.Error)
+		}
+	}
+	c.last, c.lastAt = report, time.Now()
+	return report
+}
+
+// Run ejecuta todas las comprobaciones y agrega el resultado.
+func (c *Checker) Run(ctx context.Context) Report {
+	ctx, cancel := context.WithTimeout(ctx, c.timeout)
+	defer cancel()
+
+	report := Report{Status: statusOK, Checks: make(map[string]Result, len(c.checks))}
+	var (
+		mu sync.Mutex
+		wg sync.WaitGroup
+	)
+	for _, check := range c.checks {
+		wg.Add(1)
+		go func(check Check) {
+			defer wg.Done()
+			start := time.Now()
+			detail, err := check.Run(ctx)
+			result := Result{
+				Status:     statusOK,
+				Detail:     detail,
+				DurationMS: time.Since(start).Milliseconds(),
+			}
+			if err != nil {
+				result.Status = statusFail
+				result.Error = err.Error()
+			}
+
+			mu.Lock()
+			defer mu.Unlock()
+			report.Checks[check.Name] = result
+			if err != nil {
+				report.Status = statusFail
+			}
+		}(check)
+	}
+	wg.Wait()
+	return report
+}
+
+// Live responde siempre 200 mientras el proceso pueda atender peticiones.
+func Live(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"status": statusOK})
+}
+
+// Ready responde 200 si todas las comprobaciones pasan y 503 en caso
+// contrario. Es pública, así que solo indica el estado: errores y versiones
+// quedan para Details.
+func (c *Checker) Ready(ctx *gin.Context) {
+	report := c.Report(ctx.Request.Context())
+	ctx.JSON(report.httpStatus(), gin.H{"status": report.Status})
+}
+
+// Details responde como Ready con el resultado de cada comprobación.
+func (c *Checker) Details(ctx *gin.Context) {
+	report := c.Report(ctx.Request.Context())
+	ctx.JSON(report.httpStatus(), report)
+}
+
+func (r Report) httpStatus() int {
+	if r.Status != statusOK {
+		return http.StatusServiceUnavailable
+	}
+	return http.StatusOK
+}
@@ -0,0 +1,148 @@
+package health
+
+import (
+	"GOtify/internal/testutil/ffmpegstub"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+type fakePinger struct {
+	err error
+}
+
+func (f fakePinger) Ping(context.Context) error {
+	return f.err
+}
+
+func TestReadyReportsEveryCheck(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	checker := NewChecker(time.Second,
+		PingCheck("catalog", fakePinger{}),
+		PingCheck("bucket", fakePinger{err: errors.New("connection refused")}),
+	)
+
+	router := gin.New()
+	router.GET("/readyz", checker.Ready)
+	router.GET("/admin/readyz", checker.Details)
+
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Fatalf("expected 503, got %d", rec.Code)
+	}
+	if body := strings.TrimSpace(rec.Body.String()); body != `{"status":"fail"}` {
+		t.Fatalf("expected only the status publicly, got %s", body)
+	}
+
+	rec = httptest.NewRecorder()
+	router.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/admin/readyz", nil))
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Fatalf("expected 503, got %d", rec.Code)
+	}
+	var report Report
+	if err := json.Unmarshal(rec.Body.Bytes(), &report); err != nil {
+		t.Fatalf("invalid json: %v", err)
+	}
+	if report.Status != statusFail {
+		t.Fatalf("expected fail status, got %s", report.Status)
+	}
+	if got := report.Checks["catalog"].Status; got != statusOK {
+		t.Fatalf("expected catalog ok, got %s", got)
+	}
+	bucket := report.Checks["bucket"]
+	if bucket.Status != statusFail || bucket.Error != "connection refused" {
+		t.Fatalf("unexpected bucket result: %#v", bucket)
+	}
+}
+
+func TestReadyAllHealthy(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	checker := NewChecker(time.Second, PingCheck("catalog", fakePinger{}))
+	router := gin.New()
+	router.GET("/readyz", checker.Ready)
+	router.GET("/livez", Live)
+
+	for _, path := range []string{"/readyz", "/livez"} {
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+		if rec.Code != http.StatusOK {
+			t.Fatalf("%s: expected 200, got %d", path, rec.Code)
+		}
+	}
+}
+
+func TestReportCached(t *testing.T) {
+	runs := 0
+	checker := NewChecker(time.Second, Check{
+		Name: "counter",
+		Run: func(context.Context) (string, error) {
+			runs++
+			return "", nil
+		},
+	}).WithCache(time.Hour)
+
+	for i := 0; i < 3; i++ {
+		checker.Report(context.Background())
+	}
+	if runs != 1 {
+		t.Fatalf("expected a single run within the TTL, got %d", runs)
+	}
+
+	checker.lastAt = time.Now().Add(-2 * time.Hour)
+	checker.Report(context.Background())
+	if runs != 2 {
+		t.Fatalf("expected a new run after the TTL, got %d", runs)
+	}
+}
+
+func TestReportIgnoresCancelledRequest(t *testing.T) {
+	checker := NewChecker(time.Second, Check{
+		Name: "ctx",
+		Run: func(ctx context.Context) (string, error) {
+			return "", ctx.Err()
+		},
+	}).WithCache(time.Hour)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if report := checker.Report(ctx); report.Status != statusOK {
+		t.Fatalf("a cancelled request must not poison the cached report: %#v", report)
+	}
+}
+
+func TestBinaryCheck(t *testing.T) {
+	paths := ffmpegstub.Build(t)
+
+	detail, err := BinaryCheck("ffmpeg", paths.FFmpeg).Run(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !strings.Contains(detail, "version") {
+		t.Fatalf("expected version detail, got %q", detail)
+	}
+
+	if _, err := BinaryCheck("ffmpeg", "gotify-missing-ffmpeg").Run(context.Background()); err == nil {
+		t.Fatalf("expected error for missing binary")
+	}
+}
+
+func TestTempDirCheck(t *testing.T) {
+	dir := t.TempDir()
+
+	if _, err := TempDirCheck(dir, 1).Run(context.Background()); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, err := TempDirCheck(dir, 1<<62).Run(context.Background()); err == nil {
+		t.Fatalf("expected error when free space requirement is not met")
+	}
+}
@@ -0,0 +1,301 @@
+// Package live segmenta emisiones en directo (radio) en listas HLS
+// deslizantes. Cada canal configurado admite una fuente a la vez; mientras
+// emite, su lista y sus segmentos se sirven desde disco bajo /stream como si
+// fuera una canción.
+package live
+
+import (
+	"GOtify/internal/logging"
+	"GOtify/internal/m3u8"
+	"GOtify/internal/metrics"
+	"GOtify/internal/transcode"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// ErrUnknownChannel indica un canal fuera de Config.Channels.
+var ErrUnknownChannel = errors.New("live: unknown channel")
+
+// ErrOffAir indica que el canal no tiene fuente ni emisión reciente.
+var ErrOffAir = errors.New("live: channel is off air")
+
+// ErrOnAir indica que el canal ya tiene una fuente conectada.
+var ErrOnAir = errors.New("live: channel already has a source")
+
+// ErrNotReady indica que la fuente está conectada pero aún no hay segmentos.
+var ErrNotReady = errors.New("live: no segments yet")
+
+// ErrNotFound indica una lista o segmento que no está en la ventana actual.
+var ErrNotFound = errors.New("live: not found")
+
+// Segmenter segmenta el audio de source en dir; transcode.FFmpeg lo
+// implementa.
+type Segmenter interface {
+	Live(ctx context.Context, source io.Reader, dir string, opts transcode.LiveOptions) error
+}
+
+// Config fija los canales y la forma de sus listas.
+type Config struct {
+	// Channels son los identificadores de canal; se usan en lugar del ID
+	// de canción en /token y /stream.
+	Channels       []string
+	BitrateKbps    int
+	SegmentSeconds int
+	// WindowSegments son los segmentos de la lista en directo.
+	WindowSegments int
+	// DVRWindow amplía la lista para poder retroceder ese tiempo.
+	DVRWindow time.Duration
+}
+
+// listSize son los segmentos que lista la playlist: la ventana en directo o
+// los que cubren DVRWindow si son más.
+func (c Config) listSize() int {
+	dvr := int(math.Ceil(c.DVRWindow.Seconds() / float64(c.SegmentSeconds)))
+	return max(c.WindowSegments, dvr)
+}
+
+const pollInterval = 100 * time.Millisecond
+
+// Manager reparte las fuentes entre canales y sirve sus listas.
+type Manager struct {
+	segmenter Segmenter
+	cfg       Config
+	variant   transcode.Variant
+	allowed   map[string]bool
+
+	mu       sync.Mutex
+	channels map[string]*broadcast
+	stop     chan struct{}
+	stopOnce sync.Once
+}
+
+// broadcast es una emisión de un canal. Tras desconectarse la fuente su
+// lista, ya cerrada con #EXT-X-ENDLIST, se sigue sirviendo una ventana más.
+type broadcast struct {
+	dir  string
+	done chan struct{}
+}
+
+// New crea el gestor con valores por defecto de 128 Kbps, segmentos de 4 s
+// y ventana de 6 segmentos.
+func New(segmenter Segmenter, cfg Config) *Manager {
+	if cfg.BitrateKbps <= 0 {
+		cfg.BitrateKbps = 128
+	}
+	if cfg.SegmentSeconds <= 0 {
+		cfg.SegmentSeconds = 4
+	}
+	if cfg.WindowSegments <= 0 {
+		cfg.WindowSegments = 6
+	}
+	allowed := make(map[string]bool, len(cfg.Channels))
+	for _, ch := range cfg.Channels {
+		allowed[ch] = true
+	}
+	return &Manager{
+		segmenter: segmenter,
+		cfg:       cfg,
+		variant:   transcode.Variant{Name: fmt.Sprintf("%dk", cfg.BitrateKbps), BitrateKbps: cfg.BitrateKbps},
+		allowed:   allowed,
+		channels:  make(map[string]*broadcast),
+		stop:      make(chan struct{}),
+	}
+}
+
+// Has indica si channel es un canal configurado, emita o no.
+func (m *Manager) Has(channel string) bool {
+	return m.allowed[channel]
+}
+
+// OnAir indica si channel tiene una fuente conectada.
+func (m *Manager) OnAir(channel string) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	b := m.channels[channel]
+	return b != nil && !b.ended()
+}
+
+// Variant es la única variante de los canales, nombrada por su tasa ("128k")
+// para que los tokens con variants o max_bitrate la cubran.
+func (m *Manager) Variant() transcode.Variant {
+	return m.variant
+}
+
+// Ingest segmenta source en el canal hasta que la fuente se desconecta, ctx
+// se cancela o el gestor se detiene. Solo admite una fuente por canal.
+func (m *Manager) Ingest(ctx context.Context, channel string, source io.Reader) error {
+	if !m.Has(channel) {
+		return ErrUnknownChannel
+	}
+	dir, err := os.MkdirTemp("", "gotify-live-*")
+	if err != nil {
+		return err
+	}
+	b := &broadcast{dir: dir, done: make(chan struct{})}
+
+	m.mu.Lock()
+	previous := m.channels[channel]
+	if previous != nil && !previous.ended() {
+		m.mu.Unlock()
+		os.RemoveAll(dir)
+		return ErrOnAir
+	}
+	m.channels[channel] = b
+	m.mu.Unlock()
+	if previous != nil {
+		os.RemoveAll(previous.dir)
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go func() {
+		select {
+		case <-m.stop:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	logger := logging.FromContext(ctx)
+	logger.Info("live source connected", "channel", channel)
+	metrics.LiveIngestStarted()
+	err = m.segmenter.Live(ctx, source, dir, transcode.LiveOptions{
+		Variant:        m.variant,
+		SegmentSeconds: m.cfg.SegmentSeconds,
+		ListSize:       m.cfg.listSize(),
+		Broadcast:      strconv.FormatInt(time.Now().UnixNano(), 36),
+	})
+	metrics.LiveIngestEnded(err)
+	close(b.done)
+	logger.Info("live source disconnected", "channel", channel, "error", err)
+
+	// Los oyentes terminan de reproducir la última ventana antes de borrarla.
+	linger := time.Duration(m.cfg.listSize()*m.cfg.SegmentSeconds) * time.Second
+	time.AfterFunc(linger, func() {
+		m.mu.Lock()
+		current := m.channels[channel] == b
+		if current {
+			delete(m.channels, channel)
+		}
+		m.mu.Unlock()
+		if current {
+			os.RemoveAll(dir)
+		}
+	})
+	return err
+}
+
+// Run detiene las emisiones en curso cuando ctx se cancela, para que sus
+// listas se cierren antes de apagar el servidor.
+func (m *Manager) Run(ctx context.Context) {
+	<-ctx.Done()
+	m.stopOnce.Do(func() { close(m.stop) })
+}
+
+// Master devuelve la lista maestra del canal, con su única variante.
+func (m *Manager) Master(channel string) ([]byte, error) {
+	if _, err := m.broadcast(channel); err != nil {
+		return nil, err
+	}
+	playlist := m3u8.Playlist{
+		Master:   true,
+		Header:   []m3u8.Tag{{Name: "EXT-X-VERSION", Value: "3"}},
+		Variants: []m3u8.Variant{transcode.MasterEntry(m.variant)},
+	}
+	return playlist.Encode(), nil
+}
+
+// Playlist devuelve la lista en directo de la variante name. Si la fuente
+// acaba de conectarse espera, mientras ctx lo permita y como mucho tres
+// segmentos, a que ffmpeg escriba el primero.
+func (m *Manager) Playlist(ctx context.Context, channel, name string) ([]byte, error) {
+	b, err := m.broadcast(channel)
+	if err != nil {
+		return nil, err
+	}
+	if name != m.variant.Name {
+		return nil, ErrNotFound
+	}
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Duration(m.cfg.SegmentSeconds)*time.Second)
+	defer cancel()
+	for {
+		if p, err := b.playlist(name); err == nil && len(p.Segments) > 0 {
+			return p.Encode(), nil
+		}
+		select {
+		case <-b.done:
+			return nil, ErrOffAir
+		case <-ctx.Done():
+			return nil, ErrNotReady
+		case <-time.After(pollInterval):
+		}
+	}
+}
+
+// Segment devuelve el segmento name si está en la lista actual. Los que
+// ffmpeg escribe todavía o ya sacó de la ventana no se sirven.
+func (m *Manager) Segment(channel, name string) ([]byte, error) {
+	b, err := m.broadcast(channel)
+	if err != nil {
+		return nil, err
+	}
+	p, err := b.playlist(m.variant.Name)
+	if err != nil || !listed(p, name) {
+		return nil, ErrNotFound
+	}
+	data, err := os.ReadFile(filepath.Join(b.dir, name))
+	if err != nil {
+		// Borrado por delete_segments entre la lectura de la lista y esta.
+		return nil, ErrNotFound
+	}
+	return data, nil
+}
+
+func (m *Manager) broadcast(channel string) (*broadcast, error) {
+	if !m.Has(channel) {
+		return nil, ErrUnknownChannel
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	b := m.channels[channel]
+	if b == nil {
+		return nil, ErrOffAir
+	}
+	return b, nil
+}
+
+func (b *broadcast) ended() bool {
+	select {
+	case <-b.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// playlist lee la lista que mantiene ffmpeg. La reescribe entera en cada
+// segmento, así que una lectura a medias falla al interpretarse.
+func (b *broadcast) playlist(name string) (*m3u8.Playlist, error) {
+	data, err := os.ReadFile(filepath.Join(b.dir, name+".m3u8"))
+	if err != nil {
+		return nil, err
+	}
+	return m3u8.Parse(data)
+}
+
+func listed(p *m3u8.Playlist, name string) bool {
+	for _, s := range p.Segments {
+		if s.URI == name {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,165 @@
+package live
+
+import (
+	"GOtify/internal/transcode"
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeSegmenter escribe un segmento por línea de source y mantiene una lista
+// deslizante de opts.ListSize, como ffmpeg con delete_segments.
+type fakeSegmenter struct{}
+
+func (fakeSegmenter) Live(ctx context.Context, source io.Reader, dir string, opts transcode.LiveOptions) error {
+	lines := make(chan string)
+	go func() {
+		defer close(lines)
+		scanner := bufio.NewScanner(source)
+		for scanner.Scan() {
+			lines <- scanner.Text()
+		}
+	}()
+	playlist := filepath.Join(dir, opts.Variant.Name+".m3u8")
+	var window []string
+	write := func(seq int, end bool) error {
+		list := fmt.Sprintf("#EXTM3U\n#EXT-X-TARGETDURATION:%d\n#EXT-X-MEDIA-SEQUENCE:%d\n", opts.SegmentSeconds, seq)
+		for _, name := range window {
+			list += fmt.Sprintf("#EXTINF:%d,\n%s\n", opts.SegmentSeconds, name)
+		}
+		if end {
+			list += "#EXT-X-ENDLIST\n"
+		}
+		return os.WriteFile(playlist, []byte(list), 0o644)
+	}
+	for seq := 0; ; seq++ {
+		select {
+		case line, ok := <-lines:
+			if !ok {
+				return write(seq-len(window), true)
+			}
+			name := fmt.Sprintf("%s_segment_%s_%05d.ts", opts.Variant.Name, opts.Broadcast, seq)
+			if err := os.WriteFile(filepath.Join(dir, name), []byte(line), 0o644); err != nil {
+				return err
+			}
+			window = append(window, name)
+			if len(window) > opts.ListSize {
+				os.Remove(filepath.Join(dir, window[0]))
+				window = window[1:]
+			}
+			if err := write(seq+1-len(window), false); err != nil {
+				return err
+			}
+		case <-ctx.Done():
+			return write(seq-len(window), true)
+		}
+	}
+}
+
+func TestManagerBroadcast(t *testing.T) {
+	m := New(fakeSegmenter{}, Config{Channels: []string{"radio"}, SegmentSeconds: 1, WindowSegments: 2})
+	ctx := context.Background()
+
+	if err := m.Ingest(ctx, "other", strings.NewReader("")); !errors.Is(err, ErrUnknownChannel) {
+		t.Fatalf("expected ErrUnknownChannel, got %v", err)
+	}
+	if _, err := m.Master("radio"); !errors.Is(err, ErrOffAir) {
+		t.Fatalf("expected ErrOffAir before the source connects, got %v", err)
+	}
+
+	source, feed := io.Pipe()
+	ingested := make(chan error, 1)
+	go func() { ingested <- m.Ingest(ctx, "radio", source) }()
+
+	fmt.Fprintln(feed, "first")
+	list, err := m.Playlist(ctx, "radio", "128k")
+	if err != nil || !strings.Contains(string(list), "128k_segment_") {
+		t.Fatalf("expected the first segment, got %v:\n%s", err, list)
+	}
+	// Los segmentos llevan el identificador de la emisión tras _segment_.
+	first := strings.TrimSpace(string(list[strings.Index(string(list), "128k_segment_"):]))
+	prefix := strings.TrimSuffix(first, "00000.ts")
+	if prefix == first || prefix == "128k_segment_" {
+		t.Fatalf("expected a broadcast id in %q", first)
+	}
+	master, _ := m.Master("radio")
+	if !strings.Contains(string(master), "128k.m3u8") {
+		t.Fatalf("unexpected master:\n%s", master)
+	}
+	if err := m.Ingest(ctx, "radio", strings.NewReader("")); !errors.Is(err, ErrOnAir) {
+		t.Fatalf("expected a second source to be rejected, got %v", err)
+	}
+
+	for _, line := range []string{"second", "third"} {
+		fmt.Fprintln(feed, line)
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		list, _ = m.Playlist(ctx, "radio", "128k")
+		if strings.Contains(string(list), "#EXT-X-MEDIA-SEQUENCE:1") {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("window did not slide:\n%s", list)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if data, err := m.Segment("radio", prefix+"00002.ts"); err != nil || string(data) != "third" {
+		t.Fatalf("expected listed segment, got %q %v", data, err)
+	}
+	if _, err := m.Segment("radio", first); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("expected segments outside the window to be gone, got %v", err)
+	}
+	if _, err := m.Playlist(ctx, "radio", "64k"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("expected unknown variant to be rejected, got %v", err)
+	}
+
+	feed.Close()
+	if err := <-ingested; err != nil {
+		t.Fatalf("Ingest: %v", err)
+	}
+	list, err = m.Playlist(ctx, "radio", "128k")
+	if err != nil || !strings.Contains(string(list), "#EXT-X-ENDLIST") {
+		t.Fatalf("expected the closed playlist to stay available, got %v:\n%s", err, list)
+	}
+}
+
+func TestManagerRunStopsSources(t *testing.T) {
+	m := New(fakeSegmenter{}, Config{Channels: []string{"radio"}})
+	ctx, cancel := context.WithCancel(context.Background())
+	go m.Run(ctx)
+
+	source, feed := io.Pipe()
+	defer feed.Close()
+	ingested := make(chan error, 1)
+	go func() { ingested <- m.Ingest(context.Background(), "radio", source) }()
+	fmt.Fprintln(feed, "first")
+
+	cancel()
+	select {
+	case err := <-ingested:
+		if err != nil {
+			t.Fatalf("Ingest: %v", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("source was not stopped on shutdown")
+	}
+}
+
+func TestConfigListSize(t *testing.T) {
+	cfg := Config{SegmentSeconds: 4, WindowSegments: 6}
+	if n := cfg.listSize(); n != 6 {
+		t.Fatalf("expected the live window, got %d", n)
+	}
+	cfg.DVRWindow = 2 * time.Minute
+	if n := cfg.listSize(); n != 30 {
+		t.Fatalf("expected the DVR window to widen the list, got %d", n)
+	}
+}
@@ -0,0 +1,114 @@
+package logging
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"net/url"
+	"strings"
+)
+
+// Redacted reemplaza cualquier valor sensible en los logs.
+const Redacted = "[REDACTED]"
+
+// sensitiveKeys son atributos cuyo valor nunca debe escribirse.
+var sensitiveKeys = map[string]bool{
+	"secret":        true,
+	"token":         true,
+	"t":             true,
+	"expected":      true,
+	"signature":     true,
+	"sig":           true,
+	"api_key":       true,
+	"apikey":        true,
+	"x-api-key":     true,
+	"authorization": true,
+	"cookie":        true,
+	"set-cookie":    true,
+	"password":      true,
+	"service_key":   true,
+	"key":           true,
+}
+
+// urlKeys son atributos que contienen URLs completas; se conservan pero sin
+// exponer la parte firmada de la query.
+var urlKeys = map[string]bool{
+	"url":        true,
+	"signed_url": true,
+	"location":   true,
+}
+
+// New construye un logger JSON con redacción automática de secretos.
+func New(w io.Writer, level slog.Leveler) *slog.Logger {
+	return slog.New(slog.NewJSONHandler(w, &slog.HandlerOptions{
+		Level:       level,
+		ReplaceAttr: redactAttr,
+	}))
+}
+
+// ParseLevel interpreta LOG_LEVEL (debug, info, warn, error). Devuelve info
+// cuando el valor está vacío o no es reconocido.
+func ParseLevel(value string) slog.Level {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(strings.TrimSpace(value))); err != nil {
+		return slog.LevelInfo
+	}
+	return level
+}
+
+type ctxKey struct{}
+
+// WithContext adjunta el logger al contexto de la petición.
+func WithContext(ctx context.Context, logger *slog.Logger) context.Context {
+	return context.WithValue(ctx, ctxKey{}, logger)
+}
+
+// FromContext devuelve el logger de la petición o slog.Default si no hay uno.
+func FromContext(ctx context.Context) *slog.Logger {
+	if ctx != nil {
+		if logger, ok := ctx.Value(ctxKey{}).(*slog.Logger); ok && logger != nil {
+			return logger
+		}
+	}
+	return slog.Default()
+}
+
+func redactAttr(_ []string, a slog.Attr) slog.Attr {
+	key := strings.ToLower(a.Key)
+	if sensitiveKeys[key] {
+		return slog.String(a.Key, Redacted)
+	}
+	if a.Value.Kind() != slog.KindString {
+		return a
+	}
+	value := a.Value.String()
+	if urlKeys[key] || strings.Contains(value, "?") {
+		return slog.String(a.Key, RedactURL(value))
+	}
+	return a
+}
+
+// RedactURL oculta los valores de parámetros sensibles de la query de una URL
+// (tokens de reproducción, firmas de Supabase, claves). Si la cadena no es una
+// URL válida se devuelve sin cambios.
+func RedactURL(raw string) string {
+	idx := strings.Index(raw, "?")
+	if idx == -1 {
+		return raw
+	}
+	query, err := url.ParseQuery(raw[idx+1:])
+	if err != nil {
+		return raw[:idx+1] + Redacted
+	}
+	changed := false
+	for name := range query {
+		if sensitiveKeys[strings.ToLower(name)] {
+			query[name] = []string{Redacted}
+			changed = true
+		}
+	}
+	if !changed {
+		return raw
+	}
+	return raw[:idx+1] + strings.ReplaceAll(query.Encode(), url.QueryEscape(Redacted), Redacted)
+}
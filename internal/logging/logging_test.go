@@ -0,0 +1,75 @@
+package logging
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"strings"
+	"testing"
+)
+
+func TestNewRedactsSensitiveAttributes(t *testing.T) {
+	var buf bytes.Buffer
+	logger := New(&buf, slog.LevelDebug)
+
+	logger.Info("test",
+		"token", "abc123",
+		"secret", "hunter2",
+		"signed_url", "https://bucket.example/object/sign/a.ts?token=jwt-value",
+		"path", "/stream/song?t=deadbeef&e=123",
+		"song_id", "song-1",
+	)
+
+	out := buf.String()
+	for _, leaked := range []string{"abc123", "hunter2", "jwt-value", "deadbeef"} {
+		if strings.Contains(out, leaked) {
+			t.Fatalf("log output leaked %q: %s", leaked, out)
+		}
+	}
+
+	var entry map[string]any
+	if err := json.Unmarshal(buf.Bytes(), &entry); err != nil {
+		t.Fatalf("output is not json: %v", err)
+	}
+	if entry["song_id"] != "song-1" {
+		t.Fatalf("expected song_id preserved, got %v", entry["song_id"])
+	}
+	if entry["path"] != "/stream/song?e=123&t="+Redacted {
+		t.Fatalf("unexpected redacted path: %v", entry["path"])
+	}
+}
+
+func TestParseLevel(t *testing.T) {
+	tests := map[string]slog.Level{
+		"debug": slog.LevelDebug,
+		"WARN":  slog.LevelWarn,
+		"error": slog.LevelError,
+		"":      slog.LevelInfo,
+		"bogus": slog.LevelInfo,
+	}
+	for input, want := range tests {
+		if got := ParseLevel(input); got != want {
+			t.Fatalf("ParseLevel(%q) = %v, want %v", input, got, want)
+		}
+	}
+}
+
+func TestFromContextFallsBackToDefault(t *testing.T) {
+	if FromContext(context.Background()) != slog.Default() {
+		t.Fatalf("expected default logger")
+	}
+
+	logger := New(&bytes.Buffer{}, slog.LevelInfo)
+	ctx := WithContext(context.Background(), logger)
+	if FromContext(ctx) != logger {
+		t.Fatalf("expected logger from context")
+	}
+}
+
+func TestRedactURLWithoutSensitiveParams(t *testing.T) {
+	raw := "/stream/song/64k.m3u8?e=123"
+	if got := RedactURL(raw); got != raw {
+		t.Fatalf("expected url unchanged, got %q", got)
+	}
+}
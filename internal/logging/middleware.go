@@ -0,0 +1,91 @@
+package logging
+
+import (
+	"log/slog"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// RequestIDHeader es la cabecera usada para propagar el identificador de petición.
+const RequestIDHeader = "X-Request-ID"
+
+const (
+	requestIDKey = "request_id"
+	maxRequestID = 128
+)
+
+// Middleware asigna (o propaga) un X-Request-ID, deja en el contexto un logger
+// con ese identificador y escribe una línea de acceso al terminar la petición.
+func Middleware(base *slog.Logger) gin.HandlerFunc {
+	if base == nil {
+		base = slog.Default()
+	}
+	return func(c *gin.Context) {
+		start := time.Now()
+
+		requestID := sanitizeRequestID(c.GetHeader(RequestIDHeader))
+		if requestID == "" {
+			requestID = uuid.NewString()
+		}
+		c.Set(requestIDKey, requestID)
+		c.Header(RequestIDHeader, requestID)
+
+		logger := base.With(slog.String(requestIDKey, requestID))
+		if sc := trace.SpanContextFromContext(c.Request.Context()); sc.IsValid() {
+			logger = logger.With(slog.String("trace_id", sc.TraceID().String()))
+		}
+		c.Request = c.Request.WithContext(WithContext(c.Request.Context(), logger))
+
+		c.Next()
+
+		status := c.Writer.Status()
+		level := slog.LevelInfo
+		switch {
+		case status >= 500:
+			level = slog.LevelError
+		case status >= 400:
+			level = slog.LevelWarn
+		}
+
+		attrs := []slog.Attr{
+			slog.String("method", c.Request.Method),
+			slog.String("path", c.Request.URL.Path),
+			slog.String("route", c.FullPath()),
+			slog.Int("status", status),
+			slog.Duration("latency", time.Since(start)),
+			slog.String("client_ip", c.ClientIP()),
+			slog.Int("bytes", c.Writer.Size()),
+		}
+		if len(c.Errors) > 0 {
+			attrs = append(attrs, slog.String("error", c.Errors.String()))
+		}
+		logger.LogAttrs(c.Request.Context(), level, "request", attrs...)
+	}
+}
+
+// RequestID devuelve el identificador asignado por Middleware.
+func RequestID(c *gin.Context) string {
+	return c.GetString(requestIDKey)
+}
+
+// sanitizeRequestID acepta identificadores entrantes razonables y descarta el
+// resto para evitar inyección en logs.
+func sanitizeRequestID(value string) string {
+	value = strings.TrimSpace(value)
+	if value == "" || len(value) > maxRequestID {
+		return ""
+	}
+	for _, r := range value {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+		case r == '-', r == '_', r == '.', r == ':':
+		default:
+			return ""
+		}
+	}
+	return value
+}
@@ -0,0 +1,90 @@
+package logging
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestMiddlewareGeneratesRequestID(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	var buf bytes.Buffer
+	router := gin.New()
+	router.Use(Middleware(New(&buf, slog.LevelInfo)))
+	router.GET("/stream/:id", func(c *gin.Context) {
+		FromContext(c.Request.Context()).Info("inside handler")
+		c.Status(http.StatusOK)
+	})
+
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/stream/song?t=secret-token&e=1", nil)
+	router.ServeHTTP(rec, req)
+
+	requestID := rec.Header().Get(RequestIDHeader)
+	if requestID == "" {
+		t.Fatalf("expected generated request id")
+	}
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("expected 2 log lines, got %d: %s", len(lines), buf.String())
+	}
+	for _, line := range lines {
+		var entry map[string]any
+		if err := json.Unmarshal([]byte(line), &entry); err != nil {
+			t.Fatalf("invalid json log line %q: %v", line, err)
+		}
+		if entry["request_id"] != requestID {
+			t.Fatalf("expected request_id %s, got %v", requestID, entry["request_id"])
+		}
+	}
+	if strings.Contains(buf.String(), "secret-token") {
+		t.Fatalf("access log leaked token: %s", buf.String())
+	}
+}
+
+func TestMiddlewarePropagatesRequestID(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	router := gin.New()
+	router.Use(Middleware(New(&bytes.Buffer{}, slog.LevelInfo)))
+	router.GET("/", func(c *gin.Context) {
+		if got := RequestID(c); got != "abc-123" {
+			t.Errorf("expected propagated request id, got %q", got)
+		}
+		c.Status(http.StatusNoContent)
+	})
+
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set(RequestIDHeader, "abc-123")
+	router.ServeHTTP(rec, req)
+
+	if got := rec.Header().Get(RequestIDHeader); got != "abc-123" {
+		t.Fatalf("expected echoed request id, got %q", got)
+	}
+}
+
+func TestMiddlewareRejectsUnsafeRequestID(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	router := gin.New()
+	router.Use(Middleware(New(&bytes.Buffer{}, slog.LevelInfo)))
+	router.GET("/", func(c *gin.Context) { c.Status(http.StatusNoContent) })
+
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set(RequestIDHeader, "bad\nid")
+	router.ServeHTTP(rec, req)
+
+	if got := rec.Header().Get(RequestIDHeader); got == "" || got == "bad\nid" {
+		t.Fatalf("expected replacement request id, got %q", got)
+	}
+}
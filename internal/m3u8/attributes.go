@@ -0,0 +1,109 @@
+package m3u8
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Attribute es un par NOMBRE=valor de una lista de atributos (RFC 8216,
+// sección 4.2). Quoted conserva si el valor va entre comillas.
+type Attribute struct {
+	Name   string
+	Value  string
+	Quoted bool
+}
+
+// Attributes es una lista de atributos en el orden en que aparece.
+type Attributes []Attribute
+
+// Get devuelve el valor de name sin comillas.
+func (a Attributes) Get(name string) (string, bool) {
+	for _, attr := range a {
+		if attr.Name == name {
+			return attr.Value, true
+		}
+	}
+	return "", false
+}
+
+// Set sustituye el valor de name o lo añade al final.
+func (a *Attributes) Set(name, value string, quoted bool) {
+	for i := range *a {
+		if (*a)[i].Name == name {
+			(*a)[i].Value, (*a)[i].Quoted = value, quoted
+			return
+		}
+	}
+	*a = append(*a, Attribute{Name: name, Value: value, Quoted: quoted})
+}
+
+func (a Attributes) String() string {
+	var b strings.Builder
+	for i, attr := range a {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(attr.Name)
+		b.WriteByte('=')
+		if attr.Quoted {
+			b.WriteByte('"')
+			b.WriteString(attr.Value)
+			b.WriteByte('"')
+		} else {
+			b.WriteString(attr.Value)
+		}
+	}
+	return b.String()
+}
+
+// parseAttributes lee una lista de atributos. Las comas dentro de valores
+// entre comillas no separan atributos.
+func parseAttributes(s string) (Attributes, error) {
+	attrs := Attributes{}
+	for s != "" {
+		eq := strings.IndexByte(s, '=')
+		if eq <= 0 {
+			return nil, fmt.Errorf("attribute without value in %q", s)
+		}
+		name := strings.TrimSpace(s[:eq])
+		if !validName(name) {
+			return nil, fmt.Errorf("invalid attribute name %q", name)
+		}
+		s = s[eq+1:]
+
+		attr := Attribute{Name: name}
+		if strings.HasPrefix(s, `"`) {
+			end := strings.IndexByte(s[1:], '"')
+			if end == -1 {
+				return nil, fmt.Errorf("unterminated quoted value for %s", name)
+			}
+			attr.Value, attr.Quoted = s[1:end+1], true
+			s = s[end+2:]
+			if s != "" && s[0] != ',' {
+				return nil, fmt.Errorf("unexpected %q after %s", s, name)
+			}
+		} else {
+			end := strings.IndexByte(s, ',')
+			if end == -1 {
+				end = len(s)
+			}
+			attr.Value = strings.TrimSpace(s[:end])
+			s = s[end:]
+		}
+		s = strings.TrimPrefix(s, ",")
+		attrs = append(attrs, attr)
+	}
+	return attrs, nil
+}
+
+func validName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for _, r := range name {
+		if (r < 'A' || r > 'Z') && (r < '0' || r > '9') && r != '-' {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,328 @@
+// Package m3u8 lee, modifica y escribe listas de reproducción HLS
+// (RFC 8216), tanto maestras como de medios.
+package m3u8
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// ErrNotPlaylist indica que los datos no empiezan por #EXTM3U.
+var ErrNotPlaylist = errors.New("m3u8: missing #EXTM3U header")
+
+// Tag es una línea que empieza por "#" (etiqueta o comentario) sin el "#".
+// Las etiquetas con lista de atributos (EXT-X-KEY, EXT-X-MEDIA, ...) tienen
+// Attrs; el resto guarda el texto tras ":" en Value.
+type Tag struct {
+	Name  string
+	Value string
+	Attrs Attributes
+}
+
+func (t Tag) String() string {
+	switch {
+	case t.Attrs != nil:
+		return "#" + t.Name + ":" + t.Attrs.String()
+	case t.Value != "":
+		return "#" + t.Name + ":" + t.Value
+	default:
+		return "#" + t.Name
+	}
+}
+
+// Variant es una entrada EXT-X-STREAM-INF de una lista maestra. Tags son
+// las demás etiquetas que la preceden.
+type Variant struct {
+	StreamInf Attributes
+	Tags      []Tag
+	URI       string
+}
+
+// Bandwidth devuelve el atributo BANDWIDTH en bits por segundo.
+func (v Variant) Bandwidth() int {
+	value, _ := v.StreamInf.Get("BANDWIDTH")
+	n, _ := strconv.Atoi(value)
+	return n
+}
+
+// Codecs devuelve el atributo CODECS.
+func (v Variant) Codecs() string {
+	value, _ := v.StreamInf.Get("CODECS")
+	return value
+}
+
+// Segment es un segmento de una lista de medios. Tags son las etiquetas que
+// lo preceden aparte de EXTINF (EXT-X-KEY, EXT-X-MAP, EXT-X-DISCONTINUITY...).
+type Segment struct {
+	Duration float64
+	Title    string
+	Tags     []Tag
+	URI      string
+}
+
+// Playlist es una lista maestra (Variants) o de medios (Segments). Header
+// guarda las etiquetas que afectan a toda la lista y Trailer las que siguen
+// a la última URI, como EXT-X-ENDLIST.
+type Playlist struct {
+	Master   bool
+	Header   []Tag
+	Variants []Variant
+	Segments []Segment
+	Trailer  []Tag
+}
+
+// attributeTags son las etiquetas cuyo valor es una lista de atributos.
+var attributeTags = map[string]bool{
+	"EXT-X-KEY":                true,
+	"EXT-X-MAP":                true,
+	"EXT-X-MEDIA":              true,
+	"EXT-X-STREAM-INF":         true,
+	"EXT-X-I-FRAME-STREAM-INF": true,
+	"EXT-X-SESSION-DATA":       true,
+	"EXT-X-SESSION-KEY":        true,
+	"EXT-X-START":              true,
+	"EXT-X-DATERANGE":          true,
+	"EXT-X-PART":               true,
+	"EXT-X-PART-INF":           true,
+	"EXT-X-PRELOAD-HINT":       true,
+	"EXT-X-RENDITION-REPORT":   true,
+	"EXT-X-SERVER-CONTROL":     true,
+	"EXT-X-SKIP":               true,
+	"EXT-X-DEFINE":             true,
+	"EXT-X-CONTENT-STEERING":   true,
+}
+
+// playlistTags se aplican a toda la lista y van a Header estén donde estén.
+var playlistTags = map[string]bool{
+	"EXT-X-VERSION":                true,
+	"EXT-X-TARGETDURATION":         true,
+	"EXT-X-MEDIA-SEQUENCE":         true,
+	"EXT-X-DISCONTINUITY-SEQUENCE": true,
+	"EXT-X-PLAYLIST-TYPE":          true,
+	"EXT-X-I-FRAMES-ONLY":          true,
+	"EXT-X-INDEPENDENT-SEGMENTS":   true,
+	"EXT-X-ALLOW-CACHE":            true,
+	"EXT-X-START":                  true,
+	"EXT-X-SERVER-CONTROL":         true,
+	"EXT-X-PART-INF":               true,
+	"EXT-X-DEFINE":                 true,
+	"EXT-X-MEDIA":                  true,
+	"EXT-X-I-FRAME-STREAM-INF":     true,
+	"EXT-X-SESSION-DATA":           true,
+	"EXT-X-SESSION-KEY":            true,
+	"EXT-X-CONTENT-STEERING":       true,
+}
+
+var masterTags = map[string]bool{
+	"EXT-X-STREAM-INF":         true,
+	"EXT-X-MEDIA":              true,
+	"EXT-X-I-FRAME-STREAM-INF": true,
+	"EXT-X-SESSION-DATA":       true,
+	"EXT-X-SESSION-KEY":        true,
+}
+
+// Parse lee una lista maestra o de medios. Acepta finales de línea CRLF y
+// líneas en blanco, que se descartan al escribir.
+func Parse(data []byte) (*Playlist, error) {
+	data = bytes.TrimPrefix(data, []byte("\xef\xbb\xbf"))
+	lines := strings.Split(string(data), "\n")
+
+	p := &Playlist{}
+	var (
+		header    bool
+		pending   []Tag
+		streamInf Attributes
+		extinf    *Segment
+	)
+	for i, line := range lines {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		if !header {
+			if line != "#EXTM3U" {
+				return nil, ErrNotPlaylist
+			}
+			header = true
+			continue
+		}
+
+		if !strings.HasPrefix(line, "#") {
+			switch {
+			case streamInf != nil:
+				p.Variants = append(p.Variants, Variant{StreamInf: streamInf, Tags: pending, URI: line})
+			case extinf != nil:
+				extinf.Tags, extinf.URI = pending, line
+				p.Segments = append(p.Segments, *extinf)
+			default:
+				return nil, fmt.Errorf("m3u8: line %d: URI without EXT-X-STREAM-INF or EXTINF", i+1)
+			}
+			pending, streamInf, extinf = nil, nil, nil
+			continue
+		}
+
+		tag, err := parseTag(line[1:])
+		if err != nil {
+			return nil, fmt.Errorf("m3u8: line %d: %w", i+1, err)
+		}
+		p.Master = p.Master || masterTags[tag.Name]
+		switch {
+		case tag.Name == "EXTM3U":
+		case tag.Name == "EXT-X-STREAM-INF":
+			if streamInf != nil {
+				return nil, fmt.Errorf("m3u8: line %d: EXT-X-STREAM-INF without URI", i+1)
+			}
+			streamInf = tag.Attrs
+		case tag.Name == "EXTINF":
+			if extinf != nil {
+				return nil, fmt.Errorf("m3u8: line %d: EXTINF without URI", i+1)
+			}
+			seg, err := parseExtinf(tag.Value)
+			if err != nil {
+				return nil, fmt.Errorf("m3u8: line %d: %w", i+1, err)
+			}
+			extinf = &seg
+		case playlistTags[tag.Name]:
+			p.Header = append(p.Header, tag)
+		default:
+			pending = append(pending, tag)
+		}
+	}
+
+	if !header {
+		return nil, ErrNotPlaylist
+	}
+	if streamInf != nil || extinf != nil {
+		return nil, errors.New("m3u8: playlist ends before the last URI")
+	}
+	if p.Master && len(p.Segments) > 0 {
+		return nil, errors.New("m3u8: playlist mixes variants and segments")
+	}
+	p.Trailer = pending
+	return p, nil
+}
+
+func parseTag(line string) (Tag, error) {
+	name, value, _ := strings.Cut(line, ":")
+	tag := Tag{Name: name, Value: value}
+	if attributeTags[name] {
+		attrs, err := parseAttributes(value)
+		if err != nil {
+			return Tag{}, fmt.Errorf("%s: %w", name, err)
+		}
+		tag.Value, tag.Attrs = "", attrs
+	}
+	return tag, nil
+}
+
+func parseExtinf(value string) (Segment, error) {
+	duration, title, _ := strings.Cut(value, ",")
+	d, err := strconv.ParseFloat(strings.TrimSpace(duration), 64)
+	if err != nil || d < 0 {
+		return Segment{}, fmt.Errorf("invalid EXTINF duration %q", duration)
+	}
+	return Segment{Duration: d, Title: title}, nil
+}
+
+// Encode escribe la lista con finales de línea LF.
+func (p *Playlist) Encode() []byte {
+	var b strings.Builder
+	b.WriteString("#EXTM3U\n")
+	writeTags(&b, p.Header)
+	for _, v := range p.Variants {
+		writeTags(&b, v.Tags)
+		b.WriteString(Tag{Name: "EXT-X-STREAM-INF", Attrs: v.StreamInf}.String())
+		b.WriteByte('\n')
+		b.WriteString(v.URI)
+		b.WriteByte('\n')
+	}
+	for _, s := range p.Segments {
+		writeTags(&b, s.Tags)
+		b.WriteString("#EXTINF:")
+		b.WriteString(strconv.FormatFloat(s.Duration, 'f', -1, 64))
+		b.WriteByte(',')
+		b.WriteString(s.Title)
+		b.WriteByte('\n')
+		b.WriteString(s.URI)
+		b.WriteByte('\n')
+	}
+	writeTags(&b, p.Trailer)
+	return []byte(b.String())
+}
+
+func writeTags(b *strings.Builder, tags []Tag) {
+	for _, tag := range tags {
+		b.WriteString(tag.String())
+		b.WriteByte('\n')
+	}
+}
+
+// RewriteURIs sustituye cada URI de la lista por fn(uri): las de variantes
+// y segmentos y los atributos URI de etiquetas como EXT-X-KEY, EXT-X-MAP,
+// EXT-X-MEDIA o EXT-X-I-FRAME-STREAM-INF.
+func (p *Playlist) RewriteURIs(fn func(string) string) {
+	rewriteTags(p.Header, fn)
+	for i := range p.Variants {
+		rewriteTags(p.Variants[i].Tags, fn)
+		p.Variants[i].URI = fn(p.Variants[i].URI)
+	}
+	for i := range p.Segments {
+		rewriteTags(p.Segments[i].Tags, fn)
+		p.Segments[i].URI = fn(p.Segments[i].URI)
+	}
+	rewriteTags(p.Trailer, fn)
+}
+
+func rewriteTags(tags []Tag, fn func(string) string) {
+	for i := range tags {
+		if uri, ok := tags[i].Attrs.Get("URI"); ok {
+			tags[i].Attrs.Set("URI", fn(uri), true)
+		}
+	}
+}
+
+// SetQuery añade rawQuery a uri. Los parámetros de uri con el mismo nombre
+// que alguno de rawQuery se sustituyen en vez de repetirse. Las URIs
+// absolutas y data: se devuelven sin cambios para no filtrar la query a
+// otros hosts.
+func SetQuery(uri, rawQuery string) string {
+	if rawQuery == "" || uri == "" || strings.HasPrefix(strings.ToLower(uri), "data:") {
+		return uri
+	}
+	if u, err := url.Parse(uri); err != nil || u.Scheme != "" || u.Host != "" {
+		return uri
+	}
+
+	uri, fragment, hasFragment := strings.Cut(uri, "#")
+	base, existing, _ := strings.Cut(uri, "?")
+
+	replaced := make(map[string]bool)
+	for _, pair := range strings.Split(rawQuery, "&") {
+		replaced[queryKey(pair)] = true
+	}
+	params := make([]string, 0, 4)
+	for _, pair := range strings.Split(existing, "&") {
+		if pair != "" && !replaced[queryKey(pair)] {
+			params = append(params, pair)
+		}
+	}
+	params = append(params, rawQuery)
+
+	out := base + "?" + strings.Join(params, "&")
+	if hasFragment {
+		out += "#" + fragment
+	}
+	return out
+}
+
+func queryKey(pair string) string {
+	key, _, _ := strings.Cut(pair, "=")
+	if unescaped, err := url.QueryUnescape(key); err == nil {
+		return unescaped
+	}
+	return key
+}
@@ -0,0 +1,159 @@
+package m3u8
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+const master = "#EXTM3U\r\n" +
+	"#EXT-X-VERSION:6\r\n" +
+	"#EXT-X-MEDIA:TYPE=AUDIO,GROUP-ID=\"aud\",NAME=\"en, main\",URI=\"audio/en.m3u8\"\r\n" +
+	"#EXT-X-STREAM-INF:BANDWIDTH=131072,CODECS=\"mp4a.40.2,avc1.4d401e\",AUDIO=\"aud\"\r\n" +
+	"\r\n" +
+	"128k.m3u8\r\n" +
+	"#EXT-X-I-FRAME-STREAM-INF:BANDWIDTH=20000,URI=\"iframes.m3u8?x=1\"\r\n"
+
+const media = "#EXTM3U\n" +
+	"#EXT-X-VERSION:3\n" +
+	"#EXT-X-TARGETDURATION:6\n" +
+	"#EXT-X-MEDIA-SEQUENCE:0\n" +
+	"#EXT-X-KEY:METHOD=AES-128,URI=\"key\",IV=0x0001\n" +
+	"#EXT-X-MAP:URI=\"init.mp4\"\n" +
+	"#EXTINF:6.000000,\n" +
+	"128k_segment_000.ts\n" +
+	"# generated by ffmpeg\n" +
+	"#EXTINF:2.5,tail\n" +
+	"128k_segment_001.ts?t=old&keep=1\n" +
+	"#EXT-X-ENDLIST\n"
+
+func TestParseMaster(t *testing.T) {
+	p, err := Parse([]byte(master))
+	if err != nil {
+		t.Fatalf("Parse: %v", err)
+	}
+	if !p.Master || len(p.Variants) != 1 || len(p.Segments) != 0 {
+		t.Fatalf("unexpected playlist %+v", p)
+	}
+	v := p.Variants[0]
+	if v.URI != "128k.m3u8" || v.Bandwidth() != 131072 || v.Codecs() != "mp4a.40.2,avc1.4d401e" {
+		t.Fatalf("unexpected variant %+v", v)
+	}
+	if name, _ := p.Header[1].Attrs.Get("NAME"); name != "en, main" {
+		t.Fatalf("expected quoted comma to be kept, got %q", name)
+	}
+	if len(p.Header) != 3 || p.Header[2].Name != "EXT-X-I-FRAME-STREAM-INF" {
+		t.Fatalf("expected playlist-level tags in header, got %+v", p.Header)
+	}
+}
+
+func TestParseMedia(t *testing.T) {
+	p, err := Parse([]byte(media))
+	if err != nil {
+		t.Fatalf("Parse: %v", err)
+	}
+	if p.Master || len(p.Segments) != 2 {
+		t.Fatalf("unexpected playlist %+v", p)
+	}
+	first, second := p.Segments[0], p.Segments[1]
+	if first.Duration != 6 || len(first.Tags) != 2 || first.Tags[0].Name != "EXT-X-KEY" {
+		t.Fatalf("unexpected first segment %+v", first)
+	}
+	if second.Duration != 2.5 || second.Title != "tail" || len(second.Tags) != 1 {
+		t.Fatalf("unexpected second segment %+v", second)
+	}
+	if len(p.Trailer) != 1 || p.Trailer[0].Name != "EXT-X-ENDLIST" {
+		t.Fatalf("expected ENDLIST trailer, got %+v", p.Trailer)
+	}
+}
+
+func TestEncodeRoundTrip(t *testing.T) {
+	for _, data := range []string{master, media} {
+		p, err := Parse([]byte(data))
+		if err != nil {
+			t.Fatalf("Parse: %v", err)
+		}
+		encoded := p.Encode()
+		again, err := Parse(encoded)
+		if err != nil {
+			t.Fatalf("Parse encoded: %v\n%s", err, encoded)
+		}
+		if string(again.Encode()) != string(encoded) {
+			t.Fatalf("encoding is not stable:\n%s\n---\n%s", encoded, again.Encode())
+		}
+		if strings.Contains(string(encoded), "\r") {
+			t.Fatalf("expected LF line endings, got %q", encoded)
+		}
+	}
+}
+
+func TestRewriteURIs(t *testing.T) {
+	for _, tc := range []struct {
+		data string
+		want []string
+	}{
+		{master, []string{
+			`URI="audio/en.m3u8?t=new&e=1"`,
+			"\n128k.m3u8?t=new&e=1\n",
+			`URI="iframes.m3u8?x=1&t=new&e=1"`,
+		}},
+		{media, []string{
+			`#EXT-X-KEY:METHOD=AES-128,URI="key?t=new&e=1",IV=0x0001`,
+			`#EXT-X-MAP:URI="init.mp4?t=new&e=1"`,
+			"\n128k_segment_000.ts?t=new&e=1\n",
+			"\n128k_segment_001.ts?keep=1&t=new&e=1\n",
+		}},
+	} {
+		p, err := Parse([]byte(tc.data))
+		if err != nil {
+			t.Fatalf("Parse: %v", err)
+		}
+		p.RewriteURIs(func(uri string) string { return SetQuery(uri, "t=new&e=1") })
+		got := string(p.Encode())
+		for _, want := range tc.want {
+			if !strings.Contains(got, want) {
+				t.Fatalf("expected %q in:\n%s", want, got)
+			}
+		}
+		if strings.Contains(got, "t=old") {
+			t.Fatalf("expected previous token to be replaced:\n%s", got)
+		}
+	}
+}
+
+func TestSetQuery(t *testing.T) {
+	cases := []struct{ uri, query, want string }{
+		{"seg.ts", "t=a&e=1", "seg.ts?t=a&e=1"},
+		{"seg.ts?t=old&e=0", "t=a&e=1", "seg.ts?t=a&e=1"},
+		{"seg.ts?x=1#frag", "t=a", "seg.ts?x=1&t=a#frag"},
+		{"seg.ts", "", "seg.ts"},
+		{"https://cdn.example/seg.ts", "t=a", "https://cdn.example/seg.ts"},
+		{"//cdn.example/seg.ts", "t=a", "//cdn.example/seg.ts"},
+		{"data:text/plain,abc", "t=a", "data:text/plain,abc"},
+	}
+	for _, tc := range cases {
+		if got := SetQuery(tc.uri, tc.query); got != tc.want {
+			t.Errorf("SetQuery(%q, %q) = %q, want %q", tc.uri, tc.query, got, tc.want)
+		}
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	cases := map[string]string{
+		"no header":          "variant.m3u8\n",
+		"uri without info":   "#EXTM3U\nseg.ts\n",
+		"dangling inf":       "#EXTM3U\n#EXTINF:4,\n",
+		"bad duration":       "#EXTM3U\n#EXTINF:four,\nseg.ts\n",
+		"bad attributes":     "#EXTM3U\n#EXT-X-KEY:METHOD=AES-128,URI=\"key\n#EXTINF:4,\nseg.ts\n",
+		"mixed":              "#EXTM3U\n#EXT-X-STREAM-INF:BANDWIDTH=1\na.m3u8\n#EXTINF:4,\nseg.ts\n",
+		"double stream info": "#EXTM3U\n#EXT-X-STREAM-INF:BANDWIDTH=1\n#EXT-X-STREAM-INF:BANDWIDTH=2\na.m3u8\n",
+	}
+	for name, data := range cases {
+		if _, err := Parse([]byte(data)); err == nil {
+			t.Errorf("%s: expected error", name)
+		}
+	}
+	if _, err := Parse([]byte("variant.m3u8\n")); !errors.Is(err, ErrNotPlaylist) {
+		t.Fatalf("expected ErrNotPlaylist, got %v", err)
+	}
+}
@@ -0,0 +1,228 @@
+package metrics
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const namespace = "gotify"
+
+// Registry agrupa todas las métricas expuestas en /metrics. Se usa un registro
+// propio en lugar del global para que los tests puedan inspeccionarlo sin
+// interferencias de otras librerías.
+var Registry = prometheus.NewRegistry()
+
+var (
+	httpRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "http_requests_total",
+		Help:      "HTTP requests handled, by route and status.",
+	}, []string{"method", "route", "status"})
+
+	httpDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "http_request_duration_seconds",
+		Help:      "HTTP request latency, by route and status.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"method", "route", "status"})
+
+	tokensIssued = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "tokens_issued_total",
+		Help:      "Playback tokens issued by /token.",
+	})
+
+	tokenFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "token_validation_failures_total",
+		Help:      "Rejected stream tokens, by reason (expired, bad_signature, ...).",
+	}, []string{"reason"})
+
+	streamResponses = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "stream_responses_total",
+		Help:      "Stream responses served under /stream, by kind (playlist, segment, key, file) and outcome.",
+	}, []string{"kind", "outcome"})
+
+	songOperations = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "song_operations_total",
+		Help:      "Song catalog operations handled by SongHandler, by operation and outcome.",
+	}, []string{"operation", "outcome"})
+
+	transcodeDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "transcode_duration_seconds",
+		Help:      "ffmpeg transcode duration per HLS variant.",
+		Buckets:   []float64{0.5, 1, 2.5, 5, 10, 30, 60, 120, 300},
+	}, []string{"variant", "outcome"})
+
+	storageDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "storage_operation_duration_seconds",
+		Help:      "Latency of bucket and catalog calls, by client and operation.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"client", "operation"})
+
+	storageErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "storage_operation_errors_total",
+		Help:      "Failed bucket and catalog calls, by client and operation.",
+	}, []string{"client", "operation"})
+
+	rateLimited = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "rate_limit_rejections_total",
+		Help:      "Requests rejected by the rate limiter.",
+	}, []string{"limiter"})
+	cacheLookups = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "cache_lookups_total",
+		Help:      "Storage cache lookups by cache and result (hit or miss).",
+	}, []string{"cache", "result"})
+
+	onDemandJobs = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "ondemand_jobs_total",
+		Help:      "Variants transcoded on demand from the mezzanine, by outcome.",
+	}, []string{"outcome"})
+
+	liveIngests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "live_ingests_total",
+		Help:      "Finished live source connections, by outcome.",
+	}, []string{"outcome"})
+
+	liveOnAir = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "live_channels_on_air",
+		Help:      "Live channels with a connected source.",
+	})
+)
+
+func init() {
+	Registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		httpRequests,
+		httpDuration,
+		tokensIssued,
+		tokenFailures,
+		streamResponses,
+		songOperations,
+		transcodeDuration,
+		storageDuration,
+		storageErrors,
+		rateLimited,
+		cacheLookups,
+		onDemandJobs,
+		liveIngests,
+		liveOnAir,
+	)
+}
+
+// Handler expone el registro en formato Prometheus.
+func Handler() http.Handler {
+	return promhttp.HandlerFor(Registry, promhttp.HandlerOpts{Registry: Registry})
+}
+
+// Middleware registra conteo y latencia de cada petición. Se usa la ruta
+// declarada en gin (no la URL) para mantener acotada la cardinalidad.
+func Middleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		start := time.Now()
+		c.Next()
+
+		route := c.FullPath()
+		if route == "" {
+			route = "unmatched"
+		}
+		status := strconv.Itoa(c.Writer.Status())
+		httpRequests.WithLabelValues(c.Request.Method, route, status).Inc()
+		httpDuration.WithLabelValues(c.Request.Method, route, status).Observe(time.Since(start).Seconds())
+	}
+}
+
+// TokenIssued cuenta un token emitido.
+func TokenIssued() {
+	tokensIssued.Inc()
+}
+
+// TokenRejected cuenta un token rechazado por el motivo indicado.
+func TokenRejected(reason string) {
+	tokenFailures.WithLabelValues(reason).Inc()
+}
+
+// StreamServed cuenta una respuesta de /stream.
+func StreamServed(kind string, err error) {
+	streamResponses.WithLabelValues(kind, outcome(err)).Inc()
+}
+
+// SongOperation cuenta una operación sobre el catálogo de canciones según el
+// status HTTP con el que terminó.
+func SongOperation(operation string, status int) {
+	result := "ok"
+	switch {
+	case status >= 500:
+		result = "error"
+	case status >= 400:
+		result = "rejected"
+	}
+	songOperations.WithLabelValues(operation, result).Inc()
+}
+
+// ObserveTranscode registra la duración de ffmpeg para una variante.
+func ObserveTranscode(variant string, start time.Time, err error) {
+	transcodeDuration.WithLabelValues(variant, outcome(err)).Observe(time.Since(start).Seconds())
+}
+
+// ObserveStorage registra latencia y errores de una llamada al bucket o catálogo.
+func ObserveStorage(client, operation string, start time.Time, err error) {
+	storageDuration.WithLabelValues(client, operation).Observe(time.Since(start).Seconds())
+	if err != nil {
+		storageErrors.WithLabelValues(client, operation).Inc()
+	}
+}
+
+// RateLimited cuenta un rechazo del limitador indicado.
+func RateLimited(limiter string) {
+	rateLimited.WithLabelValues(limiter).Inc()
+}
+
+// CacheLookup cuenta un acierto o fallo de la caché indicada.
+func CacheLookup(cache string, hit bool) {
+	result := "miss"
+	if hit {
+		result = "hit"
+	}
+	cacheLookups.WithLabelValues(cache, result).Inc()
+}
+
+// OnDemandJob cuenta una variante generada bajo demanda.
+func OnDemandJob(err error) {
+	onDemandJobs.WithLabelValues(outcome(err)).Inc()
+}
+
+// LiveIngestStarted cuenta una fuente en directo conectada.
+func LiveIngestStarted() {
+	liveOnAir.Inc()
+}
+
+// LiveIngestEnded descuenta una fuente en directo al desconectarse.
+func LiveIngestEnded(err error) {
+	liveOnAir.Dec()
+	liveIngests.WithLabelValues(outcome(err)).Inc()
+}
+
+func outcome(err error) string {
+	if err != nil {
+		return "error"
+	}
+	return "ok"
+}
@@ -0,0 +1,73 @@
+package metrics
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestMiddlewareRecordsRouteAndStatus(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	router := gin.New()
+	router.Use(Middleware())
+	router.GET("/stream/:file_id", func(c *gin.Context) { c.Status(http.StatusTeapot) })
+
+	before := testutil.ToFloat64(httpRequests.WithLabelValues(http.MethodGet, "/stream/:file_id", "418"))
+
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/stream/song-1", nil))
+
+	after := testutil.ToFloat64(httpRequests.WithLabelValues(http.MethodGet, "/stream/:file_id", "418"))
+	if after-before != 1 {
+		t.Fatalf("expected request counter to increase by 1, got %v", after-before)
+	}
+}
+
+func TestObserveStorageCountsErrors(t *testing.T) {
+	before := testutil.ToFloat64(storageErrors.WithLabelValues("bucket", "download"))
+
+	ObserveStorage("bucket", "download", time.Now(), nil)
+	ObserveStorage("bucket", "download", time.Now(), errors.New("boom"))
+
+	after := testutil.ToFloat64(storageErrors.WithLabelValues("bucket", "download"))
+	if after-before != 1 {
+		t.Fatalf("expected one error recorded, got %v", after-before)
+	}
+}
+
+func TestHandlerExposesMetrics(t *testing.T) {
+	TokenIssued()
+	TokenRejected("expired")
+	RateLimited("global")
+
+	rec := httptest.NewRecorder()
+	Handler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+
+	body, _ := io.ReadAll(rec.Result().Body)
+	for _, name := range []string{
+		"gotify_tokens_issued_total",
+		`gotify_token_validation_failures_total{reason="expired"}`,
+		`gotify_rate_limit_rejections_total{limiter="global"}`,
+	} {
+		if !strings.Contains(string(body), name) {
+			t.Fatalf("expected %s in metrics output", name)
+		}
+	}
+}
+
+func TestSongOperationOutcome(t *testing.T) {
+	before := testutil.ToFloat64(songOperations.WithLabelValues("create", "rejected"))
+	SongOperation("create", http.StatusBadRequest)
+	after := testutil.ToFloat64(songOperations.WithLabelValues("create", "rejected"))
+	if after-before != 1 {
+		t.Fatalf("expected rejected outcome, got delta %v", after-before)
+	}
+}
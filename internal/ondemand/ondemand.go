@@ -0,0 +1,428 @@
+// Package ondemand genera variantes HLS que no se crearon al subir la
+// canción (p. ej. un 32k añadido después) a partir del original guardado en
+// storage.MezzaninePath. La variante se sirve mientras ffmpeg la produce y al
+// terminar se sube al bucket junto al resto.
+package ondemand
+
+import (
+	"GOtify/internal/logging"
+	"GOtify/internal/m3u8"
+	"GOtify/internal/metrics"
+	"GOtify/internal/storage"
+	"GOtify/internal/transcode"
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrBusy indica que ya hay Config.MaxJobs variantes generándose.
+var ErrBusy = errors.New("ondemand: too many jobs in progress")
+
+// ErrClosed indica que el servidor se está apagando y no acepta trabajos.
+var ErrClosed = errors.New("ondemand: shutting down")
+
+// ErrUnknownVariant indica una variante fuera de Config.Variants.
+var ErrUnknownVariant = errors.New("ondemand: variant not allowed")
+
+// Backend es el bucket del que se lee el original y al que se sube la
+// variante generada.
+type Backend interface {
+	DownloadFile(ctx context.Context, objectPath string) ([]byte, error)
+	UploadBatch(ctx context.Context, prefix string, files []storage.UploadFile) error
+}
+
+// Transcoder genera una variante en dir; transcode.FFmpeg lo implementa.
+type Transcoder interface {
+	GenerateVariant(ctx context.Context, sourcePath, dir string, variant transcode.Variant, key *transcode.Key) error
+}
+
+// KeyLoader devuelve la clave AES-128 de una canción cifrada.
+type KeyLoader interface {
+	GetSongKey(ctx context.Context, songID string) (storage.SongKey, error)
+}
+
+// Config fija qué variantes pueden generarse y cuántas a la vez.
+type Config struct {
+	Variants []transcode.Variant
+	// MaxJobs limita las variantes que se generan a la vez en esta réplica.
+	MaxJobs int
+	// Timeout corta un trabajo que no termina.
+	Timeout time.Duration
+}
+
+const pollInterval = 100 * time.Millisecond
+
+// Generator reparte las peticiones de variantes ausentes entre trabajos de
+// ffmpeg: las peticiones concurrentes de la misma variante comparten uno.
+type Generator struct {
+	backend    Backend
+	transcoder Transcoder
+	keys       KeyLoader
+	cfg        Config
+
+	// base cuelga de la vida del servidor: Run lo cancela al apagarse y
+	// detiene así los trabajos en curso.
+	base     context.Context
+	shutdown context.CancelFunc
+	running  sync.WaitGroup
+
+	mu   sync.Mutex
+	jobs map[string]*job
+}
+
+// job es una variante en curso. files se rellena al terminar, antes de cerrar
+// done; mientras tanto la lista y los segmentos se leen de dir.
+type job struct {
+	variant transcode.Variant
+	dir     string
+	done    chan struct{}
+	files   map[string]transcode.ResultFile
+	err     error
+}
+
+// New crea el generador. keys puede ser nil si no hay canciones cifradas.
+func New(backend Backend, transcoder Transcoder, keys KeyLoader, cfg Config) *Generator {
+	if cfg.MaxJobs <= 0 {
+		cfg.MaxJobs = 1
+	}
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = 10 * time.Minute
+	}
+	base, shutdown := context.WithCancel(context.Background())
+	return &Generator{
+		backend:    backend,
+		transcoder: transcoder,
+		keys:       keys,
+		cfg:        cfg,
+		base:       base,
+		shutdown:   shutdown,
+		jobs:       make(map[string]*job),
+	}
+}
+
+// Run cancela los trabajos en curso cuando ctx se cancela y espera a que
+// terminen, para que ffmpeg no siga vivo ni queden temporales tras el apagado.
+func (g *Generator) Run(ctx context.Context) {
+	<-ctx.Done()
+	g.mu.Lock()
+	g.shutdown()
+	g.mu.Unlock()
+	g.running.Wait()
+}
+
+// Variants devuelve las variantes que pueden generarse bajo demanda.
+func (g *Generator) Variants() []transcode.Variant {
+	return g.cfg.Variants
+}
+
+// Allows indica si la variante name puede generarse bajo demanda.
+func (g *Generator) Allows(name string) bool {
+	_, ok := g.variant(name)
+	return ok
+}
+
+func (g *Generator) variant(name string) (transcode.Variant, bool) {
+	for _, v := range g.cfg.Variants {
+		if v.Name == name {
+			return v, true
+		}
+	}
+	return transcode.Variant{}, false
+}
+
+// Playlist devuelve la lista de la variante name de la canción songID, cuya
+// carpeta en el bucket es folder. Arranca el trabajo si no existe y espera a
+// que tenga al menos un segmento. Mientras se genera, la lista no lleva
+// #EXT-X-ENDLIST y el reproductor la vuelve a pedir.
+func (g *Generator) Playlist(ctx context.Context, songID, folder, name string) ([]byte, error) {
+	v, ok := g.variant(name)
+	if !ok {
+		return nil, ErrUnknownVariant
+	}
+	j, err := g.start(ctx, songID, folder, v)
+	if err != nil {
+		return nil, err
+	}
+	playlistName := v.Name + ".m3u8"
+	for {
+		if data, ok := j.ready(playlistName); ok {
+			return data, nil
+		}
+		select {
+		case <-j.done:
+			return nil, j.err
+		default:
+		}
+		data, err := os.ReadFile(filepath.Join(j.dir, playlistName))
+		if err == nil {
+			// ffmpeg reescribe la lista entera tras cada segmento; una lectura
+			// incompleta no se puede interpretar y se reintenta.
+			if p, err := m3u8.Parse(data); err == nil && len(p.Segments) > 0 {
+				return startAtBeginning(p), nil
+			}
+		}
+		if err := wait(ctx, j); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// Segment devuelve el segmento name de folder si pertenece a una variante que
+// se está generando; ok es false si no hay trabajo para ella y el segmento
+// debe buscarse en el bucket.
+func (g *Generator) Segment(ctx context.Context, folder, name string) (data []byte, ok bool, err error) {
+	variant, _, found := strings.Cut(name, "_segment_")
+	if !found {
+		return nil, false, nil
+	}
+	g.mu.Lock()
+	j := g.jobs[jobKey(folder, variant)]
+	g.mu.Unlock()
+	if j == nil {
+		return nil, false, nil
+	}
+
+	playlistName := variant + ".m3u8"
+	for {
+		if data, ok := j.ready(name); ok {
+			return data, true, nil
+		}
+		select {
+		case <-j.done:
+			if j.err != nil {
+				return nil, true, j.err
+			}
+			return nil, true, storage.ErrNotFound
+		default:
+		}
+		// Un segmento existe en disco antes de estar completo; solo se sirve
+		// cuando ffmpeg ya lo ha añadido a la lista.
+		if list, err := os.ReadFile(filepath.Join(j.dir, playlistName)); err == nil {
+			if p, err := m3u8.Parse(list); err == nil && listed(p, name) {
+				if data, err := os.ReadFile(filepath.Join(j.dir, name)); err == nil {
+					return data, true, nil
+				}
+			}
+		}
+		if err := wait(ctx, j); err != nil {
+			return nil, true, err
+		}
+	}
+}
+
+// start devuelve el trabajo de la variante o lanza uno nuevo.
+func (g *Generator) start(ctx context.Context, songID, folder string, v transcode.Variant) (*job, error) {
+	key := jobKey(folder, v.Name)
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if j, ok := g.jobs[key]; ok {
+		return j, nil
+	}
+	if g.base.Err() != nil {
+		return nil, ErrClosed
+	}
+	if len(g.jobs) >= g.cfg.MaxJobs {
+		return nil, ErrBusy
+	}
+	dir, err := os.MkdirTemp("", "gotify-ondemand-*")
+	if err != nil {
+		return nil, err
+	}
+	j := &job{variant: v, dir: dir, done: make(chan struct{})}
+	g.jobs[key] = j
+
+	// El trabajo sigue aunque se desconecte quien lo pidió: otros pueden estar
+	// esperando y el resultado se guarda para los siguientes. Solo lo cortan
+	// el timeout y el apagado del servidor.
+	runCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), g.cfg.Timeout)
+	stop := context.AfterFunc(g.base, cancel)
+	g.running.Add(1)
+	go func() {
+		defer g.running.Done()
+		defer stop()
+		defer cancel()
+		g.run(runCtx, j, songID, folder)
+		g.mu.Lock()
+		delete(g.jobs, key)
+		g.mu.Unlock()
+		os.RemoveAll(j.dir)
+	}()
+	return j, nil
+}
+
+// run genera la variante, publica el resultado en j y lo sube al bucket.
+func (g *Generator) run(ctx context.Context, j *job, songID, folder string) {
+	logger := logging.FromContext(ctx).With("song_id", songID, "variant", j.variant.Name)
+	files, err := g.generate(ctx, j, songID)
+	metrics.OnDemandJob(err)
+	j.files, j.err = files, err
+	close(j.done)
+	if err != nil {
+		logger.Error("on-demand transcode failed", "error", err)
+		return
+	}
+
+	uploads := make([]storage.UploadFile, 0, len(files))
+	for _, f := range files {
+		uploads = append(uploads, storage.UploadFile{Path: f.Name, Content: f.Content, ContentType: f.ContentType})
+	}
+	// Sin subir, la siguiente petición vuelve a generarla.
+	if err := g.backend.UploadBatch(ctx, folder, uploads); err != nil {
+		logger.Error("on-demand upload failed", "error", err)
+		return
+	}
+	logger.Info("on-demand variant stored", "files", len(uploads))
+}
+
+func (g *Generator) generate(ctx context.Context, j *job, songID string) (map[string]transcode.ResultFile, error) {
+	source, err := g.backend.DownloadFile(ctx, storage.MezzaninePath(songID))
+	if err != nil {
+		return nil, fmt.Errorf("mezzanine: %w", err)
+	}
+	src, err := os.CreateTemp("", "gotify-mezzanine-*")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(src.Name())
+	_, err = src.Write(source)
+	if closeErr := src.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := g.songKey(ctx, songID)
+	if err != nil {
+		return nil, err
+	}
+	if err := g.transcoder.GenerateVariant(ctx, src.Name(), j.dir, j.variant, key); err != nil {
+		return nil, err
+	}
+
+	results, err := transcode.CollectFiles(j.dir)
+	if err != nil {
+		return nil, err
+	}
+	files := make(map[string]transcode.ResultFile, len(results))
+	for _, f := range results {
+		files[f.Name] = f
+	}
+	playlistName := j.variant.Name + ".m3u8"
+	playlist, ok := files[playlistName]
+	if !ok {
+		return nil, fmt.Errorf("ffmpeg did not write %s", playlistName)
+	}
+	if playlist.Content, err = asVOD(playlist.Content); err != nil {
+		return nil, err
+	}
+	files[playlistName] = playlist
+	return files, nil
+}
+
+// songKey devuelve la clave de la canción si está cifrada, para que la nueva
+// variante use la misma que el resto.
+func (g *Generator) songKey(ctx context.Context, songID string) (*transcode.Key, error) {
+	if g.keys == nil {
+		return nil, nil
+	}
+	k, err := g.keys.GetSongKey(ctx, songID)
+	if errors.Is(err, storage.ErrNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	key, err := hex.DecodeString(k.Key)
+	if err != nil {
+		return nil, fmt.Errorf("song key: %w", err)
+	}
+	iv, err := hex.DecodeString(k.IV)
+	if err != nil {
+		return nil, fmt.Errorf("song key iv: %w", err)
+	}
+	return &transcode.Key{Key: key, IV: iv}, nil
+}
+
+// ready devuelve name si el trabajo ya terminó con éxito.
+func (j *job) ready(name string) ([]byte, bool) {
+	select {
+	case <-j.done:
+		f, ok := j.files[name]
+		return f.Content, ok && j.err == nil
+	default:
+		return nil, false
+	}
+}
+
+// wait espera al siguiente sondeo, a que termine el trabajo o a que se
+// cancele la petición.
+func wait(ctx context.Context, j *job) error {
+	timer := time.NewTimer(pollInterval)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-j.done:
+	case <-timer.C:
+	}
+	return nil
+}
+
+func jobKey(folder, variant string) string {
+	return folder + "/" + variant
+}
+
+func listed(p *m3u8.Playlist, name string) bool {
+	for _, s := range p.Segments {
+		if s.URI == name {
+			return true
+		}
+	}
+	return false
+}
+
+// startAtBeginning marca la lista en curso para que el reproductor empiece
+// por el primer segmento y no por el último, como haría con una lista EVENT.
+func startAtBeginning(p *m3u8.Playlist) []byte {
+	start := m3u8.Tag{Name: "EXT-X-START"}
+	start.Attrs.Set("TIME-OFFSET", "0", false)
+	p.Header = append(p.Header, start)
+	return p.Encode()
+}
+
+// asVOD convierte la lista EVENT terminada en la VOD que se guarda.
+func asVOD(data []byte) ([]byte, error) {
+	p, err := m3u8.Parse(data)
+	if err != nil {
+		return nil, err
+	}
+	found := false
+	for i, tag := range p.Header {
+		if tag.Name == "EXT-X-PLAYLIST-TYPE" {
+			p.Header[i].Value, found = "VOD", true
+		}
+	}
+	if !found {
+		p.Header = append(p.Header, m3u8.Tag{Name: "EXT-X-PLAYLIST-TYPE", Value: "VOD"})
+	}
+	if !hasEndList(p) {
+		p.Trailer = append(p.Trailer, m3u8.Tag{Name: "EXT-X-ENDLIST"})
+	}
+	return p.Encode(), nil
+}
+
+func hasEndList(p *m3u8.Playlist) bool {
+	for _, tag := range p.Trailer {
+		if tag.Name == "EXT-X-ENDLIST" {
+			return true
+		}
+	}
+	return false
+}
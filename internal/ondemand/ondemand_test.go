@@ -0,0 +1,240 @@
+package ondemand
+
+import (
+	"GOtify/internal/storage"
+	"GOtify/internal/transcode"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type fakeBackend struct {
+	mu       sync.Mutex
+	objects  map[string][]byte
+	uploaded chan string
+}
+
+func (f *fakeBackend) DownloadFile(_ context.Context, objectPath string) ([]byte, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	data, ok := f.objects[objectPath]
+	if !ok {
+		return nil, storage.ErrNotFound
+	}
+	return data, nil
+}
+
+func (f *fakeBackend) UploadBatch(_ context.Context, prefix string, files []storage.UploadFile) error {
+	f.mu.Lock()
+	for _, file := range files {
+		f.objects[prefix+"/"+file.Path] = file.Content
+	}
+	f.mu.Unlock()
+	f.uploaded <- prefix
+	return nil
+}
+
+func (f *fakeBackend) object(objectPath string) []byte {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.objects[objectPath]
+}
+
+// fakeTranscoder escribe un segmento, espera a release y escribe el segundo
+// con #EXT-X-ENDLIST, como ffmpeg con una lista EVENT.
+type fakeTranscoder struct {
+	calls   atomic.Int32
+	release chan struct{}
+	key     *transcode.Key
+}
+
+func (f *fakeTranscoder) GenerateVariant(ctx context.Context, sourcePath, dir string, v transcode.Variant, key *transcode.Key) error {
+	f.calls.Add(1)
+	f.key = key
+	if data, err := os.ReadFile(sourcePath); err != nil || string(data) != "original" {
+		return fmt.Errorf("unexpected source %q: %v", data, err)
+	}
+	playlist := filepath.Join(dir, v.Name+".m3u8")
+	list := "#EXTM3U\n#EXT-X-PLAYLIST-TYPE:EVENT\n"
+	for i := range 2 {
+		if i == 1 {
+			select {
+			case <-f.release:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+		name := fmt.Sprintf("%s_segment_%03d.ts", v.Name, i)
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(name), 0o644); err != nil {
+			return err
+		}
+		list += "#EXTINF:4,\n" + name + "\n"
+		if i == 1 {
+			list += "#EXT-X-ENDLIST\n"
+		}
+		if err := os.WriteFile(playlist, []byte(list), 0o644); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func newTestGenerator(maxJobs int) (*Generator, *fakeBackend, *fakeTranscoder) {
+	backend := &fakeBackend{
+		objects:  map[string][]byte{storage.MezzaninePath("song-1"): []byte("original")},
+		uploaded: make(chan string, 4),
+	}
+	transcoder := &fakeTranscoder{release: make(chan struct{})}
+	g := New(backend, transcoder, nil, Config{
+		Variants: []transcode.Variant{{Name: "32k", BitrateKbps: 32}, {Name: "48k", BitrateKbps: 48}},
+		MaxJobs:  maxJobs,
+	})
+	return g, backend, transcoder
+}
+
+func TestGeneratorServesWhileTranscoding(t *testing.T) {
+	g, backend, transcoder := newTestGenerator(1)
+	ctx := context.Background()
+
+	var wg sync.WaitGroup
+	lists := make([][]byte, 3)
+	for i := range lists {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			data, err := g.Playlist(ctx, "song-1", "my-song", "32k")
+			if err != nil {
+				t.Errorf("Playlist: %v", err)
+			}
+			lists[i] = data
+		}()
+	}
+	wg.Wait()
+	if n := transcoder.calls.Load(); n != 1 {
+		t.Fatalf("expected concurrent requests to share one job, got %d", n)
+	}
+	list := string(lists[0])
+	if !strings.Contains(list, "#EXT-X-START:TIME-OFFSET=0") || !strings.Contains(list, "32k_segment_000.ts") || strings.Contains(list, "ENDLIST") {
+		t.Fatalf("unexpected in-progress playlist:\n%s", list)
+	}
+
+	if _, err := g.Playlist(ctx, "song-1", "my-song", "48k"); !errors.Is(err, ErrBusy) {
+		t.Fatalf("expected ErrBusy beyond MaxJobs, got %v", err)
+	}
+	if _, err := g.Playlist(ctx, "song-1", "my-song", "96k"); !errors.Is(err, ErrUnknownVariant) {
+		t.Fatalf("expected ErrUnknownVariant, got %v", err)
+	}
+
+	data, ok, err := g.Segment(ctx, "my-song", "32k_segment_000.ts")
+	if !ok || err != nil || string(data) != "32k_segment_000.ts" {
+		t.Fatalf("expected first segment from the job, got %q %v %v", data, ok, err)
+	}
+	if _, ok, _ := g.Segment(ctx, "my-song", "64k_segment_000.ts"); ok {
+		t.Fatalf("segments of other variants must be left to the bucket")
+	}
+
+	next := make(chan []byte)
+	go func() {
+		data, _, _ := g.Segment(ctx, "my-song", "32k_segment_001.ts")
+		next <- data
+	}()
+	time.Sleep(2 * pollInterval)
+	close(transcoder.release)
+	if data := <-next; string(data) != "32k_segment_001.ts" {
+		t.Fatalf("expected pending segment once produced, got %q", data)
+	}
+
+	select {
+	case prefix := <-backend.uploaded:
+		if prefix != "my-song" {
+			t.Fatalf("uploaded to %q", prefix)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("variant was not uploaded")
+	}
+	stored := backend.object("my-song/32k.m3u8")
+	if !bytes.Contains(stored, []byte("#EXT-X-PLAYLIST-TYPE:VOD")) || !bytes.Contains(stored, []byte("#EXT-X-ENDLIST")) || bytes.Contains(stored, []byte("EXT-X-START")) {
+		t.Fatalf("unexpected stored playlist:\n%s", stored)
+	}
+	if backend.object("my-song/32k_segment_001.ts") == nil {
+		t.Fatalf("segments were not uploaded")
+	}
+}
+
+func TestGeneratorRunCancelsJobs(t *testing.T) {
+	g, backend, _ := newTestGenerator(1)
+	if _, err := g.Playlist(context.Background(), "song-1", "my-song", "32k"); err != nil {
+		t.Fatalf("Playlist: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan struct{})
+	go func() {
+		g.Run(ctx)
+		close(stopped)
+	}()
+	cancel()
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Run did not return after cancelling the job")
+	}
+	g.mu.Lock()
+	jobs := len(g.jobs)
+	g.mu.Unlock()
+	if jobs != 0 {
+		t.Fatalf("expected the job to be gone, got %d", jobs)
+	}
+	if backend.object("my-song/32k.m3u8") != nil {
+		t.Fatal("a cancelled job must not be uploaded")
+	}
+	if _, err := g.Playlist(context.Background(), "song-1", "my-song", "48k"); !errors.Is(err, ErrClosed) {
+		t.Fatalf("expected ErrClosed after shutdown, got %v", err)
+	}
+}
+
+func TestGeneratorErrors(t *testing.T) {
+	g, _, transcoder := newTestGenerator(2)
+	close(transcoder.release)
+
+	if _, err := g.Playlist(context.Background(), "missing", "other", "32k"); !errors.Is(err, storage.ErrNotFound) {
+		t.Fatalf("expected missing mezzanine to fail with ErrNotFound, got %v", err)
+	}
+}
+
+func TestGeneratorReusesSongKey(t *testing.T) {
+	backend := &fakeBackend{
+		objects:  map[string][]byte{storage.MezzaninePath("song-1"): []byte("original")},
+		uploaded: make(chan string, 1),
+	}
+	transcoder := &fakeTranscoder{release: make(chan struct{})}
+	close(transcoder.release)
+	keys := fakeKeys{"song-1": {SongID: "song-1", Key: "000102030405060708090a0b0c0d0e0f", IV: "0f0e0d0c0b0a09080706050403020100"}}
+	g := New(backend, transcoder, keys, Config{Variants: []transcode.Variant{{Name: "32k", BitrateKbps: 32}}})
+
+	if _, err := g.Playlist(context.Background(), "song-1", "my-song", "32k"); err != nil {
+		t.Fatalf("Playlist: %v", err)
+	}
+	<-backend.uploaded
+	if transcoder.key == nil || len(transcoder.key.Key) != 16 || transcoder.key.IV[0] != 0x0f {
+		t.Fatalf("expected the song key to be reused, got %+v", transcoder.key)
+	}
+}
+
+type fakeKeys map[string]storage.SongKey
+
+func (f fakeKeys) GetSongKey(_ context.Context, songID string) (storage.SongKey, error) {
+	k, ok := f[songID]
+	if !ok {
+		return storage.SongKey{}, storage.ErrNotFound
+	}
+	return k, nil
+}
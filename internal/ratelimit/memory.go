@@ -0,0 +1,57 @@
+package ratelimit
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// MemoryStore guarda los contadores en el proceso; no se comparte entre réplicas.
+type MemoryStore struct {
+	mu       sync.Mutex
+	counters map[string]*counter
+	now      func() time.Time
+	lastGC   time.Time
+}
+
+type counter struct {
+	count int
+	reset time.Time
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{counters: map[string]*counter{}, now: time.Now}
+}
+
+func (s *MemoryStore) Allow(_ context.Context, key string, limit int, window time.Duration) (Result, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := s.now()
+	s.collect(now, window)
+	ctr, ok := s.counters[key]
+	if !ok || !now.Before(ctr.reset) {
+		ctr = &counter{reset: now.Add(window)}
+		s.counters[key] = ctr
+	}
+	ctr.count++
+	return Result{
+		Allowed:   ctr.count <= limit,
+		Limit:     limit,
+		Remaining: max(limit-ctr.count, 0),
+		Reset:     ctr.reset,
+	}, nil
+}
+
+// collect descarta los contadores vencidos como mucho una vez por ventana.
+func (s *MemoryStore) collect(now time.Time, window time.Duration) {
+	if now.Sub(s.lastGC) < window {
+		return
+	}
+	s.lastGC = now
+	for key, ctr := range s.counters {
+		if !now.Before(ctr.reset) {
+			delete(s.counters, key)
+		}
+	}
+}
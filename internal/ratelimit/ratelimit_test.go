@@ -0,0 +1,134 @@
+package ratelimit
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/gin-gonic/gin"
+	"github.com/redis/go-redis/v9"
+)
+
+func newRouter(store Store, rule Rule) *gin.Engine {
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.GET("/", Middleware(store, rule), func(c *gin.Context) { c.Status(http.StatusOK) })
+	return r
+}
+
+func do(r http.Handler, apiKey string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	if apiKey != "" {
+		req.Header.Set("X-API-Key", apiKey)
+	}
+	rec := httptest.NewRecorder()
+	r.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestMiddlewareHeadersAndRejection(t *testing.T) {
+	r := newRouter(NewMemoryStore(), Rule{Name: "test", Limit: 2, Window: time.Minute, Key: ByAPIKey})
+
+	for i, wantRemaining := range []string{"1", "0"} {
+		rec := do(r, "key-a")
+		if rec.Code != http.StatusOK {
+			t.Fatalf("request %d: expected 200, got %d", i, rec.Code)
+		}
+		if rec.Header().Get("X-RateLimit-Limit") != "2" || rec.Header().Get("X-RateLimit-Remaining") != wantRemaining {
+			t.Fatalf("request %d: unexpected headers %v", i, rec.Header())
+		}
+		reset, err := strconv.ParseInt(rec.Header().Get("X-RateLimit-Reset"), 10, 64)
+		if err != nil || reset < time.Now().Unix() {
+			t.Fatalf("request %d: unexpected reset %q", i, rec.Header().Get("X-RateLimit-Reset"))
+		}
+	}
+
+	rec := do(r, "key-a")
+	if rec.Code != http.StatusTooManyRequests {
+		t.Fatalf("expected 429, got %d", rec.Code)
+	}
+	if rec.Header().Get("Retry-After") == "" {
+		t.Fatal("expected Retry-After on rejection")
+	}
+
+	if rec := do(r, "key-b"); rec.Code != http.StatusOK {
+		t.Fatalf("expected another api key to have its own budget, got %d", rec.Code)
+	}
+}
+
+type failingStore struct{}
+
+func (failingStore) Allow(context.Context, string, int, time.Duration) (Result, error) {
+	return Result{}, errors.New("store down")
+}
+
+func TestMiddlewareFailsOpen(t *testing.T) {
+	r := newRouter(failingStore{}, Rule{Name: "test", Limit: 1, Window: time.Minute})
+	for i := 0; i < 3; i++ {
+		if rec := do(r, ""); rec.Code != http.StatusOK {
+			t.Fatalf("expected store errors to let requests through, got %d", rec.Code)
+		}
+	}
+}
+
+func TestMemoryStoreWindowReset(t *testing.T) {
+	store := NewMemoryStore()
+	now := time.Now()
+	store.now = func() time.Time { return now }
+
+	for i := 0; i < 2; i++ {
+		if res, _ := store.Allow(context.Background(), "k", 2, time.Second); !res.Allowed {
+			t.Fatalf("request %d: expected allowed", i)
+		}
+	}
+	if res, _ := store.Allow(context.Background(), "k", 2, time.Second); res.Allowed {
+		t.Fatal("expected third request to be rejected")
+	}
+
+	now = now.Add(time.Second)
+	if res, _ := store.Allow(context.Background(), "k", 2, time.Second); !res.Allowed || res.Remaining != 1 {
+		t.Fatalf("expected a fresh window, got %+v", res)
+	}
+}
+
+func TestRedisStoreSharesCountersAcrossReplicas(t *testing.T) {
+	mr := miniredis.RunT(t)
+	replicaA := NewRedisStore(redis.NewClient(&redis.Options{Addr: mr.Addr()}))
+	replicaB, err := NewRedisStoreFromURL("redis://" + mr.Addr() + "/0")
+	if err != nil {
+		t.Fatalf("NewRedisStoreFromURL: %v", err)
+	}
+	ctx := context.Background()
+
+	if err := replicaA.Ping(ctx); err != nil {
+		t.Fatalf("Ping: %v", err)
+	}
+	if res, err := replicaA.Allow(ctx, "k", 2, time.Minute); err != nil || !res.Allowed || res.Remaining != 1 {
+		t.Fatalf("unexpected first result %+v (%v)", res, err)
+	}
+	if res, _ := replicaB.Allow(ctx, "k", 2, time.Minute); !res.Allowed || res.Remaining != 0 {
+		t.Fatalf("expected replica B to see replica A's count, got %+v", res)
+	}
+	res, _ := replicaA.Allow(ctx, "k", 2, time.Minute)
+	if res.Allowed {
+		t.Fatal("expected shared budget to be exhausted")
+	}
+	if until := time.Until(res.Reset); until <= 0 || until > time.Minute {
+		t.Fatalf("unexpected reset %v", res.Reset)
+	}
+
+	mr.FastForward(time.Minute)
+	if res, _ := replicaB.Allow(ctx, "k", 2, time.Minute); !res.Allowed {
+		t.Fatal("expected counter to expire with the window")
+	}
+
+	mr.Close()
+	if _, err := replicaA.Allow(ctx, "k", 2, time.Minute); err == nil {
+		t.Fatal("expected error when redis is unreachable")
+	}
+}
@@ -0,0 +1,72 @@
+package ratelimit
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// allowScript incrementa el contador y fija su expiración en la primera
+// petición de la ventana, de forma atómica. Devuelve {cuenta, ms restantes}.
+var allowScript = redis.NewScript(`
+local count = redis.call("INCR", KEYS[1])
+if count == 1 then
+  redis.call("PEXPIRE", KEYS[1], ARGV[1])
+end
+local ttl = redis.call("PTTL", KEYS[1])
+if ttl < 0 then
+  redis.call("PEXPIRE", KEYS[1], ARGV[1])
+  ttl = tonumber(ARGV[1])
+end
+return {count, ttl}
+`)
+
+// RedisStore comparte los contadores entre réplicas mediante cualquier
+// servidor que hable el protocolo de Redis.
+type RedisStore struct {
+	client RedisClient
+}
+
+// RedisClient es lo que RedisStore usa de un cliente; *redis.Client y
+// *redis.ClusterClient lo implementan.
+type RedisClient interface {
+	redis.Scripter
+	Ping(ctx context.Context) *redis.StatusCmd
+}
+
+func NewRedisStore(client RedisClient) *RedisStore {
+	return &RedisStore{client: client}
+}
+
+// NewRedisStoreFromURL conecta con una URL redis://[:password@]host:port/db.
+func NewRedisStoreFromURL(rawURL string) (*RedisStore, error) {
+	opts, err := redis.ParseURL(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("parse redis url: %w", err)
+	}
+	return NewRedisStore(redis.NewClient(opts)), nil
+}
+
+func (s *RedisStore) Allow(ctx context.Context, key string, limit int, window time.Duration) (Result, error) {
+	vals, err := allowScript.Run(ctx, s.client, []string{key}, window.Milliseconds()).Int64Slice()
+	if err != nil {
+		return Result{}, err
+	}
+	if len(vals) != 2 {
+		return Result{}, fmt.Errorf("unexpected rate limit script reply %v", vals)
+	}
+	count := int(vals[0])
+	return Result{
+		Allowed:   count <= limit,
+		Limit:     limit,
+		Remaining: max(limit-count, 0),
+		Reset:     time.Now().Add(time.Duration(vals[1]) * time.Millisecond),
+	}, nil
+}
+
+// Ping comprueba la conexión, para /readyz.
+func (s *RedisStore) Ping(ctx context.Context) error {
+	return s.client.Ping(ctx).Err()
+}
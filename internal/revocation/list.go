@@ -0,0 +1,174 @@
+// Package revocation mantiene en memoria la lista de tokens revocados, leída
+// del catálogo y refrescada periódicamente.
+package revocation
+
+import (
+	"GOtify/internal/logging"
+	"GOtify/internal/security"
+	"GOtify/internal/storage"
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Store persiste las revocaciones; storage.Store lo implementa.
+type Store interface {
+	ListRevocations(ctx context.Context) ([]storage.Revocation, error)
+	InsertRevocation(ctx context.Context, r storage.Revocation) error
+}
+
+var ErrInvalid = errors.New("invalid revocation")
+
+// List es la caché de revocaciones consultada en cada petición de /stream.
+type List struct {
+	store   Store
+	refresh time.Duration
+	now     func() time.Time
+
+	mu      sync.RWMutex
+	entries []storage.Revocation
+	tokens  map[string]bool
+	users   map[string]time.Time
+	songs   map[string]time.Time
+	loaded  time.Time
+}
+
+// New crea una lista vacía; llamar a Refresh o Run para cargarla.
+func New(store Store, refresh time.Duration) *List {
+	l := &List{store: store, refresh: refresh, now: time.Now}
+	l.apply(nil)
+	return l
+}
+
+// Refresh recarga la lista desde el catálogo.
+func (l *List) Refresh(ctx context.Context) error {
+	entries, err := l.store.ListRevocations(ctx)
+	if err != nil {
+		return fmt.Errorf("load revocations: %w", err)
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.apply(entries)
+	l.loaded = l.now()
+	return nil
+}
+
+// Run refresca la lista cada intervalo hasta que ctx se cancela. Si una
+// recarga falla se conserva la última lista conocida.
+func (l *List) Run(ctx context.Context) {
+	ticker := time.NewTicker(l.refresh)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := l.Refresh(ctx); err != nil && ctx.Err() == nil {
+				logging.FromContext(ctx).Warn("revocation refresh failed", "error", err)
+			}
+		}
+	}
+}
+
+// apply reconstruye los índices; requiere l.mu tomado (salvo en New).
+func (l *List) apply(entries []storage.Revocation) {
+	l.entries = entries
+	l.tokens = map[string]bool{}
+	l.users = map[string]time.Time{}
+	l.songs = map[string]time.Time{}
+	for _, r := range entries {
+		l.index(r)
+	}
+}
+
+func (l *List) index(r storage.Revocation) {
+	switch r.Kind {
+	case storage.RevokeToken:
+		l.tokens[r.Subject] = true
+	case storage.RevokeUser:
+		if r.NotBefore.After(l.users[r.Subject]) {
+			l.users[r.Subject] = r.NotBefore
+		}
+	case storage.RevokeSong:
+		if r.NotBefore.After(l.songs[r.Subject]) {
+			l.songs[r.Subject] = r.NotBefore
+		}
+	}
+}
+
+// IsRevoked indica si el token fue revocado. Los tokens sin fecha de emisión
+// (v1) se consideran emitidos antes de cualquier revocación por canción.
+func (l *List) IsRevoked(c security.Claims) bool {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	if c.ID != "" && l.tokens[c.ID] {
+		return true
+	}
+	issued := time.Unix(c.IssuedAt, 0)
+	if nb, ok := l.songs[c.File]; ok && issued.Before(nb) {
+		return true
+	}
+	if c.User != "" {
+		if nb, ok := l.users[c.User]; ok && issued.Before(nb) {
+			return true
+		}
+	}
+	return false
+}
+
+// Revoke guarda la revocación en el catálogo y la aplica de inmediato en esta
+// réplica; las demás la verán en su siguiente refresco. Sin NotBefore se usa
+// el instante actual.
+func (l *List) Revoke(ctx context.Context, r storage.Revocation) (storage.Revocation, error) {
+	r.Subject = strings.TrimSpace(r.Subject)
+	switch r.Kind {
+	case storage.RevokeToken, storage.RevokeUser, storage.RevokeSong:
+	default:
+		return r, fmt.Errorf("%w: kind must be token, user or song", ErrInvalid)
+	}
+	if r.Subject == "" {
+		return r, fmt.Errorf("%w: subject is required", ErrInvalid)
+	}
+	now := l.now().UTC()
+	if r.NotBefore.IsZero() {
+		r.NotBefore = now
+	}
+	r.ID = uuid.NewString()
+	r.CreatedAt = now
+
+	if err := l.store.InsertRevocation(ctx, r); err != nil {
+		return r, err
+	}
+	l.mu.Lock()
+	l.entries = append(l.entries, r)
+	l.index(r)
+	l.mu.Unlock()
+	return r, nil
+}
+
+// Entries devuelve una copia de las revocaciones conocidas.
+func (l *List) Entries() []storage.Revocation {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return append([]storage.Revocation(nil), l.entries...)
+}
+
+// Ping falla si la lista nunca se cargó o lleva más de tres intervalos sin
+// refrescarse, para exponerlo en /readyz.
+func (l *List) Ping(context.Context) error {
+	l.mu.RLock()
+	loaded := l.loaded
+	l.mu.RUnlock()
+	if loaded.IsZero() {
+		return errors.New("revocation list not loaded")
+	}
+	if age := l.now().Sub(loaded); age > 3*l.refresh {
+		return fmt.Errorf("revocation list stale for %s", age.Round(time.Second))
+	}
+	return nil
+}
@@ -0,0 +1,114 @@
+package revocation
+
+import (
+	"GOtify/internal/security"
+	"GOtify/internal/storage"
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+type fakeStore struct {
+	entries []storage.Revocation
+	listErr error
+}
+
+func (f *fakeStore) ListRevocations(context.Context) ([]storage.Revocation, error) {
+	if f.listErr != nil {
+		return nil, f.listErr
+	}
+	return append([]storage.Revocation(nil), f.entries...), nil
+}
+
+func (f *fakeStore) InsertRevocation(_ context.Context, r storage.Revocation) error {
+	f.entries = append(f.entries, r)
+	return nil
+}
+
+func TestListIsRevoked(t *testing.T) {
+	cutoff := time.Now()
+	store := &fakeStore{entries: []storage.Revocation{
+		{Kind: storage.RevokeToken, Subject: "tok-1"},
+		{Kind: storage.RevokeUser, Subject: "user-1", NotBefore: cutoff},
+		{Kind: storage.RevokeSong, Subject: "song-1", NotBefore: cutoff},
+	}}
+	list := New(store, time.Minute)
+	if err := list.Refresh(context.Background()); err != nil {
+		t.Fatalf("Refresh: %v", err)
+	}
+
+	before := cutoff.Add(-time.Minute).Unix()
+	after := cutoff.Add(time.Minute).Unix()
+	cases := []struct {
+		name    string
+		claims  security.Claims
+		revoked bool
+	}{
+		{"token id", security.Claims{ID: "tok-1", File: "other", IssuedAt: after}, true},
+		{"other token", security.Claims{ID: "tok-2", File: "other", IssuedAt: before}, false},
+		{"user before cutoff", security.Claims{User: "user-1", File: "other", IssuedAt: before}, true},
+		{"user after cutoff", security.Claims{User: "user-1", File: "other", IssuedAt: after}, false},
+		{"song before cutoff", security.Claims{File: "song-1", IssuedAt: before}, true},
+		{"song after cutoff", security.Claims{File: "song-1", IssuedAt: after}, false},
+		{"legacy token for revoked song", security.Claims{File: "song-1"}, true},
+	}
+	for _, tc := range cases {
+		if got := list.IsRevoked(tc.claims); got != tc.revoked {
+			t.Fatalf("%s: expected revoked=%v, got %v", tc.name, tc.revoked, got)
+		}
+	}
+}
+
+func TestListRevokeAppliesImmediately(t *testing.T) {
+	store := &fakeStore{}
+	list := New(store, time.Minute)
+
+	created, err := list.Revoke(context.Background(), storage.Revocation{Kind: storage.RevokeSong, Subject: " song-1 "})
+	if err != nil {
+		t.Fatalf("Revoke: %v", err)
+	}
+	if created.ID == "" || created.NotBefore.IsZero() || created.Subject != "song-1" {
+		t.Fatalf("unexpected revocation %+v", created)
+	}
+	if len(store.entries) != 1 {
+		t.Fatalf("expected revocation persisted, got %d", len(store.entries))
+	}
+	if !list.IsRevoked(security.Claims{File: "song-1", IssuedAt: time.Now().Add(-time.Second).Unix()}) {
+		t.Fatal("expected revocation to apply without waiting for a refresh")
+	}
+
+	for _, bad := range []storage.Revocation{{Kind: "album", Subject: "x"}, {Kind: storage.RevokeUser}} {
+		if _, err := list.Revoke(context.Background(), bad); !errors.Is(err, ErrInvalid) {
+			t.Fatalf("expected ErrInvalid for %+v, got %v", bad, err)
+		}
+	}
+}
+
+func TestListKeepsLastKnownStateOnRefreshError(t *testing.T) {
+	store := &fakeStore{entries: []storage.Revocation{{Kind: storage.RevokeToken, Subject: "tok-1"}}}
+	list := New(store, time.Minute)
+
+	if err := list.Ping(context.Background()); err == nil {
+		t.Fatal("expected Ping to fail before the first load")
+	}
+	if err := list.Refresh(context.Background()); err != nil {
+		t.Fatalf("Refresh: %v", err)
+	}
+	if err := list.Ping(context.Background()); err != nil {
+		t.Fatalf("expected Ping to pass after load: %v", err)
+	}
+
+	store.listErr = errors.New("catalog down")
+	if err := list.Refresh(context.Background()); err == nil {
+		t.Fatal("expected refresh error")
+	}
+	if !list.IsRevoked(security.Claims{ID: "tok-1"}) {
+		t.Fatal("expected previous entries to survive a failed refresh")
+	}
+
+	list.now = func() time.Time { return time.Now().Add(10 * time.Minute) }
+	if err := list.Ping(context.Background()); err == nil {
+		t.Fatal("expected stale list to fail Ping")
+	}
+}
@@ -0,0 +1,165 @@
+package security
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/netip"
+	"slices"
+	"strings"
+	"time"
+)
+
+// TokenVersion es la versión del formato de token con claims. Los tokens v1
+// (HMAC hex de "file|exp") se siguen aceptando vía Validate.
+const TokenVersion = 2
+
+const scopedPrefix = "v2."
+
+var (
+	ErrMalformedToken = errors.New("malformed token")
+	ErrBadSignature   = errors.New("bad signature")
+)
+
+// Claims describe el alcance de un token de reproducción. Los campos vacíos
+// no restringen nada.
+type Claims struct {
+	// KeyID identifica la clave de firma (ver Keyring).
+	KeyID string `json:"kid,omitempty"`
+	// ID identifica el token para poder revocarlo individualmente.
+	ID       string `json:"jti,omitempty"`
+	File     string `json:"f"`
+	IssuedAt int64  `json:"iat,omitempty"`
+	Expires  int64  `json:"e"`
+	// Variants limita las variantes HLS accesibles (p. ej. "64k", "128k").
+	Variants []string `json:"v,omitempty"`
+	// ClientIP es una IP o un rango CIDR desde el que se puede reproducir.
+	ClientIP string `json:"ip,omitempty"`
+	User     string `json:"sub,omitempty"`
+	Audience string `json:"aud,omitempty"`
+	// MaxBitrateKbps rechaza las variantes de mayor tasa de bits.
+	MaxBitrateKbps int `json:"mbr,omitempty"`
+	// Session pide canjear el token por una cookie de sesión al cargar la
+	// lista maestra, en lugar de repetirlo en cada URI de las listas.
+	Session bool `json:"ses,omitempty"`
+}
+
+// IsScoped indica si token usa el formato con claims.
+func IsScoped(token string) bool {
+	return strings.HasPrefix(token, scopedPrefix)
+}
+
+// Issue firma claims con el formato v2: "v2.<claims>.<firma>", ambos en
+// base64url sin relleno. Completa ID e IssuedAt si vienen vacíos.
+func (s *Signer) Issue(claims Claims) (string, error) {
+	if claims.ID == "" {
+		id := make([]byte, 12)
+		if _, err := rand.Read(id); err != nil {
+			return "", err
+		}
+		claims.ID = base64.RawURLEncoding.EncodeToString(id)
+	}
+	if claims.IssuedAt == 0 {
+		claims.IssuedAt = time.Now().Unix()
+	}
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	body := scopedPrefix + base64.RawURLEncoding.EncodeToString(payload)
+	return body + "." + base64.RawURLEncoding.EncodeToString(s.mac(body)), nil
+}
+
+// ParseClaims verifica la firma de un token v2 y devuelve sus claims. No
+// comprueba la expiración ni el alcance; ver Claims.
+func (s *Signer) ParseClaims(token string) (Claims, error) {
+	body, mac, claims, err := decodeScoped(token)
+	if err != nil {
+		return Claims{}, err
+	}
+	if !hmac.Equal(mac, s.mac(body)) {
+		return Claims{}, ErrBadSignature
+	}
+	return claims, nil
+}
+
+// decodeScoped separa un token v2 en el cuerpo firmado, la firma y las
+// claims, sin verificar nada.
+func decodeScoped(token string) (body string, mac []byte, claims Claims, err error) {
+	if !IsScoped(token) {
+		return "", nil, Claims{}, ErrMalformedToken
+	}
+	idx := strings.LastIndexByte(token, '.')
+	if idx <= len(scopedPrefix) {
+		return "", nil, Claims{}, ErrMalformedToken
+	}
+	body = token[:idx]
+	mac, err = base64.RawURLEncoding.DecodeString(token[idx+1:])
+	if err != nil {
+		return "", nil, Claims{}, ErrMalformedToken
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(body[len(scopedPrefix):])
+	if err != nil {
+		return "", nil, Claims{}, ErrMalformedToken
+	}
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return "", nil, Claims{}, ErrMalformedToken
+	}
+	return body, mac, claims, nil
+}
+
+func (s *Signer) mac(body string) []byte {
+	mac := hmac.New(sha256.New, s.Secret)
+	mac.Write([]byte(body))
+	return mac.Sum(nil)
+}
+
+// ParseClientScope valida el valor de la claim ip: una IP o un prefijo CIDR.
+func ParseClientScope(value string) (netip.Prefix, error) {
+	value = strings.TrimSpace(value)
+	if strings.Contains(value, "/") {
+		prefix, err := netip.ParsePrefix(value)
+		if err != nil {
+			return netip.Prefix{}, err
+		}
+		return prefix.Masked(), nil
+	}
+	addr, err := netip.ParseAddr(value)
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+	addr = addr.Unmap()
+	return netip.PrefixFrom(addr, addr.BitLen()), nil
+}
+
+// AllowsClient indica si la IP del cliente entra en la claim ip.
+func (c Claims) AllowsClient(ip string) bool {
+	if c.ClientIP == "" {
+		return true
+	}
+	scope, err := ParseClientScope(c.ClientIP)
+	if err != nil {
+		return false
+	}
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return false
+	}
+	return scope.Contains(addr.Unmap())
+}
+
+// AllowsVariant indica si la variante (nombre y tasa de bits en Kbps, 0 si se
+// desconoce) está dentro del alcance del token. Con MaxBitrateKbps, una tasa
+// desconocida no se admite.
+func (c Claims) AllowsVariant(name string, kbps int) bool {
+	if len(c.Variants) > 0 && !slices.Contains(c.Variants, name) {
+		return false
+	}
+	if c.MaxBitrateKbps > 0 && (kbps <= 0 || kbps > c.MaxBitrateKbps) {
+		return false
+	}
+	return true
+}
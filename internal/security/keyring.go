@@ -0,0 +1,279 @@
+package security
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	ErrUnknownKey = errors.New("unknown signing key")
+	ErrKeyRetired = errors.New("signing key retired")
+	ErrInvalidKey = errors.New("invalid signing key")
+)
+
+// Key es una clave de firma. Una clave con RetireAt en el pasado ya no se
+// acepta para verificar.
+type Key struct {
+	ID       string
+	Secret   []byte
+	RetireAt time.Time
+}
+
+// KeyInfo describe una clave sin exponer su secreto.
+type KeyInfo struct {
+	ID       string     `json:"id"`
+	Active   bool       `json:"active"`
+	RetireAt *time.Time `json:"retire_at,omitempty"`
+}
+
+// Keyring firma con la clave activa y verifica con cualquier clave no
+// retirada, de modo que rotar no invalida las URLs ya emitidas.
+type Keyring struct {
+	mu     sync.RWMutex
+	keys   map[string]Key
+	active string
+	// path, si no está vacío, es el archivo donde se persisten las rotaciones.
+	path string
+	// writeFile escribe path; los tests lo sustituyen para simular fallos.
+	writeFile func(path string, data []byte) error
+	now       func() time.Time
+}
+
+// NewKeyring crea un keyring cuya clave activa es active.
+func NewKeyring(active Key, others ...Key) (*Keyring, error) {
+	k := &Keyring{keys: map[string]Key{}, active: active.ID, now: time.Now}
+	for _, key := range append([]Key{active}, others...) {
+		if err := validateKey(key); err != nil {
+			return nil, err
+		}
+		if _, dup := k.keys[key.ID]; dup {
+			return nil, fmt.Errorf("%w: duplicate id %q", ErrInvalidKey, key.ID)
+		}
+		k.keys[key.ID] = key
+	}
+	return k, nil
+}
+
+func validateKey(key Key) error {
+	if strings.TrimSpace(key.ID) == "" || strings.ContainsAny(key.ID, ":,") {
+		return fmt.Errorf("%w: bad id %q", ErrInvalidKey, key.ID)
+	}
+	if len(key.Secret) == 0 {
+		return fmt.Errorf("%w: key %q has an empty secret", ErrInvalidKey, key.ID)
+	}
+	return nil
+}
+
+// Issue firma claims con la clave activa y anota su ID en la claim kid.
+func (k *Keyring) Issue(claims Claims) (string, error) {
+	k.mu.RLock()
+	key := k.keys[k.active]
+	k.mu.RUnlock()
+	claims.KeyID = key.ID
+	return (&Signer{Secret: key.Secret}).Issue(claims)
+}
+
+// ParseClaims verifica un token v2 con la clave indicada en su kid.
+func (k *Keyring) ParseClaims(token string) (Claims, error) {
+	_, _, claims, err := decodeScoped(token)
+	if err != nil {
+		return Claims{}, err
+	}
+	key, err := k.lookup(claims.KeyID)
+	if err != nil {
+		return Claims{}, err
+	}
+	return (&Signer{Secret: key.Secret}).ParseClaims(token)
+}
+
+// Validate acepta tokens v1, que no llevan kid, firmados con cualquier clave
+// no retirada.
+func (k *Keyring) Validate(file string, token string, exp int64) bool {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	for _, key := range k.keys {
+		if k.retired(key) {
+			continue
+		}
+		if (&Signer{Secret: key.Secret}).Validate(file, token, exp) {
+			return true
+		}
+	}
+	return false
+}
+
+func (k *Keyring) lookup(id string) (Key, error) {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	if id == "" {
+		id = k.active
+	}
+	key, ok := k.keys[id]
+	if !ok {
+		return Key{}, ErrUnknownKey
+	}
+	if k.retired(key) {
+		return Key{}, ErrKeyRetired
+	}
+	return key, nil
+}
+
+func (k *Keyring) retired(key Key) bool {
+	return !key.RetireAt.IsZero() && !k.now().Before(key.RetireAt)
+}
+
+// Rotate activa key (con un secreto aleatorio si no trae uno) y programa la
+// retirada de la clave activa anterior dentro de grace, que debe cubrir la
+// vida máxima de los tokens. Las claves ya retiradas se descartan.
+func (k *Keyring) Rotate(key Key, grace time.Duration) (KeyInfo, error) {
+	if len(key.Secret) == 0 {
+		key.Secret = make([]byte, 32)
+		if _, err := rand.Read(key.Secret); err != nil {
+			return KeyInfo{}, err
+		}
+	}
+	if key.ID == "" {
+		key.ID = "k" + k.now().UTC().Format("20060102T150405")
+	}
+	key.RetireAt = time.Time{}
+	if err := validateKey(key); err != nil {
+		return KeyInfo{}, err
+	}
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if _, dup := k.keys[key.ID]; dup {
+		return KeyInfo{}, fmt.Errorf("%w: duplicate id %q", ErrInvalidKey, key.ID)
+	}
+	// El nuevo estado se persiste antes de publicarlo: si la escritura falla,
+	// la clave no llega a firmar tokens que tras un reinicio no validarían.
+	keys := maps.Clone(k.keys)
+	previous := keys[k.active]
+	previous.RetireAt = k.now().Add(grace)
+	keys[previous.ID] = previous
+	keys[key.ID] = key
+	for id, existing := range keys {
+		if k.retired(existing) {
+			delete(keys, id)
+		}
+	}
+
+	if k.path != "" {
+		if err := k.save(key.ID, keys); err != nil {
+			return KeyInfo{}, fmt.Errorf("persist keyring: %w", err)
+		}
+	}
+	k.keys, k.active = keys, key.ID
+	return KeyInfo{ID: key.ID, Active: true}, nil
+}
+
+// Keys lista las claves, la activa primero.
+func (k *Keyring) Keys() []KeyInfo {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	out := make([]KeyInfo, 0, len(k.keys))
+	for _, key := range k.keys {
+		info := KeyInfo{ID: key.ID, Active: key.ID == k.active}
+		if !key.RetireAt.IsZero() {
+			retireAt := key.RetireAt
+			info.RetireAt = &retireAt
+		}
+		out = append(out, info)
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].Active != out[j].Active {
+			return out[i].Active
+		}
+		return out[i].ID < out[j].ID
+	})
+	return out
+}
+
+type keyFile struct {
+	Active string       `json:"active"`
+	Keys   []keyFileKey `json:"keys"`
+}
+
+type keyFileKey struct {
+	ID string `json:"id"`
+	// Secret va en base64 estándar.
+	Secret   string    `json:"secret"`
+	RetireAt time.Time `json:"retire_at,omitzero"`
+}
+
+// LoadKeyringFile lee un keyring en JSON:
+//
+//	{"active": "k2", "keys": [{"id": "k1", "secret": "<base64>", "retire_at": "2026-01-01T00:00:00Z"}, {"id": "k2", "secret": "<base64>"}]}
+//
+// Las rotaciones posteriores se escriben de vuelta en el mismo archivo.
+func LoadKeyringFile(path string) (*Keyring, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read keyring: %w", err)
+	}
+	var file keyFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("parse keyring %s: %w", path, err)
+	}
+
+	var active Key
+	var others []Key
+	for _, fk := range file.Keys {
+		secret, err := base64.StdEncoding.DecodeString(fk.Secret)
+		if err != nil {
+			return nil, fmt.Errorf("keyring %s: key %q: secret is not base64", path, fk.ID)
+		}
+		key := Key{ID: fk.ID, Secret: secret, RetireAt: fk.RetireAt}
+		if fk.ID == file.Active {
+			active = key
+		} else {
+			others = append(others, key)
+		}
+	}
+	if active.ID == "" {
+		return nil, fmt.Errorf("keyring %s: active key %q not found", path, file.Active)
+	}
+	ring, err := NewKeyring(active, others...)
+	if err != nil {
+		return nil, fmt.Errorf("keyring %s: %w", path, err)
+	}
+	ring.path = path
+	return ring, nil
+}
+
+func (k *Keyring) save(active string, keys map[string]Key) error {
+	file := keyFile{Active: active}
+	for _, key := range keys {
+		file.Keys = append(file.Keys, keyFileKey{
+			ID:       key.ID,
+			Secret:   base64.StdEncoding.EncodeToString(key.Secret),
+			RetireAt: key.RetireAt,
+		})
+	}
+	sort.Slice(file.Keys, func(i, j int) bool { return file.Keys[i].ID < file.Keys[j].ID })
+	data, err := json.MarshalIndent(file, "", "  ")
+	if err != nil {
+		return err
+	}
+	if k.writeFile != nil {
+		return k.writeFile(k.path, data)
+	}
+	return writeFileAtomic(k.path, data)
+}
+
+func writeFileAtomic(path string, data []byte) error {
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
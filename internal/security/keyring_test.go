@@ -0,0 +1,157 @@
+package security
+
+import (
+	"encoding/base64"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestKeyringRotationKeepsOldTokensValid(t *testing.T) {
+	ring, err := NewKeyring(Key{ID: "k1", Secret: []byte("first")})
+	if err != nil {
+		t.Fatalf("NewKeyring: %v", err)
+	}
+	claims := Claims{File: "song", Expires: time.Now().Add(time.Minute).Unix()}
+	old, err := ring.Issue(claims)
+	if err != nil {
+		t.Fatalf("Issue: %v", err)
+	}
+
+	info, err := ring.Rotate(Key{ID: "k2"}, time.Hour)
+	if err != nil {
+		t.Fatalf("Rotate: %v", err)
+	}
+	if info.ID != "k2" || !info.Active {
+		t.Fatalf("unexpected rotate result %+v", info)
+	}
+
+	fresh, _ := ring.Issue(claims)
+	got, err := ring.ParseClaims(fresh)
+	if err != nil || got.KeyID != "k2" {
+		t.Fatalf("expected new token signed with k2, got %+v (%v)", got, err)
+	}
+	if got, err := ring.ParseClaims(old); err != nil || got.KeyID != "k1" {
+		t.Fatalf("expected old token to stay valid during grace, got %+v (%v)", got, err)
+	}
+
+	keys := ring.Keys()
+	if len(keys) != 2 || keys[0].ID != "k2" || keys[1].RetireAt == nil {
+		t.Fatalf("unexpected key listing %+v", keys)
+	}
+}
+
+func TestKeyringRejectsRetiredAndUnknownKeys(t *testing.T) {
+	ring, _ := NewKeyring(Key{ID: "k1", Secret: []byte("first")})
+	token, _ := ring.Issue(Claims{File: "song", Expires: time.Now().Add(time.Minute).Unix()})
+	legacy, exp := (&Signer{Secret: []byte("first")}).Generate("song", time.Minute)
+
+	if _, err := ring.Rotate(Key{ID: "k2"}, time.Hour); err != nil {
+		t.Fatalf("Rotate: %v", err)
+	}
+	ring.now = func() time.Time { return time.Now().Add(2 * time.Hour) }
+
+	if _, err := ring.ParseClaims(token); !errors.Is(err, ErrKeyRetired) {
+		t.Fatalf("expected ErrKeyRetired, got %v", err)
+	}
+	if ring.Validate("song", legacy, exp) {
+		t.Fatal("expected legacy token signed with a retired key to be rejected")
+	}
+
+	other, _ := NewKeyring(Key{ID: "zz", Secret: []byte("other")})
+	foreign, _ := other.Issue(Claims{File: "song", Expires: time.Now().Add(time.Minute).Unix()})
+	if _, err := ring.ParseClaims(foreign); !errors.Is(err, ErrUnknownKey) {
+		t.Fatalf("expected ErrUnknownKey, got %v", err)
+	}
+}
+
+func TestKeyringValidatesLegacyTokens(t *testing.T) {
+	ring, _ := NewKeyring(Key{ID: "default", Secret: []byte("secret")})
+	token, exp := (&Signer{Secret: []byte("secret")}).Generate("song", time.Minute)
+	if !ring.Validate("song", token, exp) {
+		t.Fatal("expected v1 token to validate")
+	}
+}
+
+func TestKeyringRejectsInvalidKeys(t *testing.T) {
+	if _, err := NewKeyring(Key{ID: "k1"}); !errors.Is(err, ErrInvalidKey) {
+		t.Fatalf("expected empty secret to be rejected, got %v", err)
+	}
+	if _, err := NewKeyring(Key{ID: "k1", Secret: []byte("a")}, Key{ID: "k1", Secret: []byte("b")}); !errors.Is(err, ErrInvalidKey) {
+		t.Fatalf("expected duplicate id to be rejected, got %v", err)
+	}
+	ring, _ := NewKeyring(Key{ID: "k1", Secret: []byte("a")})
+	if _, err := ring.Rotate(Key{ID: "k1"}, time.Hour); !errors.Is(err, ErrInvalidKey) {
+		t.Fatalf("expected rotation to an existing id to fail, got %v", err)
+	}
+}
+
+func TestLoadKeyringFilePersistsRotation(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "keys.json")
+	content := `{"active": "k1", "keys": [{"id": "k1", "secret": "` + base64.StdEncoding.EncodeToString([]byte("first")) + `"}]}`
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	ring, err := LoadKeyringFile(path)
+	if err != nil {
+		t.Fatalf("LoadKeyringFile: %v", err)
+	}
+	token, _ := ring.Issue(Claims{File: "song", Expires: time.Now().Add(time.Minute).Unix()})
+	if _, err := ring.Rotate(Key{ID: "k2", Secret: []byte("second")}, time.Hour); err != nil {
+		t.Fatalf("Rotate: %v", err)
+	}
+
+	reloaded, err := LoadKeyringFile(path)
+	if err != nil {
+		t.Fatalf("reload: %v", err)
+	}
+	if keys := reloaded.Keys(); len(keys) != 2 || keys[0].ID != "k2" {
+		t.Fatalf("expected persisted rotation, got %+v", keys)
+	}
+	if _, err := reloaded.ParseClaims(token); err != nil {
+		t.Fatalf("expected token signed before rotation to validate after reload: %v", err)
+	}
+}
+
+func TestKeyringRotateKeepsStateWhenPersistFails(t *testing.T) {
+	ring, err := NewKeyring(Key{ID: "k1", Secret: []byte("first")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ring.path = filepath.Join(t.TempDir(), "keys.json")
+	ring.writeFile = func(string, []byte) error { return errors.New("disk full") }
+
+	if _, err := ring.Rotate(Key{ID: "k2", Secret: []byte("second")}, time.Hour); err == nil {
+		t.Fatal("expected rotate to fail when the keyring cannot be written")
+	}
+	if keys := ring.Keys(); len(keys) != 1 || keys[0].ID != "k1" || keys[0].RetireAt != nil {
+		t.Fatalf("expected the keyring to be unchanged, got %+v", keys)
+	}
+	token, err := ring.Issue(Claims{File: "song", Expires: time.Now().Add(time.Minute).Unix()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if claims, err := ring.ParseClaims(token); err != nil || claims.KeyID != "k1" {
+		t.Fatalf("expected tokens to keep using k1, got %+v %v", claims, err)
+	}
+}
+
+func TestLoadKeyringFileErrors(t *testing.T) {
+	dir := t.TempDir()
+	cases := map[string]string{
+		"missing active": `{"active": "nope", "keys": [{"id": "k1", "secret": "YQ=="}]}`,
+		"bad secret":     `{"active": "k1", "keys": [{"id": "k1", "secret": "%%%"}]}`,
+		"bad json":       `{`,
+	}
+	for name, content := range cases {
+		path := filepath.Join(dir, strings.ReplaceAll(name, " ", "_")+".json")
+		_ = os.WriteFile(path, []byte(content), 0o600)
+		if _, err := LoadKeyringFile(path); err == nil {
+			t.Fatalf("%s: expected error", name)
+		}
+	}
+}
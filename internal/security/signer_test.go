@@ -5,6 +5,7 @@ import (
 	"crypto/sha256"
 	"encoding/hex"
 	"fmt"
+	"strings"
 	"testing"
 	"time"
 )
@@ -46,3 +47,80 @@ func manualToken(secret []byte, file string, exp int64) string {
 	mac.Write([]byte(fmt.Sprintf("%s|%d", file, exp)))
 	return hex.EncodeToString(mac.Sum(nil))
 }
+
+func TestSignerIssueAndParseClaims(t *testing.T) {
+	s := &Signer{Secret: []byte("super-secret")}
+	want := Claims{
+		File:           "song",
+		Expires:        time.Now().Add(time.Minute).Unix(),
+		Variants:       []string{"64k", "128k"},
+		ClientIP:       "10.0.0.0/8",
+		User:           "user-1",
+		Audience:       "web",
+		MaxBitrateKbps: 128,
+	}
+	token, err := s.Issue(want)
+	if err != nil {
+		t.Fatalf("Issue: %v", err)
+	}
+	if !IsScoped(token) {
+		t.Fatalf("expected v2 token, got %q", token)
+	}
+
+	got, err := s.ParseClaims(token)
+	if err != nil {
+		t.Fatalf("ParseClaims: %v", err)
+	}
+	if got.File != want.File || got.User != want.User || got.Audience != want.Audience || len(got.Variants) != 2 {
+		t.Fatalf("claims mismatch: %+v", got)
+	}
+
+	other := &Signer{Secret: []byte("other-secret")}
+	if _, err := other.ParseClaims(token); err != ErrBadSignature {
+		t.Fatalf("expected ErrBadSignature, got %v", err)
+	}
+	if _, err := s.ParseClaims("v2.garbage"); err != ErrMalformedToken {
+		t.Fatalf("expected ErrMalformedToken, got %v", err)
+	}
+}
+
+func TestSignerParseClaimsRejectsTamperedPayload(t *testing.T) {
+	s := &Signer{Secret: []byte("super-secret")}
+	token, _ := s.Issue(Claims{File: "song", Expires: time.Now().Add(time.Minute).Unix()})
+	forged, _ := s.Issue(Claims{File: "other", Expires: time.Now().Add(time.Minute).Unix()})
+
+	sig := token[strings.LastIndexByte(token, '.'):]
+	tampered := forged[:strings.LastIndexByte(forged, '.')] + sig
+	if _, err := s.ParseClaims(tampered); err != ErrBadSignature {
+		t.Fatalf("expected tampered token to be rejected, got %v", err)
+	}
+}
+
+func TestClaimsScope(t *testing.T) {
+	c := Claims{ClientIP: "192.168.1.0/24", Variants: []string{"64k", "128k"}, MaxBitrateKbps: 96}
+
+	if !c.AllowsClient("192.168.1.20") {
+		t.Fatal("expected ip inside cidr to be allowed")
+	}
+	if c.AllowsClient("10.0.0.1") {
+		t.Fatal("expected ip outside cidr to be rejected")
+	}
+	if !(Claims{ClientIP: "::ffff:10.0.0.1"}).AllowsClient("10.0.0.1") {
+		t.Fatal("expected ipv4-mapped address to match")
+	}
+	if !c.AllowsVariant("64k", 64) {
+		t.Fatal("expected 64k to be allowed")
+	}
+	if c.AllowsVariant("128k", 128) {
+		t.Fatal("expected 128k to exceed max bitrate")
+	}
+	if c.AllowsVariant("192k", 0) {
+		t.Fatal("expected variant outside the set to be rejected")
+	}
+	if (Claims{MaxBitrateKbps: 96}).AllowsVariant("hifi", 0) {
+		t.Fatal("expected unknown bitrate to exceed max bitrate")
+	}
+	if !(Claims{}).AllowsVariant("320k", 320) {
+		t.Fatal("expected unscoped token to allow any variant")
+	}
+}
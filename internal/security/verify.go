@@ -0,0 +1,159 @@
+package security
+
+import (
+	"errors"
+	"net/http"
+	"slices"
+	"strconv"
+	"time"
+)
+
+// Reason identifica por qué se rechazó un token. Se usa como etiqueta de
+// métricas y en las respuestas de error, nunca incluye datos del token.
+type Reason string
+
+const (
+	ReasonMissing           Reason = "missing"
+	ReasonMalformed         Reason = "malformed"
+	ReasonExpired           Reason = "expired"
+	ReasonBadSignature      Reason = "bad_signature"
+	ReasonUnknownKey        Reason = "unknown_key"
+	ReasonKeyRetired        Reason = "key_retired"
+	ReasonRevoked           Reason = "revoked"
+	ReasonWrongFile         Reason = "wrong_file"
+	ReasonAudienceMismatch  Reason = "audience_mismatch"
+	ReasonIPMismatch        Reason = "ip_mismatch"
+	ReasonVariantNotAllowed Reason = "variant_not_allowed"
+)
+
+// Status devuelve el código HTTP adecuado: 401 si el token no es válido y
+// 403 si es válido pero no cubre la petición.
+func (r Reason) Status() int {
+	switch r {
+	case ReasonWrongFile, ReasonAudienceMismatch, ReasonIPMismatch, ReasonVariantNotAllowed:
+		return http.StatusForbidden
+	default:
+		return http.StatusUnauthorized
+	}
+}
+
+// VerifyError es el error devuelto por Verifier.Verify.
+type VerifyError struct {
+	Reason Reason
+}
+
+func (e *VerifyError) Error() string {
+	return "stream token rejected: " + string(e.Reason)
+}
+
+func reject(reason Reason) error {
+	return &VerifyError{Reason: reason}
+}
+
+// ReasonOf extrae el motivo de un error de Verify; ReasonMalformed si err no
+// es un *VerifyError.
+func ReasonOf(err error) Reason {
+	var verr *VerifyError
+	if errors.As(err, &verr) {
+		return verr.Reason
+	}
+	return ReasonMalformed
+}
+
+// KeySource verifica firmas; Signer y Keyring lo implementan.
+type KeySource interface {
+	ParseClaims(token string) (Claims, error)
+	Validate(file string, token string, exp int64) bool
+}
+
+// RevocationChecker indica si un token fue revocado; revocation.List lo
+// implementa.
+type RevocationChecker interface {
+	IsRevoked(claims Claims) bool
+}
+
+// StreamRequest describe la petición de reproducción a autorizar.
+type StreamRequest struct {
+	File  string
+	Token string
+	// Expires es el parámetro e; solo lo usan los tokens v1.
+	Expires string
+	// Variant y VariantKbps identifican la variante pedida; Variant vacío
+	// indica la lista maestra.
+	Variant     string
+	VariantKbps int
+	ClientIP    string
+}
+
+// Verifier es la única ruta de validación de tokens de reproducción: firma,
+// expiración y alcance.
+type Verifier struct {
+	Keys KeySource
+	// Audiences, si no está vacío, son las audiencias aceptadas.
+	Audiences []string
+	// Revocations, si no es nil, se consulta tras validar la firma.
+	Revocations RevocationChecker
+	Now         func() time.Time
+}
+
+// Verify autoriza req y devuelve las claims del token. Los errores son
+// siempre *VerifyError.
+func (v *Verifier) Verify(req StreamRequest) (Claims, error) {
+	now := time.Now
+	if v.Now != nil {
+		now = v.Now
+	}
+	if req.Token == "" {
+		return Claims{}, reject(ReasonMissing)
+	}
+
+	if !IsScoped(req.Token) {
+		exp, err := strconv.ParseInt(req.Expires, 10, 64)
+		if err != nil {
+			return Claims{}, reject(ReasonMalformed)
+		}
+		if exp < now().Unix() {
+			return Claims{}, reject(ReasonExpired)
+		}
+		if !v.Keys.Validate(req.File, req.Token, exp) {
+			return Claims{}, reject(ReasonBadSignature)
+		}
+		claims := Claims{File: req.File, Expires: exp}
+		if v.Revocations != nil && v.Revocations.IsRevoked(claims) {
+			return claims, reject(ReasonRevoked)
+		}
+		return claims, nil
+	}
+
+	claims, err := v.Keys.ParseClaims(req.Token)
+	switch {
+	case err == nil:
+	case errors.Is(err, ErrBadSignature):
+		return Claims{}, reject(ReasonBadSignature)
+	case errors.Is(err, ErrUnknownKey):
+		return Claims{}, reject(ReasonUnknownKey)
+	case errors.Is(err, ErrKeyRetired):
+		return Claims{}, reject(ReasonKeyRetired)
+	default:
+		return Claims{}, reject(ReasonMalformed)
+	}
+	if claims.Expires < now().Unix() {
+		return claims, reject(ReasonExpired)
+	}
+	if v.Revocations != nil && v.Revocations.IsRevoked(claims) {
+		return claims, reject(ReasonRevoked)
+	}
+	if claims.File != req.File {
+		return claims, reject(ReasonWrongFile)
+	}
+	if len(v.Audiences) > 0 && !slices.Contains(v.Audiences, claims.Audience) {
+		return claims, reject(ReasonAudienceMismatch)
+	}
+	if !claims.AllowsClient(req.ClientIP) {
+		return claims, reject(ReasonIPMismatch)
+	}
+	if req.Variant != "" && !claims.AllowsVariant(req.Variant, req.VariantKbps) {
+		return claims, reject(ReasonVariantNotAllowed)
+	}
+	return claims, nil
+}
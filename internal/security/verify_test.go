@@ -0,0 +1,82 @@
+package security
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestVerifierReasons(t *testing.T) {
+	ring, _ := NewKeyring(Key{ID: "k1", Secret: []byte("secret")})
+	v := &Verifier{Keys: ring, Audiences: []string{"web"}}
+	future := time.Now().Add(time.Minute).Unix()
+
+	issue := func(c Claims) string {
+		t.Helper()
+		if c.Expires == 0 {
+			c.Expires = future
+		}
+		if c.Audience == "" {
+			c.Audience = "web"
+		}
+		token, err := ring.Issue(c)
+		if err != nil {
+			t.Fatalf("Issue: %v", err)
+		}
+		return token
+	}
+	legacy, legacyExp := (&Signer{Secret: []byte("secret")}).Generate("song", time.Minute)
+	foreign, _ := (&Signer{Secret: []byte("other")}).Issue(Claims{KeyID: "k1", File: "song", Expires: future})
+	unknown, _ := (&Signer{Secret: []byte("other")}).Issue(Claims{KeyID: "k9", File: "song", Expires: future})
+
+	cases := []struct {
+		name   string
+		req    StreamRequest
+		reason Reason
+	}{
+		{"valid", StreamRequest{File: "song", Token: issue(Claims{File: "song"})}, ""},
+		{"valid legacy", StreamRequest{File: "song", Token: legacy, Expires: strconv.FormatInt(legacyExp, 10)}, ""},
+		{"missing", StreamRequest{File: "song"}, ReasonMissing},
+		{"legacy without expiry", StreamRequest{File: "song", Token: legacy}, ReasonMalformed},
+		{"legacy expired", StreamRequest{File: "song", Token: legacy, Expires: "1"}, ReasonExpired},
+		{"legacy wrong file", StreamRequest{File: "other", Token: legacy, Expires: strconv.FormatInt(legacyExp, 10)}, ReasonBadSignature},
+		{"malformed", StreamRequest{File: "song", Token: "v2.%%%"}, ReasonMalformed},
+		{"bad signature", StreamRequest{File: "song", Token: foreign}, ReasonBadSignature},
+		{"unknown key", StreamRequest{File: "song", Token: unknown}, ReasonUnknownKey},
+		{"expired", StreamRequest{File: "song", Token: issue(Claims{File: "song", Expires: 1})}, ReasonExpired},
+		{"wrong file", StreamRequest{File: "other", Token: issue(Claims{File: "song"})}, ReasonWrongFile},
+		{"audience", StreamRequest{File: "song", Token: issue(Claims{File: "song", Audience: "ios"})}, ReasonAudienceMismatch},
+		{"ip", StreamRequest{File: "song", ClientIP: "10.0.0.1", Token: issue(Claims{File: "song", ClientIP: "192.0.2.0/24"})}, ReasonIPMismatch},
+		{"variant", StreamRequest{File: "song", Variant: "192k", VariantKbps: 192, Token: issue(Claims{File: "song", MaxBitrateKbps: 128})}, ReasonVariantNotAllowed},
+		{"master ignores variant scope", StreamRequest{File: "song", Token: issue(Claims{File: "song", Variants: []string{"64k"}})}, ""},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := v.Verify(tc.req)
+			if tc.reason == "" {
+				if err != nil {
+					t.Fatalf("expected success, got %v", err)
+				}
+				return
+			}
+			var verr *VerifyError
+			if !errors.As(err, &verr) || verr.Reason != tc.reason {
+				t.Fatalf("expected %s, got %v", tc.reason, err)
+			}
+		})
+	}
+}
+
+func TestReasonStatus(t *testing.T) {
+	if ReasonExpired.Status() != http.StatusUnauthorized || ReasonBadSignature.Status() != http.StatusUnauthorized {
+		t.Fatal("expected invalid tokens to map to 401")
+	}
+	if ReasonIPMismatch.Status() != http.StatusForbidden || ReasonWrongFile.Status() != http.StatusForbidden {
+		t.Fatal("expected out-of-scope tokens to map to 403")
+	}
+	if ReasonOf(errors.New("boom")) != ReasonMalformed {
+		t.Fatal("expected unknown errors to map to malformed")
+	}
+}
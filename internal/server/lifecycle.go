@@ -0,0 +1,119 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+// Run escucha en addr hasta recibir SIGINT o SIGTERM y luego apaga el
+// servidor de forma ordenada (ver Serve).
+func (s *Server) Run(addr string) error {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	return s.Serve(ctx, ln)
+}
+
+// Start lanza en segundo plano las tareas del servidor (refresco de la lista
+// de revocación, cierre de las emisiones en directo, trabajos bajo demanda y
+// re-transcodificación masiva) hasta que ctx se cancela. Serve lo llama; quien monte Handler() en su propio http.Server debe llamarlo
+// antes de atender peticiones. Solo la primera llamada tiene efecto.
+func (s *Server) Start(ctx context.Context) {
+	s.startOnce.Do(func() {
+		for _, run := range s.workers {
+			s.running.Add(1)
+			go func() {
+				defer s.running.Done()
+				run(ctx)
+			}()
+		}
+	})
+}
+
+// Serve atiende peticiones en ln hasta que ctx se cancela. Entonces deja de
+// aceptar conexiones y espera hasta drainTimeout a que terminen las peticiones
+// en curso. Si alguna sigue activa (típicamente un transcode), cancela el
+// contexto base de las peticiones para que ffmpeg se detenga y los handlers
+// limpien sus temporales, y espera hasta cancelGrace antes de cerrar. Las
+// tareas de Start se cancelan al empezar el apagado y Serve espera, también
+// hasta cancelGrace, a que terminen.
+func (s *Server) Serve(ctx context.Context, ln net.Listener) error {
+	baseCtx, cancelRequests := context.WithCancel(context.Background())
+	defer cancelRequests()
+
+	srv := &http.Server{
+		Handler:           s.Handler(),
+		ReadHeaderTimeout: 10 * time.Second,
+		BaseContext:       func(net.Listener) context.Context { return baseCtx },
+	}
+
+	workerCtx, stopWorkers := context.WithCancel(ctx)
+	defer stopWorkers()
+	s.Start(workerCtx)
+
+	serveErr := make(chan error, 1)
+	go func() {
+		serveErr <- srv.Serve(ln)
+	}()
+
+	select {
+	case err := <-serveErr:
+		return err
+	case <-ctx.Done():
+	}
+
+	logger := slog.Default()
+	logger.Info("shutting down", "drain_timeout", s.drainTimeout)
+
+	drainCtx, cancelDrain := context.WithTimeout(context.Background(), s.drainTimeout)
+	defer cancelDrain()
+	err := srv.Shutdown(drainCtx)
+	if errors.Is(err, context.DeadlineExceeded) {
+		logger.Warn("drain timeout reached, cancelling in-flight requests", "cancel_grace", s.cancelGrace)
+		cancelRequests()
+
+		graceCtx, cancelGrace := context.WithTimeout(context.Background(), s.cancelGrace)
+		defer cancelGrace()
+		if err = srv.Shutdown(graceCtx); err != nil {
+			logger.Error("forcing close after cancel grace", "error", err)
+			err = srv.Close()
+		}
+	}
+	if serr := <-serveErr; serr != nil && !errors.Is(serr, http.ErrServerClosed) {
+		return serr
+	}
+	if !s.waitWorkers(s.cancelGrace) {
+		logger.Warn("background tasks still running after cancel grace")
+	}
+	logger.Info("shutdown complete")
+	return err
+}
+
+// waitWorkers espera hasta timeout a que terminen las tareas de Start; ya
+// tienen su contexto cancelado. Devuelve false si alguna sigue viva.
+func (s *Server) waitWorkers(timeout time.Duration) bool {
+	done := make(chan struct{})
+	go func() {
+		s.running.Wait()
+		close(done)
+	}()
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-done:
+		return true
+	case <-timer.C:
+		return false
+	}
+}
@@ -0,0 +1,98 @@
+package server
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func startTestServer(t *testing.T, engine *gin.Engine, drain time.Duration) (string, context.CancelFunc, <-chan error) {
+	t.Helper()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	s := &Server{engine: engine, drainTimeout: drain, cancelGrace: time.Second}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- s.Serve(ctx, ln) }()
+	return "http://" + ln.Addr().String(), cancel, done
+}
+
+func TestServeDrainsInFlightRequests(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	started := make(chan struct{})
+	engine := gin.New()
+	engine.GET("/slow", func(c *gin.Context) {
+		close(started)
+		time.Sleep(200 * time.Millisecond)
+		c.Status(http.StatusOK)
+	})
+
+	url, cancel, done := startTestServer(t, engine, 5*time.Second)
+
+	respCh := make(chan int, 1)
+	go func() {
+		resp, err := http.Get(url + "/slow")
+		if err != nil {
+			respCh <- 0
+			return
+		}
+		resp.Body.Close()
+		respCh <- resp.StatusCode
+	}()
+
+	<-started
+	cancel()
+
+	if code := <-respCh; code != http.StatusOK {
+		t.Fatalf("expected in-flight request to complete with 200, got %d", code)
+	}
+	if err := <-done; err != nil {
+		t.Fatalf("unexpected shutdown error: %v", err)
+	}
+}
+
+func TestServeCancelsRequestsAfterDrainTimeout(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	started := make(chan struct{})
+	cancelled := make(chan struct{})
+	engine := gin.New()
+	engine.GET("/transcode", func(c *gin.Context) {
+		close(started)
+		<-c.Request.Context().Done()
+		close(cancelled)
+		c.Status(http.StatusServiceUnavailable)
+	})
+
+	url, cancel, done := startTestServer(t, engine, 50*time.Millisecond)
+
+	go func() {
+		resp, err := http.Get(url + "/transcode")
+		if err == nil {
+			resp.Body.Close()
+		}
+	}()
+
+	<-started
+	cancel()
+
+	select {
+	case <-cancelled:
+	case <-time.After(2 * time.Second):
+		t.Fatalf("request context was not cancelled after drain timeout")
+	}
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatalf("Serve did not return")
+	}
+}
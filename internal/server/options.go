@@ -0,0 +1,318 @@
+package server
+
+import (
+	"GOtify/internal/cache"
+	"GOtify/internal/cors"
+	"GOtify/internal/handlers"
+	"GOtify/internal/health"
+	"GOtify/internal/live"
+	"GOtify/internal/ondemand"
+	"GOtify/internal/ratelimit"
+	"GOtify/internal/revocation"
+	"GOtify/internal/security"
+	"context"
+	"log/slog"
+	"net/netip"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Store es el catálogo de canciones que necesita el router.
+type Store interface {
+	handlers.SongStore
+}
+
+// Bucket agrupa las operaciones de almacenamiento de objetos que usan los
+// handlers de canciones y de streaming.
+type Bucket interface {
+	handlers.BucketClient
+	SignedURL(ctx context.Context, objectPath string, expiresIn int) (string, error)
+}
+
+// Signer emite y valida los tokens de reproducción; security.Signer lo implementa.
+type Signer interface {
+	handlers.TokenSigner
+	security.KeySource
+}
+
+// KeyStore guarda y lee las claves de cifrado de las canciones;
+// storage.Store lo implementa.
+type KeyStore interface {
+	handlers.SongKeyStore
+	handlers.SongKeyLoader
+}
+
+// Option configura un Server en New.
+type Option func(*options)
+
+type options struct {
+	store         Store
+	bucket        Bucket
+	bucketName    string
+	bucketBaseURL string
+	storageCache  *cache.Config
+	signer        Signer
+	apiKey        string
+	audiences     []string
+	publicURL     string
+	tokenTTL      handlers.TTLPolicy
+	scopeTTL      map[string]handlers.TTLPolicy
+	tokenMode     string
+	sessionTTL    time.Duration
+	revocations   *revocation.List
+	limiter       gin.HandlerFunc
+	limitStore    ratelimit.Store
+	limits        RateLimits
+	transcoder    handlers.Transcoder
+	keys          KeyStore
+	encrypt       bool
+	progressive   string
+	onDemand      *ondemand.Config
+	keepSource    bool
+	live          *live.Config
+	liveSecret    string
+	basePath      string
+	proxies       []netip.Prefix
+	proxyHeader   string
+	cors          cors.Config
+	logger        *slog.Logger
+	checks        []health.Check
+	rotationGrace time.Duration
+	drainTimeout  time.Duration
+	cancelGrace   time.Duration
+}
+
+// WithStore fija el catálogo de canciones (obligatorio).
+func WithStore(store Store) Option {
+	return func(o *options) { o.store = store }
+}
+
+// WithBucket fija el almacenamiento de objetos (obligatorio). name es el
+// nombre del bucket y baseURL su URL pública, usada en las respuestas.
+func WithBucket(bucket Bucket, name, baseURL string) Option {
+	return func(o *options) {
+		o.bucket = bucket
+		o.bucketName = name
+		o.bucketBaseURL = baseURL
+	}
+}
+
+// WithCache pone delante del bucket la caché de listas, segmentos y URLs
+// firmadas descrita por cfg. Subir o borrar una canción invalida su carpeta.
+func WithCache(cfg cache.Config) Option {
+	return func(o *options) { o.storageCache = &cfg }
+}
+
+// WithAPIKey fija la clave exigida en X-API-Key (obligatoria).
+func WithAPIKey(key string) Option {
+	return func(o *options) { o.apiKey = key }
+}
+
+// WithSigner reemplaza el firmante de tokens. Por defecto se usa un keyring
+// con la API key como única clave. Si el firmante implementa
+// handlers.KeyManager se exponen las rutas /admin/keys.
+func WithSigner(signer Signer) Option {
+	return func(o *options) { o.signer = signer }
+}
+
+// WithAudiences restringe /stream a tokens emitidos para alguna de estas
+// audiencias (claim aud). Sin audiencias no se comprueba.
+func WithAudiences(audiences ...string) Option {
+	return func(o *options) { o.audiences = append(o.audiences, audiences...) }
+}
+
+// WithPublicURL fija el origen público (p. ej. "https://cdn.example") de las
+// URLs absolutas devueltas por /token.
+func WithPublicURL(origin string) Option {
+	return func(o *options) { o.publicURL = origin }
+}
+
+// WithTokenTTL fija la vida por defecto y máxima de los tokens, y las que
+// sobrescriben por audiencia.
+func WithTokenTTL(policy handlers.TTLPolicy, scopes map[string]handlers.TTLPolicy) Option {
+	return func(o *options) {
+		o.tokenTTL = policy
+		o.scopeTTL = scopes
+	}
+}
+
+// WithTokenMode fija cómo viaja por defecto el token en las URLs de /stream
+// (handlers.TokenModeQuery, TokenModePath o TokenModeCookie) y la vida máxima
+// de la cookie de sesión (por defecto 10 minutos, nunca más que el token).
+func WithTokenMode(mode string, sessionTTL time.Duration) Option {
+	return func(o *options) {
+		o.tokenMode = mode
+		if sessionTTL > 0 {
+			o.sessionTTL = sessionTTL
+		}
+	}
+}
+
+// WithRevocations activa la lista de revocación: /stream la consulta en cada
+// petición, se exponen las rutas /admin/revocations y Start (o Serve) la
+// refresca en segundo plano.
+func WithRevocations(list *revocation.List) Option {
+	return func(o *options) { o.revocations = list }
+}
+
+// WithKeyRotationGrace fija cuánto se sigue aceptando la clave anterior tras
+// POST /admin/keys/rotate (por defecto 24h).
+func WithKeyRotationGrace(grace time.Duration) Option {
+	return func(o *options) { o.rotationGrace = grace }
+}
+
+// WithRateLimiter reemplaza los rate limiters de todos los grupos de rutas
+// por limiter.
+func WithRateLimiter(limiter gin.HandlerFunc) Option {
+	return func(o *options) { o.limiter = limiter }
+}
+
+// RateLimits son los límites de cada grupo de rutas.
+type RateLimits struct {
+	// Token cubre /token.
+	Token ratelimit.Rule
+	// Stream cubre /stream y se evalúa tras validar el token.
+	Stream ratelimit.Rule
+	// Admin cubre /songs, /admin, /metrics y /health.
+	Admin ratelimit.Rule
+	// Public cubre /readyz y /live, y se evalúa en /stream antes de validar
+	// el token.
+	Public ratelimit.Rule
+}
+
+// DefaultRateLimits devuelve los límites usados si no se configuran otros.
+func DefaultRateLimits() RateLimits {
+	return RateLimits{
+		Token:  ratelimit.Rule{Name: "token", Limit: 60, Window: time.Minute, Key: ratelimit.ByAPIKey},
+		Stream: ratelimit.Rule{Name: "stream", Limit: 600, Window: time.Minute, Key: ByStreamUser},
+		Admin:  ratelimit.Rule{Name: "admin", Limit: 60, Window: time.Minute, Key: ratelimit.ByAPIKey},
+		Public: ratelimit.Rule{Name: "public", Limit: 1200, Window: time.Minute, Key: ratelimit.ByIP},
+	}
+}
+
+// WithRateLimits fija el Store de contadores (compartirlo entre réplicas, p.
+// ej. con ratelimit.RedisStore, comparte los límites) y los límites por grupo.
+// Los grupos sin límite o sin ventana usan los de DefaultRateLimits.
+func WithRateLimits(store ratelimit.Store, limits RateLimits) Option {
+	return func(o *options) {
+		o.limitStore = store
+		o.limits = limits.withDefaults(DefaultRateLimits())
+	}
+}
+
+func (l RateLimits) withDefaults(def RateLimits) RateLimits {
+	fill := func(rule, fallback ratelimit.Rule) ratelimit.Rule {
+		if rule.Limit <= 0 || rule.Window <= 0 {
+			return fallback
+		}
+		if rule.Name == "" {
+			rule.Name = fallback.Name
+		}
+		return rule
+	}
+	return RateLimits{
+		Token:  fill(l.Token, def.Token),
+		Stream: fill(l.Stream, def.Stream),
+		Admin:  fill(l.Admin, def.Admin),
+		Public: fill(l.Public, def.Public),
+	}
+}
+
+// WithTranscoder reemplaza ffmpeg/ffprobe en la subida de canciones.
+func WithTranscoder(t handlers.Transcoder) Option {
+	return func(o *options) { o.transcoder = t }
+}
+
+// WithSongKeys activa la entrega de claves HLS en /stream/<file>/key y la
+// limpieza de claves al actualizar o borrar canciones. Con encrypt las nuevas
+// subidas se cifran con AES-128.
+func WithSongKeys(keys KeyStore, encrypt bool) Option {
+	return func(o *options) {
+		o.keys = keys
+		o.encrypt = encrypt
+	}
+}
+
+// WithProgressive indica el formato ("mp3" o "m4a") que /stream/<file>/file
+// busca primero; los demás se prueban después.
+func WithProgressive(format string) Option {
+	return func(o *options) { o.progressive = format }
+}
+
+// WithOnDemand genera las variantes de cfg la primera vez que se piden, a
+// partir del original que se guarda desde entonces en cada subida. Requiere
+// un transcodificador con GenerateVariant, como transcode.FFmpeg. Sin
+// variantes no hace nada.
+func WithOnDemand(cfg ondemand.Config) Option {
+	return func(o *options) {
+		o.onDemand = nil
+		if len(cfg.Variants) > 0 {
+			o.onDemand = &cfg
+		}
+	}
+}
+
+// WithKeepSource guarda el archivo original de cada subida en el prefijo
+// storage.MezzaninePrefix para poder re-transcodificarlo. WithOnDemand lo
+// activa igualmente.
+func WithKeepSource(keep bool) Option {
+	return func(o *options) { o.keepSource = keep }
+}
+
+// WithLive emite los canales de cfg bajo /stream/<canal>/ y acepta sus
+// fuentes en /live/<canal>, autenticadas con sourcePassword, obligatoria y
+// distinta de la API key. Requiere un transcodificador que implemente
+// live.Segmenter, como transcode.FFmpeg. Sin canales no hace nada.
+func WithLive(cfg live.Config, sourcePassword string) Option {
+	return func(o *options) {
+		o.live = nil
+		if len(cfg.Channels) > 0 {
+			o.live = &cfg
+		}
+		o.liveSecret = sourcePassword
+	}
+}
+
+// WithBasePath monta todas las rutas bajo prefix (p. ej. "/gotify").
+func WithBasePath(prefix string) Option {
+	return func(o *options) { o.basePath = prefix }
+}
+
+// WithTrustedProxies fija los proxies cuya cabecera de reenvío (ver
+// WithTrustedProxyHeader) se acepta para resolver la IP del cliente. Por
+// defecto no se confía en ninguno y se usa la dirección de la conexión.
+func WithTrustedProxies(prefixes ...netip.Prefix) Option {
+	return func(o *options) { o.proxies = append(o.proxies, prefixes...) }
+}
+
+// WithTrustedProxyHeader elige la cabecera que escriben los proxies de
+// confianza: clientip.HeaderXForwardedFor (por defecto) o
+// clientip.HeaderForwarded. La otra se ignora.
+func WithTrustedProxyHeader(header string) Option {
+	return func(o *options) { o.proxyHeader = header }
+}
+
+// WithCORS habilita CORS para reproductores web con la política cfg. Los
+// preflight se responden antes de exigir la API key.
+func WithCORS(cfg cors.Config) Option {
+	return func(o *options) { o.cors = cfg }
+}
+
+// WithLogger fija el logger base de las peticiones; por defecto slog.Default().
+func WithLogger(logger *slog.Logger) Option {
+	return func(o *options) { o.logger = logger }
+}
+
+// WithReadinessChecks añade comprobaciones a /readyz.
+func WithReadinessChecks(checks ...health.Check) Option {
+	return func(o *options) { o.checks = append(o.checks, checks...) }
+}
+
+// WithShutdownTimeouts fija los plazos de drenado y de cancelación usados por Serve.
+func WithShutdownTimeouts(drain, grace time.Duration) Option {
+	return func(o *options) {
+		o.drainTimeout = drain
+		o.cancelGrace = grace
+	}
+}
@@ -1,104 +1,452 @@
 package server
 
 import (
+	"GOtify/internal/cache"
+	"GOtify/internal/clientip"
+	"GOtify/internal/config"
+	"GOtify/internal/cors"
 	"GOtify/internal/handlers"
+	"GOtify/internal/health"
+	"GOtify/internal/live"
+	"GOtify/internal/logging"
+	"GOtify/internal/metrics"
+	"GOtify/internal/ondemand"
+	"GOtify/internal/ratelimit"
+	"GOtify/internal/revocation"
+	"GOtify/internal/security"
 	"GOtify/internal/storage"
+	"GOtify/internal/tracing"
 	"GOtify/internal/transcode"
 	"context"
-	"crypto/hmac"
-	"crypto/sha256"
 	"crypto/subtle"
-	"encoding/hex"
+	"errors"
 	"fmt"
-	"log"
+	"log/slog"
+	"math"
 	"net/http"
 	"os"
+	"path"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
-	"github.com/didip/tollbooth/v7"
-	"github.com/didip/tollbooth_gin"
 	"github.com/gin-gonic/gin"
 )
 
+// readinessCacheTTL es cuánto se reutiliza el último resultado de /readyz.
+const readinessCacheTTL = 2 * time.Second
+
 type Server struct {
 	engine *gin.Engine
-	root   string
-	store  *storage.Store
-	bucket *storage.BucketClient
+	// workers corren en segundo plano desde Start.
+	workers      []func(context.Context)
+	startOnce    sync.Once
+	running      sync.WaitGroup
+	drainTimeout time.Duration
+	cancelGrace  time.Duration
 }
 
-func New(root string) *Server {
-	ctx := context.Background()
-	store, err := storage.NewStore(ctx)
-	if err != nil {
-		panic(err)
+// New construye el router con las dependencias recibidas. Devuelve un error
+// si falta alguna obligatoria (catálogo, bucket o API key).
+func New(opts ...Option) (*Server, error) {
+	o := options{
+		logger:        slog.Default(),
+		drainTimeout:  30 * time.Second,
+		cancelGrace:   10 * time.Second,
+		rotationGrace: 24 * time.Hour,
+		sessionTTL:    10 * time.Minute,
+		limits:        DefaultRateLimits(),
 	}
-	r := gin.New()
-	r.Use(gin.Logger(), gin.Recovery())
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	secretValue := strings.TrimSpace(o.apiKey)
+	var errs []error
+	if o.store == nil {
+		errs = append(errs, errors.New("server: store is required"))
+	}
+	if o.bucket == nil {
+		errs = append(errs, errors.New("server: bucket is required"))
+	}
+	if secretValue == "" {
+		errs = append(errs, errors.New("server: api key is required"))
+	}
+	if o.live != nil {
+		switch sourceSecret := strings.TrimSpace(o.liveSecret); {
+		case sourceSecret == "":
+			errs = append(errs, errors.New("server: live channels need a source password"))
+		case sourceSecret == secretValue:
+			errs = append(errs, errors.New("server: the live source password must differ from the api key"))
+		}
+	}
+	if len(errs) > 0 {
+		return nil, errors.Join(errs...)
+	}
+
+	if o.signer == nil {
+		ring, err := security.NewKeyring(security.Key{ID: "default", Secret: []byte(secretValue)})
+		if err != nil {
+			return nil, fmt.Errorf("server: %w", err)
+		}
+		o.signer = ring
+	}
+	if o.limitStore == nil {
+		o.limitStore = ratelimit.NewMemoryStore()
+	}
+	limit := func(rule ratelimit.Rule) gin.HandlerFunc {
+		if o.limiter != nil {
+			return o.limiter
+		}
+		return ratelimit.Middleware(o.limitStore, rule)
+	}
+	basePath := "/" + strings.Trim(o.basePath, "/")
 
-	secretValue := strings.TrimSpace(os.Getenv("SECRET"))
-	secret := []byte(secretValue)
+	r := gin.New()
+	// La IP del cliente la resuelve clientip; gin no interpreta las cabeceras.
+	if err := r.SetTrustedProxies(nil); err != nil {
+		return nil, fmt.Errorf("server: %w", err)
+	}
+	r.Use(clientip.New(o.proxies, o.proxyHeader).Middleware(), tracing.Middleware(), logging.Middleware(o.logger), metrics.Middleware(), gin.Recovery(), cors.Middleware(o.cors))
 
 	// Headers
 	r.Use(func(c *gin.Context) {
 		c.Header("X-Content-Type-Options", "nosniff")
 		c.Header("X-Frame-Options", "DENY")
-		c.Header("Cache-Control", "private, max-age=600")
+		// Tokens, administración y errores no se cachean; /stream fija su
+		// propia política en las respuestas correctas.
+		c.Header("Cache-Control", "no-store")
 		c.Next()
 	})
 
-	// API key enforcement
-	r.Use(RequireSecret(secretValue))
-
-	// Rate limiting
-	limiter := tollbooth.NewLimiter(10, nil) // 10 req/s
-	r.Use(tollbooth_gin.LimitHandler(limiter))
+	bucket := Bucket(o.bucket)
+	if o.storageCache != nil {
+		cached, err := cache.New(o.bucket, *o.storageCache)
+		if err != nil {
+			return nil, fmt.Errorf("server: %w", err)
+		}
+		bucket = cached
+	}
 
 	// Handlers
-	hToken := handlers.NewTokenHandler(secret)
-	bucketClient, err := storage.NewBucketClientFromEnv()
-	if err != nil {
-		panic(err)
-	}
-	bucketName := strings.TrimSpace(os.Getenv("SUPABASE_BUCKET"))
-	hFile := handlers.NewFileHandler(store, bucketClient, bucketName)
-	segmentSeconds := parseSegmentSeconds(os.Getenv("HLS_SEGMENT_SECONDS"))
-	variantCfg := parseVariantConfig(os.Getenv("HLS_AUDIO_VARIANTS"))
-	handlerCfg := handlers.SongHandlerConfig{
-		BucketBaseURL:  strings.TrimSpace(os.Getenv("SUPABASE_BUCKET_PUBLIC_URL")),
-		FFmpegBin:      strings.TrimSpace(os.Getenv("FFMPEG_BIN")),
-		FFProbeBin:     strings.TrimSpace(os.Getenv("FFPROBE_BIN")),
-		SegmentSeconds: segmentSeconds,
-		Variants:       variantCfg,
-	}
-	hSong, err := handlers.NewSongHandler(store, bucketClient, handlerCfg)
+	hToken := handlers.NewTokenHandler(o.signer, o.store, handlers.TokenHandlerConfig{
+		BasePath:  basePath,
+		PublicURL: o.publicURL,
+		TTL:       o.tokenTTL,
+		ScopeTTL:  o.scopeTTL,
+		Mode:      o.tokenMode,
+	})
+	hFile := handlers.NewFileHandler(o.store, bucket, o.bucketName)
+	var workers []func(context.Context)
+	if o.onDemand != nil {
+		transcoder, ok := o.transcoder.(ondemand.Transcoder)
+		if !ok {
+			return nil, errors.New("server: on-demand variants need a transcoder with GenerateVariant")
+		}
+		generator := ondemand.New(bucket, transcoder, o.keys, *o.onDemand)
+		hFile.WithOnDemand(generator)
+		workers = append(workers, generator.Run)
+	}
+	var channels *live.Manager
+	if o.live != nil {
+		segmenter, ok := o.transcoder.(live.Segmenter)
+		if !ok {
+			return nil, errors.New("server: live channels need a transcoder with Live")
+		}
+		if err := checkChannelIDs(o.store, o.live.Channels); err != nil {
+			return nil, err
+		}
+		channels = live.New(segmenter, *o.live)
+		hFile.WithLive(channels)
+		hToken.WithLive(channels)
+	}
+	hSong, err := handlers.NewSongHandler(o.store, bucket, handlers.SongHandlerConfig{
+		BucketBaseURL: o.bucketBaseURL,
+		Transcoder:    o.transcoder,
+		Keys:          o.keys,
+		Encrypt:       o.encrypt,
+		KeepSource:    o.keepSource || o.onDemand != nil,
+	})
 	if err != nil {
-		panic(err)
+		return nil, fmt.Errorf("server: %w", err)
+	}
+
+	var checks []health.Check
+	if p, ok := o.store.(health.Pinger); ok {
+		checks = append(checks, health.PingCheck("catalog", p))
+	}
+	if p, ok := o.bucket.(health.Pinger); ok {
+		checks = append(checks, health.PingCheck("bucket", p))
+	}
+	if o.revocations != nil {
+		checks = append(checks, health.PingCheck("revocations", o.revocations))
 	}
+	if p, ok := o.limitStore.(health.Pinger); ok && o.limiter == nil {
+		checks = append(checks, health.PingCheck("rate_limit", p))
+	}
+	readiness := health.NewChecker(5*time.Second, append(checks, o.checks...)...).WithCache(readinessCacheTTL)
+
+	root := r.Group(basePath)
+
+	// Probes sin API key para los balanceadores. /readyz consulta las
+	// dependencias, así que pasa por el límite por IP.
+	root.GET("/livez", health.Live)
+	root.GET("/readyz", limit(o.limits.Public), readiness.Ready)
 
-	// Routes
-	r.GET("/health", func(c *gin.Context) {
+	// Reproducción: basta el token firmado (t/e), sin API key, para que
+	// AVPlayer, ExoPlayer o <audio> puedan pedir listas y segmentos.
+	verifier := &security.Verifier{Keys: o.signer, Audiences: o.audiences}
+	if o.revocations != nil {
+		verifier.Revocations = o.revocations
+	}
+	sessions := &StreamSessions{
+		Issuer:   o.signer,
+		TTL:      o.sessionTTL,
+		BasePath: basePath,
+		Secure:   strings.HasPrefix(o.publicURL, "https://"),
+	}
+	// El límite por IP va antes de validar el token, para que una avalancha
+	// de tokens inválidos también se corte; el de Stream, por usuario, va
+	// después porque necesita los claims. El token de ruta se quita antes que
+	// nada para que ni los 429 lo registren.
+	stream := root.Group("/stream", StripPathToken(), limit(o.limits.Public), AuthMiddleware(verifier, sessions), limit(o.limits.Stream))
+	{
+		routes := map[string]gin.HandlerFunc{
+			handlers.ProgressiveRoute: handlers.NewProgressiveHandler(hFile, o.progressive).Serve,
+		}
+		if o.keys != nil {
+			routes[transcode.KeyURI] = handlers.NewKeyDeliveryHandler(o.keys).Serve
+		}
+		serve := withSubRoutes(routes, hFile.Serve)
+		stream.GET("/:file_id/*quality", serve)
+		stream.HEAD("/:file_id/*quality", serve)
+	}
+
+	// Ingesta en directo: los codificadores no envían X-API-Key, así que se
+	// acepta también la contraseña de Basic auth. Cada petición dura lo que
+	// la emisión, así que solo se limitan por IP los intentos.
+	if channels != nil {
+		hIngest := handlers.NewIngestHandler(channels)
+		ingest := root.Group("/live", limit(o.limits.Public), RequireSourceSecret(strings.TrimSpace(o.liveSecret)))
+		ingest.PUT("/:channel", hIngest.Serve)
+		ingest.Handle(handlers.MethodSource, "/:channel", hIngest.Serve)
+	}
+
+	// API: emisión de tokens y administración exigen X-API-Key.
+	api := root.Group("/", RequireSecret(secretValue))
+
+	api.GET("/token/:file_id", limit(o.limits.Token), hToken.Generate)
+
+	admin := api.Group("/", limit(o.limits.Admin))
+	admin.GET("/health", func(c *gin.Context) {
 		c.Status(http.StatusOK)
 	})
-	r.GET("/token/:file_id", hToken.Generate)
-	authorized := r.Group("/stream", AuthMiddleware(secret))
-	{
-		authorized.GET("/:file_id/*quality", hFile.Serve)
+	admin.GET("/metrics", gin.WrapH(metrics.Handler()))
+	admin.GET("/admin/readyz", readiness.Details)
+	admin.POST("/songs", hSong.Create)
+	admin.GET("/songs", hSong.List)
+	admin.POST("/songs/retranscode", hSong.RetranscodeAll)
+	admin.GET("/songs/retranscode", hSong.RetranscodeStatus)
+	admin.POST("/songs/:id/retranscode", hSong.Retranscode)
+	admin.GET("/songs/:id", hSong.Get)
+	admin.PUT("/songs/:id", hSong.Update)
+	admin.DELETE("/songs/:id", hSong.Delete)
+	workers = append(workers, hSong.Run)
+	if manager, ok := o.signer.(handlers.KeyManager); ok {
+		hKeys := handlers.NewKeyHandler(manager, o.rotationGrace)
+		admin.GET("/admin/keys", hKeys.List)
+		admin.POST("/admin/keys/rotate", hKeys.Rotate)
+	}
+	if o.revocations != nil {
+		hRevoke := handlers.NewRevocationHandler(o.revocations)
+		admin.GET("/admin/revocations", hRevoke.List)
+		admin.POST("/admin/revocations", hRevoke.Create)
+		workers = append(workers, o.revocations.Run)
+	}
+	if channels != nil {
+		workers = append(workers, channels.Run)
+	}
+
+	return &Server{
+		engine:       r,
+		workers:      workers,
+		drainTimeout: o.drainTimeout,
+		cancelGrace:  o.cancelGrace,
+	}, nil
+}
+
+// FromConfig construye el Server de producción: catálogo y bucket de
+// Supabase y transcodificación con ffmpeg según cfg.
+func FromConfig(ctx context.Context, cfg config.Config) (*Server, error) {
+	storageCfg := storage.Config{
+		URL:        cfg.Supabase.URL,
+		ServiceKey: cfg.Supabase.ServiceKey,
+		Bucket:     cfg.Supabase.Bucket,
+	}
+	store, err := storage.NewStore(ctx, storageCfg)
+	if err != nil {
+		return nil, err
+	}
+	bucket, err := storage.NewBucketClient(storageCfg)
+	if err != nil {
+		return nil, err
+	}
+	keyring, err := keyringFromConfig(cfg)
+	if err != nil {
+		return nil, err
+	}
+	limitStore, limits, err := rateLimitsFromConfig(cfg.RateLimit)
+	if err != nil {
+		return nil, err
+	}
+	proxies, err := clientip.ParseTrusted(cfg.Server.TrustedProxies)
+	if err != nil {
+		return nil, err
+	}
+	revocations := revocation.New(store, cfg.Tokens.RevocationRefresh.Std())
+	if err := revocations.Refresh(ctx); err != nil {
+		// /readyz lo reporta hasta que un refresco tenga éxito.
+		slog.Warn("initial revocation load failed", "error", err)
+	}
+
+	return New(
+		WithStore(store),
+		WithBucket(bucket, cfg.Supabase.Bucket, cfg.BucketPublicURL()),
+		WithAPIKey(cfg.Server.Secret),
+		WithSigner(keyring),
+		WithRateLimits(limitStore, limits),
+		WithRevocations(revocations),
+		WithKeyRotationGrace(cfg.Tokens.RotationGrace.Std()),
+		WithSongKeys(store, cfg.Transcode.Encryption == "aes-128"),
+		WithProgressive(cfg.Transcode.ProgressiveFormat),
+		WithKeepSource(cfg.Transcode.KeepSource),
+		WithLive(live.Config{
+			Channels:       cfg.Live.Channels,
+			BitrateKbps:    cfg.Live.Bitrate,
+			SegmentSeconds: cfg.Live.SegmentSeconds,
+			WindowSegments: cfg.Live.WindowSegments,
+			DVRWindow:      cfg.Live.DVRWindow.Std(),
+		}, cfg.Live.SourcePassword),
+		WithOnDemand(ondemand.Config{
+			Variants: variantsFromKbps(cfg.Transcode.OnDemandVariants),
+			MaxJobs:  cfg.Transcode.OnDemandMaxJobs,
+		}),
+		WithTranscoder(transcode.FFmpeg{
+			Config: transcode.Config{
+				BinPath:        cfg.Transcode.FFmpegBin,
+				SegmentSeconds: cfg.Transcode.SegmentSeconds,
+				Variants:       variantsFromKbps(cfg.Transcode.Variants),
+				Progressive:    progressiveFromConfig(cfg.Transcode),
+			},
+			ProbeBin: cfg.Transcode.FFProbeBin,
+		}),
+		WithReadinessChecks(
+			health.BinaryCheck("ffmpeg", cfg.Transcode.FFmpegBin),
+			health.BinaryCheck("ffprobe", cfg.Transcode.FFProbeBin),
+			health.TempDirCheck(os.TempDir(), cfg.Health.MinTmpFreeMB<<20),
+		),
+		WithAudiences(cfg.Tokens.Audiences...),
+		WithPublicURL(cfg.Server.PublicURL),
+		WithTrustedProxies(proxies...),
+		WithTrustedProxyHeader(cfg.Server.TrustedProxyHeader),
+		WithCORS(corsFromConfig(cfg.CORS)),
+		WithCache(cache.Config{
+			PlaylistTTL:     cfg.Cache.PlaylistTTL.Std(),
+			PlaylistEntries: cfg.Cache.PlaylistEntries,
+			SegmentDir:      cfg.Cache.SegmentDir,
+			SegmentMaxBytes: int64(cfg.Cache.SegmentMaxMB) << 20,
+			SegmentTTL:      cfg.Cache.SegmentTTL.Std(),
+			SignedURLTTL:    cfg.Cache.SignedURLTTL.Std(),
+		}),
+		WithTokenTTL(ttlPolicy(cfg.Tokens.DefaultTTL, cfg.Tokens.MaxTTL), scopeTTLFromConfig(cfg.Tokens.ScopeTTL)),
+		WithTokenMode(cfg.Tokens.Mode, cfg.Tokens.SessionTTL.Std()),
+		WithShutdownTimeouts(cfg.Server.DrainTimeout.Std(), cfg.Server.CancelGrace.Std()),
+	)
+}
+
+// keyringFromConfig carga las claves de firma desde el archivo o la lista
+// configurada; sin ninguna de las dos firma con el secreto del servidor.
+func keyringFromConfig(cfg config.Config) (*security.Keyring, error) {
+	if cfg.Tokens.KeysFile != "" {
+		return security.LoadKeyringFile(cfg.Tokens.KeysFile)
+	}
+	if len(cfg.Tokens.Keys) == 0 {
+		return security.NewKeyring(security.Key{ID: "default", Secret: []byte(strings.TrimSpace(cfg.Server.Secret))})
+	}
+	var active security.Key
+	var others []security.Key
+	for _, k := range cfg.Tokens.Keys {
+		key := security.Key{ID: k.ID, Secret: []byte(k.Secret), RetireAt: k.RetireAt}
+		if k.ID == cfg.Tokens.ActiveKey {
+			active = key
+		} else {
+			others = append(others, key)
+		}
+	}
+	return security.NewKeyring(active, others...)
+}
+
+// rateLimitKeys asocia los nombres de clave de la configuración a su KeyFunc.
+var rateLimitKeys = map[string]ratelimit.KeyFunc{
+	"ip":      ratelimit.ByIP,
+	"api_key": ratelimit.ByAPIKey,
+	"user":    ByStreamUser,
+}
+
+func rateLimitsFromConfig(cfg config.RateLimitConfig) (ratelimit.Store, RateLimits, error) {
+	rule := func(name string, r config.RateLimitRule) ratelimit.Rule {
+		return ratelimit.Rule{Name: name, Limit: r.Limit, Window: r.Window.Std(), Key: rateLimitKeys[r.Key]}
+	}
+	limits := RateLimits{
+		Token:  rule("token", cfg.Token),
+		Stream: rule("stream", cfg.Stream),
+		Admin:  rule("admin", cfg.Admin),
+		Public: rule("public", cfg.Public),
+	}
+	if cfg.Backend != "redis" {
+		return ratelimit.NewMemoryStore(), limits, nil
+	}
+	store, err := ratelimit.NewRedisStoreFromURL(cfg.RedisURL)
+	if err != nil {
+		return nil, limits, err
+	}
+	return store, limits, nil
+}
+
+// corsFromConfig completa la política configurada con cors.DefaultConfig.
+func corsFromConfig(cfg config.CORSConfig) cors.Config {
+	out := cors.DefaultConfig()
+	out.AllowedOrigins = cfg.AllowedOrigins
+	out.AllowCredentials = cfg.AllowCredentials
+	out.MaxAge = cfg.MaxAge.Std()
+	if len(cfg.AllowedMethods) > 0 {
+		out.AllowedMethods = cfg.AllowedMethods
 	}
-	r.POST("/songs", hSong.Create)
-	r.GET("/songs", hSong.List)
-	r.GET("/songs/:id", hSong.Get)
-	r.PUT("/songs/:id", hSong.Update)
-	r.DELETE("/songs/:id", hSong.Delete)
-	return &Server{engine: r, root: root, store: store, bucket: bucketClient}
+	if len(cfg.AllowedHeaders) > 0 {
+		out.AllowedHeaders = cfg.AllowedHeaders
+	}
+	if len(cfg.ExposedHeaders) > 0 {
+		out.ExposedHeaders = cfg.ExposedHeaders
+	}
+	return out
 }
 
-func (s *Server) Run(addr string) {
-	if err := s.engine.Run(addr); err != nil {
-		panic(err)
+func ttlPolicy(def, max config.Duration) handlers.TTLPolicy {
+	return handlers.TTLPolicy{Default: def.Std(), Max: max.Std()}
+}
+
+func scopeTTLFromConfig(scopes map[string]config.TTLScope) map[string]handlers.TTLPolicy {
+	out := make(map[string]handlers.TTLPolicy, len(scopes))
+	for aud, scope := range scopes {
+		out[aud] = ttlPolicy(scope.Default, scope.Max)
 	}
+	return out
+}
+
+// Handler devuelve el router como http.Handler para montarlo en otro servidor.
+func (s *Server) Handler() http.Handler {
+	return s.engine
 }
 
 func RequireSecret(secret string) gin.HandlerFunc {
@@ -123,73 +471,179 @@ func RequireSecret(secret string) gin.HandlerFunc {
 	}
 }
 
-func AuthMiddleware(secret []byte) gin.HandlerFunc {
+// checkChannelIDs falla si algún canal tiene el ID de una canción: /stream y
+// /token resuelven antes los canales, así que la canción quedaría oculta. Las
+// canciones nuevas reciben un UUID, que config no admite como canal.
+func checkChannelIDs(store Store, channels []string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	for _, channel := range channels {
+		_, err := store.GetSong(ctx, channel)
+		switch {
+		case err == nil:
+			return fmt.Errorf("server: live channel %q has the id of a song", channel)
+		case !errors.Is(err, storage.ErrNotFound):
+			return fmt.Errorf("server: checking live channel %q: %w", channel, err)
+		}
+	}
+	return nil
+}
+
+// RequireSourceSecret autoriza las fuentes en directo con X-API-Key o con la
+// contraseña de Basic auth (el usuario se ignora; Icecast usa "source").
+func RequireSourceSecret(secret string) gin.HandlerFunc {
+	secretBytes := []byte(secret)
+	return func(c *gin.Context) {
+		if len(secretBytes) == 0 {
+			c.AbortWithStatus(http.StatusInternalServerError)
+			return
+		}
+		input := strings.TrimSpace(c.GetHeader("X-API-Key"))
+		if input == "" {
+			_, input, _ = c.Request.BasicAuth()
+		}
+		if input == "" || subtle.ConstantTimeCompare([]byte(input), secretBytes) != 1 {
+			c.Header("WWW-Authenticate", `Basic realm="gotify"`)
+			c.AbortWithStatus(http.StatusUnauthorized)
+			return
+		}
+		c.Next()
+	}
+}
+
+// claimsKey guarda en el contexto de gin las claims del token validado.
+const claimsKey = "stream_claims"
+
+// AuthMiddleware autoriza /stream con security.Verifier. El token puede
+// llegar en un prefijo de ruta firmado (/stream/<token>/<exp>/<file>/...), en
+// la query (t y e) o en la cookie de sesión, por ese orden. Con sessions, los
+// tokens emitidos con mode=cookie se canjean por la cookie al cargar la lista
+// maestra. Los rechazos se registran y se cuentan por motivo, y responden con
+// un error estructurado sin datos del token.
+func AuthMiddleware(verifier *security.Verifier, sessions *StreamSessions) gin.HandlerFunc {
 	return func(c *gin.Context) {
-		token := c.Query("t")
-		expires := c.Query("e")
+		req := security.StreamRequest{ClientIP: c.ClientIP()}
+		fromQuery, fromCookie := false, false
+		token, exp, fromPath := pathToken(c)
 		file := c.Param("file_id")
 		if file == "" {
 			file = c.Param("file")
 		}
+		quality := c.Param("quality")
+		if fromPath {
+			req.Token, req.Expires = token, exp
+		} else if token := c.Query("t"); token != "" {
+			req.Token, req.Expires = token, c.Query("e")
+			fromQuery = true
+		} else if token, err := c.Cookie(SessionCookie); err == nil {
+			req.Token, fromCookie = token, true
+		}
+		req.File = file
+		if name, kbps, ok := variantFromQuality(quality); ok {
+			req.Variant, req.VariantKbps = name, kbps
+		}
 
-		et, _ := strconv.ParseInt(expires, 10, 64)
-		if et < time.Now().Unix() {
-			log.Println("Token expired:", et, "<", time.Now().Unix())
-			c.AbortWithStatus(http.StatusUnauthorized)
+		claims, err := verifier.Verify(req)
+		if err != nil {
+			reason := security.ReasonOf(err)
+			logging.FromContext(c.Request.Context()).Warn("stream token rejected",
+				"reason", reason, "file_id", file, "kid", claims.KeyID, "variant", req.Variant)
+			metrics.TokenRejected(string(reason))
+			c.AbortWithStatusJSON(reason.Status(), gin.H{
+				"error":  "token de reproduccion rechazado",
+				"reason": reason,
+			})
 			return
 		}
 
-		msg := fmt.Sprintf("%s|%s", file, expires)
-		mac := hmac.New(sha256.New, secret)
-		mac.Write([]byte(msg))
-		expected := hex.EncodeToString(mac.Sum(nil))
-
-		if !hmac.Equal([]byte(token), []byte(expected)) {
-			log.Println("Invalid token:", token, "!=", expected, "for msg:", msg)
-			c.AbortWithStatus(http.StatusUnauthorized)
-			return
+		private := fromCookie || claims.ClientIP != ""
+		if fromQuery && claims.Session && req.Variant == "" && sessions != nil {
+			if err := sessions.start(c, file, claims); err != nil {
+				// Sin cookie la lista se reescribe con la query como siempre.
+				logging.FromContext(c.Request.Context()).Error("stream session failed", "file_id", file, "error", err)
+			} else {
+				private = true
+			}
+		}
+		if fromCookie {
+			c.Writer.Header().Add("Vary", "Cookie")
+		}
+		if private {
+			c.Set(handlers.PrivateCacheKey, true)
 		}
 
+		c.Set(claimsKey, claims)
 		c.Next()
 	}
 }
 
-func parseSegmentSeconds(value string) int {
-	trimmed := strings.TrimSpace(value)
-	if trimmed == "" {
-		return 0
+// ByStreamUser limita por la claim user del token de /stream; si no la tiene,
+// por el ID del token, y para tokens v1 por IP.
+func ByStreamUser(c *gin.Context) string {
+	if v, ok := c.Get(claimsKey); ok {
+		claims := v.(security.Claims)
+		switch {
+		case claims.User != "":
+			return "user:" + claims.User
+		case claims.ID != "":
+			return "jti:" + claims.ID
+		}
 	}
-	seconds, err := strconv.Atoi(trimmed)
-	if err != nil || seconds <= 0 {
-		return 0
+	return ratelimit.ByIP(c)
+}
+
+// withSubRoutes sirve con routes las rutas fijas bajo /stream/<file_id>/
+// (la clave transcode.KeyURI, el archivo progresivo) y el resto con
+// fallback. Comparten ruta porque gin no admite otra junto al comodín
+// *quality.
+func withSubRoutes(routes map[string]gin.HandlerFunc, fallback gin.HandlerFunc) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if h, ok := routes[strings.TrimPrefix(c.Param("quality"), "/")]; ok {
+			h(c)
+			return
+		}
+		fallback(c)
 	}
-	return seconds
 }
 
-func parseVariantConfig(value string) []transcode.Variant {
-	trimmed := strings.TrimSpace(value)
-	if trimmed == "" {
+// variantFromQuality deduce la variante HLS de la ruta pedida según los
+// nombres que genera transcode ("128k.m3u8", "128k_segment_000.ts"). ok es
+// false para la lista maestra y la clave; el archivo progresivo cuenta como
+// la variante "file". La ruta se normaliza antes ("//", "/./") para que no
+// esquive el alcance del token.
+func variantFromQuality(quality string) (name string, kbps int, ok bool) {
+	name = strings.TrimPrefix(path.Clean("/"+quality), "/")
+	if i := strings.Index(name, "_segment_"); i != -1 {
+		name = name[:i]
+	} else if i := strings.LastIndex(name, "."); i != -1 {
+		name = name[:i]
+	}
+	if name == "" || name == "master" || name == transcode.KeyURI {
+		return "", 0, false
+	}
+	if name == handlers.ProgressiveRoute {
+		// Su tasa no sale del nombre: un token con max_bitrate no lo cubre y
+		// uno con variants debe incluir "file".
+		return name, math.MaxInt, true
+	}
+	kbps, _ = strconv.Atoi(strings.TrimSuffix(strings.ToLower(name), "k"))
+	return name, kbps, true
+}
+
+// progressiveFromConfig devuelve nil si el archivo progresivo está desactivado.
+func progressiveFromConfig(cfg config.TranscodeConfig) *transcode.Progressive {
+	if cfg.ProgressiveFormat == "" || cfg.ProgressiveFormat == "none" {
 		return nil
 	}
-	parts := strings.Split(trimmed, ",")
-	var variants []transcode.Variant
-	seen := map[int]bool{}
-	for _, part := range parts {
-		part = strings.TrimSpace(part)
-		if part == "" {
-			continue
-		}
-		num, err := strconv.Atoi(part)
-		if err != nil || num <= 0 {
-			continue
-		}
-		if seen[num] {
-			continue
-		}
-		seen[num] = true
+	return &transcode.Progressive{Format: cfg.ProgressiveFormat, BitrateKbps: cfg.ProgressiveBitrate}
+}
+
+func variantsFromKbps(kbps []int) []transcode.Variant {
+	variants := make([]transcode.Variant, 0, len(kbps))
+	for _, rate := range kbps {
 		variants = append(variants, transcode.Variant{
-			Name:        fmt.Sprintf("%dk", num),
-			BitrateKbps: num,
+			Name:        fmt.Sprintf("%dk", rate),
+			BitrateKbps: rate,
 		})
 	}
 	return variants
@@ -1,51 +1,1243 @@
 package server
 
 import (
+	"GOtify/internal/cache"
+	"GOtify/internal/cors"
+	"GOtify/internal/handlers"
+	"GOtify/internal/health"
+	"GOtify/internal/live"
+	"GOtify/internal/logging"
+	"GOtify/internal/ondemand"
+	"GOtify/internal/ratelimit"
+	"GOtify/internal/revocation"
+	"GOtify/internal/storage"
+	"GOtify/internal/testutil/ffmpegstub"
+	"GOtify/internal/transcode"
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"net/url"
+	"strings"
+	"sync"
 	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
 )
 
-func TestParseSegmentSeconds(t *testing.T) {
-	if got := parseSegmentSeconds("5"); got != 5 {
-		t.Fatalf("expected 5, got %d", got)
+type fakeStore struct {
+	songs map[string]storage.Song
+}
+
+func (f *fakeStore) UpsertSong(_ context.Context, song storage.Song) error {
+	f.songs[song.ID] = song
+	return nil
+}
+
+func (f *fakeStore) GetSong(_ context.Context, id string) (storage.Song, error) {
+	song, ok := f.songs[id]
+	if !ok {
+		return storage.Song{}, storage.ErrNotFound
 	}
-	if got := parseSegmentSeconds("invalid"); got != 0 {
-		t.Fatalf("expected 0 for invalid input, got %d", got)
+	return song, nil
+}
+
+func (f *fakeStore) ListSongs(context.Context) ([]storage.Song, error) {
+	out := make([]storage.Song, 0, len(f.songs))
+	for _, song := range f.songs {
+		out = append(out, song)
 	}
-	if got := parseSegmentSeconds(""); got != 0 {
-		t.Fatalf("expected 0 for empty input, got %d", got)
+	return out, nil
+}
+
+func (f *fakeStore) DeleteSong(_ context.Context, id string) error {
+	delete(f.songs, id)
+	return nil
+}
+
+type fakeBucket struct {
+	mu      sync.Mutex
+	objects map[string][]byte
+}
+
+func (f *fakeBucket) UploadBatch(_ context.Context, prefix string, files []storage.UploadFile) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, file := range files {
+		f.objects[prefix+"/"+file.Path] = file.Content
 	}
+	return nil
 }
 
-func TestParseVariantConfig(t *testing.T) {
-	tests := []struct {
-		input    string
-		expected []int
-	}{
-		{"64,128,192", []int{64, 128, 192}},
-		{"128,128,invalid", []int{128}},
-		{"", nil},
+func (f *fakeBucket) DeletePrefix(_ context.Context, prefix string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for key := range f.objects {
+		if strings.HasPrefix(key, prefix+"/") {
+			delete(f.objects, key)
+		}
+	}
+	return nil
+}
+
+func (f *fakeBucket) DownloadFile(_ context.Context, objectPath string) ([]byte, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	data, ok := f.objects[objectPath]
+	if !ok {
+		return nil, storage.ErrNotFound
+	}
+	return data, nil
+}
+
+func (f *fakeBucket) SignedURL(_ context.Context, objectPath string, _ int) (string, error) {
+	return "https://bucket.example/" + objectPath + "?token=signed", nil
+}
+
+type fakeRevocationStore struct {
+	mu      sync.Mutex
+	entries []storage.Revocation
+}
+
+func (f *fakeRevocationStore) ListRevocations(context.Context) ([]storage.Revocation, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]storage.Revocation(nil), f.entries...), nil
+}
+
+func (f *fakeRevocationStore) InsertRevocation(_ context.Context, r storage.Revocation) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.entries = append(f.entries, r)
+	return nil
+}
+
+type fakeTranscoder struct{}
+
+func (fakeTranscoder) ProbeDuration(context.Context, string) (int32, error) {
+	return 42, nil
+}
+
+func (fakeTranscoder) GenerateHLS(context.Context, string, *transcode.Key) ([]transcode.ResultFile, error) {
+	return []transcode.ResultFile{{Name: "master.m3u8", Content: []byte("#EXTM3U\n")}}, nil
+}
+
+const testAPIKey = "test-key"
+
+func newTestServer(t *testing.T, opts ...Option) *Server {
+	t.Helper()
+	gin.SetMode(gin.TestMode)
+
+	store := &fakeStore{songs: map[string]storage.Song{
+		"song-1": {ID: "song-1", Name: "Song", Duration: 42, BucketFolder: "song-1"},
+	}}
+	bucket := &fakeBucket{objects: map[string][]byte{
+		"song-1/master.m3u8":         []byte("#EXTM3U\n#EXT-X-STREAM-INF:BANDWIDTH=128000\n128k.m3u8\n"),
+		"song-1/128k_segment_000.ts": []byte("segment"),
+		"song-1/progressive.mp3":     []byte("progressive"),
+	}}
+	base := []Option{
+		WithStore(store),
+		WithBucket(bucket, "audio", "https://bucket.example"),
+		WithAPIKey(testAPIKey),
+		WithTranscoder(fakeTranscoder{}),
+		WithRateLimiter(func(c *gin.Context) { c.Next() }),
+	}
+	s, err := New(append(base, opts...)...)
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	return s
+}
+
+func serve(s *Server, method, target string, apiKey bool) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, target, nil)
+	if apiKey {
+		req.Header.Set("X-API-Key", testAPIKey)
+	}
+	rec := httptest.NewRecorder()
+	s.Handler().ServeHTTP(rec, req)
+	return rec
+}
+
+func TestNewRequiresDependencies(t *testing.T) {
+	_, err := New()
+	if err == nil {
+		t.Fatal("expected error without dependencies")
+	}
+	for _, want := range []string{"store", "bucket", "api key"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Fatalf("expected error to mention %q, got %v", want, err)
+		}
+	}
+}
+
+func TestServerRequiresAPIKey(t *testing.T) {
+	s := newTestServer(t)
+
+	if rec := serve(s, http.MethodGet, "/livez", false); rec.Code != http.StatusOK {
+		t.Fatalf("expected /livez without api key to be 200, got %d", rec.Code)
+	}
+	if rec := serve(s, http.MethodGet, "/songs", false); rec.Code != http.StatusUnauthorized {
+		t.Fatalf("expected 401 without api key, got %d", rec.Code)
+	}
+
+	rec := serve(s, http.MethodGet, "/songs", true)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200 listing songs, got %d: %s", rec.Code, rec.Body.String())
+	}
+	if !strings.Contains(rec.Body.String(), "song-1") {
+		t.Fatalf("expected song-1 in list, got %s", rec.Body.String())
+	}
+}
+
+func TestServerStreamIsTokenOnly(t *testing.T) {
+	s := newTestServer(t)
+
+	if rec := serve(s, http.MethodGet, "/token/song-1", false); rec.Code != http.StatusUnauthorized {
+		t.Fatalf("expected /token to require the api key, got %d", rec.Code)
+	}
+	rec := serve(s, http.MethodGet, "/token/song-1", true)
+	var body struct {
+		URL string `json:"url"`
+	}
+	_ = json.Unmarshal(rec.Body.Bytes(), &body)
+	issued, _ := url.Parse(body.URL)
+
+	if rec := serve(s, http.MethodGet, issued.Path+"/?"+issued.RawQuery, false); rec.Code != http.StatusOK {
+		t.Fatalf("expected playlist with token only, got %d: %s", rec.Code, rec.Body.String())
+	}
+	if rec := serve(s, http.MethodGet, issued.Path+"/128k_segment_000.ts?"+issued.RawQuery, false); rec.Code != http.StatusTemporaryRedirect {
+		t.Fatalf("expected segment redirect with token only, got %d", rec.Code)
+	}
+	if rec := serve(s, http.MethodGet, issued.Path+"/", false); rec.Code != http.StatusUnauthorized {
+		t.Fatalf("expected stream without token to be rejected, got %d", rec.Code)
+	}
+	for _, path := range []string{"/songs", "/admin/keys", "/metrics"} {
+		if rec := serve(s, http.MethodGet, path, false); rec.Code != http.StatusUnauthorized {
+			t.Fatalf("expected %s to require the api key, got %d", path, rec.Code)
+		}
+	}
+}
+
+type fakeKeys struct {
+	keys map[string]storage.SongKey
+}
+
+func (f *fakeKeys) UpsertSongKey(_ context.Context, key storage.SongKey) error {
+	f.keys[key.SongID] = key
+	return nil
+}
+
+func (f *fakeKeys) GetSongKey(_ context.Context, id string) (storage.SongKey, error) {
+	key, ok := f.keys[id]
+	if !ok {
+		return storage.SongKey{}, storage.ErrNotFound
+	}
+	return key, nil
+}
+
+func (f *fakeKeys) DeleteSongKey(_ context.Context, id string) error {
+	delete(f.keys, id)
+	return nil
+}
+
+func TestServerKeyDelivery(t *testing.T) {
+	keys := &fakeKeys{keys: map[string]storage.SongKey{
+		"song-1": {SongID: "song-1", Key: "000102030405060708090a0b0c0d0e0f"},
+	}}
+	s := newTestServer(t, WithSongKeys(keys, true))
+
+	rec := serve(s, http.MethodGet, "/token/song-1", true)
+	var body struct {
+		URL string `json:"url"`
+	}
+	_ = json.Unmarshal(rec.Body.Bytes(), &body)
+	issued, _ := url.Parse(body.URL)
+
+	rec = serve(s, http.MethodGet, issued.Path+"/key?"+issued.RawQuery, false)
+	if rec.Code != http.StatusOK || rec.Body.Len() != 16 {
+		t.Fatalf("expected 16 byte key, got %d (%d bytes)", rec.Code, rec.Body.Len())
+	}
+	if rec := serve(s, http.MethodGet, issued.Path+"/key", false); rec.Code != http.StatusUnauthorized {
+		t.Fatalf("expected key without token to be rejected, got %d", rec.Code)
+	}
+	if rec := serve(s, http.MethodGet, issued.Path+"/key", true); rec.Code != http.StatusUnauthorized {
+		t.Fatalf("expected api key alone not to unlock keys, got %d", rec.Code)
+	}
+}
+
+func TestServerProgressiveFile(t *testing.T) {
+	s := newTestServer(t, WithProgressive("mp3"))
+
+	rec := serve(s, http.MethodGet, "/token/song-1", true)
+	var body struct {
+		URL string `json:"url"`
+	}
+	_ = json.Unmarshal(rec.Body.Bytes(), &body)
+	issued, _ := url.Parse(body.URL)
+
+	// Sin caché en disco el bucket sirve el archivo y sus rangos.
+	rec = serve(s, http.MethodGet, issued.Path+"/file?"+issued.RawQuery, false)
+	if rec.Code != http.StatusTemporaryRedirect || rec.Header().Get("Location") != "https://bucket.example/song-1/progressive.mp3?token=signed" {
+		t.Fatalf("expected a redirect to the signed progressive file, got %d %v", rec.Code, rec.Header())
+	}
+	if rec := serve(s, http.MethodGet, issued.Path+"/file", true); rec.Code != http.StatusUnauthorized {
+		t.Fatalf("expected progressive file without token to be rejected, got %d", rec.Code)
+	}
+	// El objeto no se alcanza por su nombre, que esquivaría el alcance "file".
+	rec = serve(s, http.MethodGet, "/token/song-1?variants=128k", true)
+	_ = json.Unmarshal(rec.Body.Bytes(), &body)
+	scoped, _ := url.Parse(body.URL)
+	if rec := serve(s, http.MethodGet, scoped.Path+"/file?"+scoped.RawQuery, false); rec.Code != http.StatusForbidden {
+		t.Fatalf("expected the scoped token not to cover the progressive file, got %d", rec.Code)
 	}
+	if rec := serve(s, http.MethodGet, scoped.Path+"/progressive.mp3?"+scoped.RawQuery, false); rec.Code != http.StatusForbidden {
+		t.Fatalf("expected the scoped token to be refused for the progressive object, got %d", rec.Code)
+	}
+	if rec := serve(s, http.MethodGet, issued.Path+"/progressive.mp3?"+issued.RawQuery, false); rec.Code != http.StatusNotFound {
+		t.Fatalf("expected the progressive object to be unreachable by name, got %d", rec.Code)
+	}
+}
+
+func TestServerProgressiveFileCached(t *testing.T) {
+	cfg := cache.DefaultConfig()
+	cfg.SegmentDir = t.TempDir()
+	s := newTestServer(t, WithProgressive("mp3"), WithCache(cfg))
+
+	rec := serve(s, http.MethodGet, "/token/song-1", true)
+	var body struct {
+		URL string `json:"url"`
+	}
+	_ = json.Unmarshal(rec.Body.Bytes(), &body)
+	issued, _ := url.Parse(body.URL)
+
+	req := httptest.NewRequest(http.MethodGet, issued.Path+"/file?"+issued.RawQuery, nil)
+	req.Header.Set("Range", "bytes=0-3")
+	rec = httptest.NewRecorder()
+	s.Handler().ServeHTTP(rec, req)
+	if rec.Code != http.StatusPartialContent || rec.Body.String() != "prog" {
+		t.Fatalf("expected partial progressive file, got %d %q", rec.Code, rec.Body.String())
+	}
+	if rec.Header().Get("Content-Type") != "audio/mpeg" || rec.Header().Get("Content-Range") != "bytes 0-3/11" {
+		t.Fatalf("unexpected headers %v", rec.Header())
+	}
+
+	rec = serve(s, http.MethodHead, issued.Path+"/file?"+issued.RawQuery, false)
+	if rec.Code != http.StatusOK || rec.Header().Get("Content-Length") != "11" || rec.Body.Len() != 0 {
+		t.Fatalf("expected HEAD with length and no body, got %d %v", rec.Code, rec.Header())
+	}
+}
 
-	for _, tc := range tests {
-		variants := parseVariantConfig(tc.input)
-		if len(variants) != len(tc.expected) {
-			t.Fatalf("input %q: expected %d variants, got %d", tc.input, len(tc.expected), len(variants))
+func TestServerOnDemandVariant(t *testing.T) {
+	paths := ffmpegstub.Build(t)
+	bucket := &fakeBucket{objects: map[string][]byte{
+		"song-1/master.m3u8":            []byte("#EXTM3U\n#EXT-X-STREAM-INF:BANDWIDTH=131072\n128k.m3u8\n"),
+		storage.MezzaninePath("song-1"): []byte("original"),
+	}}
+	store := &fakeStore{songs: map[string]storage.Song{
+		"song-1": {ID: "song-1", Name: "Song", BucketFolder: "song-1", Source: &storage.SongSource{Format: "wav"}},
+	}}
+	s := newTestServer(t,
+		WithStore(store),
+		WithBucket(bucket, "audio", "https://bucket.example"),
+		WithTranscoder(transcode.FFmpeg{Config: transcode.Config{BinPath: paths.FFmpeg}, ProbeBin: paths.FFProbe}),
+		WithOnDemand(ondemand.Config{Variants: []transcode.Variant{{Name: "32k", BitrateKbps: 32}}}),
+	)
+
+	rec := serve(s, http.MethodGet, "/token/song-1", true)
+	var body struct {
+		URL string `json:"url"`
+	}
+	_ = json.Unmarshal(rec.Body.Bytes(), &body)
+	issued, _ := url.Parse(body.URL)
+
+	rec = serve(s, http.MethodGet, issued.Path+"/?"+issued.RawQuery, false)
+	if !strings.Contains(rec.Body.String(), "32k.m3u8?") {
+		t.Fatalf("expected master to list the on-demand variant, got:\n%s", rec.Body.String())
+	}
+	rec = serve(s, http.MethodGet, issued.Path+"/32k.m3u8?"+issued.RawQuery, false)
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), "#EXTINF") {
+		t.Fatalf("expected generated playlist, got %d:\n%s", rec.Code, rec.Body.String())
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if data, err := bucket.DownloadFile(context.Background(), "song-1/32k.m3u8"); err == nil {
+			if !strings.Contains(string(data), "#EXT-X-ENDLIST") {
+				t.Fatalf("expected stored playlist to be complete:\n%s", data)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("on-demand variant was not stored in the bucket")
 		}
-		for i, v := range variants {
-			if v.BitrateKbps != tc.expected[i] {
-				t.Fatalf("input %q: expected bitrate %d, got %d", tc.input, tc.expected[i], v.BitrateKbps)
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	if _, err := New(
+		WithStore(&fakeStore{}), WithBucket(bucket, "audio", ""), WithAPIKey(testAPIKey),
+		WithTranscoder(fakeTranscoder{}),
+		WithOnDemand(ondemand.Config{Variants: []transcode.Variant{{Name: "32k", BitrateKbps: 32}}}),
+	); err == nil {
+		t.Fatal("expected on-demand variants to require GenerateVariant")
+	}
+}
+
+func TestServerRetranscodeRoutes(t *testing.T) {
+	s := newTestServer(t, WithKeepSource(true))
+
+	if rec := serve(s, http.MethodPost, "/songs/song-1/retranscode", false); rec.Code != http.StatusUnauthorized {
+		t.Fatalf("expected retranscode to require the API key, got %d", rec.Code)
+	}
+	// song-1 se subió sin original.
+	if rec := serve(s, http.MethodPost, "/songs/song-1/retranscode", true); rec.Code != http.StatusConflict {
+		t.Fatalf("expected 409 without mezzanine, got %d: %s", rec.Code, rec.Body.String())
+	}
+	rec := serve(s, http.MethodGet, "/songs/retranscode", true)
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), `"running":false`) {
+		t.Fatalf("expected bulk status, got %d: %s", rec.Code, rec.Body.String())
+	}
+	if rec := serve(s, http.MethodGet, "/songs/song-1", true); rec.Code != http.StatusOK {
+		t.Fatalf("expected song routes to keep working, got %d", rec.Code)
+	}
+}
+
+func TestServerLiveChannel(t *testing.T) {
+	paths := ffmpegstub.Build(t)
+	s := newTestServer(t,
+		WithTranscoder(transcode.FFmpeg{Config: transcode.Config{BinPath: paths.FFmpeg}, ProbeBin: paths.FFProbe}),
+		WithLive(live.Config{Channels: []string{"radio"}, SegmentSeconds: 1, WindowSegments: 3}, "hackme"),
+	)
+	ts := httptest.NewServer(s.Handler())
+	defer ts.Close()
+
+	// Con contraseña de fuente propia, la API key no basta.
+	rec := serve(s, http.MethodPut, "/live/radio", true)
+	if rec.Code != http.StatusUnauthorized || rec.Header().Get("WWW-Authenticate") == "" {
+		t.Fatalf("expected basic auth challenge, got %d %v", rec.Code, rec.Header())
+	}
+	req := httptest.NewRequest(http.MethodPut, "/live/radio", nil)
+	req.Header.Set("X-API-Key", "hackme")
+	rec = httptest.NewRecorder()
+	s.Handler().ServeHTTP(rec, req)
+	if rec.Code != http.StatusNoContent {
+		t.Fatalf("expected the source password in X-API-Key to be accepted, got %d", rec.Code)
+	}
+
+	rec = serve(s, http.MethodGet, "/token/radio", true)
+	var body struct {
+		URL  string `json:"url"`
+		Live bool   `json:"live"`
+	}
+	_ = json.Unmarshal(rec.Body.Bytes(), &body)
+	issued, _ := url.Parse(body.URL)
+	if rec.Code != http.StatusOK || !body.Live {
+		t.Fatalf("expected a live token, got %d: %s", rec.Code, rec.Body.String())
+	}
+	get := func(path string) *httptest.ResponseRecorder {
+		return serve(s, http.MethodGet, issued.Path+path+"?"+issued.RawQuery, false)
+	}
+	// waitSegment espera a que la lista en directo sirva un segmento con want.
+	waitSegment := func(want string) {
+		t.Helper()
+		deadline := time.Now().Add(5 * time.Second)
+		for {
+			list := get("/128k.m3u8").Body.String()
+			for _, line := range strings.Split(list, "\n") {
+				if name, _, ok := strings.Cut(line, "?"); ok && strings.HasPrefix(name, "128k_segment_") {
+					if rec := get("/" + name); rec.Body.String() == want {
+						if !strings.Contains(rec.Header().Get("Cache-Control"), "immutable") {
+							t.Fatalf("expected immutable live segment, got %v", rec.Header())
+						}
+						return
+					}
+				}
 			}
-			expectedName := fmt.Sprintf("%dk", tc.expected[i])
-			if v.Name != expectedName {
-				t.Fatalf("expected name %s, got %s", expectedName, v.Name)
+			if time.Now().After(deadline) {
+				t.Fatalf("segment %q never appeared:\n%s", want, list)
 			}
+			time.Sleep(20 * time.Millisecond)
 		}
 	}
 
-	// ensure duplicates removed
-	variants := parseVariantConfig("64,64,64")
-	if len(variants) != 1 || variants[0].BitrateKbps != 64 {
-		t.Fatalf("expected single variant 64k, got %#v", variants)
+	source, feed := io.Pipe()
+	put, _ := http.NewRequest(http.MethodPut, ts.URL+"/live/radio", source)
+	put.SetBasicAuth("source", "hackme")
+	done := make(chan *http.Response, 1)
+	go func() {
+		resp, err := http.DefaultClient.Do(put)
+		if err != nil {
+			t.Errorf("PUT ingest: %v", err)
+		}
+		done <- resp
+	}()
+	fmt.Fprintln(feed, "first")
+	waitSegment("first")
+	if rec := get("/"); rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), "128k.m3u8?") {
+		t.Fatalf("expected live master, got %d:\n%s", rec.Code, rec.Body.String())
+	}
+	feed.Close()
+	if resp := <-done; resp == nil || resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("expected PUT ingest to end with 204, got %v", resp)
+	}
+
+	// Codificadores Icecast antiguos: método SOURCE y audio tras la respuesta.
+	conn, err := net.Dial("tcp", ts.Listener.Addr().String())
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer conn.Close()
+	fmt.Fprintf(conn, "SOURCE /live/radio HTTP/1.0\r\nAuthorization: Basic %s\r\nContent-Type: audio/mpeg\r\n\r\n",
+		base64.StdEncoding.EncodeToString([]byte("source:hackme")))
+	status, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil || !strings.Contains(status, "200") {
+		t.Fatalf("expected SOURCE handshake, got %q %v", status, err)
+	}
+	fmt.Fprintln(conn, "second")
+	waitSegment("second")
+
+	if _, err := New(
+		WithStore(&fakeStore{}), WithBucket(&fakeBucket{}, "audio", ""), WithAPIKey(testAPIKey),
+		WithTranscoder(fakeTranscoder{}),
+		WithLive(live.Config{Channels: []string{"radio"}}, "hackme"),
+	); err == nil {
+		t.Fatal("expected live channels to require a transcoder with Live")
+	}
+	if _, err := New(
+		WithStore(&fakeStore{songs: map[string]storage.Song{"radio": {ID: "radio", Name: "Radio"}}}),
+		WithBucket(&fakeBucket{}, "audio", ""), WithAPIKey(testAPIKey),
+		WithTranscoder(transcode.FFmpeg{Config: transcode.Config{BinPath: paths.FFmpeg}, ProbeBin: paths.FFProbe}),
+		WithLive(live.Config{Channels: []string{"radio"}}, "hackme"),
+	); err == nil || !strings.Contains(err.Error(), "id of a song") {
+		t.Fatalf("expected a channel named like a song to be refused, got %v", err)
+	}
+	for _, password := range []string{"", " ", testAPIKey} {
+		if _, err := New(
+			WithStore(&fakeStore{}), WithBucket(&fakeBucket{}, "audio", ""), WithAPIKey(testAPIKey),
+			WithTranscoder(transcode.FFmpeg{Config: transcode.Config{BinPath: paths.FFmpeg}, ProbeBin: paths.FFProbe}),
+			WithLive(live.Config{Channels: []string{"radio"}}, password),
+		); err == nil || !strings.Contains(err.Error(), "source password") {
+			t.Fatalf("expected source password %q to be refused, got %v", password, err)
+		}
+	}
+}
+
+func TestServerLiveIngestRateLimited(t *testing.T) {
+	paths := ffmpegstub.Build(t)
+	limits := DefaultRateLimits()
+	limits.Public.Limit = 2
+	s := newTestServer(t,
+		WithRateLimiter(nil), WithRateLimits(ratelimit.NewMemoryStore(), limits),
+		WithTranscoder(transcode.FFmpeg{Config: transcode.Config{BinPath: paths.FFmpeg}, ProbeBin: paths.FFProbe}),
+		WithLive(live.Config{Channels: []string{"radio"}, SegmentSeconds: 1, WindowSegments: 3}, "hackme"),
+	)
+
+	guess := func() int {
+		req := httptest.NewRequest(http.MethodPut, "/live/radio", nil)
+		req.SetBasicAuth("source", "guess")
+		rec := httptest.NewRecorder()
+		s.Handler().ServeHTTP(rec, req)
+		return rec.Code
+	}
+	for i := 0; i < 2; i++ {
+		if code := guess(); code != http.StatusUnauthorized {
+			t.Fatalf("expected wrong password %d to be rejected, got %d", i, code)
+		}
+	}
+	if code := guess(); code != http.StatusTooManyRequests {
+		t.Fatalf("expected password guesses to be rate limited, got %d", code)
+	}
+}
+
+func TestServerCacheHeaders(t *testing.T) {
+	s := newTestServer(t)
+
+	rec := serve(s, http.MethodGet, "/token/song-1", true)
+	if cc := rec.Header().Get("Cache-Control"); cc != "no-store" {
+		t.Fatalf("expected token response to be no-store, got %q", cc)
+	}
+	var body struct {
+		URL string `json:"url"`
+	}
+	_ = json.Unmarshal(rec.Body.Bytes(), &body)
+	issued, _ := url.Parse(body.URL)
+
+	rec = serve(s, http.MethodGet, issued.Path+"/?"+issued.RawQuery, false)
+	etag := rec.Header().Get("ETag")
+	if rec.Code != http.StatusOK || etag == "" || rec.Header().Get("Cache-Control") != "public, max-age=10" {
+		t.Fatalf("expected short-lived public playlist with ETag, got %d %v", rec.Code, rec.Header())
+	}
+	if rec.Header().Get("X-Content-Type-Options") != "nosniff" {
+		t.Fatalf("expected protection headers to stay, got %v", rec.Header())
+	}
+
+	req := httptest.NewRequest(http.MethodGet, issued.Path+"/?"+issued.RawQuery, nil)
+	req.Header.Set("If-None-Match", etag)
+	rec = httptest.NewRecorder()
+	s.Handler().ServeHTTP(rec, req)
+	if rec.Code != http.StatusNotModified || rec.Body.Len() != 0 {
+		t.Fatalf("expected 304 for a matching ETag, got %d", rec.Code)
+	}
+
+	for _, target := range []string{issued.Path + "/", "/songs", "/stream/missing/?" + issued.RawQuery} {
+		if cc := serve(s, http.MethodGet, target, false).Header().Get("Cache-Control"); cc != "no-store" {
+			t.Fatalf("expected %s error to be no-store, got %q", target, cc)
+		}
+	}
+}
+
+func TestServerCachedSegments(t *testing.T) {
+	cfg := cache.DefaultConfig()
+	cfg.SegmentDir = t.TempDir()
+	s := newTestServer(t, WithCache(cfg))
+
+	rec := serve(s, http.MethodGet, "/token/song-1", true)
+	var body struct {
+		URL string `json:"url"`
+	}
+	_ = json.Unmarshal(rec.Body.Bytes(), &body)
+	issued, _ := url.Parse(body.URL)
+
+	rec = serve(s, http.MethodGet, issued.Path+"/128k_segment_000.ts?"+issued.RawQuery, false)
+	if rec.Code != http.StatusOK || rec.Body.String() != "segment" || rec.Header().Get("Content-Type") != "video/mp2t" {
+		t.Fatalf("expected segment served from the cache, got %d %q %v", rec.Code, rec.Body.String(), rec.Header())
+	}
+	if cc := rec.Header().Get("Cache-Control"); cc != "public, max-age=31536000, immutable" {
+		t.Fatalf("expected immutable segment, got %q", cc)
+	}
+	if rec := serve(s, http.MethodGet, issued.Path+"/128k_segment_009.ts?"+issued.RawQuery, false); rec.Code != http.StatusNotFound {
+		t.Fatalf("expected missing segment to be 404, got %d", rec.Code)
+	}
+}
+
+func TestServerTokenAndStreamFlow(t *testing.T) {
+	s := newTestServer(t, WithBasePath("/gotify/"))
+
+	rec := serve(s, http.MethodGet, "/gotify/token/song-1", true)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected token 200, got %d", rec.Code)
+	}
+	var body struct {
+		URL string `json:"url"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+		t.Fatalf("decode token response: %v", err)
+	}
+	issued, err := url.Parse(body.URL)
+	if err != nil {
+		t.Fatalf("parse url: %v", err)
+	}
+	if issued.Path != "/gotify/stream/song-1" {
+		t.Fatalf("expected url under base path, got %q", issued.Path)
+	}
+
+	rec = serve(s, http.MethodGet, issued.Path+"/?"+issued.RawQuery, true)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected master playlist, got %d", rec.Code)
+	}
+	if !strings.Contains(rec.Body.String(), "128k.m3u8?") {
+		t.Fatalf("expected variant rewritten with token, got %q", rec.Body.String())
+	}
+
+	q := issued.Query()
+	q.Set("t", "forged")
+	if rec := serve(s, http.MethodGet, issued.Path+"/?"+q.Encode(), true); rec.Code != http.StatusUnauthorized {
+		t.Fatalf("expected forged token to be rejected, got %d", rec.Code)
+	}
+
+	if rec := serve(s, http.MethodGet, "/token/song-1", true); rec.Code != http.StatusNotFound {
+		t.Fatalf("expected routes outside base path to be 404, got %d", rec.Code)
+	}
+}
+
+func TestServerScopedTokens(t *testing.T) {
+	s := newTestServer(t, WithAudiences("web"))
+
+	issue := func(query string) string {
+		t.Helper()
+		rec := serve(s, http.MethodGet, "/token/song-1?"+query, true)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("token %q: expected 200, got %d", query, rec.Code)
+		}
+		var body struct {
+			URL string `json:"url"`
+		}
+		_ = json.Unmarshal(rec.Body.Bytes(), &body)
+		issued, _ := url.Parse(body.URL)
+		return issued.RawQuery
+	}
+
+	cases := []struct {
+		name    string
+		query   string
+		quality string
+		status  int
+		reason  string
+	}{
+		{"allowed variant", "aud=web&variants=64k", "/64k.m3u8", http.StatusOK, ""},
+		{"master always allowed", "aud=web&variants=64k", "/", http.StatusOK, ""},
+		{"variant outside set", "aud=web&variants=64k", "/128k_segment_000.ts", http.StatusForbidden, "variant_not_allowed"},
+		{"bitrate ceiling", "aud=web&max_bitrate=64", "/128k.m3u8", http.StatusForbidden, "variant_not_allowed"},
+		{"ceiling with dot segment", "aud=web&max_bitrate=64", "/./128k_segment_000.ts", http.StatusForbidden, "variant_not_allowed"},
+		{"ceiling with double slash", "aud=web&max_bitrate=64", "//128k_segment_000.ts", http.StatusForbidden, "variant_not_allowed"},
+		{"ceiling with unknown bitrate", "aud=web&max_bitrate=64", "/hifi.m3u8", http.StatusForbidden, "variant_not_allowed"},
+		{"progressive outside set", "aud=web&variants=64k", "/file", http.StatusForbidden, "variant_not_allowed"},
+		{"progressive in set", "aud=web&variants=64k,file", "/file", http.StatusOK, ""},
+		{"progressive with ceiling", "aud=web&max_bitrate=320", "/file", http.StatusForbidden, "variant_not_allowed"},
+		{"client ip", "aud=web&ip=10.0.0.0/8", "/", http.StatusForbidden, "ip_mismatch"},
+		{"matching ip", "aud=web&ip=192.0.2.0/24", "/", http.StatusOK, ""},
+		{"audience", "aud=ios", "/", http.StatusForbidden, "audience_mismatch"},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			rec := serve(s, http.MethodGet, "/stream/song-1"+tc.quality+"?"+issue(tc.query), true)
+			// Las variantes no existen en el bucket falso: un 404 también
+			// significa que el token fue aceptado.
+			if tc.status == http.StatusOK {
+				if rec.Code == http.StatusUnauthorized || rec.Code == http.StatusForbidden {
+					t.Fatalf("expected request to pass auth, got %d: %s", rec.Code, rec.Body.String())
+				}
+				return
+			}
+			if rec.Code != tc.status || !strings.Contains(rec.Body.String(), tc.reason) {
+				t.Fatalf("expected %d %s, got %d: %s", tc.status, tc.reason, rec.Code, rec.Body.String())
+			}
+		})
+	}
+
+	rec := serve(s, http.MethodGet, "/stream/other-song/?"+issue("aud=web"), true)
+	if rec.Code != http.StatusForbidden || !strings.Contains(rec.Body.String(), "wrong_file") {
+		t.Fatalf("expected wrong_file, got %d: %s", rec.Code, rec.Body.String())
+	}
+}
+
+func TestServerRejectionsDoNotLeakTokens(t *testing.T) {
+	var logs bytes.Buffer
+	s := newTestServer(t, WithLogger(logging.New(&logs, slog.LevelDebug)))
+
+	rec := serve(s, http.MethodGet, "/token/song-1", true)
+	var body struct {
+		URL string `json:"url"`
+	}
+	_ = json.Unmarshal(rec.Body.Bytes(), &body)
+	issued, _ := url.Parse(body.URL)
+	token := issued.Query().Get("t")
+
+	rec = serve(s, http.MethodGet, "/stream/other-song/?"+issued.RawQuery, true)
+	if rec.Code != http.StatusForbidden {
+		t.Fatalf("expected 403, got %d", rec.Code)
+	}
+	var errBody struct {
+		Error  string `json:"error"`
+		Reason string `json:"reason"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &errBody); err != nil || errBody.Reason != "wrong_file" || errBody.Error == "" {
+		t.Fatalf("unexpected error body %s (%v)", rec.Body.String(), err)
+	}
+	if strings.Contains(rec.Body.String(), token) {
+		t.Fatal("error response must not include the token")
+	}
+	if !strings.Contains(logs.String(), "stream token rejected") {
+		t.Fatalf("expected rejection to be logged, got:\n%s", logs.String())
+	}
+	if strings.Contains(logs.String(), token) || strings.Contains(logs.String(), token[len(token)-20:]) {
+		t.Fatalf("token leaked into logs:\n%s", logs.String())
+	}
+}
+
+func TestServerPathTokens(t *testing.T) {
+	var logs bytes.Buffer
+	s := newTestServer(t, WithBasePath("/gotify"), WithLogger(logging.New(&logs, slog.LevelDebug)))
+
+	rec := serve(s, http.MethodGet, "/gotify/token/song-1?mode=path", true)
+	var body struct {
+		URL         string `json:"url"`
+		PlaybackURL string `json:"playback_url"`
+	}
+	_ = json.Unmarshal(rec.Body.Bytes(), &body)
+	playback, _ := url.Parse(body.PlaybackURL)
+	if playback.RawQuery != "" || !strings.HasPrefix(playback.Path, "/gotify/stream/v2.") || !strings.HasSuffix(playback.Path, "/song-1/master.m3u8") {
+		t.Fatalf("unexpected path playback url %q", body.PlaybackURL)
+	}
+	token := strings.Split(playback.Path, "/")[3]
+
+	rec = serve(s, http.MethodGet, playback.Path, false)
+	if rec.Code != http.StatusOK || strings.Contains(rec.Body.String(), "?") {
+		t.Fatalf("expected playlist without per-uri tokens, got %d %q", rec.Code, rec.Body.String())
+	}
+	segment := strings.TrimSuffix(playback.Path, "master.m3u8") + "128k_segment_000.ts"
+	if rec := serve(s, http.MethodGet, segment, false); rec.Code != http.StatusTemporaryRedirect {
+		t.Fatalf("expected segment redirect with path token, got %d", rec.Code)
+	}
+	other := strings.Replace(playback.Path, "/song-1/", "/other-song/", 1)
+	if rec := serve(s, http.MethodGet, other, false); rec.Code != http.StatusForbidden {
+		t.Fatalf("expected path token to be bound to its song, got %d", rec.Code)
+	}
+	if strings.Contains(logs.String(), token[len(token)-20:]) {
+		t.Fatalf("path token leaked into logs:\n%s", logs.String())
+	}
+}
+
+func TestServerPathTokenRateLimited(t *testing.T) {
+	var logs bytes.Buffer
+	limits := DefaultRateLimits()
+	limits.Public.Limit = 1
+	s := newTestServer(t, WithLogger(logging.New(&logs, slog.LevelDebug)),
+		WithRateLimiter(nil), WithRateLimits(ratelimit.NewMemoryStore(), limits))
+
+	rec := serve(s, http.MethodGet, "/token/song-1?mode=path", true)
+	var body struct {
+		PlaybackURL string `json:"playback_url"`
+	}
+	_ = json.Unmarshal(rec.Body.Bytes(), &body)
+	playback, _ := url.Parse(body.PlaybackURL)
+	token := strings.Split(playback.Path, "/")[2]
+
+	serve(s, http.MethodGet, playback.Path, false)
+	if rec := serve(s, http.MethodGet, playback.Path, false); rec.Code != http.StatusTooManyRequests {
+		t.Fatalf("expected the public limit to be exhausted, got %d", rec.Code)
+	}
+	if strings.Contains(logs.String(), token[len(token)-20:]) {
+		t.Fatalf("path token leaked into the rate limited log:\n%s", logs.String())
+	}
+}
+
+func TestServerSessionCookie(t *testing.T) {
+	s := newTestServer(t, WithTokenMode(handlers.TokenModeCookie, time.Minute))
+
+	rec := serve(s, http.MethodGet, "/token/song-1", true)
+	var body struct {
+		PlaybackURL string `json:"playback_url"`
+		Mode        string `json:"mode"`
+	}
+	_ = json.Unmarshal(rec.Body.Bytes(), &body)
+	if body.Mode != handlers.TokenModeCookie {
+		t.Fatalf("expected server default mode, got %q", body.Mode)
+	}
+	playback, _ := url.Parse(body.PlaybackURL)
+
+	rec = serve(s, http.MethodGet, playback.RequestURI(), false)
+	if rec.Code != http.StatusOK || strings.Contains(rec.Body.String(), "t=") {
+		t.Fatalf("expected playlist without tokens, got %d %q", rec.Code, rec.Body.String())
+	}
+	cookies := rec.Result().Cookies()
+	if len(cookies) != 1 || cookies[0].Name != SessionCookie || !cookies[0].HttpOnly || cookies[0].Path != "/stream/song-1/" {
+		t.Fatalf("unexpected session cookie %+v", cookies)
+	}
+	if cookies[0].MaxAge <= 0 || cookies[0].MaxAge > 60 {
+		t.Fatalf("expected cookie capped by the session ttl, got %d", cookies[0].MaxAge)
+	}
+
+	withCookie := func(target string, cookie *http.Cookie) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, target, nil)
+		if cookie != nil {
+			req.AddCookie(cookie)
+		}
+		rec := httptest.NewRecorder()
+		s.Handler().ServeHTTP(rec, req)
+		return rec
+	}
+	if cc := rec.Header().Get("Cache-Control"); !strings.HasPrefix(cc, "private,") {
+		t.Fatalf("expected playlist setting a cookie to be private, got %q", cc)
+	}
+	rec = withCookie("/stream/song-1/128k_segment_000.ts", cookies[0])
+	if rec.Code != http.StatusTemporaryRedirect {
+		t.Fatalf("expected segment with session cookie, got %d", rec.Code)
+	}
+	if !strings.HasPrefix(rec.Header().Get("Cache-Control"), "private,") || rec.Header().Get("Vary") != "Cookie" {
+		t.Fatalf("expected cookie-authenticated response to be private and vary on Cookie, got %v", rec.Header())
+	}
+	if rec := withCookie("/stream/other-song/128k_segment_000.ts", cookies[0]); rec.Code != http.StatusForbidden {
+		t.Fatalf("expected session cookie to be bound to its song, got %d", rec.Code)
+	}
+	if rec := withCookie("/stream/song-1/128k_segment_000.ts", nil); rec.Code != http.StatusUnauthorized {
+		t.Fatalf("expected segment without cookie to be rejected, got %d", rec.Code)
+	}
+
+	rec = serve(s, http.MethodGet, "/token/song-1?mode=query", true)
+	_ = json.Unmarshal(rec.Body.Bytes(), &body)
+	playback, _ = url.Parse(body.PlaybackURL)
+	rec = serve(s, http.MethodGet, playback.RequestURI(), false)
+	if len(rec.Result().Cookies()) != 0 || !strings.Contains(rec.Body.String(), "t=") {
+		t.Fatalf("expected query mode override to keep rewriting, got %q", rec.Body.String())
+	}
+}
+
+func TestServerRevocation(t *testing.T) {
+	list := revocation.New(&fakeRevocationStore{}, time.Minute)
+	s := newTestServer(t, WithRevocations(list))
+
+	rec := serve(s, http.MethodGet, "/token/song-1", true)
+	var body struct {
+		URL string `json:"url"`
+	}
+	_ = json.Unmarshal(rec.Body.Bytes(), &body)
+	issued, _ := url.Parse(body.URL)
+	streamURL := issued.Path + "/?" + issued.RawQuery
+
+	if rec := serve(s, http.MethodGet, streamURL, true); rec.Code != http.StatusOK {
+		t.Fatalf("expected token to be valid before revocation, got %d", rec.Code)
+	}
+
+	notBefore := time.Now().Add(time.Second).UTC().Format(time.RFC3339)
+	req := httptest.NewRequest(http.MethodPost, "/admin/revocations", strings.NewReader(`{"kind": "song", "subject": "song-1", "not_before": "`+notBefore+`"}`))
+	req.Header.Set("X-API-Key", testAPIKey)
+	rec = httptest.NewRecorder()
+	s.Handler().ServeHTTP(rec, req)
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("expected 201, got %d: %s", rec.Code, rec.Body.String())
+	}
+
+	rec = serve(s, http.MethodGet, streamURL, true)
+	if rec.Code != http.StatusUnauthorized || !strings.Contains(rec.Body.String(), "revoked") {
+		t.Fatalf("expected revoked token to be rejected, got %d: %s", rec.Code, rec.Body.String())
+	}
+
+	rec = serve(s, http.MethodGet, "/admin/revocations", true)
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), "song-1") {
+		t.Fatalf("expected revocation listing, got %d: %s", rec.Code, rec.Body.String())
+	}
+}
+
+func TestServerStartRefreshesWithoutServe(t *testing.T) {
+	store := &fakeRevocationStore{}
+	list := revocation.New(store, 10*time.Millisecond)
+	s := newTestServer(t, WithRevocations(list))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	s.Start(ctx)
+	s.Start(ctx)
+
+	rec := serve(s, http.MethodGet, "/token/song-1", true)
+	var body struct {
+		URL string `json:"url"`
+	}
+	_ = json.Unmarshal(rec.Body.Bytes(), &body)
+	issued, _ := url.Parse(body.URL)
+	streamURL := issued.Path + "/?" + issued.RawQuery
+
+	// Otra réplica revoca la canción directamente en el catálogo.
+	store.InsertRevocation(ctx, storage.Revocation{Kind: storage.RevokeSong, Subject: "song-1", NotBefore: time.Now().Add(time.Second)})
+	deadline := time.Now().Add(2 * time.Second)
+	for serve(s, http.MethodGet, streamURL, false).Code != http.StatusUnauthorized {
+		if time.Now().After(deadline) {
+			t.Fatal("expected Start to refresh the revocation list for embedders using Handler")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestServerKeyRotation(t *testing.T) {
+	s := newTestServer(t)
+
+	tokenURL := func() string {
+		t.Helper()
+		rec := serve(s, http.MethodGet, "/token/song-1", true)
+		var body struct {
+			URL string `json:"url"`
+		}
+		_ = json.Unmarshal(rec.Body.Bytes(), &body)
+		return body.URL
+	}
+	before := tokenURL()
+
+	if rec := serve(s, http.MethodPost, "/admin/keys/rotate", false); rec.Code != http.StatusUnauthorized {
+		t.Fatalf("expected rotation to require the api key, got %d", rec.Code)
+	}
+	rec := serve(s, http.MethodPost, "/admin/keys/rotate", true)
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("expected 201, got %d: %s", rec.Code, rec.Body.String())
+	}
+
+	after := tokenURL()
+	if before == after {
+		t.Fatal("expected a different token after rotation")
+	}
+	for _, u := range []string{before, after} {
+		issued, _ := url.Parse(u)
+		if rec := serve(s, http.MethodGet, issued.Path+"/?"+issued.RawQuery, true); rec.Code != http.StatusOK {
+			t.Fatalf("expected token %s to stay valid, got %d", u, rec.Code)
+		}
+	}
+}
+
+func TestVariantFromQuality(t *testing.T) {
+	cases := []struct {
+		quality string
+		name    string
+		kbps    int
+		ok      bool
+	}{
+		{"", "", 0, false},
+		{"/", "", 0, false},
+		{"/master", "", 0, false},
+		{"/master.m3u8", "", 0, false},
+		{"/key", "", 0, false},
+		{"/file", "file", math.MaxInt, true},
+		{"/128k", "128k", 128, true},
+		{"/64k.m3u8", "64k", 64, true},
+		{"/192k_segment_004.ts", "192k", 192, true},
+		{"/hifi.m3u8", "hifi", 0, true},
+		{"//128k_segment_000.ts", "128k", 128, true},
+		{"/./128k_segment_000.ts", "128k", 128, true},
+		{"/.//64k.m3u8", "64k", 64, true},
+	}
+	for _, tc := range cases {
+		name, kbps, ok := variantFromQuality(tc.quality)
+		if name != tc.name || kbps != tc.kbps || ok != tc.ok {
+			t.Fatalf("%q: got (%q, %d, %v), want (%q, %d, %v)", tc.quality, name, kbps, ok, tc.name, tc.kbps, tc.ok)
+		}
+	}
+}
+
+func TestServerCustomRateLimiter(t *testing.T) {
+	s := newTestServer(t, WithRateLimiter(func(c *gin.Context) {
+		c.AbortWithStatus(http.StatusTooManyRequests)
+	}))
+
+	if rec := serve(s, http.MethodGet, "/songs", true); rec.Code != http.StatusTooManyRequests {
+		t.Fatalf("expected injected limiter to reject, got %d", rec.Code)
+	}
+	if rec := serve(s, http.MethodGet, "/livez", false); rec.Code != http.StatusOK {
+		t.Fatalf("expected liveness to bypass limiter, got %d", rec.Code)
+	}
+	if rec := serve(s, http.MethodGet, "/readyz", false); rec.Code != http.StatusTooManyRequests {
+		t.Fatalf("expected readiness to go through the limiter, got %d", rec.Code)
+	}
+}
+
+func TestServerReadiness(t *testing.T) {
+	s := newTestServer(t, WithReadinessChecks(health.Check{
+		Name: "bucket",
+		Run: func(context.Context) (string, error) {
+			return "v1.2.3", errors.New("dial tcp 10.0.0.7:443: connection refused")
+		},
+	}))
+
+	rec := serve(s, http.MethodGet, "/readyz", false)
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Fatalf("expected 503, got %d", rec.Code)
+	}
+	if body := strings.TrimSpace(rec.Body.String()); body != `{"status":"fail"}` {
+		t.Fatalf("public readiness must not leak details, got %s", body)
+	}
+
+	if rec := serve(s, http.MethodGet, "/admin/readyz", false); rec.Code != http.StatusUnauthorized {
+		t.Fatalf("expected details to require the API key, got %d", rec.Code)
+	}
+	rec = serve(s, http.MethodGet, "/admin/readyz", true)
+	if rec.Code != http.StatusServiceUnavailable || !strings.Contains(rec.Body.String(), "connection refused") {
+		t.Fatalf("expected detailed report, got %d %s", rec.Code, rec.Body.String())
+	}
+}
+
+func TestServerRateLimitsPerGroup(t *testing.T) {
+	limits := DefaultRateLimits()
+	limits.Token.Limit = 1
+	limits.Admin.Limit = 2
+	s := newTestServer(t, WithRateLimiter(nil), WithRateLimits(ratelimit.NewMemoryStore(), limits))
+
+	rec := serve(s, http.MethodGet, "/token/song-1", true)
+	if rec.Code != http.StatusOK || rec.Header().Get("X-RateLimit-Limit") != "1" {
+		t.Fatalf("expected token request with limit headers, got %d %v", rec.Code, rec.Header())
+	}
+	var body struct {
+		URL string `json:"url"`
+	}
+	_ = json.Unmarshal(rec.Body.Bytes(), &body)
+	if rec := serve(s, http.MethodGet, "/token/song-1", true); rec.Code != http.StatusTooManyRequests {
+		t.Fatalf("expected token group to be exhausted, got %d", rec.Code)
+	}
+
+	issued, _ := url.Parse(body.URL)
+	for i := 0; i < 5; i++ {
+		rec := serve(s, http.MethodGet, issued.Path+"/?"+issued.RawQuery, true)
+		if rec.Code != http.StatusOK || rec.Header().Get("X-RateLimit-Limit") != "600" {
+			t.Fatalf("expected stream group to have its own budget, got %d %v", rec.Code, rec.Header())
+		}
+	}
+
+	for i := 0; i < 2; i++ {
+		if rec := serve(s, http.MethodGet, "/songs", true); rec.Code != http.StatusOK {
+			t.Fatalf("expected admin request %d to pass, got %d", i, rec.Code)
+		}
+	}
+	if rec := serve(s, http.MethodGet, "/songs", true); rec.Code != http.StatusTooManyRequests {
+		t.Fatalf("expected admin group to be exhausted, got %d", rec.Code)
+	}
+}
+
+func TestServerDefaultRateLimits(t *testing.T) {
+	s, err := New(WithStore(&fakeStore{songs: map[string]storage.Song{
+		"song-1": {ID: "song-1", Name: "Song", BucketFolder: "song-1"},
+	}}), WithBucket(&fakeBucket{}, "audio", ""), WithAPIKey(testAPIKey))
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	checks := []struct {
+		target string
+		apiKey bool
+		limit  string
+	}{
+		{"/readyz", false, "1200"},
+		{"/songs", true, "60"},
+		{"/token/song-1", true, "60"},
+	}
+	for _, tc := range checks {
+		rec := serve(s, http.MethodGet, tc.target, tc.apiKey)
+		if rec.Code != http.StatusOK || rec.Header().Get("X-RateLimit-Limit") != tc.limit {
+			t.Fatalf("%s: expected the default limit %s, got %d %v", tc.target, tc.limit, rec.Code, rec.Header())
+		}
+	}
+
+	// Un grupo sin configurar en WithRateLimits conserva su valor por defecto.
+	s = newTestServer(t, WithRateLimiter(nil), WithRateLimits(ratelimit.NewMemoryStore(), RateLimits{
+		Token: ratelimit.Rule{Name: "token", Limit: 5, Window: time.Minute},
+	}))
+	if rec := serve(s, http.MethodGet, "/token/song-1", true); rec.Code != http.StatusOK || rec.Header().Get("X-RateLimit-Limit") != "5" {
+		t.Fatalf("expected the configured token limit, got %d %v", rec.Code, rec.Header())
+	}
+	if rec := serve(s, http.MethodGet, "/songs", true); rec.Code != http.StatusOK || rec.Header().Get("X-RateLimit-Limit") != "60" {
+		t.Fatalf("expected the default admin limit, got %d %v", rec.Code, rec.Header())
+	}
+}
+
+func TestServerStreamLimitedBeforeAuth(t *testing.T) {
+	limits := DefaultRateLimits()
+	limits.Public.Limit = 3
+	s := newTestServer(t, WithRateLimiter(nil), WithRateLimits(ratelimit.NewMemoryStore(), limits))
+
+	for i := 0; i < 3; i++ {
+		if rec := serve(s, http.MethodGet, "/stream/song-1/?t=forged&e=1", false); rec.Code != http.StatusUnauthorized {
+			t.Fatalf("expected invalid token %d to be rejected by auth, got %d", i, rec.Code)
+		}
+	}
+	rec := serve(s, http.MethodGet, "/stream/song-1/?t=forged&e=1", false)
+	if rec.Code != http.StatusTooManyRequests || rec.Header().Get("X-RateLimit-Limit") != "3" {
+		t.Fatalf("expected invalid tokens to exhaust the per-IP budget, got %d %v", rec.Code, rec.Header())
+	}
+}
+
+func TestServerTrustedProxies(t *testing.T) {
+	// httptest usa 192.0.2.1 como dirección de la conexión.
+	proxy := netip.MustParsePrefix("192.0.2.0/24")
+	limits := DefaultRateLimits()
+	limits.Token = ratelimit.Rule{Name: "token", Limit: 1, Window: time.Minute, Key: ratelimit.ByIP}
+
+	from := func(s *Server, target, forwardedFor string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, target, nil)
+		req.Header.Set("X-API-Key", testAPIKey)
+		if forwardedFor != "" {
+			req.Header.Set("X-Forwarded-For", forwardedFor)
+		}
+		rec := httptest.NewRecorder()
+		s.Handler().ServeHTTP(rec, req)
+		return rec
+	}
+	issue := func(s *Server, forwardedFor string) string {
+		t.Helper()
+		rec := from(s, "/token/song-1?ip=198.51.100.7", forwardedFor)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("expected token 200, got %d", rec.Code)
+		}
+		var body struct {
+			URL string `json:"url"`
+		}
+		_ = json.Unmarshal(rec.Body.Bytes(), &body)
+		return body.URL
+	}
+
+	s := newTestServer(t, WithTrustedProxies(proxy), WithRateLimiter(nil), WithRateLimits(ratelimit.NewMemoryStore(), limits))
+	issued, _ := url.Parse(issue(s, "198.51.100.7"))
+	if rec := from(s, "/token/song-1", "203.0.113.5"); rec.Code != http.StatusOK {
+		t.Fatalf("expected a different client to have its own budget, got %d", rec.Code)
+	}
+	if rec := from(s, "/token/song-1", "1.1.1.1, 198.51.100.7"); rec.Code != http.StatusTooManyRequests {
+		t.Fatalf("expected spoofed left entries to be ignored, got %d", rec.Code)
+	}
+
+	stream := issued.Path + "/?" + issued.RawQuery
+	if rec := from(s, stream, "198.51.100.7"); rec.Code != http.StatusOK {
+		t.Fatalf("expected forwarded client to match ip claim, got %d: %s", rec.Code, rec.Body.String())
+	}
+	if rec := from(s, stream, ""); rec.Code != http.StatusForbidden {
+		t.Fatalf("expected proxy address to fail ip claim, got %d", rec.Code)
+	}
+	// El proxy solo escribe X-Forwarded-For: un Forwarded del cliente no
+	// cuenta.
+	req := httptest.NewRequest(http.MethodGet, stream, nil)
+	req.Header.Set("Forwarded", "for=198.51.100.7")
+	rec := httptest.NewRecorder()
+	s.Handler().ServeHTTP(rec, req)
+	if rec.Code != http.StatusForbidden {
+		t.Fatalf("expected a client-supplied Forwarded header to be ignored, got %d", rec.Code)
+	}
+
+	untrusted := newTestServer(t)
+	issued, _ = url.Parse(issue(untrusted, ""))
+	if rec := from(untrusted, issued.Path+"/?"+issued.RawQuery, "198.51.100.7"); rec.Code != http.StatusForbidden {
+		t.Fatalf("expected headers from untrusted peers to be ignored, got %d", rec.Code)
+	}
+}
+
+func TestServerCORS(t *testing.T) {
+	cfg := cors.DefaultConfig()
+	cfg.AllowedOrigins = []string{"https://player.example"}
+	s := newTestServer(t, WithCORS(cfg), WithBasePath("/gotify"))
+
+	req := httptest.NewRequest(http.MethodOptions, "/gotify/token/song-1", nil)
+	req.Header.Set("Origin", "https://player.example")
+	req.Header.Set("Access-Control-Request-Method", http.MethodGet)
+	req.Header.Set("Access-Control-Request-Headers", "X-API-Key")
+	rec := httptest.NewRecorder()
+	s.Handler().ServeHTTP(rec, req)
+	if rec.Code != http.StatusNoContent || rec.Header().Get("Access-Control-Allow-Origin") != "https://player.example" {
+		t.Fatalf("expected preflight without api key to succeed, got %d %v", rec.Code, rec.Header())
+	}
+
+	rec = serve(s, http.MethodGet, "/gotify/token/song-1", true)
+	var body struct {
+		URL string `json:"url"`
+	}
+	_ = json.Unmarshal(rec.Body.Bytes(), &body)
+	issued, _ := url.Parse(body.URL)
+
+	for _, quality := range []string{"/", "/128k_segment_000.ts"} {
+		req := httptest.NewRequest(http.MethodGet, issued.Path+quality+"?"+issued.RawQuery, nil)
+		req.Header.Set("X-API-Key", testAPIKey)
+		req.Header.Set("Origin", "https://player.example")
+		rec := httptest.NewRecorder()
+		s.Handler().ServeHTTP(rec, req)
+		if rec.Code >= 400 || rec.Header().Get("Access-Control-Allow-Origin") != "https://player.example" {
+			t.Fatalf("%s: expected cors headers, got %d %v", quality, rec.Code, rec.Header())
+		}
+	}
+}
+
+func TestVariantsFromKbps(t *testing.T) {
+	variants := variantsFromKbps([]int{64, 128, 192})
+	if len(variants) != 3 {
+		t.Fatalf("expected 3 variants, got %d", len(variants))
+	}
+	for i, want := range []string{"64k", "128k", "192k"} {
+		if variants[i].Name != want {
+			t.Fatalf("expected name %s, got %s", want, variants[i].Name)
+		}
+	}
+	if variants[1].BitrateKbps != 128 {
+		t.Fatalf("expected bitrate 128, got %d", variants[1].BitrateKbps)
 	}
 }
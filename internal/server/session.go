@@ -0,0 +1,135 @@
+package server
+
+import (
+	"GOtify/internal/handlers"
+	"GOtify/internal/security"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// SessionCookie es la cookie con el token de sesión de /stream.
+const SessionCookie = "gotify_session"
+
+// StreamSessions canjea los tokens emitidos con mode=cookie por una cookie de
+// sesión limitada a la ruta de la canción.
+type StreamSessions struct {
+	Issuer handlers.TokenSigner
+	// TTL es la vida máxima de la cookie; nunca supera la del token.
+	TTL      time.Duration
+	BasePath string
+	// Secure marca la cookie como Secure y SameSite=None, necesario para
+	// reproductores web en otro origen. Las peticiones TLS la marcan siempre.
+	Secure bool
+}
+
+// start emite la cookie con las mismas claims (y el mismo ID, para que las
+// revocaciones apliquen) y quita t y e de la query para que la lista maestra
+// no los repita en cada URI.
+func (s *StreamSessions) start(c *gin.Context, file string, claims security.Claims) error {
+	now := time.Now()
+	session := claims
+	session.Session = false
+	session.Expires = min(claims.Expires, now.Add(s.TTL).Unix())
+	token, err := s.Issuer.Issue(session)
+	if err != nil {
+		return err
+	}
+
+	secure := s.Secure || c.Request.TLS != nil
+	if secure {
+		c.SetSameSite(http.SameSiteNoneMode)
+	} else {
+		c.SetSameSite(http.SameSiteLaxMode)
+	}
+	path := strings.TrimRight(s.BasePath, "/") + "/stream/" + file + "/"
+	c.SetCookie(SessionCookie, token, int(session.Expires-now.Unix()), path, "", secure, true)
+
+	query := c.Request.URL.Query()
+	query.Del("t")
+	query.Del("e")
+	c.Request.URL.RawQuery = query.Encode()
+	return nil
+}
+
+// tokenFromPath reconoce las URLs con prefijo firmado
+// /stream/<token>/<exp>/<file>/<quality>, que gin entrega como file_id=<token>
+// y quality=/<exp>/<file>/<quality>.
+func tokenFromPath(param, quality string) (token, exp, file, rest string, ok bool) {
+	if !security.IsScoped(param) {
+		return "", "", "", "", false
+	}
+	parts := strings.SplitN(strings.TrimPrefix(quality, "/"), "/", 3)
+	if len(parts) < 2 || parts[1] == "" {
+		return "", "", "", "", false
+	}
+	if _, err := strconv.ParseUint(parts[0], 10, 64); err != nil {
+		return "", "", "", "", false
+	}
+	rest = "/"
+	if len(parts) == 3 {
+		rest += parts[2]
+	}
+	return param, parts[0], parts[1], rest, true
+}
+
+// pathTokenKey guarda en el contexto de gin el token y la expiración ya
+// extraídos de la ruta.
+const pathTokenKey = "stream_path_token"
+
+// StripPathToken saca el prefijo firmado de la ruta antes de que nada más lo
+// vea: va delante del límite por IP para que los 429 tampoco registren ni
+// tracen el token. AuthMiddleware reutiliza lo extraído.
+func StripPathToken() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		pathToken(c)
+		c.Next()
+	}
+}
+
+// pathToken extrae una sola vez el prefijo firmado: reescribe file_id y
+// quality, quita el token de la ruta y lo deja en el contexto.
+func pathToken(c *gin.Context) (token, exp string, ok bool) {
+	if v, found := c.Get(pathTokenKey); found {
+		p := v.([2]string)
+		return p[0], p[1], true
+	}
+	token, exp, file, quality, ok := tokenFromPath(c.Param("file_id"), c.Param("quality"))
+	if !ok {
+		return "", "", false
+	}
+	setParam(c, "file_id", file)
+	setParam(c, "quality", quality)
+	stripPathToken(c, token, exp)
+	c.Set(pathTokenKey, [2]string{token, exp})
+	return token, exp, true
+}
+
+// stripPathToken quita el token de la ruta de la petición y del span para que
+// no llegue al log de acceso ni a las trazas.
+func stripPathToken(c *gin.Context, token, exp string) {
+	segment := "/" + token + "/" + exp
+	u := c.Request.URL
+	if i := strings.Index(u.Path, segment+"/"); i != -1 {
+		u.Path = u.Path[:i] + u.Path[i+len(segment):]
+		u.RawPath = ""
+	}
+	trace.SpanFromContext(c.Request.Context()).SetAttributes(attribute.String("url.path", u.Path))
+}
+
+// setParam reemplaza el valor de un parámetro de ruta para los handlers
+// siguientes.
+func setParam(c *gin.Context, key, value string) {
+	for i := range c.Params {
+		if c.Params[i].Key == key {
+			c.Params[i].Value = value
+			return
+		}
+	}
+	c.Params = append(c.Params, gin.Param{Key: key, Value: value})
+}
@@ -3,14 +3,16 @@ package storage
 import (
 	"bytes"
 	"context"
+	"errors"
 	"fmt"
 	"io"
-	"os"
+	"net/http"
 	"path"
 	"strings"
 
 	storage_go "github.com/supabase-community/storage-go"
 	supabase "github.com/supabase-community/supabase-go"
+	"go.opentelemetry.io/otel/attribute"
 )
 
 type storageClient interface {
@@ -18,6 +20,7 @@ type storageClient interface {
 	RemoveFile(bucketID string, paths []string) ([]storage_go.FileUploadResponse, error)
 	DownloadFile(bucketID string, filePath string, urlOptions ...storage_go.UrlOptions) ([]byte, error)
 	CreateSignedUrl(bucketId string, filePath string, expiresIn int) (storage_go.SignedUrlResponse, error)
+	GetBucket(id string) (storage_go.Bucket, error)
 }
 type BucketClient struct {
 	storage storageClient
@@ -30,13 +33,14 @@ type UploadFile struct {
 	ContentType string
 }
 
-func NewBucketClientFromEnv() (*BucketClient, error) {
-	projectURL := strings.TrimRight(os.Getenv("SUPABASE_URL"), "/")
-	serviceKey := strings.TrimSpace(os.Getenv("SUPABASE_SERVICE_KEY"))
-	bucket := strings.TrimSpace(os.Getenv("SUPABASE_BUCKET"))
+// NewBucketClient crea el cliente del bucket de Supabase Storage.
+func NewBucketClient(cfg Config) (*BucketClient, error) {
+	projectURL := strings.TrimRight(cfg.URL, "/")
+	serviceKey := strings.TrimSpace(cfg.ServiceKey)
+	bucket := strings.TrimSpace(cfg.Bucket)
 
 	if projectURL == "" || serviceKey == "" || bucket == "" {
-		return nil, fmt.Errorf("supabase bucket env vars missing")
+		return nil, fmt.Errorf("supabase url, service key and bucket are required")
 	}
 
 	client, err := supabase.NewClient(projectURL, serviceKey, nil)
@@ -50,7 +54,7 @@ func NewBucketClientFromEnv() (*BucketClient, error) {
 	}, nil
 }
 
-func (c *BucketClient) UploadBytes(_ context.Context, objectPath string, data []byte, contentType string) error {
+func (c *BucketClient) UploadBytes(ctx context.Context, objectPath string, data []byte, contentType string) error {
 	key := strings.TrimLeft(objectPath, "/")
 	if key == "" {
 		return fmt.Errorf("empty object path")
@@ -62,13 +66,18 @@ func (c *BucketClient) UploadBytes(_ context.Context, objectPath string, data []
 		opts.ContentType = &trimmedType
 	}
 
+	_, done := instrument(ctx, "bucket", "upload", attribute.String("object", key), attribute.Int("bytes", len(data)))
 	_, err := c.storage.UploadFile(c.bucket, key, bytes.NewReader(data), opts)
+	done(err)
 	return err
 }
 
 func (c *BucketClient) UploadBatch(ctx context.Context, prefix string, files []UploadFile) error {
 	cleanPrefix := strings.Trim(prefix, "/")
 	for _, file := range files {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
 		objectPath := file.Path
 		if cleanPrefix != "" {
 			objectPath = path.Join(cleanPrefix, objectPath)
@@ -80,30 +89,61 @@ func (c *BucketClient) UploadBatch(ctx context.Context, prefix string, files []U
 	return nil
 }
 
-func (c *BucketClient) DeletePrefix(_ context.Context, prefix string) error {
+func (c *BucketClient) DeletePrefix(ctx context.Context, prefix string) error {
 	clean := strings.Trim(prefix, "/")
 	if clean == "" {
 		return fmt.Errorf("cannot delete empty prefix")
 	}
+	_, done := instrument(ctx, "bucket", "delete", attribute.String("prefix", clean))
 	_, err := c.storage.RemoveFile(c.bucket, []string{clean + "/"})
+	done(err)
 	return err
 }
 
 // DownloadFile recupera un objeto sin exponer la URL pública.
-func (c *BucketClient) DownloadFile(objectPath string) ([]byte, error) {
+func (c *BucketClient) DownloadFile(ctx context.Context, objectPath string) ([]byte, error) {
 	key := strings.TrimLeft(objectPath, "/")
-	return c.storage.DownloadFile(c.bucket, key)
+	_, done := instrument(ctx, "bucket", "download", attribute.String("object", key))
+	data, err := c.storage.DownloadFile(c.bucket, key)
+	err = objectError(err)
+	done(err)
+	return data, err
 }
 
 // SignedURL genera una URL temporal firmada para acceder al objeto directamente.
-func (c *BucketClient) SignedURL(objectPath string, expiresIn int) (string, error) {
+func (c *BucketClient) SignedURL(ctx context.Context, objectPath string, expiresIn int) (string, error) {
 	key := strings.TrimLeft(objectPath, "/")
 	if expiresIn <= 0 {
 		expiresIn = 60
 	}
+	_, done := instrument(ctx, "bucket", "signed_url", attribute.String("object", key))
 	resp, err := c.storage.CreateSignedUrl(c.bucket, key, expiresIn)
+	err = objectError(err)
+	done(err)
 	if err != nil {
 		return "", err
 	}
 	return resp.SignedURL, nil
 }
+
+// objectError traduce la respuesta de Storage para un objeto inexistente a
+// ErrNotFound. Según la versión, Storage responde 404 o 400 con el mensaje
+// "Object not found", y storage-go no rellena el estado desde el cuerpo.
+func objectError(err error) error {
+	var serr *storage_go.StorageError
+	if !errors.As(err, &serr) {
+		return err
+	}
+	if serr.Status == http.StatusNotFound || strings.Contains(strings.ToLower(serr.Message), "not found") {
+		return fmt.Errorf("%w: %s", ErrNotFound, serr.Message)
+	}
+	return err
+}
+
+// Ping comprueba que el bucket configurado exista y sea accesible.
+func (c *BucketClient) Ping(ctx context.Context) error {
+	_, done := instrument(ctx, "bucket", "ping")
+	_, err := c.storage.GetBucket(c.bucket)
+	done(err)
+	return err
+}
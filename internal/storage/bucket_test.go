@@ -2,21 +2,20 @@ package storage
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"io"
+	"net/http"
+	"net/http/httptest"
 	"strings"
 	"testing"
 
 	storage_go "github.com/supabase-community/storage-go"
 )
 
-func TestNewBucketClientFromEnvMissing(t *testing.T) {
-	t.Setenv("SUPABASE_URL", "")
-	t.Setenv("SUPABASE_SERVICE_KEY", "")
-	t.Setenv("SUPABASE_BUCKET", "")
-
-	if _, err := NewBucketClientFromEnv(); err == nil {
-		t.Fatalf("expected error when env vars are missing")
+func TestNewBucketClientMissingConfig(t *testing.T) {
+	if _, err := NewBucketClient(Config{URL: "https://example.supabase.co", ServiceKey: "key"}); err == nil {
+		t.Fatalf("expected error when bucket is missing")
 	}
 }
 
@@ -57,6 +56,13 @@ func (f *fakeStorage) RemoveFile(bucketID string, paths []string) ([]storage_go.
 func (f *fakeStorage) CreateSignedUrl(bucketID string, filePath string, expiresIn int) (storage_go.SignedUrlResponse, error) {
 	return storage_go.SignedUrlResponse{SignedURL: fmt.Sprintf("https://signed/%s/%s?ttl=%d", bucketID, filePath, expiresIn)}, nil
 }
+func (f *fakeStorage) GetBucket(id string) (storage_go.Bucket, error) {
+	if id != "audio" {
+		return storage_go.Bucket{}, fmt.Errorf("bucket %s not found", id)
+	}
+	return storage_go.Bucket{Id: id, Name: id}, nil
+}
+
 func (f *fakeStorage) DownloadFile(bucketID string, filePath string, _ ...storage_go.UrlOptions) ([]byte, error) {
 	return nil, nil
 }
@@ -131,3 +137,45 @@ func equalStringSlices(a, b []string) bool {
 	}
 	return true
 }
+
+func TestBucketClientPing(t *testing.T) {
+	client := &BucketClient{storage: &fakeStorage{}, bucket: "audio"}
+	if err := client.Ping(context.Background()); err != nil {
+		t.Fatalf("unexpected ping error: %v", err)
+	}
+
+	missing := &BucketClient{storage: &fakeStorage{}, bucket: "missing"}
+	if err := missing.Ping(context.Background()); err == nil {
+		t.Fatalf("expected ping error for missing bucket")
+	}
+}
+
+func TestBucketClientMissingObject(t *testing.T) {
+	// Respuestas reales de Storage para un objeto inexistente.
+	for _, status := range []int{http.StatusBadRequest, http.StatusNotFound} {
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(status)
+			fmt.Fprintf(w, `{"statusCode":"%d","error":"not_found","message":"Object not found"}`, status)
+		}))
+		client := &BucketClient{storage: storage_go.NewClient(ts.URL, "key", nil), bucket: "audio"}
+
+		if _, err := client.DownloadFile(context.Background(), "song/64k.m3u8"); !errors.Is(err, ErrNotFound) {
+			t.Errorf("status %d: expected download to return ErrNotFound, got %v", status, err)
+		}
+		if _, err := client.SignedURL(context.Background(), "song/64k_segment_000.ts", 60); !errors.Is(err, ErrNotFound) {
+			t.Errorf("status %d: expected signed url to return ErrNotFound, got %v", status, err)
+		}
+		ts.Close()
+	}
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprint(w, `{"statusCode":"500","error":"internal","message":"database timeout"}`)
+	}))
+	defer ts.Close()
+	client := &BucketClient{storage: storage_go.NewClient(ts.URL, "key", nil), bucket: "audio"}
+	if _, err := client.DownloadFile(context.Background(), "song/64k.m3u8"); err == nil || errors.Is(err, ErrNotFound) {
+		t.Fatalf("expected other storage errors to pass through, got %v", err)
+	}
+}
@@ -0,0 +1,21 @@
+package storage
+
+import (
+	"GOtify/internal/metrics"
+	"GOtify/internal/tracing"
+	"context"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// instrument abre un span para una llamada al bucket o al catálogo y devuelve
+// la función que lo cierra registrando latencia y errores en las métricas.
+func instrument(ctx context.Context, client, operation string, attrs ...attribute.KeyValue) (context.Context, func(error)) {
+	start := time.Now()
+	ctx, span := tracing.Start(ctx, client+"."+operation, attrs...)
+	return ctx, func(err error) {
+		metrics.ObserveStorage(client, operation, start, err)
+		tracing.End(span, err)
+	}
+}
@@ -0,0 +1,59 @@
+package storage
+
+import (
+	"context"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// SongKey es la clave AES-128 con la que se cifraron los segmentos HLS de una
+// canción. Se guarda en el catálogo y nunca en el bucket, junto a los
+// segmentos que protege. Key e IV van en hexadecimal.
+type SongKey struct {
+	SongID    string    `json:"song_id"`
+	Key       string    `json:"key"`
+	IV        string    `json:"iv"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+func (s *Store) UpsertSongKey(ctx context.Context, key SongKey) error {
+	_, done := instrument(ctx, "catalog", "upsert_song_key", attribute.String("song_id", key.SongID))
+	_, _, err := s.client.
+		From("song_keys").
+		Upsert(key, "song_id", "minimal", "").
+		Execute()
+	done(err)
+	return err
+}
+
+// GetSongKey devuelve ErrNotFound si la canción no está cifrada.
+func (s *Store) GetSongKey(ctx context.Context, songID string) (SongKey, error) {
+	var keys []SongKey
+	_, done := instrument(ctx, "catalog", "get_song_key", attribute.String("song_id", songID))
+	_, err := s.client.
+		From("song_keys").
+		Select("*", "", false).
+		Eq("song_id", songID).
+		ExecuteTo(&keys)
+	done(err)
+	if err != nil {
+		return SongKey{}, err
+	}
+	if len(keys) == 0 {
+		return SongKey{}, ErrNotFound
+	}
+	return keys[0], nil
+}
+
+// DeleteSongKey no falla si la canción no tenía clave.
+func (s *Store) DeleteSongKey(ctx context.Context, songID string) error {
+	_, done := instrument(ctx, "catalog", "delete_song_key", attribute.String("song_id", songID))
+	_, _, err := s.client.
+		From("song_keys").
+		Delete("minimal", "").
+		Eq("song_id", songID).
+		Execute()
+	done(err)
+	return err
+}
@@ -0,0 +1,30 @@
+package storage
+
+import "path"
+
+// MezzaninePrefix es la carpeta del bucket donde se guarda el archivo original
+// de cada canción. El guion bajo no aparece en los slugs de las carpetas de
+// canciones, así que ninguna canción puede llamarse igual ni borrarla, y
+// /stream rechaza las rutas bajo ella.
+const MezzaninePrefix = "_mezzanine"
+
+// mezzanineName es el nombre del original dentro de su carpeta.
+const mezzanineName = "source"
+
+// MezzanineFolder es la carpeta con el original de songID.
+func MezzanineFolder(songID string) string {
+	return path.Join(MezzaninePrefix, songID)
+}
+
+// MezzaninePath es la ruta del original de songID dentro del bucket.
+func MezzaninePath(songID string) string {
+	return path.Join(MezzanineFolder(songID), mezzanineName)
+}
+
+// MezzanineFile prepara el original para UploadBatch sobre MezzanineFolder.
+func MezzanineFile(content []byte, contentType string) UploadFile {
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	return UploadFile{Path: mezzanineName, Content: content, ContentType: contentType}
+}
@@ -0,0 +1,53 @@
+package storage
+
+import (
+	"context"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// Tipos de revocación.
+const (
+	RevokeToken = "token"
+	RevokeUser  = "user"
+	RevokeSong  = "song"
+)
+
+// Revocation invalida tokens de reproducción. Con Kind token, Subject es el
+// ID del token (jti); con user o song se invalidan los tokens de ese usuario o
+// canción emitidos antes de NotBefore.
+type Revocation struct {
+	ID        string    `json:"id"`
+	Kind      string    `json:"kind"`
+	Subject   string    `json:"subject"`
+	NotBefore time.Time `json:"not_before"`
+	Reason    string    `json:"reason,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// ListRevocations lee la tabla token_revocations completa.
+func (s *Store) ListRevocations(ctx context.Context) ([]Revocation, error) {
+	var out []Revocation
+	_, done := instrument(ctx, "catalog", "list_revocations")
+	_, err := s.client.
+		From("token_revocations").
+		Select("*", "", false).
+		ExecuteTo(&out)
+	done(err)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (s *Store) InsertRevocation(ctx context.Context, r Revocation) error {
+	_, done := instrument(ctx, "catalog", "insert_revocation",
+		attribute.String("kind", r.Kind))
+	_, _, err := s.client.
+		From("token_revocations").
+		Insert(r, false, "", "minimal", "").
+		Execute()
+	done(err)
+	return err
+}
@@ -4,11 +4,11 @@ import (
 	"context"
 	"errors"
 	"fmt"
-	"os"
 	"strings"
 
 	postgrest "github.com/supabase-community/postgrest-go"
 	supabase "github.com/supabase-community/supabase-go"
+	"go.opentelemetry.io/otel/attribute"
 )
 
 type Store struct {
@@ -16,17 +16,41 @@ type Store struct {
 }
 
 type Song struct {
-	ID              string `json:"id"`
-	Name            string `json:"name"`
-	Duration int32  `json:"duration_seconds"`
-	BucketFolder      string `json:"bucket_folder"`
+	ID           string `json:"id"`
+	Name         string `json:"name"`
+	Duration     int32  `json:"duration_seconds"`
+	BucketFolder string `json:"bucket_folder"`
+	// Source describe el original guardado en MezzaninePath; nil si la
+	// canción se subió sin guardarlo.
+	Source *SongSource `json:"source,omitempty"`
+}
+
+// SongSource son el hash y los datos de ffprobe del archivo original. Se
+// guarda como jsonb en la columna source de songs.
+type SongSource struct {
+	SHA256      string  `json:"sha256"`
+	Size        int64   `json:"size"`
+	ContentType string  `json:"content_type,omitempty"`
+	Format      string  `json:"format,omitempty"`
+	Codec       string  `json:"codec,omitempty"`
+	SampleRate  int     `json:"sample_rate,omitempty"`
+	Channels    int     `json:"channels,omitempty"`
+	BitrateKbps int     `json:"bitrate_kbps,omitempty"`
+	Duration    float64 `json:"duration_seconds,omitempty"`
 }
 
 var ErrNotFound = errors.New("song not found")
 
-func NewStore(_ context.Context) (*Store, error) {
-	projectURL := strings.TrimSpace(os.Getenv("SUPABASE_URL"))
-	serviceKey := strings.TrimSpace(os.Getenv("SUPABASE_SERVICE_KEY"))
+// Config identifica el proyecto de Supabase y el bucket de assets.
+type Config struct {
+	URL        string
+	ServiceKey string
+	Bucket     string
+}
+
+func NewStore(_ context.Context, cfg Config) (*Store, error) {
+	projectURL := strings.TrimSpace(cfg.URL)
+	serviceKey := strings.TrimSpace(cfg.ServiceKey)
 	if projectURL == "" || serviceKey == "" {
 		return nil, fmt.Errorf("supabase url/service key not configured")
 	}
@@ -39,21 +63,37 @@ func NewStore(_ context.Context) (*Store, error) {
 	return &Store{client: client}, nil
 }
 
-func (s *Store) UpsertSong(_ context.Context, song Song) error {
+// Ping comprueba la conectividad con el catálogo leyendo una fila de songs.
+func (s *Store) Ping(ctx context.Context) error {
+	_, done := instrument(ctx, "catalog", "ping")
+	_, _, err := s.client.
+		From("songs").
+		Select("id", "", false).
+		Limit(1, "").
+		Execute()
+	done(err)
+	return err
+}
+
+func (s *Store) UpsertSong(ctx context.Context, song Song) error {
+	_, done := instrument(ctx, "catalog", "upsert_song", attribute.String("song_id", song.ID))
 	_, _, err := s.client.
 		From("songs").
 		Upsert(song, "id", "minimal", "").
 		Execute()
+	done(err)
 	return err
 }
 
-func (s *Store) GetSong(_ context.Context, id string) (Song, error) {
+func (s *Store) GetSong(ctx context.Context, id string) (Song, error) {
 	var songs []Song
+	_, done := instrument(ctx, "catalog", "get_song", attribute.String("song_id", id))
 	_, err := s.client.
 		From("songs").
 		Select("*", "", false).
 		Eq("id", id).
 		ExecuteTo(&songs)
+	done(err)
 	if err != nil {
 		return Song{}, err
 	}
@@ -63,25 +103,29 @@ func (s *Store) GetSong(_ context.Context, id string) (Song, error) {
 	return songs[0], nil
 }
 
-func (s *Store) ListSongs(_ context.Context) ([]Song, error) {
+func (s *Store) ListSongs(ctx context.Context) ([]Song, error) {
 	var songs []Song
+	_, done := instrument(ctx, "catalog", "list_songs")
 	_, err := s.client.
 		From("songs").
 		Select("*", "", false).
 		Order("name", &postgrest.OrderOpts{Ascending: true}).
 		ExecuteTo(&songs)
+	done(err)
 	if err != nil {
 		return nil, err
 	}
 	return songs, nil
 }
 
-func (s *Store) DeleteSong(_ context.Context, id string) error {
+func (s *Store) DeleteSong(ctx context.Context, id string) error {
+	_, done := instrument(ctx, "catalog", "delete_song", attribute.String("song_id", id))
 	_, count, err := s.client.
 		From("songs").
 		Delete("minimal", "exact").
 		Eq("id", id).
 		Execute()
+	done(err)
 	if err != nil {
 		return err
 	}
@@ -3,6 +3,7 @@ package storage
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"io"
 	"net/http"
 	"net/http/httptest"
@@ -10,12 +11,9 @@ import (
 	"testing"
 )
 
-func TestNewStoreMissingEnv(t *testing.T) {
-	t.Setenv("SUPABASE_URL", "")
-	t.Setenv("SUPABASE_SERVICE_KEY", "")
-
-	if _, err := NewStore(context.Background()); err == nil {
-		t.Fatalf("expected error when env vars missing")
+func TestNewStoreMissingConfig(t *testing.T) {
+	if _, err := NewStore(context.Background(), Config{}); err == nil {
+		t.Fatalf("expected error when url/service key missing")
 	}
 }
 
@@ -36,10 +34,10 @@ func TestStoreUpsertSong(t *testing.T) {
 	store := newTestStore(t, handler)
 
 	err := store.UpsertSong(context.Background(), Song{
-		ID:              "song-1",
-		Name:            "Test",
-		Duration: 120,
-		BucketFolder:      "bucket/master.m3u8",
+		ID:           "song-1",
+		Name:         "Test",
+		Duration:     120,
+		BucketFolder: "bucket/master.m3u8",
 	})
 	if err != nil {
 		t.Fatalf("unexpected error: %v", err)
@@ -75,10 +73,10 @@ func TestStoreGetSongSuccess(t *testing.T) {
 	handler := func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Content-Type", "application/json")
 		resp := []Song{{
-			ID:              "song-1",
-			Name:            "Test",
-			Duration: 90,
-			BucketFolder:      "bucket/master.m3u8",
+			ID:           "song-1",
+			Name:         "Test",
+			Duration:     90,
+			BucketFolder: "bucket/master.m3u8",
 		}}
 		_ = json.NewEncoder(w).Encode(resp)
 	}
@@ -141,16 +139,102 @@ func TestStoreDeleteSongNotFound(t *testing.T) {
 	}
 }
 
+func TestStorePing(t *testing.T) {
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/rest/v1/songs" || !strings.Contains(r.URL.RawQuery, "limit=1") {
+			t.Fatalf("unexpected ping request: %s?%s", r.URL.Path, r.URL.RawQuery)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte("[]"))
+	}
+	store := newTestStore(t, handler)
+
+	if err := store.Ping(context.Background()); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
 func newTestStore(t *testing.T, handler func(http.ResponseWriter, *http.Request)) *Store {
 	server := httptest.NewServer(http.HandlerFunc(handler))
 	t.Cleanup(server.Close)
 
-	t.Setenv("SUPABASE_URL", server.URL)
-	t.Setenv("SUPABASE_SERVICE_KEY", "test-key")
-
-	store, err := NewStore(context.Background())
+	store, err := NewStore(context.Background(), Config{URL: server.URL, ServiceKey: "test-key"})
 	if err != nil {
 		t.Fatalf("unexpected error creating store: %v", err)
 	}
 	return store
 }
+
+func TestStoreRevocations(t *testing.T) {
+	var paths []string
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		paths = append(paths, r.Method+" "+r.URL.Path)
+		if r.Method == http.MethodGet {
+			w.Header().Set("Content-Type", "application/json")
+			_, _ = w.Write([]byte(`[{"id":"r1","kind":"song","subject":"song-1","not_before":"2026-01-01T00:00:00Z","created_at":"2026-01-01T00:00:00Z"}]`))
+			return
+		}
+		body, _ := io.ReadAll(r.Body)
+		if !strings.Contains(string(body), `"kind":"user"`) {
+			t.Fatalf("unexpected body: %s", body)
+		}
+		w.WriteHeader(http.StatusCreated)
+	}
+	store := newTestStore(t, handler)
+
+	if err := store.InsertRevocation(context.Background(), Revocation{Kind: RevokeUser, Subject: "u1"}); err != nil {
+		t.Fatalf("InsertRevocation: %v", err)
+	}
+	got, err := store.ListRevocations(context.Background())
+	if err != nil {
+		t.Fatalf("ListRevocations: %v", err)
+	}
+	if len(got) != 1 || got[0].Kind != RevokeSong || got[0].NotBefore.Year() != 2026 {
+		t.Fatalf("unexpected revocations %+v", got)
+	}
+	if paths[0] != "POST /rest/v1/token_revocations" || paths[1] != "GET /rest/v1/token_revocations" {
+		t.Fatalf("unexpected requests %v", paths)
+	}
+}
+
+func TestStoreSongKeys(t *testing.T) {
+	var paths []string
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		paths = append(paths, r.Method+" "+r.URL.Path)
+		switch r.Method {
+		case http.MethodGet:
+			w.Header().Set("Content-Type", "application/json")
+			if strings.Contains(r.URL.RawQuery, "song-1") {
+				_, _ = w.Write([]byte(`[{"song_id":"song-1","key":"00112233445566778899aabbccddeeff","iv":"0f"}]`))
+				return
+			}
+			_, _ = w.Write([]byte(`[]`))
+		case http.MethodPost:
+			if !strings.Contains(r.URL.RawQuery, "on_conflict=song_id") {
+				t.Fatalf("expected upsert on song_id, got %s", r.URL.RawQuery)
+			}
+			w.WriteHeader(http.StatusCreated)
+		default:
+			w.WriteHeader(http.StatusNoContent)
+		}
+	}
+	store := newTestStore(t, handler)
+	ctx := context.Background()
+
+	if err := store.UpsertSongKey(ctx, SongKey{SongID: "song-1", Key: "00", IV: "0f"}); err != nil {
+		t.Fatalf("UpsertSongKey: %v", err)
+	}
+	key, err := store.GetSongKey(ctx, "song-1")
+	if err != nil || key.Key != "00112233445566778899aabbccddeeff" {
+		t.Fatalf("GetSongKey: %+v %v", key, err)
+	}
+	if _, err := store.GetSongKey(ctx, "song-2"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("expected ErrNotFound, got %v", err)
+	}
+	if err := store.DeleteSongKey(ctx, "song-1"); err != nil {
+		t.Fatalf("DeleteSongKey: %v", err)
+	}
+	if paths[0] != "POST /rest/v1/song_keys" || paths[3] != "DELETE /rest/v1/song_keys" {
+		t.Fatalf("unexpected requests %v", paths)
+	}
+}
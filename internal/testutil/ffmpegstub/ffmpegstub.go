@@ -26,17 +26,29 @@ func Build(t *testing.T) Paths {
 package main
 
 import (
+	"bufio"
 	"encoding/json"
 	"fmt"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"strconv"
 	"strings"
 )
 
 func main() {
 	name := filepath.Base(os.Args[0])
 
+	if len(os.Args) > 1 && os.Args[1] == "-version" {
+		fmt.Println(strings.TrimSuffix(name, ".exe") + " version stub")
+		return
+	}
+
 	if strings.Contains(name, "ffprobe") {
+		if strings.Contains(strings.Join(os.Args, " "), "-of json") {
+			fmt.Println(` + "`" + `{"streams":[{"codec_name":"pcm_s16le","sample_rate":"44100","channels":2}],"format":{"format_name":"wav","duration":"120.000000","bit_rate":"1411200"}}` + "`" + `)
+			return
+		}
 		// Devuelve una duración en segundos.
 		fmt.Println("120")
 		return
@@ -51,6 +63,9 @@ func main() {
 	var (
 		segmentPattern string
 		outputPlaylist string
+		keyInfo        string
+		listSize       int
+		live           bool
 	)
 
 	for i := 0; i < len(args); i++ {
@@ -59,9 +74,63 @@ func main() {
 			i++
 			continue
 		}
+		if args[i] == "-hls_list_size" && i+1 < len(args) {
+			listSize, _ = strconv.Atoi(args[i+1])
+			i++
+			continue
+		}
+		if args[i] == "-i" && i+1 < len(args) {
+			live = args[i+1] == "pipe:0"
+			i++
+			continue
+		}
+		if args[i] == "-hls_key_info_file" && i+1 < len(args) {
+			keyInfo = args[i+1]
+			i++
+			continue
+		}
 		outputPlaylist = args[i]
 	}
 
+	if live {
+		// Directo: cada línea de stdin es un segmento; la lista guarda los
+		// últimos listSize y borra los anteriores, como delete_segments.
+		// Como ffmpeg, una interrupción cierra la lista y sale con 255.
+		interrupt := make(chan os.Signal, 1)
+		signal.Notify(interrupt, os.Interrupt)
+		go func() {
+			<-interrupt
+			writeLive(outputPlaylist, 0, nil, true)
+			os.Exit(255)
+		}()
+		scanner := bufio.NewScanner(os.Stdin)
+		var window []string
+		for seq := 0; scanner.Scan(); seq++ {
+			path := fmt.Sprintf(segmentPattern, seq)
+			if err := os.WriteFile(path, scanner.Bytes(), 0o644); err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(1)
+			}
+			window = append(window, filepath.Base(path))
+			if len(window) > listSize {
+				_ = os.Remove(filepath.Join(filepath.Dir(path), window[0]))
+				window = window[1:]
+			}
+			writeLive(outputPlaylist, seq+1-len(window), window, false)
+		}
+		writeLive(outputPlaylist, 0, nil, true)
+		return
+	}
+
+	if segmentPattern == "" && outputPlaylist != "" && !strings.HasSuffix(outputPlaylist, ".m3u8") {
+		// Archivo progresivo: una sola salida sin segmentos.
+		if err := os.WriteFile(outputPlaylist, []byte("progressive audio"), 0o644); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+
 	if segmentPattern == "" || outputPlaylist == "" {
 		fmt.Fprintln(os.Stderr, "missing parameters")
 		os.Exit(1)
@@ -85,6 +154,24 @@ func main() {
 	}
 
 	playlistContent := "#EXTM3U\n"
+	if keyInfo != "" {
+		// Como ffmpeg: URI, ruta de la clave e IV opcional, una por línea.
+		data, err := os.ReadFile(keyInfo)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+		if _, err := os.Stat(lines[1]); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		playlistContent += fmt.Sprintf("#EXT-X-KEY:METHOD=AES-128,URI=\"%s\"", lines[0])
+		if len(lines) > 2 {
+			playlistContent += ",IV=0x" + lines[2]
+		}
+		playlistContent += "\n"
+	}
 	for i := 0; i < 2; i++ {
 		playlistContent += fmt.Sprintf("#EXTINF:4,\nsegment_%03d.ts\n", i)
 	}
@@ -100,6 +187,23 @@ func main() {
 	data, _ := json.Marshal(metaData)
 	_ = os.WriteFile(metaPath, data, 0o644)
 }
+
+// writeLive escribe la lista del directo; con end añade EXT-X-ENDLIST a la
+// que ya existe.
+func writeLive(playlist string, sequence int, window []string, end bool) {
+	if end {
+		data, _ := os.ReadFile(playlist)
+		_ = os.WriteFile(playlist, append(data, "#EXT-X-ENDLIST\n"...), 0o644)
+		return
+	}
+	content := fmt.Sprintf("#EXTM3U\n#EXT-X-VERSION:3\n#EXT-X-TARGETDURATION:4\n#EXT-X-MEDIA-SEQUENCE:%d\n", sequence)
+	for _, name := range window {
+		content += "#EXTINF:4.000000,\n" + name + "\n"
+	}
+	tmp := playlist + ".tmp"
+	_ = os.WriteFile(tmp, []byte(content), 0o644)
+	_ = os.Rename(tmp, playlist)
+}
 `
 
 	if err := os.WriteFile(src, []byte(program), 0o644); err != nil {
@@ -128,7 +232,7 @@ func main() {
 	}
 	defer in.Close()
 
-	out, err := os.Create(ffprobePath)
+	out, err := os.OpenFile(ffprobePath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o755)
 	if err != nil {
 		t.Fatalf("create ffprobe stub: %v", err)
 	}
@@ -0,0 +1,94 @@
+package tracing
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func installRecorder(t *testing.T) *tracetest.SpanRecorder {
+	t.Helper()
+	recorder := tracetest.NewSpanRecorder()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+	previous := otel.GetTracerProvider()
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	t.Cleanup(func() { otel.SetTracerProvider(previous) })
+	return recorder
+}
+
+func TestMiddlewareContinuesIncomingTrace(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	recorder := installRecorder(t)
+
+	router := gin.New()
+	router.Use(Middleware())
+	router.GET("/stream/:file_id", func(c *gin.Context) {
+		_, span := Start(c.Request.Context(), "bucket.download")
+		End(span, nil)
+		c.Status(http.StatusOK)
+	})
+
+	const traceID = "4bf92f3577b34da6a3ce929d0e0e4736"
+	req := httptest.NewRequest(http.MethodGet, "/stream/song-1", nil)
+	req.Header.Set("traceparent", "00-"+traceID+"-00f067aa0ba902b7-01")
+	router.ServeHTTP(httptest.NewRecorder(), req)
+
+	spans := recorder.Ended()
+	if len(spans) != 2 {
+		t.Fatalf("expected 2 spans, got %d", len(spans))
+	}
+	for _, span := range spans {
+		if got := span.SpanContext().TraceID().String(); got != traceID {
+			t.Fatalf("span %s has trace id %s, want %s", span.Name(), got, traceID)
+		}
+	}
+	if spans[1].Name() != "GET /stream/:file_id" {
+		t.Fatalf("unexpected server span name %q", spans[1].Name())
+	}
+}
+
+func TestEndRecordsError(t *testing.T) {
+	recorder := installRecorder(t)
+
+	_, span := Start(context.Background(), "ffmpeg.hls")
+	End(span, errors.New("boom"))
+
+	spans := recorder.Ended()
+	if len(spans) != 1 || spans[0].Status().Code != codes.Error {
+		t.Fatalf("expected errored span, got %#v", spans)
+	}
+}
+
+func TestSetupExporters(t *testing.T) {
+	previous := otel.GetTracerProvider()
+	t.Cleanup(func() { otel.SetTracerProvider(previous) })
+
+	if _, err := Setup(context.Background(), Config{Exporter: "zipkin"}); err == nil {
+		t.Fatalf("expected error for unknown exporter")
+	}
+
+	var buf bytes.Buffer
+	shutdown, err := Setup(context.Background(), Config{Exporter: ExporterStdout, Writer: &buf})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	_, span := Start(context.Background(), "test-span")
+	span.End()
+	if err := shutdown(context.Background()); err != nil {
+		t.Fatalf("shutdown failed: %v", err)
+	}
+	if !bytes.Contains(buf.Bytes(), []byte("test-span")) {
+		t.Fatalf("expected span in stdout exporter output, got %s", buf.String())
+	}
+}
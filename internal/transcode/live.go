@@ -0,0 +1,95 @@
+package transcode
+
+import (
+	"GOtify/internal/tracing"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// liveStopDelay es lo que se espera a ffmpeg tras interrumpirlo antes de
+// matarlo, y a que termine de leer source una vez que ha salido.
+const liveStopDelay = 5 * time.Second
+
+// LiveOptions parametriza la segmentación de una emisión en directo.
+type LiveOptions struct {
+	Variant        Variant
+	SegmentSeconds int
+	// ListSize son los segmentos que lista la playlist; los que salen de
+	// ella se borran de dir.
+	ListSize int
+	// Broadcast distingue los segmentos de cada emisión, que reinician la
+	// numeración: <variante>_segment_<Broadcast>_00000.ts.
+	Broadcast string
+}
+
+// Live segmenta el audio que llega por source en una lista HLS deslizante
+// (<variante>.m3u8 con EXT-X-MEDIA-SEQUENCE) dentro de dir, hasta que source
+// termina. ffmpeg cierra entonces la lista con #EXT-X-ENDLIST. Al cancelar
+// ctx recibe una interrupción para que la cierre igual antes de salir.
+func (f FFmpeg) Live(ctx context.Context, source io.Reader, dir string, opts LiveOptions) error {
+	binPath := f.Config.BinPath
+	if binPath == "" {
+		binPath = "ffmpeg"
+	}
+	if opts.Variant.Name == "" || opts.Variant.BitrateKbps <= 0 {
+		return fmt.Errorf("invalid live variant %+v", opts.Variant)
+	}
+	if opts.SegmentSeconds <= 0 {
+		opts.SegmentSeconds = 4
+	}
+	if opts.ListSize <= 0 {
+		opts.ListSize = 6
+	}
+
+	segment := opts.Variant.Name + "_segment_"
+	if opts.Broadcast != "" {
+		segment += opts.Broadcast + "_"
+	}
+
+	args := []string{
+		"-y",
+		"-i", "pipe:0",
+		"-vn",
+		"-c:a", "aac",
+		"-b:a", fmt.Sprintf("%dk", opts.Variant.BitrateKbps),
+		"-ac", "2",
+		"-f", "hls",
+		"-hls_time", strconv.Itoa(opts.SegmentSeconds),
+		"-hls_list_size", strconv.Itoa(opts.ListSize),
+		"-hls_flags", "delete_segments+program_date_time",
+		"-hls_segment_filename", filepath.Join(dir, segment+"%05d.ts"),
+		filepath.Join(dir, opts.Variant.Name+".m3u8"),
+	}
+
+	ctx, span := tracing.Start(ctx, "ffmpeg.live",
+		attribute.String("variant", opts.Variant.Name),
+		attribute.Int("bitrate_kbps", opts.Variant.BitrateKbps),
+	)
+	cmd := exec.CommandContext(ctx, binPath, args...)
+	cmd.Cancel = func() error { return cmd.Process.Signal(os.Interrupt) }
+	cmd.WaitDelay = liveStopDelay
+	cmd.Stdin = source
+	var stderr bytes.Buffer
+	cmd.Stdout = io.Discard
+	cmd.Stderr = &stderr
+
+	err := cmd.Run()
+	if ctx.Err() != nil && err != nil {
+		// Interrumpido a propósito: ffmpeg sale con error tras cerrar la lista.
+		err = nil
+	}
+	tracing.End(span, err)
+	if err != nil {
+		return fmt.Errorf("ffmpeg live failed: %w, stderr: %s", err, stderr.String())
+	}
+	return nil
+}
@@ -1,8 +1,14 @@
 package transcode
 
 import (
+	"GOtify/internal/m3u8"
+	"GOtify/internal/metrics"
+	"GOtify/internal/tracing"
 	"bytes"
 	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
 	"fmt"
 	"io"
 	"math"
@@ -11,6 +17,9 @@ import (
 	"path/filepath"
 	"strconv"
 	"strings"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
 )
 
 // Variant describe una tasa de bits objetivo en Kbps.
@@ -26,14 +35,77 @@ type ResultFile struct {
 	ContentType string
 }
 
+// KeyURI es la URI relativa de la clave en #EXT-X-KEY. Se resuelve junto a
+// las listas, así que el endpoint de entrega la autoriza con el mismo token.
+const KeyURI = "key"
+
+// Key es la clave AES-128 con la que se cifran los segmentos de una canción.
+type Key struct {
+	Key []byte
+	IV  []byte
+}
+
+// NewKey genera una clave y un IV aleatorios.
+func NewKey() (*Key, error) {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return nil, err
+	}
+	return &Key{Key: buf[:16], IV: buf[16:]}, nil
+}
+
+// ProgressiveName es el nombre base del archivo progresivo dentro de la
+// carpeta de la canción ("progressive.mp3").
+const ProgressiveName = "progressive"
+
+// ProgressiveFormats son los formatos de archivo progresivo admitidos y su
+// Content-Type.
+var ProgressiveFormats = map[string]string{
+	"mp3": "audio/mpeg",
+	"m4a": "audio/mp4",
+}
+
+// Progressive describe el archivo único que se genera junto a HLS para
+// clientes que no lo soportan (altavoces, <audio> sin hls.js).
+type Progressive struct {
+	Format      string
+	BitrateKbps int
+}
+
 // Config permite personalizar el comportamiento del transcodificador.
 type Config struct {
 	BinPath        string
 	SegmentSeconds int
 	Variants       []Variant
+	// Key, si no es nil, cifra los segmentos con AES-128. Es por canción, así
+	// que no se fija en la configuración compartida sino en cada llamada.
+	Key *Key
+	// Progressive, si no es nil, añade un archivo progresivo. No se cifra,
+	// así que se omite cuando Key no es nil.
+	Progressive *Progressive
+}
+
+// FFmpeg transcodifica con los binarios de ffmpeg y ffprobe del sistema.
+type FFmpeg struct {
+	Config   Config
+	ProbeBin string
 }
 
-// GenerateHLS genera las listas y segmentos HLS necesarios a partir de un archivo fuente.
+// ProbeDuration devuelve la duración del archivo fuente en segundos.
+func (f FFmpeg) ProbeDuration(ctx context.Context, sourcePath string) (int32, error) {
+	return ProbeDuration(ctx, f.ProbeBin, sourcePath)
+}
+
+// GenerateHLS genera la escalera HLS configurada para el archivo fuente,
+// cifrada con key si no es nil.
+func (f FFmpeg) GenerateHLS(ctx context.Context, sourcePath string, key *Key) ([]ResultFile, error) {
+	cfg := f.Config
+	cfg.Key = key
+	return GenerateHLS(ctx, sourcePath, cfg)
+}
+
+// GenerateHLS genera las listas y segmentos HLS necesarios a partir de un
+// archivo fuente y, con cfg.Progressive, el archivo progresivo.
 func GenerateHLS(ctx context.Context, sourcePath string, cfg Config) ([]ResultFile, error) {
 	if sourcePath == "" {
 		return nil, fmt.Errorf("missing source path")
@@ -59,67 +131,212 @@ func GenerateHLS(ctx context.Context, sourcePath string, cfg Config) ([]ResultFi
 	}
 	defer os.RemoveAll(tempDir)
 
-	for _, variant := range cfg.Variants {
-		if variant.Name == "" {
-			return nil, fmt.Errorf("variant name required")
+	var keyInfo string
+	if cfg.Key != nil {
+		// Fuera de tempDir: CollectFiles no debe subir la clave al bucket.
+		keyDir, err := os.MkdirTemp("", "gotify-key-*")
+		if err != nil {
+			return nil, err
 		}
-		if variant.BitrateKbps <= 0 {
-			return nil, fmt.Errorf("invalid bitrate for variant %s", variant.Name)
+		defer os.RemoveAll(keyDir)
+		if keyInfo, err = writeKeyInfo(keyDir, cfg.Key); err != nil {
+			return nil, err
 		}
+	}
 
-		segmentPattern := filepath.Join(tempDir, fmt.Sprintf("%s_segment_%%03d.ts", variant.Name))
-		outputPlaylist := filepath.Join(tempDir, fmt.Sprintf("%s.m3u8", variant.Name))
-
-		args := []string{
-			"-y",
-			"-i", sourcePath,
-			"-vn",
-			"-c:a", "aac",
-			"-b:a", fmt.Sprintf("%dk", variant.BitrateKbps),
-			"-ac", "2",
-			"-f", "hls",
-			"-hls_time", strconv.Itoa(cfg.SegmentSeconds),
-			"-hls_playlist_type", "vod",
-			"-hls_segment_filename", segmentPattern,
-			outputPlaylist,
+	for _, variant := range cfg.Variants {
+		if err := ctx.Err(); err != nil {
+			return nil, err
 		}
-
-		cmd := exec.CommandContext(ctx, cfg.BinPath, args...)
-		var stderr bytes.Buffer
-		cmd.Stdout = io.Discard
-		cmd.Stderr = &stderr
-
-		if err := cmd.Run(); err != nil {
-			return nil, fmt.Errorf("ffmpeg failed for variant %s: %w, stderr: %s", variant.Name, err, stderr.String())
+		if err := runVariant(ctx, cfg, sourcePath, tempDir, variant, keyInfo, "vod"); err != nil {
+			return nil, err
 		}
 	}
 
 	if err := writeMasterPlaylist(tempDir, cfg.Variants); err != nil {
 		return nil, err
 	}
+	// Una copia sin cifrar dejaría el audio fuera del alcance de la clave.
+	if cfg.Progressive != nil && cfg.Key == nil {
+		if err := generateProgressive(ctx, cfg.BinPath, sourcePath, tempDir, *cfg.Progressive); err != nil {
+			return nil, err
+		}
+	}
 
-	files, err := collectFiles(tempDir)
+	files, err := CollectFiles(tempDir)
 	if err != nil {
 		return nil, err
 	}
 	return files, nil
 }
 
-func writeMasterPlaylist(dir string, variants []Variant) error {
-	var builder strings.Builder
-	builder.WriteString("#EXTM3U\n")
-	builder.WriteString("#EXT-X-VERSION:3\n")
+// GenerateVariant escribe en dir la lista "<nombre>.m3u8" y los segmentos de
+// una sola variante. La lista es de tipo EVENT y ffmpeg la reescribe tras
+// cada segmento, así que puede servirse mientras se genera; al terminar
+// lleva #EXT-X-ENDLIST.
+func (f FFmpeg) GenerateVariant(ctx context.Context, sourcePath, dir string, variant Variant, key *Key) error {
+	cfg := f.Config
+	if cfg.BinPath == "" {
+		cfg.BinPath = "ffmpeg"
+	}
+	if cfg.SegmentSeconds <= 0 {
+		cfg.SegmentSeconds = 6
+	}
+	if _, err := os.Stat(sourcePath); err != nil {
+		return fmt.Errorf("source not accessible: %w", err)
+	}
+
+	var keyInfo string
+	if key != nil {
+		keyDir, err := os.MkdirTemp("", "gotify-key-*")
+		if err != nil {
+			return err
+		}
+		defer os.RemoveAll(keyDir)
+		if keyInfo, err = writeKeyInfo(keyDir, key); err != nil {
+			return err
+		}
+	}
+	return runVariant(ctx, cfg, sourcePath, dir, variant, keyInfo, "event")
+}
 
+// runVariant ejecuta ffmpeg para una variante de la escalera.
+func runVariant(ctx context.Context, cfg Config, sourcePath, dir string, variant Variant, keyInfo, playlistType string) error {
+	if variant.Name == "" {
+		return fmt.Errorf("variant name required")
+	}
+	if variant.BitrateKbps <= 0 {
+		return fmt.Errorf("invalid bitrate for variant %s", variant.Name)
+	}
+
+	segmentPattern := filepath.Join(dir, fmt.Sprintf("%s_segment_%%03d.ts", variant.Name))
+	outputPlaylist := filepath.Join(dir, fmt.Sprintf("%s.m3u8", variant.Name))
+
+	args := []string{
+		"-y",
+		"-i", sourcePath,
+		"-vn",
+		"-c:a", "aac",
+		"-b:a", fmt.Sprintf("%dk", variant.BitrateKbps),
+		"-ac", "2",
+		"-f", "hls",
+		"-hls_time", strconv.Itoa(cfg.SegmentSeconds),
+		"-hls_playlist_type", playlistType,
+		"-hls_segment_filename", segmentPattern,
+	}
+	if keyInfo != "" {
+		args = append(args, "-hls_key_info_file", keyInfo)
+	}
+	args = append(args, outputPlaylist)
+
+	spanCtx, span := tracing.Start(ctx, "ffmpeg.hls",
+		attribute.String("variant", variant.Name),
+		attribute.Int("bitrate_kbps", variant.BitrateKbps),
+	)
+	cmd := exec.CommandContext(spanCtx, cfg.BinPath, args...)
+	var stderr bytes.Buffer
+	cmd.Stdout = io.Discard
+	cmd.Stderr = &stderr
+
+	start := time.Now()
+	err := cmd.Run()
+	metrics.ObserveTranscode(variant.Name, start, err)
+	tracing.End(span, err)
+	if err != nil {
+		return fmt.Errorf("ffmpeg failed for variant %s: %w, stderr: %s", variant.Name, err, stderr.String())
+	}
+	return nil
+}
+
+// generateProgressive codifica sourcePath en un único archivo
+// ProgressiveName.<formato> dentro de dir.
+func generateProgressive(ctx context.Context, binPath, sourcePath, dir string, p Progressive) error {
+	if _, ok := ProgressiveFormats[p.Format]; !ok {
+		return fmt.Errorf("unsupported progressive format %q", p.Format)
+	}
+	if p.BitrateKbps <= 0 {
+		return fmt.Errorf("invalid bitrate for progressive file")
+	}
+	args := []string{"-y", "-i", sourcePath, "-vn"}
+	switch p.Format {
+	case "mp3":
+		args = append(args, "-c:a", "libmp3lame")
+	case "m4a":
+		// faststart mueve el índice al principio para reproducir mientras se descarga.
+		args = append(args, "-c:a", "aac", "-movflags", "+faststart")
+	}
+	args = append(args,
+		"-b:a", fmt.Sprintf("%dk", p.BitrateKbps),
+		"-ac", "2",
+		filepath.Join(dir, ProgressiveName+"."+p.Format),
+	)
+
+	spanCtx, span := tracing.Start(ctx, "ffmpeg.progressive",
+		attribute.String("format", p.Format),
+		attribute.Int("bitrate_kbps", p.BitrateKbps),
+	)
+	cmd := exec.CommandContext(spanCtx, binPath, args...)
+	var stderr bytes.Buffer
+	cmd.Stdout = io.Discard
+	cmd.Stderr = &stderr
+
+	start := time.Now()
+	err := cmd.Run()
+	metrics.ObserveTranscode(ProgressiveName, start, err)
+	tracing.End(span, err)
+	if err != nil {
+		return fmt.Errorf("ffmpeg failed for progressive %s: %w, stderr: %s", p.Format, err, stderr.String())
+	}
+	return nil
+}
+
+// writeKeyInfo escribe la clave y el archivo -hls_key_info_file de ffmpeg:
+// URI de la clave, ruta local y IV en hexadecimal.
+func writeKeyInfo(dir string, key *Key) (string, error) {
+	if len(key.Key) != 16 {
+		return "", fmt.Errorf("aes-128 key must be 16 bytes, got %d", len(key.Key))
+	}
+	keyPath := filepath.Join(dir, "segments.key")
+	if err := os.WriteFile(keyPath, key.Key, 0o600); err != nil {
+		return "", err
+	}
+	info := KeyURI + "\n" + keyPath + "\n"
+	if len(key.IV) > 0 {
+		info += hex.EncodeToString(key.IV) + "\n"
+	}
+	infoPath := filepath.Join(dir, "key_info")
+	if err := os.WriteFile(infoPath, []byte(info), 0o600); err != nil {
+		return "", err
+	}
+	return infoPath, nil
+}
+
+// MasterEntry es la entrada de variant en la lista maestra.
+func MasterEntry(variant Variant) m3u8.Variant {
+	return m3u8.Variant{
+		StreamInf: m3u8.Attributes{
+			{Name: "BANDWIDTH", Value: strconv.Itoa(variant.BitrateKbps * 1024)},
+			{Name: "CODECS", Value: "mp4a.40.2", Quoted: true},
+		},
+		URI: variant.Name + ".m3u8",
+	}
+}
+
+func writeMasterPlaylist(dir string, variants []Variant) error {
+	playlist := m3u8.Playlist{
+		Master: true,
+		Header: []m3u8.Tag{{Name: "EXT-X-VERSION", Value: "3"}},
+	}
 	for _, variant := range variants {
-		bandwidth := variant.BitrateKbps * 1024
-		builder.WriteString(fmt.Sprintf("#EXT-X-STREAM-INF:BANDWIDTH=%d,CODECS=\"mp4a.40.2\"\n", bandwidth))
-		builder.WriteString(fmt.Sprintf("%s.m3u8\n", variant.Name))
+		playlist.Variants = append(playlist.Variants, MasterEntry(variant))
 	}
 
-	return os.WriteFile(filepath.Join(dir, "master.m3u8"), []byte(builder.String()), 0o644)
+	return os.WriteFile(filepath.Join(dir, "master.m3u8"), playlist.Encode(), 0o644)
 }
 
-func collectFiles(root string) ([]ResultFile, error) {
+// CollectFiles lee los archivos generados en root (y sus subdirectorios) con
+// su Content-Type.
+func CollectFiles(root string) ([]ResultFile, error) {
 	entries, err := os.ReadDir(root)
 	if err != nil {
 		return nil, err
@@ -130,7 +347,7 @@ func collectFiles(root string) ([]ResultFile, error) {
 		name := entry.Name()
 		fullPath := filepath.Join(root, name)
 		if entry.IsDir() {
-			subFiles, err := collectFiles(fullPath)
+			subFiles, err := CollectFiles(fullPath)
 			if err != nil {
 				return nil, err
 			}
@@ -149,6 +366,10 @@ func collectFiles(root string) ([]ResultFile, error) {
 			contentType = "application/vnd.apple.mpegurl"
 		case strings.HasSuffix(name, ".ts"):
 			contentType = "video/mp2t"
+		case strings.HasPrefix(name, ProgressiveName+"."):
+			if ct, ok := ProgressiveFormats[strings.TrimPrefix(name, ProgressiveName+".")]; ok {
+				contentType = ct
+			}
 		}
 
 		out = append(out, ResultFile{
@@ -179,12 +400,15 @@ func ProbeDuration(ctx context.Context, probeBin string, sourcePath string) (int
 		sourcePath,
 	}
 
+	ctx, span := tracing.Start(ctx, "ffprobe.duration")
 	var stdout bytes.Buffer
 	cmd := exec.CommandContext(ctx, probeBin, args...)
 	cmd.Stdout = &stdout
 	cmd.Stderr = io.Discard
 
-	if err := cmd.Run(); err != nil {
+	err := cmd.Run()
+	tracing.End(span, err)
+	if err != nil {
 		return 0, fmt.Errorf("ffprobe failed: %w", err)
 	}
 
@@ -200,3 +424,101 @@ func ProbeDuration(ctx context.Context, probeBin string, sourcePath string) (int
 
 	return int32(math.Round(seconds)), nil
 }
+
+// ProbeInfo son los datos de ffprobe sobre el archivo original.
+type ProbeInfo struct {
+	Format      string
+	Codec       string
+	SampleRate  int
+	Channels    int
+	BitrateKbps int
+	Duration    float64
+}
+
+// Probe devuelve formato, códec y parámetros de la primera pista de audio.
+func (f FFmpeg) Probe(ctx context.Context, sourcePath string) (ProbeInfo, error) {
+	return Probe(ctx, f.ProbeBin, sourcePath)
+}
+
+// Probe ejecuta ffprobe sobre sourcePath y devuelve su primera pista de audio.
+func Probe(ctx context.Context, probeBin string, sourcePath string) (ProbeInfo, error) {
+	if _, err := os.Stat(sourcePath); err != nil {
+		return ProbeInfo{}, fmt.Errorf("source not accessible: %w", err)
+	}
+	if probeBin == "" {
+		probeBin = "ffprobe"
+	}
+
+	args := []string{
+		"-v", "error",
+		"-select_streams", "a:0",
+		"-show_entries", "format=format_name,duration,bit_rate:stream=codec_name,sample_rate,channels",
+		"-of", "json",
+		sourcePath,
+	}
+
+	ctx, span := tracing.Start(ctx, "ffprobe.probe")
+	var stdout bytes.Buffer
+	cmd := exec.CommandContext(ctx, probeBin, args...)
+	cmd.Stdout = &stdout
+	cmd.Stderr = io.Discard
+	err := cmd.Run()
+	tracing.End(span, err)
+	if err != nil {
+		return ProbeInfo{}, fmt.Errorf("ffprobe failed: %w", err)
+	}
+
+	// ffprobe escribe los números de format y sample_rate como cadenas.
+	var out struct {
+		Streams []struct {
+			CodecName  string `json:"codec_name"`
+			SampleRate string `json:"sample_rate"`
+			Channels   int    `json:"channels"`
+		} `json:"streams"`
+		Format struct {
+			FormatName string `json:"format_name"`
+			Duration   string `json:"duration"`
+			BitRate    string `json:"bit_rate"`
+		} `json:"format"`
+	}
+	if err := json.Unmarshal(stdout.Bytes(), &out); err != nil {
+		return ProbeInfo{}, fmt.Errorf("invalid ffprobe output: %w", err)
+	}
+	if len(out.Streams) == 0 {
+		return ProbeInfo{}, fmt.Errorf("no audio stream in source")
+	}
+
+	info := ProbeInfo{
+		Format:   out.Format.FormatName,
+		Codec:    out.Streams[0].CodecName,
+		Channels: out.Streams[0].Channels,
+	}
+	info.SampleRate, _ = strconv.Atoi(out.Streams[0].SampleRate)
+	info.Duration, _ = strconv.ParseFloat(out.Format.Duration, 64)
+	if bps, err := strconv.Atoi(out.Format.BitRate); err == nil {
+		info.BitrateKbps = bps / 1000
+	}
+	return info, nil
+}
+
+// Version ejecuta "<bin> -version" y devuelve la primera línea de la salida.
+func Version(ctx context.Context, bin string) (string, error) {
+	if bin == "" {
+		return "", fmt.Errorf("missing binary path")
+	}
+	path, err := exec.LookPath(bin)
+	if err != nil {
+		return "", fmt.Errorf("%s not found: %w", bin, err)
+	}
+
+	var stdout bytes.Buffer
+	cmd := exec.CommandContext(ctx, path, "-version")
+	cmd.Stdout = &stdout
+	cmd.Stderr = io.Discard
+	if err := cmd.Run(); err != nil {
+		return "", fmt.Errorf("%s -version failed: %w", bin, err)
+	}
+
+	line, _, _ := strings.Cut(stdout.String(), "\n")
+	return strings.TrimSpace(line), nil
+}
@@ -2,7 +2,9 @@ package transcode
 
 import (
 	"GOtify/internal/testutil/ffmpegstub"
+	"bytes"
 	"context"
+	"errors"
 	"os"
 	"path/filepath"
 	"strings"
@@ -70,6 +72,99 @@ func TestGenerateHLSWithFakeFFmpeg(t *testing.T) {
 		t.Errorf("segments not generated")
 	}
 }
+
+func TestGenerateHLSEncrypted(t *testing.T) {
+	paths := ffmpegstub.Build(t)
+
+	sourcePath := filepath.Join(t.TempDir(), "input.wav")
+	if err := os.WriteFile(sourcePath, []byte("audio"), 0o644); err != nil {
+		t.Fatalf("create source: %v", err)
+	}
+	key, err := NewKey()
+	if err != nil {
+		t.Fatalf("NewKey: %v", err)
+	}
+
+	cfg := Config{
+		BinPath:     paths.FFmpeg,
+		Variants:    []Variant{{Name: "128k", BitrateKbps: 128}},
+		Key:         key,
+		Progressive: &Progressive{Format: "mp3", BitrateKbps: 128},
+	}
+	files, err := GenerateHLS(context.Background(), sourcePath, cfg)
+	if err != nil {
+		t.Fatalf("GenerateHLS failed: %v", err)
+	}
+	for _, file := range files {
+		if strings.HasPrefix(file.Name, ProgressiveName+".") {
+			t.Fatalf("encrypted songs must not get an unencrypted progressive file")
+		}
+		if strings.Contains(file.Name, "key") || bytes.Contains(file.Content, key.Key) {
+			t.Fatalf("key material must not be uploaded, found in %s", file.Name)
+		}
+		if file.Name == "128k.m3u8" && !strings.Contains(string(file.Content), `#EXT-X-KEY:METHOD=AES-128,URI="key"`) {
+			t.Fatalf("variant playlist missing key tag:\n%s", file.Content)
+		}
+	}
+
+	if _, err := GenerateHLS(context.Background(), sourcePath, Config{BinPath: paths.FFmpeg, Key: &Key{Key: []byte("short")}}); err == nil {
+		t.Fatalf("expected invalid key length to fail")
+	}
+}
+
+func TestGenerateHLSProgressive(t *testing.T) {
+	paths := ffmpegstub.Build(t)
+
+	sourcePath := filepath.Join(t.TempDir(), "input.wav")
+	if err := os.WriteFile(sourcePath, []byte("audio"), 0o644); err != nil {
+		t.Fatalf("create source: %v", err)
+	}
+
+	cfg := Config{
+		BinPath:     paths.FFmpeg,
+		Variants:    []Variant{{Name: "128k", BitrateKbps: 128}},
+		Progressive: &Progressive{Format: "m4a", BitrateKbps: 192},
+	}
+	files, err := GenerateHLS(context.Background(), sourcePath, cfg)
+	if err != nil {
+		t.Fatalf("GenerateHLS failed: %v", err)
+	}
+	var found bool
+	for _, file := range files {
+		if file.Name == "progressive.m4a" {
+			found = true
+			if file.ContentType != "audio/mp4" {
+				t.Errorf("unexpected content type for progressive file: %s", file.ContentType)
+			}
+		}
+	}
+	if !found {
+		t.Fatalf("progressive file not generated")
+	}
+
+	cfg.Progressive = &Progressive{Format: "ogg", BitrateKbps: 128}
+	if _, err := GenerateHLS(context.Background(), sourcePath, cfg); err == nil {
+		t.Fatalf("expected unsupported progressive format to fail")
+	}
+}
+
+func TestGenerateHLSStopsWhenContextCancelled(t *testing.T) {
+	paths := ffmpegstub.Build(t)
+
+	sourcePath := filepath.Join(t.TempDir(), "input.wav")
+	if err := os.WriteFile(sourcePath, []byte("audio"), 0o644); err != nil {
+		t.Fatalf("create source: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	_, err := GenerateHLS(ctx, sourcePath, Config{BinPath: paths.FFmpeg})
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected context.Canceled, got %v", err)
+	}
+}
+
 func TestGenerateHLSErrorWhenSourceMissing(t *testing.T) {
 	_, err := GenerateHLS(context.Background(), "", Config{})
 	if err == nil || !strings.Contains(err.Error(), "missing source path") {
@@ -94,3 +189,62 @@ func TestProbeDuration(t *testing.T) {
 		t.Fatalf("expected duration 120, got %d", duration)
 	}
 }
+
+func TestProbe(t *testing.T) {
+	paths := ffmpegstub.Build(t)
+
+	sourcePath := filepath.Join(t.TempDir(), "input.wav")
+	if err := os.WriteFile(sourcePath, []byte("audio"), 0o644); err != nil {
+		t.Fatalf("create source: %v", err)
+	}
+
+	info, err := Probe(context.Background(), paths.FFProbe, sourcePath)
+	if err != nil {
+		t.Fatalf("Probe failed: %v", err)
+	}
+	want := ProbeInfo{Format: "wav", Codec: "pcm_s16le", SampleRate: 44100, Channels: 2, BitrateKbps: 1411, Duration: 120}
+	if info != want {
+		t.Fatalf("unexpected probe info %+v", info)
+	}
+}
+
+func TestVersion(t *testing.T) {
+	paths := ffmpegstub.Build(t)
+
+	version, err := Version(context.Background(), paths.FFProbe)
+	if err != nil {
+		t.Fatalf("Version failed: %v", err)
+	}
+	if version != "ffprobe version stub" {
+		t.Fatalf("unexpected version %q", version)
+	}
+}
+
+func TestLive(t *testing.T) {
+	paths := ffmpegstub.Build(t)
+	dir := t.TempDir()
+
+	f := FFmpeg{Config: Config{BinPath: paths.FFmpeg}}
+	source := strings.NewReader("one\ntwo\nthree\n")
+	err := f.Live(context.Background(), source, dir, LiveOptions{
+		Variant:        Variant{Name: "128k", BitrateKbps: 128},
+		SegmentSeconds: 4,
+		ListSize:       2,
+		Broadcast:      "b1",
+	})
+	if err != nil {
+		t.Fatalf("Live failed: %v", err)
+	}
+
+	data, err := os.ReadFile(filepath.Join(dir, "128k.m3u8"))
+	if err != nil {
+		t.Fatalf("read playlist: %v", err)
+	}
+	list := string(data)
+	if !strings.Contains(list, "#EXT-X-MEDIA-SEQUENCE:1") || strings.Contains(list, "128k_segment_b1_00000.ts") || !strings.Contains(list, "128k_segment_b1_00002.ts") || !strings.HasSuffix(list, "#EXT-X-ENDLIST\n") {
+		t.Fatalf("unexpected live playlist:\n%s", list)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "128k_segment_b1_00000.ts")); !os.IsNotExist(err) {
+		t.Fatalf("expected segments outside the window to be deleted, got %v", err)
+	}
+}